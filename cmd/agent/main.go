@@ -4,7 +4,6 @@ package main
 import (
 	"context"
 	"fmt"
-	"net/http"
 	"os"
 	"os/signal"
 	"sync"
@@ -48,6 +47,8 @@ func run() error {
 	if err != nil {
 		return err
 	}
+	cfg.Version = Version
+	cfg.BuildCommit = BuildCommit
 
 	do := make(chan int)
 	if cfg.Profile {
@@ -61,13 +62,24 @@ func run() error {
 
 	logger.Info("Agent config initialized")
 
-	client := &http.Client{}
+	client, err := agent.NewClient(cfg)
+	if err != nil {
+		return err
+	}
+	if cfg.IP == "" {
+		cfg.IP = agent.LocalIP(cfg)
+	}
 
 	// To be able to cancel tasks, make ctx and signal handler
 
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
 
+	// hash keys file can be changed while agent runs, SIGHUP reloads it and metrics are signed with the new current key
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go cfg.HashKeys.Watch(reload, logger)
+
 	//starting list of metrices, with ability to cancel it
 	var m models.MetricList
 	ch := []chan models.MetricList{make(chan models.MetricList, 1), make(chan models.MetricList, 1)}
@@ -5,6 +5,7 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
@@ -13,6 +14,9 @@ import (
 
 	globalConf "github.com/maffka123/metricCollector/internal/config"
 	"github.com/maffka123/metricCollector/internal/handlers"
+	"github.com/maffka123/metricCollector/internal/ingest"
+	"github.com/maffka123/metricCollector/internal/rates"
+	"github.com/maffka123/metricCollector/internal/replication"
 	"github.com/maffka123/metricCollector/internal/server"
 	"github.com/maffka123/metricCollector/internal/server/config"
 	"github.com/maffka123/metricCollector/internal/storage"
@@ -29,10 +33,15 @@ var (
 // - initialize config
 // - initialize logger
 // - initilize DB (can be in-memory of postgres)
+// - wrap DB for replication if role is configured
+// - initilize ingestion queue if it is configured
+// - start sampling counters for their rates
 // - initilize router
 // - start goroutine to catch quit signal
 // - start goroutine to make periodical db dumps
+// - start goroutine to evict stale metrics
 // - start serving
+// - after shutdown drain ingestion queue
 func main() {
 	fmt.Printf("Build version: %s\nBuild date: %s\nBuild commit: %s\n", Version, BuildDate, BuildCommit)
 	cfg, err := config.InitConfig()
@@ -54,14 +63,44 @@ func main() {
 
 	logger.Info("Init config: done")
 
-	r, dbUpdated := handlers.MetricRouter(db, &cfg, logger)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if cfg.Role != "" {
+		node := replication.NewNode(db, &cfg, logger)
+		node.Start(ctx)
+		db = node
+	}
+
+	var queue *ingest.Queue
+	if cfg.QueueSize > 0 {
+		queue = ingest.NewQueue(db, &cfg, logger)
+	}
+
+	tracker := rates.NewTracker(db, &cfg, logger)
+	tracker.Start(ctx)
+
+	r, dbUpdated := handlers.MetricRouter(db, queue, tracker, &cfg, logger)
+	if queue != nil {
+		queue.Start(dbUpdated)
+	}
 
 	srv := server.NewServer(cfg.Endpoint, r)
+	srv.TLSConfig, err = server.TLSConfig(&cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	quit := make(chan os.Signal)
+	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
 
+	// hash keys file can be changed while server runs, SIGHUP reloads it
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go cfg.HashKeys.Watch(reload, logger)
+
 	//See example here: https://pkg.go.dev/net/http#example-Server.Shutdown
+	idleConnsClosed := make(chan struct{})
 	go func() {
 		sig := <-quit
 		logger.Info(fmt.Sprintf("caught sig: %+v", sig))
@@ -69,10 +108,18 @@ func main() {
 			// Error from closing listeners, or context timeout:
 			logger.Error("HTTP server Shutdown:", zap.Error(err))
 		}
+		// no handlers are running anymore, write down what is left in the queue
+		if queue != nil {
+			queue.Close()
+		}
+		close(idleConnsClosed)
 	}()
 
 	go server.DealWithDumps(&cfg, db, dbUpdated)
+	go server.DealWithStale(&cfg, db, logger, dbUpdated)
 	logger.Info("Start serving on", zap.String("endpoint name", cfg.Endpoint))
-	log.Fatal(srv.ListenAndServe())
-
+	if err := server.ListenAndServe(srv); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-idleConnsClosed
 }
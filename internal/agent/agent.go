@@ -5,13 +5,22 @@ import (
 	"bytes"
 	"compress/gzip"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"runtime"
 	"runtime/pprof"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -23,6 +32,8 @@ import (
 	"github.com/maffka123/metricCollector/internal/agent/config"
 	"github.com/maffka123/metricCollector/internal/agent/models"
 	"github.com/maffka123/metricCollector/internal/collector"
+	"github.com/maffka123/metricCollector/internal/hashkeys"
+	globalModels "github.com/maffka123/metricCollector/internal/models"
 )
 
 // sendDataFunc defines a function for sending data over http, it is neede for backoff.
@@ -30,33 +41,48 @@ type sendDataFunc func(context.Context, config.Config, *http.Client, []collector
 
 // InitMetrics initializes list with all metrics of interest, send first values to the server.
 func InitMetrics(ctx context.Context, cfg config.Config, client *http.Client, ch chan models.MetricList, logger *zap.Logger) {
-	metricList := collector.GetAllMetrics(&cfg.Key)
+	keys := cfg.HashKeys.Or(cfg.Key)
+	metricList := collector.GetAllMetrics(keys)
 	m := make([]collector.MetricInterface, len(metricList))
+	names := make([]string, 0, len(metricList))
 	for i := range metricList {
 		m[i] = metricList[i]
+		names = append(names, metricList[i].Name)
+	}
+	for _, h := range collector.GetHistogramMetrics(keys, cfg.PauseBuckets) {
+		m = append(m, h)
+		names = append(names, h.Name)
+	}
+	for _, i := range collector.GetInfoMetrics(keys, cfg.Version, cfg.BuildCommit) {
+		m = append(m, i)
+		names = append(names, i.Name)
 	}
 
 	err := simpleBackoff(ctx, sendJSONData, cfg, client, m, logger)
 	if err != nil {
 		ch <- models.MetricList{MetricList: nil, Err: err}
 	}
+	sendMeta(ctx, cfg, client, collector.GetMeta(names...), logger)
 	a := models.MetricList{MetricList: m, Err: nil}
 	ch <- a
 }
 
 // InitPSMetrics initializes psutil metrics.
 func InitPSMetrics(ctx context.Context, cfg config.Config, client *http.Client, ch chan models.MetricList, logger *zap.Logger) {
-
-	metricList := collector.GetAllPSUtilMetrics(&cfg.Key)
+	keys := cfg.HashKeys.Or(cfg.Key)
+	metricList := collector.GetAllPSUtilMetrics(keys)
 	m := make([]collector.MetricInterface, len(metricList))
+	names := make([]string, 0, len(metricList))
 	for i := range metricList {
 		m[i] = metricList[i]
+		names = append(names, metricList[i].Name)
 	}
 
 	err := simpleBackoff(ctx, sendJSONData, cfg, client, m, logger)
 	if err != nil {
 		ch <- models.MetricList{MetricList: nil, Err: err}
 	}
+	sendMeta(ctx, cfg, client, collector.GetMeta(names...), logger)
 	a := models.MetricList{MetricList: m, Err: nil}
 	ch <- a
 }
@@ -88,9 +114,50 @@ func UpdateMetrics(ctx context.Context, cfg config.Config, cond *sync.Mutex, t <
 	}
 }
 
+// NewClient makes http client for the server, it verifies server with CA bundle and presents client certificate if they are given.
+func NewClient(cfg config.Config) (*http.Client, error) {
+	if cfg.CACert == "" && cfg.TLSCert == "" {
+		return &http.Client{}, nil
+	}
+	tlsCfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.CACert != "" {
+		pem, err := ioutil.ReadFile(cfg.CACert)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", cfg.CACert)
+		}
+		tlsCfg.RootCAs = pool
+	}
+	if cfg.TLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsCfg
+	return &http.Client{Transport: transport}, nil
+}
+
+// serverURL builds url of server endpoint. Endpoint can be given with scheme, otherwise https is used if TLS is configured.
+func serverURL(cfg config.Config, path string) string {
+	if strings.Contains(cfg.Endpoint, "://") {
+		return strings.TrimSuffix(cfg.Endpoint, "/") + path
+	}
+	scheme := "http"
+	if cfg.CACert != "" || cfg.TLSCert != "" {
+		scheme = "https"
+	}
+	return scheme + "://" + cfg.Endpoint + path
+}
+
 //sendJSONData sends metric in json format to the server.
 func sendJSONData(ctx context.Context, cfg config.Config, client *http.Client, m []collector.MetricInterface, logger *zap.Logger) error {
-	url := fmt.Sprintf("http://%s/updates/", cfg.Endpoint)
+	url := serverURL(cfg, "/updates/")
 
 	metricToSend, err := json.Marshal(m)
 
@@ -98,6 +165,7 @@ func sendJSONData(ctx context.Context, cfg config.Config, client *http.Client, m
 		logger.Error("JSON marshal failed", zap.Error(err))
 		return err
 	}
+	plain := metricToSend
 
 	// encode data
 	if cfg.CryptoKey.E != 0 {
@@ -113,15 +181,22 @@ func sendJSONData(ctx context.Context, cfg config.Config, client *http.Client, m
 	// create a request
 	request, err := http.NewRequest(http.MethodPost, url, &buf)
 	request.Header.Add("Content-Type", "application/json")
-	request.Header.Add("Content-Encoding", "gzip")
+	// codings are listed in the order they were applied
 	if cfg.CryptoKey.E != 0 {
 		request.Header.Add("Content-Encoding", "64base")
 	}
+	request.Header.Add("Content-Encoding", "gzip")
+	setIdentity(request, cfg)
 
 	if err != nil {
 		logger.Error("request creation failed", zap.Error(err))
 		return err
 	}
+	// json is signed as it is, server checks it after decoding
+	if err := cfg.HashKeys.Or(cfg.Key).SignRequest(request, plain, time.Now()); err != nil {
+		logger.Error("request signing failed", zap.Error(err))
+		return err
+	}
 
 	// execute the request
 	response, requestErr := client.Do(request)
@@ -132,6 +207,166 @@ func sendJSONData(ctx context.Context, cfg config.Config, client *http.Client, m
 	defer response.Body.Close()
 
 	logger.Info("Sent data with status code", zap.String("code", response.Status))
+
+	// server cannot take metrics now, back off and try again
+	if response.StatusCode == http.StatusTooManyRequests || response.StatusCode == http.StatusServiceUnavailable {
+		return &busyError{status: response.Status, retryAfter: parseRetryAfter(response.Header.Get("Retry-After"), time.Now())}
+	}
+	// retry is signed again, so it is fresh
+	if err := rejection(response); err != nil {
+		logger.Error("Data was rejected", zap.Error(err))
+		return err
+	}
+	// accumulated observations are accepted, they must not be sent again
+	if response.StatusCode != http.StatusOK {
+		return nil
+	}
+	for _, metric := range m {
+		if a, ok := metric.(collector.Accumulator); ok {
+			a.Sent()
+		}
+	}
+	return nil
+}
+
+// LocalIP finds address of interface which is used to reach the server, empty string is returned if it cannot be found.
+func LocalIP(cfg config.Config) string {
+	u, err := url.Parse(serverURL(cfg, "/"))
+	if err != nil {
+		return ""
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	// udp dial sends nothing, it only picks the route
+	conn, err := net.Dial("udp", net.JoinHostPort(u.Hostname(), port))
+	if err != nil {
+		return ""
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP.String()
+}
+
+// setIdentity adds agent id, agent address and API key to the request.
+func setIdentity(request *http.Request, cfg config.Config) {
+	if cfg.ID != "" {
+		request.Header.Set("X-Agent-ID", cfg.ID)
+	}
+	if cfg.IP != "" {
+		request.Header.Set("X-Real-IP", cfg.IP)
+	}
+	if cfg.Token != "" {
+		request.Header.Set("Authorization", "Bearer "+cfg.Token)
+	}
+}
+
+// busyError is returned when server asks to send later, retryAfter is zero if server did not tell when.
+type busyError struct {
+	status     string
+	retryAfter time.Duration
+}
+
+func (e *busyError) Error() string {
+	return fmt.Sprintf("server is busy: %s", e.status)
+}
+
+// rejectedError is returned when server rejects request signature, e.g. as stale or replayed.
+type rejectedError struct {
+	reason string
+	msg    string
+}
+
+func (e *rejectedError) Error() string {
+	return fmt.Sprintf("request is rejected as %s: %s", e.reason, e.msg)
+}
+
+// rejection reads why server rejected request signature, nil is returned if it did not.
+func rejection(response *http.Response) error {
+	reason := response.Header.Get(hashkeys.RejectHeader)
+	if reason == "" {
+		return nil
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+	return &rejectedError{reason: reason, msg: strings.TrimSpace(string(msg))}
+}
+
+// parseRetryAfter reads Retry-After header given in seconds or as http date.
+func parseRetryAfter(h string, now time.Time) time.Duration {
+	if h == "" {
+		return 0
+	}
+	if s, err := strconv.Atoi(h); err == nil && s > 0 {
+		return time.Duration(s) * time.Second
+	}
+	if t, err := http.ParseTime(h); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
+
+// sendMeta sends description and unit of every metric to the server in one request,
+// it is sent again while the server is busy. Metadata is not needed to collect metrics, so failures are only logged.
+func sendMeta(ctx context.Context, cfg config.Config, client *http.Client, metas []globalModels.Meta, logger *zap.Logger) {
+	if len(metas) == 0 {
+		return
+	}
+	body, err := json.Marshal(metas)
+	if err != nil {
+		logger.Error("JSON marshal failed", zap.Error(err))
+		return
+	}
+	for i := 1; ; i++ {
+		err := putMeta(ctx, cfg, client, body)
+		var busy *busyError
+		if !errors.As(err, &busy) || i >= cfg.Retries {
+			if err != nil {
+				logger.Warn("Metadata was not sent", zap.Int("n", len(metas)), zap.Error(err))
+			}
+			return
+		}
+		// server knows better when it can take metadata again
+		delay := cfg.Delay * time.Duration(i)
+		if busy.retryAfter > 0 {
+			delay = busy.retryAfter
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// putMeta sends json list of metadata to the server.
+func putMeta(ctx context.Context, cfg config.Config, client *http.Client, body []byte) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPut, serverURL(cfg, "/meta/"), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Add("Content-Type", "application/json")
+	setIdentity(request, cfg)
+	if err := cfg.HashKeys.Or(cfg.Key).SignRequest(request, body, time.Now()); err != nil {
+		return err
+	}
+
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusTooManyRequests || response.StatusCode == http.StatusServiceUnavailable {
+		return &busyError{status: response.Status, retryAfter: parseRetryAfter(response.Header.Get("Retry-After"), time.Now())}
+	}
+	if err := rejection(response); err != nil {
+		return err
+	}
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("metadata was not accepted: %s", response.Status)
+	}
 	return nil
 }
 
@@ -196,7 +431,13 @@ backoff:
 				break backoff
 			}
 			logger.Info("Backing off number", zap.String("n", fmt.Sprint(i+1)))
-			time.Sleep(cfg.Delay * time.Duration(i+1))
+			delay := cfg.Delay * time.Duration(i+1)
+			// server knows better when it can take metrics again
+			var busy *busyError
+			if errors.As(err, &busy) && busy.retryAfter > 0 {
+				delay = busy.retryAfter
+			}
+			time.Sleep(delay)
 		}
 	}
 	return err
@@ -1,20 +1,28 @@
 package agent
 
 import (
+	"compress/gzip"
 	"context"
+	"encoding/json"
 	"errors"
+	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
 	"log"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
 
 	"github.com/maffka123/metricCollector/internal/agent/config"
 	"github.com/maffka123/metricCollector/internal/collector"
+	"github.com/maffka123/metricCollector/internal/hashkeys"
+	globalModels "github.com/maffka123/metricCollector/internal/models"
 )
 
 var logger *zap.Logger = zap.NewExample()
@@ -112,7 +120,7 @@ func Test_sendData(t *testing.T) {
 
 			m := make([]collector.MetricInterface, len(tt.args.m))
 			for i := range tt.args.m {
-				tt.args.m[i].Key = &cfg.Key
+				tt.args.m[i].Keys = hashkeys.New(hashkeys.Key{Secret: cfg.Key})
 				m[i] = tt.args.m[i]
 			}
 			err := sendJSONData(ctx, cfg, client, m, logger)
@@ -120,3 +128,178 @@ func Test_sendData(t *testing.T) {
 		})
 	}
 }
+
+func Test_sendDataResetsHistogram(t *testing.T) {
+	status := http.StatusServiceUnavailable
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	cfg := config.Config{Endpoint: strings.TrimPrefix(server.URL, "http://")}
+	h := collector.GetHistogramMetrics(hashkeys.Ring{}, []float64{0.01})[0]
+	h.Change.Observe(0.001)
+	m := []collector.MetricInterface{h}
+
+	// pauses are kept for the next send
+	assert.Error(t, sendJSONData(context.Background(), cfg, server.Client(), m, logger))
+	assert.Equal(t, uint64(1), h.Change.Count)
+
+	status = http.StatusOK
+	assert.NoError(t, sendJSONData(context.Background(), cfg, server.Client(), m, logger))
+	assert.Equal(t, uint64(0), h.Change.Count)
+}
+
+func Test_sendDataBusy(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "a1", r.Header.Get("X-Agent-ID"))
+		assert.Equal(t, "Bearer t1", r.Header.Get("Authorization"))
+		assert.Equal(t, "10.0.0.5", r.Header.Get("X-Real-IP"))
+		w.Header().Set("Retry-After", "3")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	cfg := config.Config{Endpoint: strings.TrimPrefix(server.URL, "http://"), ID: "a1", Token: "t1", IP: "10.0.0.5"}
+	m := []collector.MetricInterface{&collector.Metric{Name: "PollCount", Type: "counter"}}
+	err := sendJSONData(context.Background(), cfg, server.Client(), m, logger)
+
+	var busy *busyError
+	assert.ErrorAs(t, err, &busy)
+	assert.Equal(t, 3*time.Second, busy.retryAfter)
+}
+
+func Test_sendDataSigned(t *testing.T) {
+	keys := hashkeys.New(hashkeys.Key{ID: "k1", Secret: "secret"})
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		gz, err := gzip.NewReader(r.Body)
+		require.NoError(t, err)
+		body, _ := ioutil.ReadAll(gz)
+		assert.NoError(t, keys.VerifyRequest(r, body))
+		if calls > 1 {
+			w.Header().Set(hashkeys.RejectHeader, "replayed")
+			http.Error(w, "400 - Request is rejected: nonce was already used", http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	cfg := config.Config{Endpoint: strings.TrimPrefix(server.URL, "http://"), HashKeys: keys}
+	m := []collector.MetricInterface{&collector.Metric{Name: "PollCount", Type: "counter", Keys: keys}}
+	assert.NoError(t, sendJSONData(context.Background(), cfg, server.Client(), m, logger))
+
+	err := sendJSONData(context.Background(), cfg, server.Client(), m, logger)
+	var rejected *rejectedError
+	require.ErrorAs(t, err, &rejected)
+	assert.Equal(t, "replayed", rejected.reason)
+	assert.Equal(t, "request is rejected as replayed: 400 - Request is rejected: nonce was already used", err.Error())
+}
+
+func Test_simpleBackoffRetryAfter(t *testing.T) {
+	cfg := prepConf()
+	cfg.Delay = time.Hour
+	cfg.Retries = 2
+	calls := 0
+	f := sendDataFunc(func(ctx context.Context, cfg config.Config, c *http.Client, m []collector.MetricInterface, logger *zap.Logger) error {
+		calls++
+		if calls == 1 {
+			return &busyError{status: "429 Too Many Requests", retryAfter: time.Millisecond}
+		}
+		return nil
+	})
+
+	// delay is too long for the test, it passes only if Retry-After is used instead
+	assert.NoError(t, simpleBackoff(context.Background(), f, cfg, &http.Client{}, nil, logger))
+	assert.Equal(t, 2, calls)
+}
+
+func Test_parseRetryAfter(t *testing.T) {
+	now := time.Date(2022, 3, 1, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		header string
+		want   time.Duration
+	}{
+		{name: "empty", header: "", want: 0},
+		{name: "seconds", header: "5", want: 5 * time.Second},
+		{name: "date", header: "Tue, 01 Mar 2022 10:00:30 GMT", want: 30 * time.Second},
+		{name: "date in the past", header: "Tue, 01 Mar 2022 09:00:00 GMT", want: 0},
+		{name: "garbage", header: "soon", want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, parseRetryAfter(tt.header, now))
+		})
+	}
+}
+
+func Test_sendMeta(t *testing.T) {
+	var got []globalModels.Meta
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		assert.Equal(t, http.MethodPut, r.Method)
+		assert.Equal(t, "/meta/", r.URL.Path)
+		assert.Equal(t, "Bearer t1", r.Header.Get("Authorization"))
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&got))
+	}))
+	defer server.Close()
+
+	cfg := config.Config{Endpoint: strings.TrimPrefix(server.URL, "http://"), Token: "t1"}
+	metas := collector.GetMeta("Alloc", "CPUutilization1")
+	sendMeta(context.Background(), cfg, server.Client(), metas, logger)
+	assert.Equal(t, 1, calls, "metadata is sent in one request")
+	assert.Equal(t, metas, got)
+}
+
+func Test_sendMetaBusy(t *testing.T) {
+	var got []globalModels.Meta
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "429 - Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&got))
+	}))
+	defer server.Close()
+
+	// delay is too long for the test, it passes only if Retry-After is used instead
+	cfg := config.Config{Endpoint: strings.TrimPrefix(server.URL, "http://"), Retries: 2, Delay: time.Hour}
+	metas := collector.GetMeta("Alloc", "PollCount")
+	sendMeta(context.Background(), cfg, server.Client(), metas, logger)
+	assert.Equal(t, 2, calls)
+	assert.Equal(t, metas, got)
+}
+
+func Test_serverURL(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  config.Config
+		want string
+	}{
+		{name: "plain", cfg: config.Config{Endpoint: "127.0.0.1:8080"}, want: "http://127.0.0.1:8080/updates/"},
+		{name: "tls", cfg: config.Config{Endpoint: "127.0.0.1:8080", CACert: "ca.crt"}, want: "https://127.0.0.1:8080/updates/"},
+		{name: "client cert", cfg: config.Config{Endpoint: "127.0.0.1:8080", TLSCert: "agent.crt"}, want: "https://127.0.0.1:8080/updates/"},
+		{name: "with scheme", cfg: config.Config{Endpoint: "https://metrics.local/"}, want: "https://metrics.local/updates/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, serverURL(tt.cfg, "/updates/"))
+		})
+	}
+
+	_, err := NewClient(config.Config{CACert: "config/testdata/missing.pem"})
+	assert.Error(t, err)
+	_, err = NewClient(config.Config{CACert: "config/testdata/key.pem"})
+	assert.Error(t, err)
+}
+
+func TestLocalIP(t *testing.T) {
+	assert.Equal(t, "127.0.0.1", LocalIP(config.Config{Endpoint: "127.0.0.1:8080"}))
+	assert.Equal(t, "127.0.0.1", LocalIP(config.Config{Endpoint: "https://127.0.0.1"}))
+	assert.Equal(t, "", LocalIP(config.Config{Endpoint: "http://[bad"}))
+}
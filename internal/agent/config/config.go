@@ -11,10 +11,13 @@ import (
 	"os"
 	"reflect"
 	"strconv"
+	"strings"
 	"time"
 
 	"encoding/json"
 	"github.com/caarlos0/env/v6"
+
+	"github.com/maffka123/metricCollector/internal/hashkeys"
 )
 
 // Config is a majoj config structure.
@@ -25,10 +28,20 @@ type Config struct {
 	Retries        int           `env:"BACKOFF_RETRIES"`
 	Delay          time.Duration `env:"BACKOFF_DELAY"`
 	Key            string        `env:"KEY"`
+	HashKeys       hashkeys.Ring `env:"KEY_FILE" json:"key_file"`
 	Debug          bool          `env:"METRIC_SERVER_DEBUG"`
 	Profile        bool          `env:"METRIC_SERVER_PROFILE"`
 	CryptoKey      rsaPubKey     `env:"CRYPTO_KEY" json:"crypto_key"`
+	PauseBuckets   []float64     `env:"PAUSE_BUCKETS" envSeparator:"," json:"pause_buckets"`
+	ID             string        `env:"AGENT_ID" json:"agent_id"`
+	Token          string        `env:"TOKEN"`
+	CACert         string        `env:"CA_CERT" json:"ca_cert"`
+	TLSCert        string        `env:"TLS_CERT" json:"tls_cert"`
+	TLSKey         string        `env:"TLS_KEY" json:"tls_key"`
+	IP             string        `env:"AGENT_IP" json:"agent_ip"`
 	configFile     string        `env:"CONFIG"`
+	Version        string        `json:"-"` // set by main from build flags, sent as info metric
+	BuildCommit    string        `json:"-"` // set by main from build flags, sent as info metric
 }
 
 type rsaPubKey rsa.PublicKey
@@ -55,20 +68,37 @@ func (v *rsaPubKey) Set(s string) error {
 	return nil
 }
 
+// DefaultPauseBuckets are upper bounds of GC pause histogram buckets in seconds.
+var DefaultPauseBuckets = []float64{0.00001, 0.00005, 0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1}
+
 // InitConfig initilizes config so that it first checks flags and the env variables.
 func InitConfig() (Config, error) {
 	var cfg Config
 
-	flag.StringVar(&cfg.Endpoint, "a", "127.0.0.1:8080", "server address as host:port")
+	flag.StringVar(&cfg.Endpoint, "a", "127.0.0.1:8080", "server address as host:port or with scheme, e.g. https://host:port")
 	flag.DurationVar(&cfg.PollInterval, "p", 2*time.Second, "how often to update metrics")
 	flag.DurationVar(&cfg.ReportInterval, "r", 10*time.Second, "how often to send metrics to the server")
 	flag.IntVar(&cfg.Retries, "n", 3, "how many times should try to send metrics in case of error")
 	flag.DurationVar(&cfg.Delay, "t", 10*time.Second, "delay in case of error and retry")
 	flag.StringVar(&cfg.Key, "k", "", "key for hash function")
+	flag.Var(&cfg.HashKeys, "kf", "json file with hash keys and their ids, the first one signs metrics, it is used instead of -k if given")
 	flag.Var(&cfg.CryptoKey, "ck", "crypto key for asymmetric encoding")
 	flag.BoolVar(&cfg.Debug, "debug", true, "if debugging is needed")
 	flag.BoolVar(&cfg.Profile, "profile", false, "if profiling is needed")
 	flag.StringVar(&cfg.configFile, "c", "", "location of config.json file")
+	hostname, _ := os.Hostname()
+	flag.StringVar(&cfg.ID, "id", hostname, "agent id sent in X-Agent-ID header, it is informational, server tells agents apart by certificate or API key")
+	flag.StringVar(&cfg.Token, "token", "", "API key with write scope, sent as bearer token")
+	flag.StringVar(&cfg.CACert, "ca", "", "CA bundle to verify server certificate, https is used if it is given")
+	flag.StringVar(&cfg.TLSCert, "tc", "", "client certificate file, server can identify agent by it")
+	flag.StringVar(&cfg.TLSKey, "tk", "", "client private key file")
+	flag.StringVar(&cfg.IP, "ip", "", "agent address sent in X-Real-IP header, by default address of interface which reaches the server")
+	cfg.PauseBuckets = DefaultPauseBuckets
+	flag.Func("pb", "comma separated upper bounds of GC pause histogram buckets in seconds", func(s string) error {
+		bounds, err := parseBuckets(s)
+		cfg.PauseBuckets = bounds
+		return err
+	})
 
 	// config from env variables
 	flag.Parse()
@@ -84,9 +114,50 @@ func InitConfig() (Config, error) {
 			return cfg, err
 		}
 	}
+
+	// server knows agent by its certificate, so id should be the same
+	if cfg.TLSCert != "" {
+		id, err := certSubject(cfg.TLSCert)
+		if err != nil {
+			return cfg, err
+		}
+		if id != "" {
+			cfg.ID = id
+		}
+	}
 	return cfg, nil
 }
 
+// certSubject reads common name of the first certificate in pem file.
+func certSubject(file string) (string, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return "", errors.New("no certificate in " + file)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return "", err
+	}
+	return cert.Subject.CommonName, nil
+}
+
+// parseBuckets parses comma separated bucket bounds.
+func parseBuckets(s string) ([]float64, error) {
+	var bounds []float64
+	for _, b := range strings.Split(s, ",") {
+		f, err := strconv.ParseFloat(strings.TrimSpace(b), 64)
+		if err != nil {
+			return nil, err
+		}
+		bounds = append(bounds, f)
+	}
+	return bounds, nil
+}
+
 func GetConfig(cfg *Config) error {
 	if err := env.ParseWithFuncs(cfg, map[reflect.Type]env.ParserFunc{
 		reflect.TypeOf(rsaPubKey{}): rsaPubKeyParser,
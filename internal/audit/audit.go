@@ -0,0 +1,78 @@
+// Package audit records administrative operations, so that one can find out later who changed what.
+package audit
+
+import (
+	"net/http"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"go.uber.org/zap"
+
+	"github.com/maffka123/metricCollector/internal/auth"
+)
+
+// Trail writes audit records as json lines.
+type Trail struct {
+	logger *zap.Logger
+}
+
+// NewTrail initializes audit trail writing into the file, if file is empty records go to the service logger.
+func NewTrail(file string, logger *zap.Logger) (*Trail, error) {
+	if file == "" {
+		return &Trail{logger: logger.Named("audit")}, nil
+	}
+
+	zapConfig := zap.NewProductionConfig()
+	zapConfig.OutputPaths = []string{file}
+	zapConfig.EncoderConfig.MessageKey = "action"
+	zapConfig.DisableStacktrace = true
+	zapConfig.DisableCaller = true
+	auditLogger, err := zapConfig.Build()
+	if err != nil {
+		return nil, err
+	}
+	return &Trail{logger: auditLogger}, nil
+}
+
+// Record records an operation done within the request.
+// User is the client of API key if request has one, otherwise basic auth user.
+func (t *Trail) Record(r *http.Request, action string, fields ...zap.Field) {
+	user, _, _ := r.BasicAuth()
+	if c, ok := auth.ClientFrom(r.Context()); ok {
+		user = c.Name
+	}
+	fields = append(fields,
+		zap.String("user", user),
+		zap.String("remote_addr", r.RemoteAddr),
+		zap.String("request_id", middleware.GetReqID(r.Context())),
+	)
+	t.logger.Info(action, fields...)
+}
+
+// Guard wraps authentication middleware, so that requests it does not let through are recorded as well,
+// e.g. someone guessing admin credentials.
+func (t *Trail) Guard(guard func(http.Handler) http.HandlerFunc) func(http.Handler) http.HandlerFunc {
+	return func(next http.Handler) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			passed := false
+			sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+			guard(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+				passed = true
+				next.ServeHTTP(w, r)
+			})).ServeHTTP(sw, r)
+			if !passed {
+				t.Record(r, "access denied", zap.String("method", r.Method), zap.String("path", r.URL.Path), zap.Int("status", sw.status))
+			}
+		}
+	}
+}
+
+// statusWriter remembers response status.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
@@ -0,0 +1,62 @@
+package audit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+
+	"github.com/maffka123/metricCollector/internal/auth"
+)
+
+func TestTrail(t *testing.T) {
+	core, records := observer.New(zap.InfoLevel)
+	trail, err := NewTrail("", zap.New(core))
+	require.NoError(t, err)
+
+	keys, err := auth.Load("../auth/testdata/keys.json")
+	require.NoError(t, err)
+	guard := trail.Guard(keys.Require(auth.ScopeAdmin))
+	handler := guard(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		trail.Record(r, "reset counter")
+	}))
+
+	tests := []struct {
+		name       string
+		user       string
+		key        string
+		statusCode int
+		action     string
+		wantUser   string
+	}{
+		{name: "bearer key", key: "admin-key", statusCode: http.StatusOK, action: "reset counter", wantUser: "ops"},
+		{name: "basic auth key", user: "someone", key: "admin-key", statusCode: http.StatusOK, action: "reset counter", wantUser: "ops"},
+		{name: "no admin scope", key: "write-key", statusCode: http.StatusForbidden, action: "access denied"},
+		{name: "unknown key", user: "guess", key: "guess", statusCode: http.StatusUnauthorized, action: "access denied", wantUser: "guess"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPost, "/reset/counter/PollCount", nil)
+			if tt.user != "" {
+				request.SetBasicAuth(tt.user, tt.key)
+			} else {
+				request.Header.Set("Authorization", "Bearer "+tt.key)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, request)
+			assert.Equal(t, tt.statusCode, w.Code)
+
+			logs := records.TakeAll()
+			require.Len(t, logs, 1)
+			assert.Equal(t, tt.action, logs[0].Message)
+			assert.Equal(t, tt.wantUser, logs[0].ContextMap()["user"])
+			if tt.action == "access denied" {
+				assert.Equal(t, int64(tt.statusCode), logs[0].ContextMap()["status"])
+			}
+		})
+	}
+}
@@ -0,0 +1,194 @@
+// Package auth checks API keys which clients send as bearer tokens.
+// Every key belongs to a named client and has one scope: read, write or admin, a higher scope allows everything lower ones do.
+// Browsers can send the key as basic auth password, so that html pages work too.
+// Clients can be known by their TLS certificates as well, see CertName.
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// Scope is what a key allows.
+type Scope int
+
+// Scopes from the lowest to the highest.
+const (
+	ScopeRead Scope = iota + 1
+	ScopeWrite
+	ScopeAdmin
+)
+
+var scopeNames = map[Scope]string{ScopeRead: "read", ScopeWrite: "write", ScopeAdmin: "admin"}
+
+func (s Scope) String() string {
+	return scopeNames[s]
+}
+
+// ParseScope parses scope name.
+func ParseScope(name string) (Scope, error) {
+	for s, n := range scopeNames {
+		if n == name {
+			return s, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown scope %q, it must be read, write or admin", name)
+}
+
+// Client is an owner of a key.
+type Client struct {
+	Name  string
+	Scope Scope
+}
+
+// keyEntry is one key as it is written in keys file.
+type keyEntry struct {
+	Name  string `json:"name"`
+	Key   string `json:"key"`
+	Scope string `json:"scope"`
+}
+
+// Keys holds clients by sha256 of their keys, so that lookup time does not depend on how much of a key is right.
+// Zero Keys means authentication is disabled.
+type Keys struct {
+	file    string
+	clients map[[sha256.Size]byte]Client
+}
+
+// Load reads keys file, which is json array like [{"name": "agent-1", "key": "...", "scope": "write"}].
+func Load(file string) (Keys, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return Keys{}, err
+	}
+	var entries []keyEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return Keys{}, fmt.Errorf("keys file cannot be decoded: %w", err)
+	}
+
+	k := Keys{file: file, clients: make(map[[sha256.Size]byte]Client, len(entries))}
+	for i, e := range entries {
+		if e.Name == "" || e.Key == "" {
+			return Keys{}, fmt.Errorf("key %d has no name or no key", i)
+		}
+		scope, err := ParseScope(e.Scope)
+		if err != nil {
+			return Keys{}, fmt.Errorf("key %s: %w", e.Name, err)
+		}
+		sum := sha256.Sum256([]byte(e.Key))
+		if _, ok := k.clients[sum]; ok {
+			return Keys{}, fmt.Errorf("key %s is given twice", e.Name)
+		}
+		k.clients[sum] = Client{Name: e.Name, Scope: scope}
+	}
+	return k, nil
+}
+
+func (k Keys) String() string {
+	return k.file
+}
+
+// Set loads keys from file given in flag.
+func (k *Keys) Set(file string) error {
+	if file == "" {
+		*k = Keys{}
+		return nil
+	}
+	loaded, err := Load(file)
+	if err != nil {
+		return err
+	}
+	*k = loaded
+	return nil
+}
+
+// UnmarshalText loads keys from file given in env variable or config file.
+func (k *Keys) UnmarshalText(text []byte) error {
+	return k.Set(string(text))
+}
+
+// Enabled checks if any keys are configured.
+func (k Keys) Enabled() bool {
+	return k.clients != nil
+}
+
+// Lookup finds client by its key.
+func (k Keys) Lookup(key string) (Client, bool) {
+	c, ok := k.clients[sha256.Sum256([]byte(key))]
+	return c, ok
+}
+
+// ClientOf finds client by the key sent with the request, without checking its scope.
+func (k Keys) ClientOf(r *http.Request) (Client, bool) {
+	key := token(r)
+	if key == "" {
+		return Client{}, false
+	}
+	return k.Lookup(key)
+}
+
+type clientKey struct{}
+
+// ClientFrom returns client which key was checked by Require.
+func ClientFrom(ctx context.Context) (Client, bool) {
+	c, ok := ctx.Value(clientKey{}).(Client)
+	return c, ok
+}
+
+// Require lets through only requests with a key of the scope or a higher one, everything is let through if keys are disabled.
+func (k Keys) Require(scope Scope) func(http.Handler) http.HandlerFunc {
+	return func(next http.Handler) http.HandlerFunc {
+		if !k.Enabled() {
+			return next.ServeHTTP
+		}
+		return func(w http.ResponseWriter, r *http.Request) {
+			key := token(r)
+			if key == "" {
+				unauthorized(w, "401 - API key required")
+				return
+			}
+			c, ok := k.Lookup(key)
+			if !ok {
+				unauthorized(w, "401 - Unknown API key")
+				return
+			}
+			if c.Scope < scope {
+				http.Error(w, fmt.Sprintf("403 - Key of %s has no %s scope", c.Name, scope), http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientKey{}, c)))
+		}
+	}
+}
+
+// token takes key from bearer token or from basic auth password.
+func token(r *http.Request) string {
+	h := r.Header.Get("Authorization")
+	if len(h) > 7 && strings.EqualFold(h[:7], "bearer ") {
+		return strings.TrimSpace(h[7:])
+	}
+	if _, password, ok := r.BasicAuth(); ok {
+		return password
+	}
+	return ""
+}
+
+// unauthorized asks for a key, Basic lets browsers ask user for it.
+func unauthorized(w http.ResponseWriter, msg string) {
+	w.Header().Add("WWW-Authenticate", `Bearer realm="metrics"`)
+	w.Header().Add("WWW-Authenticate", `Basic realm="metrics"`)
+	http.Error(w, msg, http.StatusUnauthorized)
+}
+
+// CertName returns common name of client certificate verified by the server, it is empty if there is none.
+func CertName(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return r.TLS.VerifiedChains[0][0].Subject.CommonName
+}
@@ -0,0 +1,119 @@
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{name: "bad json", content: `{`, wantErr: "keys file cannot be decoded"},
+		{name: "no key", content: `[{"name": "a1", "scope": "read"}]`, wantErr: "key 0 has no name or no key"},
+		{name: "bad scope", content: `[{"name": "a1", "key": "k", "scope": "root"}]`, wantErr: `key a1: unknown scope "root"`},
+		{name: "same key", content: `[{"name": "a1", "key": "k", "scope": "read"}, {"name": "a2", "key": "k", "scope": "write"}]`,
+			wantErr: "key a2 is given twice"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(dir, "keys.json")
+			require.NoError(t, ioutil.WriteFile(file, []byte(tt.content), 0600))
+			_, err := Load(file)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.wantErr)
+		})
+	}
+
+	_, err := Load(filepath.Join(dir, "missing.json"))
+	assert.Error(t, err)
+
+	k, err := Load("testdata/keys.json")
+	require.NoError(t, err)
+	c, ok := k.Lookup("write-key")
+	assert.True(t, ok)
+	assert.Equal(t, Client{Name: "agent-1", Scope: ScopeWrite}, c)
+	_, ok = k.Lookup("write-ke")
+	assert.False(t, ok)
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	_, ok = k.ClientOf(r)
+	assert.False(t, ok)
+	r.SetBasicAuth("", "read-key")
+	c, ok = k.ClientOf(r)
+	assert.True(t, ok)
+	assert.Equal(t, "dashboard", c.Name)
+}
+
+func TestKeys_Require(t *testing.T) {
+	var k Keys
+	require.NoError(t, k.Set("testdata/keys.json"))
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, _ := ClientFrom(r.Context())
+		w.Write([]byte(c.Name))
+	})
+
+	tests := []struct {
+		name       string
+		scope      Scope
+		bearer     string
+		password   string
+		statusCode int
+		want       string
+	}{
+		{name: "no key", scope: ScopeRead, statusCode: 401, want: "401 - API key required\n"},
+		{name: "unknown key", scope: ScopeRead, bearer: "other", statusCode: 401, want: "401 - Unknown API key\n"},
+		{name: "read", scope: ScopeRead, bearer: "read-key", statusCode: 200, want: "dashboard"},
+		{name: "read as basic auth", scope: ScopeRead, password: "read-key", statusCode: 200, want: "dashboard"},
+		{name: "read cannot write", scope: ScopeWrite, bearer: "read-key", statusCode: 403, want: "403 - Key of dashboard has no write scope\n"},
+		{name: "write", scope: ScopeWrite, bearer: "write-key", statusCode: 200, want: "agent-1"},
+		{name: "write can read", scope: ScopeRead, bearer: "write-key", statusCode: 200, want: "agent-1"},
+		{name: "write is not admin", scope: ScopeAdmin, bearer: "write-key", statusCode: 403, want: "403 - Key of agent-1 has no admin scope\n"},
+		{name: "admin", scope: ScopeAdmin, bearer: "admin-key", statusCode: 200, want: "ops"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.bearer != "" {
+				request.Header.Set("Authorization", "Bearer "+tt.bearer)
+			}
+			if tt.password != "" {
+				request.SetBasicAuth("anyone", tt.password)
+			}
+			w := httptest.NewRecorder()
+			k.Require(tt.scope)(ok).ServeHTTP(w, request)
+
+			assert.Equal(t, tt.statusCode, w.Code)
+			assert.Equal(t, tt.want, w.Body.String())
+			if tt.statusCode == http.StatusUnauthorized {
+				assert.Equal(t, []string{`Bearer realm="metrics"`, `Basic realm="metrics"`}, w.Header().Values("WWW-Authenticate"))
+			}
+		})
+	}
+
+	// without keys everything is let through
+	w := httptest.NewRecorder()
+	Keys{}.Require(ScopeAdmin)(ok).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestCertName(t *testing.T) {
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	assert.Equal(t, "", CertName(request))
+	request.TLS = &tls.ConnectionState{}
+	assert.Equal(t, "", CertName(request))
+	request.TLS.VerifiedChains = [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "agent-1"}}}}
+	assert.Equal(t, "agent-1", CertName(request))
+}
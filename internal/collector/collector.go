@@ -14,6 +14,7 @@ import (
 	"github.com/shirou/gopsutil/v3/cpu"
 	"github.com/shirou/gopsutil/v3/mem"
 
+	"github.com/maffka123/metricCollector/internal/hashkeys"
 	"github.com/maffka123/metricCollector/internal/models"
 )
 
@@ -34,7 +35,7 @@ type Metric struct {
 	currVal number
 	Change  number
 	Type    string
-	Key     *string
+	Keys    hashkeys.Ring
 }
 
 // PSMetric type for psutil metrics with its own methods.
@@ -50,17 +51,17 @@ type MetricInterface interface {
 
 // GetAllMetrics prepares and intialize all metrics that are collected in this service.
 // see example here: https://github.com/tevjef/go-runtime-metrics/blob/master/collector/collector.go
-func GetAllMetrics(k *string) []*Metric {
+func GetAllMetrics(k hashkeys.Ring) []*Metric {
 	metricList := []*Metric{}
 	for _, value := range runtimeMetricNameList {
 
-		m := Metric{Name: value, Type: "gauge", Key: k}
+		m := Metric{Name: value, Type: "gauge", Keys: k}
 		m.init()
 		metricList = append(metricList, &m)
 	}
 
-	metricList = append(metricList, &Metric{Name: "PollCount", Type: "counter", currVal: number{integer: 1, float: 0.0}, Key: k})
-	metricList = append(metricList, &Metric{Name: "RandomValue", Type: "gauge", currVal: number{integer: rand.Intn(100), float: 0.0}, Key: k})
+	metricList = append(metricList, &Metric{Name: "PollCount", Type: "counter", currVal: number{integer: 1, float: 0.0}, Keys: k})
+	metricList = append(metricList, &Metric{Name: "RandomValue", Type: "gauge", currVal: number{integer: rand.Intn(100), float: 0.0}, Keys: k})
 
 	return metricList
 }
@@ -124,19 +125,17 @@ func (m *Metric) MarshalJSON() ([]byte, error) {
 		newM.Value = m.Change.FloatValue()
 	}
 
-	if m.Key != nil && *m.Key != "" {
-		newM.CalcHash(*m.Key)
-	}
+	m.Keys.Sign(&newM)
 
 	return json.Marshal(newM)
 }
 
 // GetAllPSUtilMetrics collects all psutil metrics at the start.
-func GetAllPSUtilMetrics(k *string) []*PSMetric {
+func GetAllPSUtilMetrics(k hashkeys.Ring) []*PSMetric {
 	metricList := []*PSMetric{}
 	for _, value := range psutilMetricNameList {
 
-		m := PSMetric{Name: value, Type: "gauge", Key: k}
+		m := PSMetric{Name: value, Type: "gauge", Keys: k}
 		m.init()
 		metricList = append(metricList, &m)
 	}
@@ -180,9 +179,7 @@ func (m *PSMetric) MarshalJSON() ([]byte, error) {
 		newM.Value = m.Change.FloatValue()
 	}
 
-	if m.Key != nil && *m.Key != "" {
-		newM.CalcHash(*m.Key)
-	}
+	m.Keys.Sign(&newM)
 
 	return json.Marshal(newM)
 }
@@ -216,10 +213,10 @@ func (m *PSMetric) MetricByName() {
 }
 
 // psMetricCPU collects cpu metrics for initialization of the metrics.
-func psMetricCPU(metricList *[]*PSMetric, k *string) {
+func psMetricCPU(metricList *[]*PSMetric, k hashkeys.Ring) {
 	c, _ := cpu.Times(true)
 	for i, usage := range c {
-		m := PSMetric{Name: fmt.Sprintf("CPUutilization%d", i), Type: "gauge", Key: k}
+		m := PSMetric{Name: fmt.Sprintf("CPUutilization%d", i), Type: "gauge", Keys: k}
 		m.initWithVal(usage.Total())
 		*metricList = append(*metricList, &m)
 	}
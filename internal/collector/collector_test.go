@@ -8,6 +8,7 @@ import (
 
 	"github.com/stretchr/testify/assert"
 
+	"github.com/maffka123/metricCollector/internal/hashkeys"
 	"github.com/maffka123/metricCollector/internal/models"
 )
 
@@ -52,7 +53,7 @@ func TestMetric_Update(t *testing.T) {
 }
 
 func TestGetAllMetrics(t *testing.T) {
-	key := "test"
+	key := hashkeys.New(hashkeys.Key{Secret: "test"})
 	tests := []struct {
 		name string
 		want []*Metric
@@ -61,7 +62,7 @@ func TestGetAllMetrics(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got := GetAllMetrics(&key)
+			got := GetAllMetrics(key)
 			assert.IsType(t, tt.want, got)
 			assert.Equal(t, 29, len(got))
 		})
@@ -121,7 +122,7 @@ func TestMetric_MarshalJSON(t *testing.T) {
 				Name:   tt.fields.Name,
 				Change: tt.fields.Change,
 				Type:   tt.fields.Type,
-				Key:    &tt.key,
+				Keys:   hashkeys.New(hashkeys.Key{Secret: tt.key}),
 			}
 			got, err := m.MarshalJSON()
 			assert.NoError(t, err)
@@ -158,7 +159,7 @@ func TestPSMetric_init(t *testing.T) {
 }
 
 func TestGetAllPSutilMetric(t *testing.T) {
-	key := "test"
+	key := hashkeys.New(hashkeys.Key{Secret: "test"})
 	tests := []struct {
 		name string
 		want []*PSMetric
@@ -167,7 +168,7 @@ func TestGetAllPSutilMetric(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got := GetAllPSUtilMetrics(&key)
+			got := GetAllPSUtilMetrics(key)
 			assert.IsType(t, tt.want, got)
 			assert.Equal(t, got[2].Name, "CPUutilization0")
 		})
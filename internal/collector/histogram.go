@@ -0,0 +1,95 @@
+package collector
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"sort"
+	"sync"
+
+	"github.com/maffka123/metricCollector/internal/hashkeys"
+	"github.com/maffka123/metricCollector/internal/models"
+)
+
+// HistogramMetric type for metrics which are distributions of many observations, e.g. GC pauses.
+// It sends observations made since the previous successful send, server adds them up.
+type HistogramMetric struct {
+	Name      string
+	Keys      hashkeys.Ring
+	bounds    []float64
+	lastNumGC uint32
+	Change    *models.Histogram
+}
+
+// Accumulator is implemented by metrics which keep observations until they are sent successfully.
+type Accumulator interface {
+	Sent()
+}
+
+// GetHistogramMetrics prepares histogram metrics, bounds are upper bounds of buckets.
+func GetHistogramMetrics(k hashkeys.Ring, bounds []float64) []*HistogramMetric {
+	// server accepts only sorted unique bounds
+	sorted := make([]float64, len(bounds))
+	copy(sorted, bounds)
+	sort.Float64s(sorted)
+	unique := make([]float64, 0, len(sorted))
+	for _, b := range sorted {
+		if len(unique) == 0 || b != unique[len(unique)-1] {
+			unique = append(unique, b)
+		}
+	}
+
+	m := HistogramMetric{Name: "GCPause", Keys: k, bounds: unique}
+	m.init()
+	return []*HistogramMetric{&m}
+}
+
+// init initializes histogram, GC pauses which happened before agent start are not counted.
+func (m *HistogramMetric) init() {
+	m.Change = models.NewHistogram(m.bounds)
+	m.lastNumGC = startStats().NumGC
+}
+
+// Print is more for debugging, print what is inside metric.
+func (m *HistogramMetric) Print() {
+	fmt.Printf("%s: count %d, sum %f\n", m.Name, m.Change.Count, m.Change.Sum)
+}
+
+// Update adds GC pauses happened since the previous update, in seconds, to the ones which are not sent yet.
+func (m *HistogramMetric) Update(wg *sync.WaitGroup) {
+	defer wg.Done()
+	memStats := &runtime.MemStats{}
+	runtime.ReadMemStats(memStats)
+	m.Change.Merge(pausesSince(memStats, m.lastNumGC, m.bounds))
+	m.lastNumGC = memStats.NumGC
+}
+
+// Sent starts a new histogram, observations of the current one were accepted by server.
+func (m *HistogramMetric) Sent() {
+	m.Change = models.NewHistogram(m.bounds)
+}
+
+// pausesSince puts GC pauses after given GC number into histogram.
+// PauseNs is a circular buffer, so only the last len(PauseNs) pauses can be seen.
+func pausesSince(memStats *runtime.MemStats, lastNumGC uint32, bounds []float64) *models.Histogram {
+	h := models.NewHistogram(bounds)
+	n := memStats.NumGC - lastNumGC
+	if n > uint32(len(memStats.PauseNs)) {
+		n = uint32(len(memStats.PauseNs))
+	}
+	for i := uint32(0); i < n; i++ {
+		gc := memStats.NumGC - i
+		pause := memStats.PauseNs[(gc+uint32(len(memStats.PauseNs))-1)%uint32(len(memStats.PauseNs))]
+		h.Observe(float64(pause) / 1e9)
+	}
+	return h
+}
+
+// MarshalJSON marshalls metrics to json.
+func (m *HistogramMetric) MarshalJSON() ([]byte, error) {
+	newM := models.Metrics{ID: m.Name, MType: "histogram", Histogram: m.Change}
+
+	m.Keys.Sign(&newM)
+
+	return json.Marshal(newM)
+}
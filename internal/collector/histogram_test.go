@@ -0,0 +1,60 @@
+package collector
+
+import (
+	"runtime"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/maffka123/metricCollector/internal/hashkeys"
+)
+
+func TestGetHistogramMetrics(t *testing.T) {
+	key := hashkeys.New(hashkeys.Key{Secret: "test"})
+	ms := GetHistogramMetrics(key, []float64{0.1, 0.01, 0.1})
+	assert.Len(t, ms, 1)
+	assert.Equal(t, "GCPause", ms[0].Name)
+	assert.Equal(t, []float64{0.01, 0.1}, ms[0].Change.Bounds)
+	assert.Equal(t, uint64(0), ms[0].Change.Count)
+}
+
+func TestHistogramMetric_Update(t *testing.T) {
+	m := GetHistogramMetrics(hashkeys.Ring{}, []float64{0.01})[0]
+	var wg sync.WaitGroup
+	for i := 1; i <= 3; i++ {
+		runtime.GC()
+		wg.Add(1)
+		m.Update(&wg)
+		assert.GreaterOrEqual(t, m.Change.Count, uint64(i), "pauses of previous polls are kept until they are sent")
+	}
+	assert.NoError(t, m.Change.Validate())
+
+	m.Sent()
+	assert.Equal(t, uint64(0), m.Change.Count)
+	assert.Equal(t, []float64{0.01}, m.Change.Bounds)
+}
+
+func Test_pausesSince(t *testing.T) {
+	memStats := &runtime.MemStats{NumGC: 3}
+	memStats.PauseNs[0] = 1e6 // 0.001s
+	memStats.PauseNs[1] = 2e7 // 0.02s
+	memStats.PauseNs[2] = 3e8 // 0.3s
+
+	tests := []struct {
+		name      string
+		lastNumGC uint32
+		counts    []uint64
+	}{
+		{name: "all", lastNumGC: 0, counts: []uint64{1, 1, 1}},
+		{name: "new only", lastNumGC: 2, counts: []uint64{0, 0, 1}},
+		{name: "nothing new", lastNumGC: 3, counts: []uint64{0, 0, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := pausesSince(memStats, tt.lastNumGC, []float64{0.01, 0.1})
+			assert.Equal(t, tt.counts, h.Counts)
+			assert.NoError(t, h.Validate())
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package collector
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/shirou/gopsutil/v3/host"
+
+	"github.com/maffka123/metricCollector/internal/hashkeys"
+	"github.com/maffka123/metricCollector/internal/models"
+)
+
+// InfoMetric type for metrics with string value, e.g. versions, which do not change while agent runs.
+type InfoMetric struct {
+	Name  string
+	Keys  hashkeys.Ring
+	Value string
+}
+
+// GetInfoMetrics prepares info metrics about agent build and host.
+func GetInfoMetrics(k hashkeys.Ring, version string, commit string) []*InfoMetric {
+	metricList := []*InfoMetric{
+		{Name: "AgentVersion", Keys: k, Value: version},
+		{Name: "AgentBuildCommit", Keys: k, Value: commit},
+		{Name: "KernelVersion", Keys: k},
+	}
+	for _, m := range metricList {
+		m.init()
+	}
+	return metricList
+}
+
+// init reads values which are not known beforehand.
+func (m *InfoMetric) init() {
+	if m.Name != "KernelVersion" {
+		return
+	}
+	v, err := host.KernelVersion()
+	if err != nil {
+		v = "N/A"
+	}
+	m.Value = v
+}
+
+// Print is more for debugging, print what is inside metric.
+func (m *InfoMetric) Print() {
+	fmt.Printf("%s: %s\n", m.Name, m.Value)
+}
+
+// Update does nothing, info does not change.
+func (m *InfoMetric) Update(wg *sync.WaitGroup) {
+	defer wg.Done()
+}
+
+// MarshalJSON marshalls metrics to json.
+func (m *InfoMetric) MarshalJSON() ([]byte, error) {
+	v := m.Value
+	newM := models.Metrics{ID: m.Name, MType: "info", Info: &v}
+
+	m.Keys.Sign(&newM)
+
+	return json.Marshal(newM)
+}
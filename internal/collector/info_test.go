@@ -0,0 +1,27 @@
+package collector
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/maffka123/metricCollector/internal/hashkeys"
+	"github.com/maffka123/metricCollector/internal/models"
+)
+
+func TestGetInfoMetrics(t *testing.T) {
+	ms := GetInfoMetrics(hashkeys.Ring{}, "v1.0.0", "abc123")
+	assert.Len(t, ms, 3)
+	assert.Equal(t, "v1.0.0", ms[0].Value)
+	assert.Equal(t, "abc123", ms[1].Value)
+	assert.NotEmpty(t, ms[2].Value)
+
+	b, err := json.Marshal(ms[0])
+	assert.NoError(t, err)
+	var m models.Metrics
+	assert.NoError(t, json.Unmarshal(b, &m))
+	assert.Equal(t, "info", m.MType)
+	assert.Equal(t, "v1.0.0", *m.Info)
+	assert.NoError(t, m.Validate())
+}
@@ -0,0 +1,64 @@
+package collector
+
+import (
+	"strings"
+
+	"github.com/maffka123/metricCollector/internal/models"
+)
+
+// metricMeta describes built-in metrics, descriptions follow runtime.MemStats docs.
+var metricMeta = map[string]models.Meta{
+	"Alloc":            {Description: "Bytes of allocated heap objects", Unit: "bytes", Type: "gauge"},
+	"BuckHashSys":      {Description: "Bytes of memory in profiling bucket hash tables", Unit: "bytes", Type: "gauge"},
+	"Frees":            {Description: "Cumulative count of heap objects freed", Unit: "objects", Type: "gauge"},
+	"GCCPUFraction":    {Description: "Fraction of available CPU time used by the GC since the program started", Unit: "ratio", Type: "gauge"},
+	"GCSys":            {Description: "Bytes of memory in garbage collection metadata", Unit: "bytes", Type: "gauge"},
+	"HeapAlloc":        {Description: "Bytes of allocated heap objects", Unit: "bytes", Type: "gauge"},
+	"HeapIdle":         {Description: "Bytes in idle (unused) heap spans", Unit: "bytes", Type: "gauge"},
+	"HeapInuse":        {Description: "Bytes in in-use heap spans", Unit: "bytes", Type: "gauge"},
+	"HeapObjects":      {Description: "Number of allocated heap objects", Unit: "objects", Type: "gauge"},
+	"HeapReleased":     {Description: "Bytes of physical memory returned to the OS", Unit: "bytes", Type: "gauge"},
+	"HeapSys":          {Description: "Bytes of heap memory obtained from the OS", Unit: "bytes", Type: "gauge"},
+	"LastGC":           {Description: "Time the last garbage collection finished, since 1970", Unit: "nanoseconds", Type: "gauge"},
+	"Lookups":          {Description: "Number of pointer lookups performed by the runtime", Unit: "lookups", Type: "gauge"},
+	"MCacheInuse":      {Description: "Bytes of allocated mcache structures", Unit: "bytes", Type: "gauge"},
+	"MCacheSys":        {Description: "Bytes of memory obtained from the OS for mcache structures", Unit: "bytes", Type: "gauge"},
+	"MSpanInuse":       {Description: "Bytes of allocated mspan structures", Unit: "bytes", Type: "gauge"},
+	"MSpanSys":         {Description: "Bytes of memory obtained from the OS for mspan structures", Unit: "bytes", Type: "gauge"},
+	"Mallocs":          {Description: "Cumulative count of heap objects allocated", Unit: "objects", Type: "gauge"},
+	"NextGC":           {Description: "Target heap size of the next GC cycle", Unit: "bytes", Type: "gauge"},
+	"NumForcedGC":      {Description: "Number of GC cycles forced by the application", Unit: "cycles", Type: "gauge"},
+	"NumGC":            {Description: "Number of completed GC cycles", Unit: "cycles", Type: "gauge"},
+	"OtherSys":         {Description: "Bytes of memory in miscellaneous off-heap runtime allocations", Unit: "bytes", Type: "gauge"},
+	"PauseTotalNs":     {Description: "Cumulative time spent in GC stop-the-world pauses", Unit: "nanoseconds", Type: "gauge"},
+	"StackInuse":       {Description: "Bytes in stack spans", Unit: "bytes", Type: "gauge"},
+	"StackSys":         {Description: "Bytes of stack memory obtained from the OS", Unit: "bytes", Type: "gauge"},
+	"Sys":              {Description: "Total bytes of memory obtained from the OS", Unit: "bytes", Type: "gauge"},
+	"TotalAlloc":       {Description: "Cumulative bytes allocated for heap objects", Unit: "bytes", Type: "gauge"},
+	"PollCount":        {Description: "Number of times metrics were polled", Unit: "polls", Type: "counter"},
+	"RandomValue":      {Description: "Random value updated on every poll", Type: "gauge"},
+	"GCPause":          {Description: "GC stop-the-world pauses", Unit: "seconds", Type: "histogram"},
+	"AgentVersion":     {Description: "Version of the agent", Type: "info"},
+	"AgentBuildCommit": {Description: "Commit the agent was built from", Type: "info"},
+	"KernelVersion":    {Description: "Kernel version of the host", Type: "info"},
+	"TotalMemory":      {Description: "Total amount of RAM on the host", Unit: "bytes", Type: "gauge"},
+	"FreeMemory":       {Description: "Amount of free RAM on the host", Unit: "bytes", Type: "gauge"},
+}
+
+// GetMeta returns metadata of built-in metrics with given names, unknown names are skipped.
+func GetMeta(names ...string) []models.Meta {
+	res := make([]models.Meta, 0, len(names))
+	for _, name := range names {
+		meta, ok := metricMeta[name]
+		if !ok && strings.HasPrefix(name, "CPUutilization") {
+			meta = models.Meta{Description: "CPU time of core " + strings.TrimPrefix(name, "CPUutilization"), Unit: "seconds", Type: "gauge"}
+			ok = true
+		}
+		if !ok {
+			continue
+		}
+		meta.Name = name
+		res = append(res, meta)
+	}
+	return res
+}
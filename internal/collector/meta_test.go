@@ -0,0 +1,27 @@
+package collector
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/maffka123/metricCollector/internal/models"
+)
+
+func TestGetMeta(t *testing.T) {
+	metas := GetMeta("HeapIdle", "CPUutilization3", "Unknown")
+	assert.Equal(t, []models.Meta{
+		{Name: "HeapIdle", Description: "Bytes in idle (unused) heap spans", Unit: "bytes", Type: "gauge"},
+		{Name: "CPUutilization3", Description: "CPU time of core 3", Unit: "seconds", Type: "gauge"},
+	}, metas)
+
+	// every built-in metric is described
+	names := append([]string{}, runtimeMetricNameList[:]...)
+	names = append(names, psutilMetricNameList[:]...)
+	names = append(names, "PollCount", "RandomValue", "GCPause", "AgentVersion", "AgentBuildCommit", "KernelVersion")
+	metas = GetMeta(names...)
+	assert.Len(t, metas, len(names))
+	for _, meta := range metas {
+		assert.NoError(t, meta.Validate())
+	}
+}
@@ -0,0 +1,300 @@
+package handlers
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap"
+
+	"github.com/maffka123/metricCollector/internal/hashkeys"
+	"github.com/maffka123/metricCollector/internal/models"
+	"github.com/maffka123/metricCollector/internal/rates"
+	"github.com/maffka123/metricCollector/internal/storage"
+)
+
+// openAPISpec describes /api/v2, it is served as is.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// apiData is the envelope of every successful /api/v2 response.
+type apiData struct {
+	Data interface{} `json:"data"`
+}
+
+// apiError is the envelope of every failed /api/v2 response.
+type apiError struct {
+	Error apiErrorBody `json:"error"`
+}
+
+type apiErrorBody struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+}
+
+// writeStats is returned after metrics are written with /api/v2.
+type writeStats struct {
+	Accepted int `json:"accepted"`
+	Rejected int `json:"rejected"`
+}
+
+// APIv2 routes versioned json API, all responses are either {"data": ...} or {"error": {"status": ..., "message": ...}}.
+func (mh *MetricHandler) APIv2(dbUpdated chan time.Time, keys hashkeys.Ring, unpack Middleware, checkWritable Middleware) chi.Router {
+	r := chi.NewRouter()
+	r.Use(jsonErrors)
+	r.NotFound(func(w http.ResponseWriter, r *http.Request) {
+		writeAPIError(w, http.StatusNotFound, "no such endpoint: "+r.URL.Path)
+	})
+	r.MethodNotAllowed(func(w http.ResponseWriter, r *http.Request) {
+		writeAPIError(w, http.StatusMethodNotAllowed, r.Method+" is not allowed on "+r.URL.Path)
+	})
+
+	r.Get("/metrics", Conveyor(mh.getMetricsV2(), packGZIP, mh.readGuard))
+	r.Post("/metrics", Conveyor(mh.postMetricsV2(dbUpdated, keys), mh.checkSigned, unpack, requireJSON, checkWritable, mh.ingestGuard))
+	r.Get("/metrics/{type}/{name}", Conveyor(mh.getMetricV2(), mh.readGuard))
+	r.Get("/query", Conveyor(mh.getQueryV2(), packGZIP, mh.readGuard))
+	r.Get("/history", Conveyor(mh.getHistoryV2(), packGZIP, mh.readGuard))
+	r.Get("/meta", Conveyor(mh.getMetaListV2(), mh.readGuard))
+	r.Get("/meta/{name}", Conveyor(mh.getMetaV2(), mh.readGuard))
+	r.Put("/meta/{name}", Conveyor(mh.putMetaV2(dbUpdated), mh.checkSigned, unpack, requireJSON, checkWritable, mh.ingestGuard))
+	r.Get("/openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(openAPISpec)
+	})
+	return r
+}
+
+// writeAPIData sends successful /api/v2 response.
+func writeAPIData(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(apiData{Data: data})
+}
+
+// writeAPIError sends failed /api/v2 response.
+func writeAPIError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Del("X-Content-Type-Options")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(apiError{Error: apiErrorBody{Status: status, Message: msg}})
+}
+
+// jsonErrors turns plain text errors of shared middlewares, e.g. "403 - Replica is read-only", into /api/v2 error envelope.
+func jsonErrors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ew := &errorWriter{ResponseWriter: w}
+		next.ServeHTTP(ew, r)
+		if ew.status != 0 {
+			msg := strings.TrimSpace(ew.body.String())
+			msg = strings.TrimPrefix(msg, strconv.Itoa(ew.status)+" - ")
+			writeAPIError(w, ew.status, msg)
+		}
+	})
+}
+
+// errorWriter holds back plain text error responses, everything else is written through.
+type errorWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (ew *errorWriter) WriteHeader(status int) {
+	if status >= http.StatusBadRequest && strings.HasPrefix(ew.Header().Get("Content-Type"), "text/plain") {
+		ew.status = status
+		return
+	}
+	ew.ResponseWriter.WriteHeader(status)
+}
+
+func (ew *errorWriter) Write(b []byte) (int, error) {
+	if ew.status != 0 {
+		return ew.body.Write(b)
+	}
+	return ew.ResponseWriter.Write(b)
+}
+
+// requireJSON lets through only requests with json body, which can be compressed with gzip or deflate.
+func requireJSON(next http.Handler) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+			writeAPIError(w, http.StatusUnsupportedMediaType, "Content-Type must be application/json")
+			return
+		}
+		for _, c := range contentCodings(r.Header) {
+			if c != "gzip" && c != "x-gzip" && c != "deflate" {
+				writeAPIError(w, http.StatusUnsupportedMediaType, "Content-Encoding must be gzip or deflate")
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// getMetricsV2 returns all metrics, optionally only of one type or only stale or live ones.
+func (mh *MetricHandler) getMetricsV2() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		stale, err := staleFilter(r)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		mType := r.URL.Query().Get("type")
+		if mType != "" && !knownType(mType) {
+			writeAPIError(w, http.StatusBadRequest, "unknown metric type: "+mType)
+			return
+		}
+
+		res, _ := mh.db.SelectAll(storage.ListOptions{Type: mType, Stale: stale, StaleTTL: mh.staleTTL})
+		writeAPIData(w, http.StatusOK, res)
+	}
+}
+
+// getMetricV2 returns one metric.
+func (mh *MetricHandler) getMetricV2() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		mType := strings.ToLower(chi.URLParam(r, "type"))
+		name := chi.URLParam(r, "name")
+		if !knownType(mType) {
+			writeAPIError(w, http.StatusBadRequest, "unknown metric type: "+mType)
+			return
+		}
+		for _, m := range mh.selectMetrics() {
+			if m.MType == mType && m.ID == name {
+				writeAPIData(w, http.StatusOK, m)
+				return
+			}
+		}
+		writeAPIError(w, http.StatusNotFound, fmt.Sprintf("%s %s does not exist", mType, name))
+	}
+}
+
+// postMetricsV2 writes json array of metrics, either all of them are valid or nothing is written.
+func (mh *MetricHandler) postMetricsV2(dbUpdated chan time.Time, keys hashkeys.Ring) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var ms []models.Metrics
+		if err := json.NewDecoder(r.Body).Decode(&ms); err != nil {
+			writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("metrics json cannot be decoded: %s", err))
+			return
+		}
+		if len(ms) == 0 {
+			writeAPIError(w, http.StatusBadRequest, "no metrics given")
+			return
+		}
+		if mh.maxBatch > 0 && len(ms) > mh.maxBatch {
+			writeAPIError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("batch of %d metrics is larger than %d", len(ms), mh.maxBatch))
+			return
+		}
+		for i := range ms {
+			if err := ms[i].Validate(); err != nil {
+				writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("%s: %s", ms[i].ID, err))
+				return
+			}
+			if err := keys.Verify(&ms[i]); err != nil {
+				writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("%s: %s", ms[i].ID, err))
+				return
+			}
+		}
+
+		rejected, werr := mh.storeMetrics(r, dbUpdated, ms)
+		if werr != nil {
+			if werr.retryAfter > 0 {
+				w.Header().Set("Retry-After", strconv.Itoa(werr.retryAfter))
+			}
+			writeAPIError(w, werr.code, werr.msg)
+			return
+		}
+		writeAPIData(w, http.StatusOK, writeStats{Accepted: len(ms) - rejected, Rejected: rejected})
+		mh.logger.Debug("got", zap.Int("metrics n", len(ms)))
+	}
+}
+
+// getQueryV2 selects and aggregates metrics, parameters are the same as of /query.
+func (mh *MetricHandler) getQueryV2() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q, err := mh.parseQuery(r)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		res, err := q.Exec(mh.db)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeAPIData(w, http.StatusOK, res)
+	}
+}
+
+// getHistoryV2 returns recent values of numeric metrics sampled by rates tracker, nothing without tracker.
+func (mh *MetricHandler) getHistoryV2() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		history := []rates.History{}
+		if mh.rates != nil {
+			history = mh.rates.History()
+		}
+		writeAPIData(w, http.StatusOK, history)
+	}
+}
+
+// getMetaListV2 returns metadata of all metrics.
+func (mh *MetricHandler) getMetaListV2() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeAPIData(w, http.StatusOK, mh.db.SelectAllMeta())
+	}
+}
+
+// getMetaV2 returns metadata of a metric.
+func (mh *MetricHandler) getMetaV2() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := chi.URLParam(r, "name")
+		meta, ok := mh.db.SelectMeta(name)
+		if !ok {
+			writeAPIError(w, http.StatusNotFound, "no metadata for "+name)
+			return
+		}
+		writeAPIData(w, http.StatusOK, meta)
+	}
+}
+
+// putMetaV2 sets metadata of a metric.
+func (mh *MetricHandler) putMetaV2(dbUpdated chan time.Time) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var meta models.Meta
+		if err := json.NewDecoder(r.Body).Decode(&meta); err != nil {
+			writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("metadata json cannot be decoded: %s", err))
+			return
+		}
+		meta.Name = chi.URLParam(r, "name")
+		if err := meta.Validate(); err != nil {
+			writeAPIError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		mh.db.InsertMeta(meta)
+		writeAPIData(w, http.StatusOK, meta)
+		dbUpdated <- time.Now()
+	}
+}
+
+// selectMetrics returns all metrics sorted by name with stale flag set.
+func (mh *MetricHandler) selectMetrics() []models.Metrics {
+	ms, _ := mh.db.SelectAll(storage.ListOptions{StaleTTL: mh.staleTTL})
+	return ms
+}
+
+// knownType checks that metric of such type can be stored.
+func knownType(mType string) bool {
+	switch mType {
+	case "counter", "gauge", "histogram", "set", "info":
+		return true
+	}
+	return false
+}
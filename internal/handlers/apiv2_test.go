@@ -0,0 +1,237 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/maffka123/metricCollector/internal/rates"
+	"github.com/maffka123/metricCollector/internal/storage"
+)
+
+// spec is the part of openapi document needed to check handlers against it.
+type spec struct {
+	Paths map[string]map[string]json.RawMessage `json:"paths"`
+}
+
+func loadSpec(t *testing.T) spec {
+	var s spec
+	require.NoError(t, json.Unmarshal(openAPISpec, &s))
+	return s
+}
+
+// documentedStatuses returns response codes documented for the operation.
+func (s spec) documentedStatuses(t *testing.T, method string, path string) []string {
+	var op struct {
+		Responses map[string]json.RawMessage `json:"responses"`
+	}
+	raw, ok := s.Paths[path][strings.ToLower(method)]
+	require.True(t, ok, "%s %s is not documented", method, path)
+	require.NoError(t, json.Unmarshal(raw, &op))
+	res := []string{}
+	for code := range op.Responses {
+		res = append(res, code)
+	}
+	return res
+}
+
+func TestAPIv2_SpecCoversRoutes(t *testing.T) {
+	cfg := prepConf()
+	db := storage.Connect(cfg, logger)
+	r, _ := MetricRouter(db, nil, nil, cfg, logger)
+
+	routes := []string{}
+	err := chi.Walk(r, func(method string, route string, handler http.Handler, middlewares ...func(http.Handler) http.Handler) error {
+		if strings.HasPrefix(route, "/api/v2/") {
+			routes = append(routes, method+" "+strings.TrimPrefix(route, "/api/v2"))
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	documented := []string{}
+	for path, ops := range loadSpec(t).Paths {
+		for method := range ops {
+			if method == "parameters" {
+				continue
+			}
+			documented = append(documented, strings.ToUpper(method)+" "+path)
+		}
+	}
+	sort.Strings(routes)
+	sort.Strings(documented)
+	assert.Equal(t, documented, routes)
+}
+
+func TestAPIv2(t *testing.T) {
+	cfg := prepConf()
+	db := storage.Connect(cfg, logger)
+	db.InsertGouge(`Alloc{agent="a1"}`, 1024)
+	db.InsertCounter("PollCount", 5)
+	r, dbUpdated := MetricRouter(db, nil, nil, cfg, logger)
+	go func() {
+		for range dbUpdated {
+		}
+	}()
+	s := loadSpec(t)
+
+	tests := []struct {
+		name        string
+		method      string
+		request     string
+		path        string // documented path the request goes to
+		contentType string
+		encoding    string
+		body        string
+		statusCode  int
+		wantBody    string
+	}{
+		{name: "list", method: http.MethodGet, request: "/api/v2/metrics?type=counter", path: "/metrics",
+			statusCode: 200, wantBody: `{"data":[{"id":"PollCount","type":"counter","delta":5`},
+		{name: "list unknown type", method: http.MethodGet, request: "/api/v2/metrics?type=float", path: "/metrics",
+			statusCode: 400, wantBody: `{"error":{"status":400,"message":"unknown metric type: float"}}`},
+		{name: "list bad stale", method: http.MethodGet, request: "/api/v2/metrics?stale=maybe", path: "/metrics",
+			statusCode: 400, wantBody: `"message":"stale must be true or false`},
+		{name: "get", method: http.MethodGet, request: `/api/v2/metrics/gauge/Alloc{agent="a1"}`, path: "/metrics/{type}/{name}",
+			statusCode: 200, wantBody: `{"data":{"id":"Alloc{agent=\"a1\"}","type":"gauge","value":1024`},
+		{name: "get unknown", method: http.MethodGet, request: "/api/v2/metrics/gauge/Unknown", path: "/metrics/{type}/{name}",
+			statusCode: 404, wantBody: `{"error":{"status":404,"message":"gauge Unknown does not exist"}}`},
+		{name: "get unknown type", method: http.MethodGet, request: "/api/v2/metrics/float/Alloc", path: "/metrics/{type}/{name}",
+			statusCode: 400, wantBody: `"message":"unknown metric type: float"`},
+		{name: "post", method: http.MethodPost, request: "/api/v2/metrics", path: "/metrics", contentType: "application/json",
+			body:       `[{"id":"Sys","type":"gauge","value":2},{"id":"PollCount","type":"counter","delta":1}]`,
+			statusCode: 200, wantBody: `{"data":{"accepted":2,"rejected":0}}`},
+		{name: "post invalid", method: http.MethodPost, request: "/api/v2/metrics", path: "/metrics", contentType: "application/json",
+			body:       `[{"id":"Sys","type":"gauge"}]`,
+			statusCode: 400, wantBody: `{"error":{"status":400,"message":"Sys: metric has no value"}}`},
+		{name: "post unknown type", method: http.MethodPost, request: "/api/v2/metrics", path: "/metrics", contentType: "application/json",
+			body:       `[{"id":"Sys","type":"float","value":2}]`,
+			statusCode: 400, wantBody: `"message":"Sys: metric type unknown"`},
+		{name: "post bad json", method: http.MethodPost, request: "/api/v2/metrics", path: "/metrics", contentType: "application/json",
+			body:       `{`,
+			statusCode: 400, wantBody: `"message":"metrics json cannot be decoded: unexpected EOF"`},
+		{name: "post empty", method: http.MethodPost, request: "/api/v2/metrics", path: "/metrics", contentType: "application/json",
+			body:       `[]`,
+			statusCode: 400, wantBody: `"message":"no metrics given"`},
+		{name: "post conflicting type", method: http.MethodPost, request: "/api/v2/metrics", path: "/metrics", contentType: "application/json",
+			body:       `[{"id":"PollCount","type":"gauge","value":1}]`,
+			statusCode: 409, wantBody: `"message":"PollCount is registered as counter, cannot write it as gauge"`},
+		{name: "post not json", method: http.MethodPost, request: "/api/v2/metrics", path: "/metrics", contentType: "text/plain",
+			body:       `[]`,
+			statusCode: 415, wantBody: `"message":"Content-Type must be application/json"`},
+		{name: "query", method: http.MethodGet, request: "/api/v2/query?name=PollCount", path: "/query",
+			statusCode: 200, wantBody: `{"data":[{"name":"PollCount","type":"counter","labels":{},"value":6}]}`},
+		{name: "query bad k", method: http.MethodGet, request: "/api/v2/query?agg=topk&k=a", path: "/query",
+			statusCode: 400, wantBody: `{"error":{"status":400,"message":"k must be int"}}`},
+		{name: "put meta", method: http.MethodPut, request: "/api/v2/meta/Alloc", path: "/meta/{name}", contentType: "application/json",
+			body:       `{"description":"Bytes of allocated heap objects","unit":"bytes"}`,
+			statusCode: 200, wantBody: `{"data":{"name":"Alloc","description":"Bytes of allocated heap objects","unit":"bytes"}}`},
+		{name: "put meta unknown type", method: http.MethodPut, request: "/api/v2/meta/Alloc", path: "/meta/{name}", contentType: "application/json",
+			body:       `{"type":"float"}`,
+			statusCode: 400, wantBody: `"message":"metric type unknown"`},
+		{name: "put meta unsupported encoding", method: http.MethodPut, request: "/api/v2/meta/Alloc", path: "/meta/{name}", contentType: "application/json", encoding: "br",
+			body:       `{}`,
+			statusCode: 415, wantBody: `"message":"Content-Encoding must be gzip or deflate"`},
+		{name: "get meta", method: http.MethodGet, request: "/api/v2/meta/Alloc", path: "/meta/{name}",
+			statusCode: 200, wantBody: `{"data":{"name":"Alloc"`},
+		{name: "get meta unknown", method: http.MethodGet, request: "/api/v2/meta/Unknown", path: "/meta/{name}",
+			statusCode: 404, wantBody: `"message":"no metadata for Unknown"`},
+		{name: "history without tracker", method: http.MethodGet, request: "/api/v2/history", path: "/history",
+			statusCode: 200, wantBody: `{"data":[]}`},
+		{name: "list meta", method: http.MethodGet, request: "/api/v2/meta", path: "/meta",
+			statusCode: 200, wantBody: `{"data":[{"name":"Alloc"`},
+		{name: "spec", method: http.MethodGet, request: "/api/v2/openapi.json", path: "/openapi.json",
+			statusCode: 200, wantBody: `"openapi": "3.0.3"`},
+		{name: "unknown endpoint", method: http.MethodGet, request: "/api/v2/unknown",
+			statusCode: 404, wantBody: `{"error":{"status":404,"message":"no such endpoint: /api/v2/unknown"}}`},
+		{name: "method not allowed", method: http.MethodDelete, request: "/api/v2/metrics",
+			statusCode: 405, wantBody: `{"error":{"status":405,"message":"DELETE is not allowed on /api/v2/metrics"}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(tt.method, tt.request, strings.NewReader(tt.body))
+			if tt.contentType != "" {
+				request.Header.Set("Content-Type", tt.contentType)
+			}
+			if tt.encoding != "" {
+				request.Header.Set("Content-Encoding", tt.encoding)
+			}
+			w := httptest.NewRecorder()
+
+			r.ServeHTTP(w, request)
+			result := w.Result()
+			defer result.Body.Close()
+
+			assert.Equal(t, tt.statusCode, result.StatusCode)
+			assert.Equal(t, "application/json", result.Header.Get("Content-Type"))
+			assert.Contains(t, w.Body.String(), tt.wantBody)
+			if tt.path != "" {
+				assert.Contains(t, s.documentedStatuses(t, tt.method, tt.path), strconv.Itoa(tt.statusCode))
+			}
+			if tt.path == "/openapi.json" {
+				return
+			}
+
+			var envelope map[string]json.RawMessage
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &envelope))
+			if tt.statusCode < 400 {
+				assert.Contains(t, envelope, "data")
+				assert.NotContains(t, envelope, "error")
+			} else {
+				assert.Contains(t, envelope, "error")
+				assert.NotContains(t, envelope, "data")
+			}
+		})
+	}
+}
+
+func TestAPIv2_History(t *testing.T) {
+	cfg := prepConf()
+	db := storage.Connect(cfg, logger)
+	db.InsertGouge("Alloc", 1)
+	db.InsertInfo("Version", "v1")
+	tracker := rates.NewTracker(db, cfg, logger)
+	now := time.Now().UTC()
+	tracker.Sample(now.Add(-10 * time.Second))
+	db.InsertGouge("Alloc", 2)
+	tracker.Sample(now)
+	r, _ := MetricRouter(db, nil, tracker, cfg, logger)
+
+	request := httptest.NewRequest(http.MethodGet, "/api/v2/history", nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, request)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	var body struct {
+		Data []rates.History `json:"data"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	require.Len(t, body.Data, 1)
+	assert.Equal(t, "Alloc", body.Data[0].ID)
+	assert.Equal(t, "gauge", body.Data[0].MType)
+	require.Len(t, body.Data[0].Points, 2)
+	assert.Equal(t, 1.0, body.Data[0].Points[0].Value)
+	assert.Equal(t, 2.0, body.Data[0].Points[1].Value)
+	assert.True(t, now.Equal(body.Data[0].Points[1].Time))
+}
+
+func TestJSONErrors(t *testing.T) {
+	h := jsonErrors(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "403 - Replica is read-only", http.StatusForbidden)
+	}))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/v2/metrics", nil))
+
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.Equal(t, `{"error":{"status":403,"message":"Replica is read-only"}}`+"\n", w.Body.String())
+}
@@ -0,0 +1,30 @@
+package handlers
+
+import (
+	"io/fs"
+	"net/http"
+
+	"github.com/maffka123/metricCollector/internal/handlers/templates"
+)
+
+// dashboardIndex writes the dashboard page, it is the root page of the server.
+func dashboardIndex(w http.ResponseWriter) {
+	page, err := fs.ReadFile(templates.Dashboard, "dashboard/index.html")
+	if err != nil {
+		// file is embedded, so it is always there
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(page)
+}
+
+// dashboard serves static files of the dashboard, data is loaded by the page from /api/v2 and /stream.
+func dashboard() http.HandlerFunc {
+	files, err := fs.Sub(templates.Dashboard, "dashboard")
+	if err != nil {
+		// directory is embedded, so it is always there
+		panic(err)
+	}
+	return http.StripPrefix("/dashboard/", http.FileServer(http.FS(files))).ServeHTTP
+}
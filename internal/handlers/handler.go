@@ -1,39 +1,50 @@
 package handlers
 
 import (
+	"bytes"
 	"context"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"html/template"
+	"io"
 	"net/http"
+	"path"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/go-chi/chi/v5"
-	"github.com/jackc/pgx/v4/pgxpool"
 	"go.uber.org/zap"
 
-	"github.com/maffka123/metricCollector/internal/handlers/templates"
+	"github.com/maffka123/metricCollector/internal/audit"
+	"github.com/maffka123/metricCollector/internal/auth"
+	"github.com/maffka123/metricCollector/internal/hashkeys"
+	"github.com/maffka123/metricCollector/internal/ingest"
+	"github.com/maffka123/metricCollector/internal/limits"
 	"github.com/maffka123/metricCollector/internal/models"
+	"github.com/maffka123/metricCollector/internal/query"
+	"github.com/maffka123/metricCollector/internal/rates"
 	"github.com/maffka123/metricCollector/internal/storage"
+	"github.com/maffka123/metricCollector/internal/stream"
 )
 
 // MetricHandler struct to avoid repeating parsing of db and logger in every function.
 type MetricHandler struct {
-	db     storage.Repositories
-	logger *zap.Logger
-}
-
-// metricsName type for using with html-templates.
-type metricsName struct {
-	NameValue string
-}
-
-// allMetricsList type allow to collects all metrics in one separated by their type.
-type allMetricsList struct {
-	Counter []metricsName
-	Gauge   []metricsName
+	db       storage.Repositories
+	queue    *ingest.Queue
+	limiter  *limits.Limiter
+	rates    *rates.Tracker
+	audit    *audit.Trail
+	hub      *stream.Hub
+	staleTTL time.Duration
+	maxBatch int
+	// ingestGuard and readGuard limit request rate of every client and check its key on write and read routes
+	ingestGuard Middleware
+	readGuard   Middleware
+	// checkSigned rejects replayed writes, it goes right before a handler as requests are signed before compression
+	checkSigned Middleware
+	logger      *zap.Logger
 }
 
 // NewMetricHandler initializes handler.
@@ -44,6 +55,104 @@ func NewMetricHandler(db storage.Repositories, logger *zap.Logger) MetricHandler
 	}
 }
 
+// writeError is returned when metrics cannot be written, it knows which status code to send to the client.
+type writeError struct {
+	code       int
+	msg        string
+	retryAfter int // seconds, sent in Retry-After header if set
+}
+
+func (e *writeError) Error() string {
+	return e.msg
+}
+
+// writeMetrics writes metrics to db directly or puts them into ingestion queue if it is enabled.
+// If metrics cannot be written, error is returned to the client and false is returned, see storeMetrics.
+// Number of metrics dropped because of limits is sent in X-Rejected-Metrics header.
+func (mh *MetricHandler) writeMetrics(w http.ResponseWriter, r *http.Request, dbUpdated chan time.Time, ms ...models.Metrics) bool {
+	rejected, err := mh.storeMetrics(r, dbUpdated, ms)
+	if err != nil {
+		if err.retryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(err.retryAfter))
+		}
+		http.Error(w, fmt.Sprintf("%d - %s", err.code, err.msg), err.code)
+		return false
+	}
+	if rejected > 0 {
+		w.Header().Set("X-Rejected-Metrics", strconv.Itoa(rejected))
+	}
+	return true
+}
+
+// storeMetrics writes metrics and returns how many of them were dropped because of limits.
+// Metrics which names are registered with another type are not written, 409 is returned;
+// the type is checked by storage when metrics are written, with the queue it is checked before metrics are queued.
+// If metrics cannot be accepted now, 503 with Retry-After is returned.
+// If limits are configured, metrics over the limits are dropped, when nothing is left or agent is over its rate 429 is returned.
+// Empty request is accepted, nothing is written then.
+func (mh *MetricHandler) storeMetrics(r *http.Request, dbUpdated chan time.Time, ms []models.Metrics) (int, *writeError) {
+	if len(ms) == 0 {
+		return 0, nil
+	}
+	rejected := 0
+	if mh.limiter != nil {
+		accepted, rej, err := mh.limiter.Allow(agentID(r), ms)
+		mh.writeRejections(dbUpdated)
+		var rateErr *limits.RateError
+		if errors.As(err, &rateErr) {
+			return 0, &writeError{code: http.StatusTooManyRequests, msg: err.Error(), retryAfter: rateErr.RetryAfter}
+		}
+		if len(accepted) == 0 {
+			return 0, &writeError{code: http.StatusTooManyRequests, msg: "Series limit exceeded"}
+		}
+		rejected = len(rej)
+		ms = accepted
+	}
+	if err := mh.write(dbUpdated, ms); err != nil {
+		return 0, err
+	}
+	return rejected, nil
+}
+
+// write puts metrics into ingestion queue if it is enabled, otherwise writes them to db and publishes stored values.
+func (mh *MetricHandler) write(dbUpdated chan time.Time, ms []models.Metrics) *writeError {
+	var conflict *storage.TypeConflictError
+	if mh.queue != nil {
+		err := mh.queue.Put(ms)
+		if errors.As(err, &conflict) {
+			return &writeError{code: http.StatusConflict, msg: err.Error()}
+		}
+		if err != nil {
+			mh.logger.Warn("Metrics rejected: ", zap.Error(err))
+			return &writeError{code: http.StatusServiceUnavailable, msg: err.Error(), retryAfter: mh.queue.RetryAfter()}
+		}
+		// queue writers signal dbUpdated themselves after group commit
+		return nil
+	}
+
+	stored, err := mh.db.BatchInsert(ms)
+	if errors.As(err, &conflict) {
+		return &writeError{code: http.StatusConflict, msg: err.Error()}
+	}
+	if err != nil {
+		return &writeError{code: http.StatusInternalServerError, msg: "Metrics cannot be written"}
+	}
+	mh.hub.Publish(stored)
+	dbUpdated <- time.Now()
+	return nil
+}
+
+// writeRejections writes self-metrics of limiter, the request is answered anyway, so failure is only logged.
+func (mh *MetricHandler) writeRejections(dbUpdated chan time.Time) {
+	self := mh.limiter.Rejections()
+	if len(self) == 0 {
+		return
+	}
+	if err := mh.write(dbUpdated, self); err != nil {
+		mh.logger.Warn("Limit rejections cannot be written: ", zap.String("error", err.msg))
+	}
+}
+
 // PostHandlerGouge processes POST request to add/replace value of a gouge metric.
 func (mh *MetricHandler) PostHandlerGouge(dbUpdated chan time.Time) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -55,13 +164,14 @@ func (mh *MetricHandler) PostHandlerGouge(dbUpdated chan time.Time) http.Handler
 			http.Error(w, "400 - Metric must be float!", http.StatusBadRequest)
 			return
 		}
-		mh.db.InsertGouge(q[len(q)-2], val)
+		if !mh.writeMetrics(w, r, dbUpdated, models.Metrics{ID: q[len(q)-2], MType: "gauge", Value: &val}) {
+			return
+		}
 
 		w.Header().Set("application-type", "text/plain")
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte(`{"status":"ok}`))
 		mh.logger.Debug("Got gauge: ", zap.String("len", q[len(q)-2]))
-		dbUpdated <- time.Now()
 	}
 }
 
@@ -75,16 +185,21 @@ func (mh *MetricHandler) PostHandlerCounter(dbUpdated chan time.Time) http.Handl
 			http.Error(w, "400 - Metric must be int!", http.StatusBadRequest)
 			return
 		}
-		mh.db.InsertCounter(q[len(q)-2], int64(val))
+		delta := int64(val)
+		if !mh.writeMetrics(w, r, dbUpdated, models.Metrics{ID: q[len(q)-2], MType: "counter", Delta: &delta}) {
+			return
+		}
 		w.Header().Set("application-type", "text/plain")
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte(`{"status":"ok}`))
 		mh.logger.Debug("Got counter: ", zap.String("len", q[len(q)-2]))
-		dbUpdated <- time.Now()
 	}
 }
 
 // GetHandlerValue processes GET request to return value of a specific metric.
+// For counters query parameters fn=rate|increase and window allow to get how fast counter grows.
+// Histogram is returned as json, with query parameter q its q-quantile is returned instead.
+// For set estimated number of distinct values is returned, for info its string value.
 func (mh *MetricHandler) GetHandlerValue() http.HandlerFunc {
 	return func(rw http.ResponseWriter, r *http.Request) {
 		metricType := strings.ToLower(chi.URLParam(r, "type"))
@@ -101,15 +216,67 @@ func (mh *MetricHandler) GetHandlerValue() http.HandlerFunc {
 			}
 		} else if metricType == "counter" {
 			if mh.db.NameInCounter(metricName) {
+				fn, window, err := mh.counterFn(r)
+				if err != nil {
+					http.Error(rw, fmt.Sprintf("400 - %s", err), http.StatusBadRequest)
+					return
+				}
+				payload := fmt.Sprintf("%d", mh.db.ValueFromCounter(metricName))
+				if fn != "" {
+					q := query.Query{Fn: fn, Window: window, Counters: mh.rates}
+					v, ok := q.Apply(metricName)
+					if !ok {
+						http.Error(rw, "404 - Not enough samples of "+metricName+" yet", http.StatusNotFound)
+						return
+					}
+					payload = fmt.Sprintf("%.3f", v)
+				}
+
 				rw.Header().Set("Content-Type", "text/plain")
 				rw.WriteHeader(http.StatusOK)
-
-				payload := fmt.Sprintf("%d", mh.db.ValueFromCounter(metricName))
 				rw.Write([]byte(payload))
 
 			} else {
 				http.Error(rw, metricName+" does not exist in Counter db", http.StatusNotFound)
 			}
+		} else if metricType == "histogram" {
+			h := mh.db.ValueFromHistogram(metricName)
+			if h == nil {
+				http.Error(rw, metricName+" does not exist in Histogram db", http.StatusNotFound)
+				return
+			}
+			s := r.URL.Query().Get("q")
+			if s == "" {
+				rw.Header().Set("Content-Type", "application/json")
+				rw.WriteHeader(http.StatusOK)
+				json.NewEncoder(rw).Encode(h)
+				return
+			}
+			q, err := strconv.ParseFloat(s, 64)
+			if err != nil || q < 0 || q > 1 {
+				http.Error(rw, "400 - q must be float between 0 and 1", http.StatusBadRequest)
+				return
+			}
+			rw.Header().Set("Content-Type", "text/plain")
+			rw.WriteHeader(http.StatusOK)
+			rw.Write([]byte(fmt.Sprintf("%.3f", h.Quantile(q))))
+		} else if metricType == "set" {
+			set := mh.db.ValueFromSet(metricName)
+			if set == nil {
+				http.Error(rw, metricName+" does not exist in Set db", http.StatusNotFound)
+				return
+			}
+			rw.Header().Set("Content-Type", "text/plain")
+			rw.WriteHeader(http.StatusOK)
+			rw.Write([]byte(fmt.Sprintf("%d", set.Estimate())))
+		} else if metricType == "info" {
+			if !mh.db.NameInInfo(metricName) {
+				http.Error(rw, metricName+" does not exist in Info db", http.StatusNotFound)
+				return
+			}
+			rw.Header().Set("Content-Type", "text/plain")
+			rw.WriteHeader(http.StatusOK)
+			rw.Write([]byte(mh.db.ValueFromInfo(metricName)))
 		} else {
 			http.Error(rw, metricType+" does not exist in db", http.StatusNotFound)
 		}
@@ -117,40 +284,254 @@ func (mh *MetricHandler) GetHandlerValue() http.HandlerFunc {
 	}
 }
 
-// GetAllNames processes GET request to return all available metrics.
+// GetAllNames processes GET request to return all available metrics as json or csv depending on Accept header,
+// browsers asking for html get the dashboard, which loads metrics itself.
+// Query parameters: type, prefix (of metric id with labels), stale=true|false, sort=name|type|updated, order=asc|desc,
+// limit and offset. Number of matching metrics before paging is sent in X-Total-Count header.
 func (mh *MetricHandler) GetAllNames() http.HandlerFunc {
 	return func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Add("Vary", "Accept")
+		format := negotiate(r.Header.Get("Accept"), "text/html", "application/json", "text/csv")
+		if format == "" {
+			http.Error(rw, "406 - Metrics can be returned as text/html, application/json or text/csv", http.StatusNotAcceptable)
+			return
+		}
+		if format == "text/html" {
+			dashboardIndex(rw)
+			return
+		}
+		opts, err := mh.listOptions(r)
+		if err != nil {
+			http.Error(rw, fmt.Sprintf("400 - %s", err), http.StatusBadRequest)
+			return
+		}
 
-		tmpl := template.Must(template.New("MetricsList").Parse(templates.MetricTemplate))
-		var aml allMetricsList
-		mlc := []metricsName{}
-		mlg := []metricsName{}
+		ms, total := mh.db.SelectAll(opts)
+		rw.Header().Set("X-Total-Count", strconv.Itoa(total))
+		switch format {
+		case "application/json":
+			rw.Header().Set("Content-Type", "application/json")
+			rw.WriteHeader(http.StatusOK)
+			if err := json.NewEncoder(rw).Encode(ms); err != nil {
+				mh.logger.Error("JSON marshal failed: ", zap.Error(err))
+			}
+		default:
+			rw.Header().Set("Content-Type", "text/csv")
+			rw.WriteHeader(http.StatusOK)
+			writeCSV(rw, ms)
+		}
+	}
+}
 
-		rw.Header().Set("Content-Type", "text/html")
-		rw.WriteHeader(http.StatusOK)
-		listCounter, listGouge := mh.db.SelectAll()
+// listOptions parses query parameters of GetAllNames.
+func (mh *MetricHandler) listOptions(r *http.Request) (storage.ListOptions, error) {
+	params := r.URL.Query()
+	opts := storage.ListOptions{
+		Type:     params.Get("type"),
+		Prefix:   params.Get("prefix"),
+		StaleTTL: mh.staleTTL,
+		Sort:     params.Get("sort"),
+	}
+	var err error
+	if opts.Type != "" && !knownType(opts.Type) {
+		return opts, fmt.Errorf("%w: %s", models.ErrUnknownType, opts.Type)
+	}
+	if err := opts.Validate(); err != nil {
+		return opts, err
+	}
+	switch params.Get("order") {
+	case "", "asc":
+	case "desc":
+		opts.Desc = true
+	default:
+		return opts, errors.New("order must be asc or desc")
+	}
+	if opts.Stale, err = staleFilter(r); err != nil {
+		return opts, err
+	}
+	if s := params.Get("limit"); s != "" {
+		if opts.Limit, err = strconv.Atoi(s); err != nil || opts.Limit < 0 {
+			return opts, errors.New("limit must be non-negative int")
+		}
+	}
+	if s := params.Get("offset"); s != "" {
+		if opts.Offset, err = strconv.Atoi(s); err != nil || opts.Offset < 0 {
+			return opts, errors.New("offset must be non-negative int")
+		}
+	}
+	return opts, nil
+}
 
-		for _, v := range listCounter {
-			mlc = append(mlc, metricsName{NameValue: v})
+// writeCSV writes metrics as csv with header, value of histogram is number of observations, of set its estimate.
+func writeCSV(w io.Writer, ms []models.Metrics) {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"id", "type", "value", "updated_at", "stale"})
+	for _, m := range ms {
+		var value string
+		switch m.MType {
+		case "counter":
+			value = strconv.FormatInt(*m.Delta, 10)
+		case "histogram":
+			value = strconv.FormatUint(m.Histogram.Count, 10)
+		case "set":
+			value = strconv.FormatUint(m.Set.Estimate(), 10)
+		case "info":
+			value = *m.Info
+		default:
+			value = strconv.FormatFloat(*m.Value, 'f', -1, 64)
+		}
+		updated := ""
+		if m.UpdatedAt != nil {
+			updated = m.UpdatedAt.Format(time.RFC3339)
+		}
+		cw.Write([]string{m.ID, m.MType, value, updated, strconv.FormatBool(m.Stale)})
+	}
+	cw.Flush()
+}
 
+// negotiate picks the offered media type client prefers in Accept header, empty string means none is acceptable.
+// Without Accept header the first offer is returned.
+func negotiate(accept string, offers ...string) string {
+	if strings.TrimSpace(accept) == "" {
+		return offers[0]
+	}
+	best, bestQ := "", 0.0
+	for _, offer := range offers {
+		q := 0.0
+		for _, part := range strings.Split(accept, ",") {
+			fields := strings.Split(part, ";")
+			mediaType := strings.ToLower(strings.TrimSpace(fields[0]))
+			if mediaType != offer && mediaType != "*/*" && mediaType != offer[:strings.IndexByte(offer, '/')]+"/*" {
+				continue
+			}
+			partQ := 1.0
+			for _, param := range fields[1:] {
+				if v := strings.TrimSpace(param); strings.HasPrefix(v, "q=") {
+					if f, err := strconv.ParseFloat(v[2:], 64); err == nil {
+						partQ = f
+					}
+				}
+			}
+			// exact media type is more specific than wildcards
+			if mediaType == offer {
+				q = partQ
+				break
+			}
+			if partQ > q {
+				q = partQ
+			}
 		}
+		if q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
 
-		for _, v := range listGouge {
-			mlg = append(mlg, metricsName{NameValue: v})
+// GetHandlerQuery processes GET request to select metrics and aggregate them.
+// Query parameters: name (glob), type, match (label matcher, can be repeated), agg, by (comma separated labels), k (for topk),
+// fn (rate or increase of counters) and window, q (quantile of histograms).
+func (mh *MetricHandler) GetHandlerQuery() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q, err := mh.parseQuery(r)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("400 - %s", err), http.StatusBadRequest)
+			return
+		}
 
+		res, err := q.Exec(mh.db)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("400 - %s", err), http.StatusBadRequest)
+			return
 		}
 
-		aml = allMetricsList{
-			Counter: mlc,
-			Gauge:   mlg,
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(res); err != nil {
+			mh.logger.Error("JSON marshal failed: ", zap.Error(err))
+		}
+	}
+}
+
+// parseQuery builds query from request parameters.
+func (mh *MetricHandler) parseQuery(r *http.Request) (query.Query, error) {
+	params := r.URL.Query()
+	q := query.Query{
+		Name:  params.Get("name"),
+		MType: params.Get("type"),
+		Agg:   params.Get("agg"),
+	}
+	if by := params.Get("by"); by != "" {
+		q.By = strings.Split(by, ",")
+	}
+	var err error
+	if k := params.Get("k"); k != "" {
+		if q.K, err = strconv.Atoi(k); err != nil {
+			return q, errors.New("k must be int")
+		}
+	}
+	if q.Fn, q.Window, err = mh.counterFn(r); err != nil {
+		return q, err
+	}
+	if mh.rates != nil {
+		q.Counters = mh.rates
+	}
+	if s := params.Get("q"); s != "" {
+		if q.Fn != "" {
+			return q, errors.New("q cannot be used together with fn")
+		}
+		q.Fn = query.FnQuantile
+		if q.Quantile, err = strconv.ParseFloat(s, 64); err != nil {
+			return q, errors.New("q must be float")
+		}
+	}
+	for _, s := range params["match"] {
+		m, err := query.ParseMatcher(s)
+		if err != nil {
+			return q, err
 		}
+		q.Matchers = append(q.Matchers, m)
+	}
+	return q, nil
+}
 
-		tmpl.Execute(rw, aml)
+// counterFn parses fn and window query parameters, by default window is as long as samples are kept.
+func (mh *MetricHandler) counterFn(r *http.Request) (string, time.Duration, error) {
+	fn := r.URL.Query().Get("fn")
+	if fn == "" {
+		return "", 0, nil
+	}
+	if fn != query.FnRate && fn != query.FnIncrease {
+		return "", 0, fmt.Errorf("unknown function %s", fn)
+	}
+	if mh.rates == nil {
+		return "", 0, errors.New("counter rates are not tracked")
+	}
+	window := mh.rates.Window()
+	if s := r.URL.Query().Get("window"); s != "" {
+		var err error
+		if window, err = time.ParseDuration(s); err != nil {
+			return "", 0, fmt.Errorf("bad window: %w", err)
+		}
 	}
+	return fn, window, nil
+}
+
+// staleFilter parses stale query parameter, nil means no filter.
+func staleFilter(r *http.Request) (*bool, error) {
+	s := r.URL.Query().Get("stale")
+	if s == "" {
+		return nil, nil
+	}
+	stale, err := strconv.ParseBool(s)
+	if err != nil {
+		return nil, fmt.Errorf("stale must be true or false: %w", err)
+	}
+	return &stale, nil
 }
 
 // PostHandlerUpdate processes POST request with json data to update particular metric.
-func (mh *MetricHandler) PostHandlerUpdate(dbUpdated chan time.Time, key *string) http.HandlerFunc {
+func (mh *MetricHandler) PostHandlerUpdate(dbUpdated chan time.Time, keys hashkeys.Ring) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		decoder := json.NewDecoder(r.Body)
 		var m models.Metrics
@@ -160,30 +541,23 @@ func (mh *MetricHandler) PostHandlerUpdate(dbUpdated chan time.Time, key *string
 			http.Error(w, fmt.Sprintf("400 - Metric json cannot be decoded: %s", err), http.StatusBadRequest)
 			return
 		}
-		if m.MType == "counter" {
-			mh.db.InsertCounter(m.ID, *m.Delta)
-		} else {
-			mh.db.InsertGouge(m.ID, *m.Value)
+		if !validMetric(w, &m) || !validHash(w, keys, &m) {
+			return
 		}
 
-		if key != nil && *key != "" {
-			err := m.CompareHash(*key)
-			if err != nil {
-				http.Error(w, "400 - Hashes do not agree", http.StatusBadRequest)
-				return
-			}
+		if !mh.writeMetrics(w, r, dbUpdated, m) {
+			return
 		}
 
 		w.Header().Set("application-type", "text/plain")
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte(`{"status":"ok}`))
 		mh.logger.Debug("Got metric: ", zap.String("name", m.ID))
-		dbUpdated <- time.Now()
 	}
 }
 
 // PostHandlerReturn processes POST request with json to return particular metric.
-func (mh *MetricHandler) PostHandlerReturn(key *string) http.HandlerFunc {
+func (mh *MetricHandler) PostHandlerReturn(keys hashkeys.Ring) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		decoder := json.NewDecoder(r.Body)
 		var m models.Metrics
@@ -196,22 +570,38 @@ func (mh *MetricHandler) PostHandlerReturn(key *string) http.HandlerFunc {
 		if m.MType == "counter" {
 			r := mh.db.ValueFromCounter(m.ID)
 			m.Delta = &r
+		} else if m.MType == "histogram" {
+			m.Histogram = mh.db.ValueFromHistogram(m.ID)
+			if m.Histogram == nil {
+				http.Error(w, m.ID+" does not exist in Histogram db", http.StatusNotFound)
+				return
+			}
+		} else if m.MType == "set" {
+			m.Set = mh.db.ValueFromSet(m.ID)
+			if m.Set == nil {
+				http.Error(w, m.ID+" does not exist in Set db", http.StatusNotFound)
+				return
+			}
+		} else if m.MType == "info" {
+			if !mh.db.NameInInfo(m.ID) {
+				http.Error(w, m.ID+" does not exist in Info db", http.StatusNotFound)
+				return
+			}
+			r := mh.db.ValueFromInfo(m.ID)
+			m.Info = &r
 		} else {
 			r := mh.db.ValueFromGouge(m.ID)
 			m.Value = &r
 		}
-
-		if m.Hash != "" {
-			err = m.CompareHash(*key)
-			if err != nil {
-				http.Error(w, "400 - Hashes do not agree", http.StatusBadRequest)
-				return
-			}
+		if t := mh.db.UpdatedAt(m.MType, m.ID); !t.IsZero() {
+			m.UpdatedAt = &t
+			m.Stale = m.IsStale(mh.staleTTL)
 		}
 
-		if *key != "" {
-			m.CalcHash(*key)
+		if m.Hash != "" && !validHash(w, keys, &m) {
+			return
 		}
+		keys.Sign(&m)
 
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
@@ -223,19 +613,90 @@ func (mh *MetricHandler) PostHandlerReturn(key *string) http.HandlerFunc {
 	}
 }
 
+// valuesRequest selects metrics for PostHandlerValues by glob pattern for their names (with labels) and optionally by type.
+type valuesRequest struct {
+	Pattern string `json:"pattern"`
+	MType   string `json:"type,omitempty"`
+}
+
+// PostHandlerValues processes POST request to return many metrics at once.
+// Body is either json array of metrics with id and type, or {"pattern": "Heap*", "type": "gauge"}.
+// Metrics which do not exist are left out, found ones are returned as json array with hashes if key is set.
+func (mh *MetricHandler) PostHandlerValues(keys hashkeys.Ring) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("400 - Body cannot be read: %s", err), http.StatusBadRequest)
+			return
+		}
+
+		res := []models.Metrics{}
+		if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '[' {
+			var ms []models.Metrics
+			if err := json.Unmarshal(body, &ms); err != nil {
+				http.Error(w, fmt.Sprintf("400 - Metric json cannot be decoded: %s", err), http.StatusBadRequest)
+				return
+			}
+			byID := map[string]models.Metrics{}
+			for _, m := range mh.selectMetrics() {
+				byID[m.MType+":"+m.ID] = m
+			}
+			for _, m := range ms {
+				if found, ok := byID[m.MType+":"+m.ID]; ok {
+					res = append(res, found)
+				}
+			}
+		} else {
+			var req valuesRequest
+			if err := json.Unmarshal(body, &req); err != nil {
+				http.Error(w, fmt.Sprintf("400 - Metric json cannot be decoded: %s", err), http.StatusBadRequest)
+				return
+			}
+			if req.Pattern == "" {
+				http.Error(w, "400 - list of metrics or pattern must be given", http.StatusBadRequest)
+				return
+			}
+			if _, err := path.Match(req.Pattern, ""); err != nil {
+				http.Error(w, fmt.Sprintf("400 - Bad pattern: %s", err), http.StatusBadRequest)
+				return
+			}
+			for _, m := range mh.selectMetrics() {
+				if ok, _ := path.Match(req.Pattern, m.ID); ok && (req.MType == "" || req.MType == m.MType) {
+					res = append(res, m)
+				}
+			}
+		}
+
+		for i := range res {
+			keys.Sign(&res[i])
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(res); err != nil {
+			mh.logger.Error("JSON marshal failed: ", zap.Error(err))
+		}
+	}
+}
+
 // GetHandlerPing pings postgres db after GET request.
 func (mh *MetricHandler) GetHandlerPing() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
-		// convert first to PGDB then to pgxpool to be able to use Ping method
-		conn := mh.db.(*storage.PGDB).Conn.(*pgxpool.Pool)
+		// only db with Ping method can be pinged, e.g. postgres
+		db, ok := mh.db.(interface{ Ping(context.Context) error })
+		if !ok {
+			http.Error(w, "500 - Ping failed", http.StatusInternalServerError)
+			return
+		}
 
 		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
 		defer cancel()
-		err := conn.Ping(ctx)
+		err := db.Ping(ctx)
 
 		if err != nil {
 			http.Error(w, "500 - Ping failed", http.StatusInternalServerError)
+			return
 		}
 
 		w.Header().Set("Content-Type", "text/html")
@@ -245,7 +706,7 @@ func (mh *MetricHandler) GetHandlerPing() http.HandlerFunc {
 }
 
 // PostHandlerUpdates updates db in batch after POST request with json data.
-func (mh *MetricHandler) PostHandlerUpdates(dbUpdated chan time.Time, key *string) http.HandlerFunc {
+func (mh *MetricHandler) PostHandlerUpdates(dbUpdated chan time.Time, keys hashkeys.Ring) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		decoder := json.NewDecoder(r.Body)
 		var ms []models.Metrics
@@ -255,14 +716,174 @@ func (mh *MetricHandler) PostHandlerUpdates(dbUpdated chan time.Time, key *strin
 			http.Error(w, fmt.Sprintf("400 - Metric json cannot be decoded: %s", err), http.StatusBadRequest)
 			return
 		}
+		if mh.maxBatch > 0 && len(ms) > mh.maxBatch {
+			http.Error(w, fmt.Sprintf("413 - Batch of %d metrics is larger than %d", len(ms), mh.maxBatch), http.StatusRequestEntityTooLarge)
+			return
+		}
+		for i := range ms {
+			if !validMetric(w, &ms[i]) || !validHash(w, keys, &ms[i]) {
+				return
+			}
+		}
 
-		mh.db.BatchInsert(ms)
+		if !mh.writeMetrics(w, r, dbUpdated, ms...) {
+			return
+		}
 
 		w.Header().Set("application-type", "text/plain")
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte(`{"status":"ok}`))
 
 		mh.logger.Debug("got", zap.String("metrics n", fmt.Sprint(len(ms))))
+	}
+}
+
+// agentID identifies agent by its client certificate, its API key or by address of the connection.
+// Headers are not used, so that agent cannot get new quotas by changing them.
+func agentID(r *http.Request) string {
+	if name := auth.CertName(r); name != "" {
+		return "cert:" + name
+	}
+	if c, ok := auth.ClientFrom(r.Context()); ok {
+		return "key:" + c.Name
+	}
+	return peerIP(r)
+}
+
+// validHash checks hash of the metric with active keys and returns error to the client if it is not valid.
+func validHash(w http.ResponseWriter, keys hashkeys.Ring, m *models.Metrics) bool {
+	err := keys.Verify(m)
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, hashkeys.ErrUnknownKey):
+		http.Error(w, fmt.Sprintf("400 - Unknown hash key %s", m.HashKeyID()), http.StatusBadRequest)
+	default:
+		http.Error(w, "400 - Hashes do not agree", http.StatusBadRequest)
+	}
+	return false
+}
+
+// validMetric checks metric before it is written and returns error to the client if it is not valid.
+func validMetric(w http.ResponseWriter, m *models.Metrics) bool {
+	err := m.Validate()
+	switch {
+	case errors.Is(err, models.ErrUnknownType):
+		http.Error(w, fmt.Sprintf("501 - Metric type unknown: %s", m.MType), http.StatusNotImplemented)
+		return false
+	case err != nil:
+		http.Error(w, fmt.Sprintf("400 - %s: %s", m.ID, err), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// DeleteHandlerValue deletes one metric after DELETE request.
+func (mh *MetricHandler) DeleteHandlerValue(dbUpdated chan time.Time) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		metricType := strings.ToLower(chi.URLParam(r, "type"))
+		metricName := chi.URLParam(r, "name")
+
+		if !mh.db.DeleteMetric(metricType, metricName) {
+			http.Error(w, metricName+" does not exist in "+metricType+" db", http.StatusNotFound)
+			return
+		}
+		mh.audit.Record(r, "delete metric", zap.String("type", metricType), zap.String("name", metricName))
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"deleted":1}`))
 		dbUpdated <- time.Now()
 	}
 }
+
+// DeleteHandlerValues deletes all metrics with names matching glob pattern or starting with prefix, both given as query parameters.
+func (mh *MetricHandler) DeleteHandlerValues(dbUpdated chan time.Time) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pattern := r.URL.Query().Get("pattern")
+		if prefix := r.URL.Query().Get("prefix"); prefix != "" {
+			pattern = escapeGlob(prefix) + "*"
+		}
+		if pattern == "" {
+			http.Error(w, "400 - pattern or prefix must be given", http.StatusBadRequest)
+			return
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			http.Error(w, fmt.Sprintf("400 - Bad pattern: %s", err), http.StatusBadRequest)
+			return
+		}
+
+		n := mh.db.DeleteMetrics(pattern)
+		mh.audit.Record(r, "delete metrics", zap.String("pattern", pattern), zap.Int("deleted", n))
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, `{"deleted":%d}`, n)
+		if n > 0 {
+			dbUpdated <- time.Now()
+		}
+	}
+}
+
+// PostHandlerResetCounter sets counter to zero after POST request.
+func (mh *MetricHandler) PostHandlerResetCounter(dbUpdated chan time.Time) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		metricName := chi.URLParam(r, "name")
+
+		if !mh.db.ResetCounter(metricName) {
+			http.Error(w, metricName+" does not exist in Counter db", http.StatusNotFound)
+			return
+		}
+		mh.audit.Record(r, "reset counter", zap.String("name", metricName))
+		zero := int64(0)
+		mh.hub.Publish([]models.Metrics{{ID: metricName, MType: "counter", Delta: &zero}})
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"status":"ok"}`))
+		dbUpdated <- time.Now()
+	}
+}
+
+// PostHandlerRetype changes type of a metric after POST request, new type is given as query parameter type.
+// Value is converted between gauge and counter, metrics of other types are deleted, so that they can be written with the new type.
+func (mh *MetricHandler) PostHandlerRetype(dbUpdated chan time.Time) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		metricName := chi.URLParam(r, "name")
+		to := strings.ToLower(r.URL.Query().Get("type"))
+		switch to {
+		case "counter", "gauge", "histogram", "set", "info":
+		default:
+			http.Error(w, fmt.Sprintf("400 - Metric type unknown: %s", to), http.StatusBadRequest)
+			return
+		}
+		from, converted, err := mh.db.Retype(metricName, to)
+		if errors.Is(err, storage.ErrNoMetric) {
+			http.Error(w, "404 - "+metricName+" does not exist in db", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			mh.logger.Error("Metric cannot be retyped: ", zap.String("name", metricName), zap.Error(err))
+			http.Error(w, "500 - metric type cannot be changed", http.StatusInternalServerError)
+			return
+		}
+		mh.audit.Record(r, "change metric type", zap.String("name", metricName), zap.String("from", from), zap.String("to", to))
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, `{"name":%q,"from":%q,"to":%q,"converted":%t}`, metricName, from, to, converted)
+		dbUpdated <- time.Now()
+	}
+}
+
+// escapeGlob escapes special characters of glob pattern, so that string is matched as it is.
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		if strings.ContainsRune(`*?[]\`, c) {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
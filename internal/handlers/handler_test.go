@@ -1,25 +1,35 @@
 package handlers
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/caarlos0/env/v6"
 	"github.com/driftprogramming/pgxpoolmock"
 	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
 
 	globalConf "github.com/maffka123/metricCollector/internal/config"
+	"github.com/maffka123/metricCollector/internal/hashkeys"
+	"github.com/maffka123/metricCollector/internal/ingest"
+	"github.com/maffka123/metricCollector/internal/limits"
 	"github.com/maffka123/metricCollector/internal/models"
+	"github.com/maffka123/metricCollector/internal/rates"
 	"github.com/maffka123/metricCollector/internal/server/config"
 	"github.com/maffka123/metricCollector/internal/storage"
 )
@@ -77,7 +87,7 @@ func TestPostHandlerGouge(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			r, dbUpdated := MetricRouter(db, cfg, logger)
+			r, dbUpdated := MetricRouter(db, nil, nil, cfg, logger)
 
 			go func() { <-dbUpdated }()
 
@@ -136,7 +146,7 @@ func TestPostHandlerCounter(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			r, dbUpdated := MetricRouter(db, cfg, logger)
+			r, dbUpdated := MetricRouter(db, nil, nil, cfg, logger)
 			go func() { <-dbUpdated }()
 
 			request := httptest.NewRequest(http.MethodPost, tt.request, nil)
@@ -206,7 +216,7 @@ func TestGetHandlerValue(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			r, dbUpdated := MetricRouter(db, cfg, logger)
+			r, dbUpdated := MetricRouter(db, nil, nil, cfg, logger)
 			go func() { <-dbUpdated }()
 
 			request := httptest.NewRequest(http.MethodGet, tt.request, nil)
@@ -228,40 +238,83 @@ func TestGetHandlerValue(t *testing.T) {
 
 func TestGetAllNames(t *testing.T) {
 	cfg := prepConf()
+	cfg.StaleTTL = time.Hour
 	db := storage.Connect(cfg, logger)
 	db.InsertCounter("PollCount", 3)
 	db.InsertGouge("Alloc", 1.5)
-	type args struct {
-		db storage.Repositories
-	}
+	now := time.Now().UTC()
+	db.CounterUpdated["PollCount"] = now
+	db.GougeUpdated["Alloc"] = time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	counterJSON := `{"id":"PollCount","type":"counter","delta":3,"updated_at":"` + now.Format(time.RFC3339Nano) + `"}`
+	gaugeJSON := `{"id":"Alloc","type":"gauge","value":1.5,"updated_at":"2022-01-01T00:00:00Z","stale":true}`
 	type want struct {
 		contentType string
 		statusCode  int
-		html        string
+		body        string
 	}
 	tests := []struct {
 		name    string
-		args    args
 		want    want
+		accept  string
 		request string
 	}{
 		{
-			name: "allmetrics_test1",
-			args: args{db: db},
+			name: "dashboard",
+			want: want{
+				contentType: "text/html; charset=utf-8",
+				statusCode:  200,
+				body:        `<script src="/dashboard/dashboard.js"></script>`,
+			},
+			request: "/",
+		},
+		{
+			name: "all",
 			want: want{
-				contentType: "text/html",
+				contentType: "application/json",
 				statusCode:  200,
-				html:        "<html>\n    <head>\n    <title>(/^▽^)/</title>\n    </head>\n    <body>\n        <h1>Counter</h1>>\n    \n            <li>[PollCount]: [3]\n</li>\n    \n\n    <h1>Gauge</h1>>\n    \n    <li>[Alloc]: [1.500]\n</li>\n\n\n    </body>\n</html>",
+				body:        "[" + gaugeJSON + "," + counterJSON + "]\n",
 			},
+			accept:  "application/json",
 			request: "/",
 		},
+		{
+			name: "only_stale",
+			want: want{
+				contentType: "application/json",
+				statusCode:  200,
+				body:        "[" + gaugeJSON + "]\n",
+			},
+			accept:  "application/json",
+			request: "/?stale=true",
+		},
+		{
+			name: "only_live",
+			want: want{
+				contentType: "application/json",
+				statusCode:  200,
+				body:        "[" + counterJSON + "]\n",
+			},
+			accept:  "application/json",
+			request: "/?stale=false",
+		},
+		{
+			name: "bad_filter",
+			want: want{
+				contentType: "text/plain; charset=utf-8",
+				statusCode:  400,
+				body:        "400 - stale must be true or false: strconv.ParseBool: parsing \"maybe\": invalid syntax\n",
+			},
+			accept:  "application/json",
+			request: "/?stale=maybe",
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			r, dbUpdated := MetricRouter(db, cfg, logger)
+			r, dbUpdated := MetricRouter(db, nil, nil, cfg, logger)
 			go func() { <-dbUpdated }()
 
 			request := httptest.NewRequest(http.MethodGet, tt.request, nil)
+			request.Header.Set("Accept", tt.accept)
 			w := httptest.NewRecorder()
 
 			r.ServeHTTP(w, request)
@@ -270,10 +323,90 @@ func TestGetAllNames(t *testing.T) {
 
 			assert.Equal(t, tt.want.statusCode, result.StatusCode)
 			assert.Equal(t, tt.want.contentType, result.Header.Get("Content-Type"))
+			assert.Contains(t, w.Body.String(), tt.want.body)
+		})
+	}
+}
 
-			fmt.Println(w.Body.String())
+func TestGetAllNamesFormats(t *testing.T) {
+	cfg := prepConf()
+	db := storage.Connect(cfg, logger)
+	db.InsertCounter("PollCount", 3)
+	db.InsertGouge("Alloc", 1.5)
+	db.InsertGouge("HeapIdle", 2)
+	db.InsertInfo("AgentVersion", "v1, beta")
+	updated := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	db.CounterUpdated["PollCount"] = updated
+	db.GougeUpdated["Alloc"] = updated
+	db.GougeUpdated["HeapIdle"] = updated.Add(time.Hour)
+	db.InfoUpdated["AgentVersion"] = updated
+	r, _ := MetricRouter(db, nil, nil, cfg, logger)
+
+	tests := []struct {
+		name        string
+		request     string
+		accept      string
+		statusCode  int
+		contentType string
+		total       string
+		body        string
+	}{
+		{name: "json", request: "/?type=gauge", accept: "application/json", statusCode: 200, contentType: "application/json", total: "2",
+			body: `[{"id":"Alloc","type":"gauge","value":1.5,"updated_at":"2022-01-01T00:00:00Z"},{"id":"HeapIdle","type":"gauge","value":2,"updated_at":"2022-01-01T01:00:00Z"}]` + "\n"},
+		{name: "csv", request: "/?sort=type&order=desc", accept: "text/csv", statusCode: 200, contentType: "text/csv", total: "4",
+			body: "id,type,value,updated_at,stale\nAgentVersion,info,\"v1, beta\",2022-01-01T00:00:00Z,false\nHeapIdle,gauge,2,2022-01-01T01:00:00Z,false\n" +
+				"Alloc,gauge,1.5,2022-01-01T00:00:00Z,false\nPollCount,counter,3,2022-01-01T00:00:00Z,false\n"},
+		{name: "prefix", request: "/?prefix=Heap", accept: "text/csv", statusCode: 200, contentType: "text/csv", total: "1",
+			body: "id,type,value,updated_at,stale\nHeapIdle,gauge,2,2022-01-01T01:00:00Z,false\n"},
+		{name: "page", request: "/?sort=updated&order=desc&limit=1&offset=1", accept: "text/csv", statusCode: 200, contentType: "text/csv", total: "4",
+			body: "id,type,value,updated_at,stale\nPollCount,counter,3,2022-01-01T00:00:00Z,false\n"},
+		{name: "preferred by q", request: "/?limit=1", accept: "text/html;q=0.5, text/csv;q=0.9", statusCode: 200, contentType: "text/csv", total: "4",
+			body: "id,type,value,updated_at,stale\nAgentVersion,info,\"v1, beta\",2022-01-01T00:00:00Z,false\n"},
+		{name: "browser", request: "/?type=info", accept: "text/html,application/xhtml+xml,*/*;q=0.8", statusCode: 200, contentType: "text/html; charset=utf-8",
+			body: "<title>Metrics dashboard</title>"},
+		{name: "not acceptable", request: "/", accept: "application/xml", statusCode: 406,
+			body: "406 - Metrics can be returned as text/html, application/json or text/csv\n"},
+		{name: "bad type", request: "/?type=float", accept: "application/json", statusCode: 400, body: "400 - metric type unknown: float\n"},
+		{name: "bad sort", request: "/?sort=value", accept: "application/json", statusCode: 400, body: "400 - sort must be name, type or updated\n"},
+		{name: "bad order", request: "/?order=up", accept: "application/json", statusCode: 400, body: "400 - order must be asc or desc\n"},
+		{name: "bad limit", request: "/?limit=-1", accept: "application/json", statusCode: 400, body: "400 - limit must be non-negative int\n"},
+		{name: "bad offset", request: "/?offset=a", accept: "application/json", statusCode: 400, body: "400 - offset must be non-negative int\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, tt.request, nil)
+			request.Header.Set("Accept", tt.accept)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, request)
 
-			assert.Equal(t, tt.want.html, w.Body.String())
+			assert.Equal(t, tt.statusCode, w.Code)
+			if tt.statusCode == 200 {
+				assert.Equal(t, tt.contentType, w.Header().Get("Content-Type"))
+				assert.Equal(t, tt.total, w.Header().Get("X-Total-Count"))
+				assert.Equal(t, "Accept", w.Header().Get("Vary"))
+			}
+			assert.Contains(t, w.Body.String(), tt.body)
+		})
+	}
+}
+
+func Test_negotiate(t *testing.T) {
+	offers := []string{"text/html", "application/json", "text/csv"}
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{accept: "", want: "text/html"},
+		{accept: "*/*", want: "text/html"},
+		{accept: "application/json", want: "application/json"},
+		{accept: "text/*;q=0.5, application/json;q=0.4", want: "text/html"},
+		{accept: "text/*, text/html;q=0", want: "text/csv"},
+		{accept: "TEXT/CSV", want: "text/csv"},
+		{accept: "image/png", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.accept, func(t *testing.T) {
+			assert.Equal(t, tt.want, negotiate(tt.accept, offers...))
 		})
 	}
 }
@@ -282,6 +415,8 @@ func TestPostHandlerUpdate(t *testing.T) {
 	f := float64(1.5)
 	cfg := prepConf()
 	cfg.Key = "test"
+	// requests are not signed, only metric hashes are checked
+	cfg.AllowUnsigned = true
 	db := storage.Connect(cfg, logger)
 	type args struct {
 		db storage.Repositories
@@ -315,7 +450,7 @@ func TestPostHandlerUpdate(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 
-			r, dbUpdated := MetricRouter(db, cfg, logger)
+			r, dbUpdated := MetricRouter(db, nil, nil, cfg, logger)
 			go func() { <-dbUpdated }()
 			body, _ := json.Marshal(tt.request.body)
 			request := httptest.NewRequest(http.MethodPost, tt.request.request, bytes.NewBuffer(body))
@@ -335,6 +470,7 @@ func TestPostHandlerUpdate(t *testing.T) {
 
 func TestPostHandlerReturn(t *testing.T) {
 	f := float64(1.5)
+	updated := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
 	cfg := prepConf()
 	db := storage.Connect(cfg, logger)
 	cfg.Key = "test"
@@ -362,7 +498,7 @@ func TestPostHandlerReturn(t *testing.T) {
 			want: want{
 				applicationType: "application/json",
 				statusCode:      200,
-				json:            models.Metrics{ID: "Alloc", MType: "gauge", Value: &f, Hash: "bd4208a757a7c5e94a4ce2975530aaddadf889c8ee627798e57e89eb066d6c3d"},
+				json:            models.Metrics{ID: "Alloc", MType: "gauge", Value: &f, Hash: "bd4208a757a7c5e94a4ce2975530aaddadf889c8ee627798e57e89eb066d6c3d", UpdatedAt: &updated},
 			},
 			request: request{request: "/value/", body: models.Metrics{ID: "Alloc", MType: "gauge", Hash: "bd4208a757a7c5e94a4ce2975530aaddadf889c8ee627798e57e89eb066d6c3d"}},
 		},
@@ -372,7 +508,7 @@ func TestPostHandlerReturn(t *testing.T) {
 			want: want{
 				applicationType: "application/json",
 				statusCode:      200,
-				json:            models.Metrics{ID: "Alloc", MType: "gauge", Value: &f, Hash: "bd4208a757a7c5e94a4ce2975530aaddadf889c8ee627798e57e89eb066d6c3d"},
+				json:            models.Metrics{ID: "Alloc", MType: "gauge", Value: &f, Hash: "bd4208a757a7c5e94a4ce2975530aaddadf889c8ee627798e57e89eb066d6c3d", UpdatedAt: &updated},
 			},
 			request: request{request: "/value/", body: models.Metrics{ID: "Alloc", MType: "gauge"}},
 		},
@@ -380,7 +516,8 @@ func TestPostHandlerReturn(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			db.InsertGouge("Alloc", float64(1.5))
-			r, dbUpdated := MetricRouter(db, cfg, logger)
+			db.GougeUpdated["Alloc"] = updated
+			r, dbUpdated := MetricRouter(db, nil, nil, cfg, logger)
 			go func() { <-dbUpdated }()
 			body, _ := json.Marshal(tt.request.body)
 			request := httptest.NewRequest(http.MethodPost, tt.request.request, bytes.NewBuffer(body))
@@ -401,15 +538,182 @@ func TestPostHandlerReturn(t *testing.T) {
 	}
 }
 
+func TestPostHandlerValues(t *testing.T) {
+	updated := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	cfg := prepConf()
+	cfg.Key = "test"
+	db := storage.Connect(cfg, logger)
+	db.InsertGouge("HeapIdle", 1.5)
+	db.InsertGouge("HeapInuse", 2.5)
+	db.InsertCounter("PollCount", 3)
+	db.GougeUpdated["HeapIdle"] = updated
+	db.GougeUpdated["HeapInuse"] = updated
+	db.CounterUpdated["PollCount"] = updated
+	r, _ := MetricRouter(db, nil, nil, cfg, logger)
+
+	tests := []struct {
+		name       string
+		body       string
+		statusCode int
+		want       []string // ids of returned metrics
+		wantBody   string
+	}{
+		{name: "list", body: `[{"id":"PollCount","type":"counter"},{"id":"HeapIdle","type":"gauge"}]`,
+			statusCode: 200, want: []string{"PollCount", "HeapIdle"}},
+		{name: "list skips unknown", body: `[{"id":"Unknown","type":"gauge"},{"id":"PollCount","type":"gauge"},{"id":"HeapIdle","type":"gauge"}]`,
+			statusCode: 200, want: []string{"HeapIdle"}},
+		{name: "pattern", body: `{"pattern":"Heap*"}`,
+			statusCode: 200, want: []string{"HeapIdle", "HeapInuse"}},
+		{name: "pattern with type", body: `{"pattern":"*","type":"counter"}`,
+			statusCode: 200, want: []string{"PollCount"}},
+		{name: "nothing found", body: `{"pattern":"Unknown*"}`,
+			statusCode: 200, want: []string{}},
+		{name: "no pattern", body: `{}`,
+			statusCode: 400, wantBody: "400 - list of metrics or pattern must be given\n"},
+		{name: "bad pattern", body: `{"pattern":"["}`,
+			statusCode: 400, wantBody: "400 - Bad pattern: syntax error in pattern\n"},
+		{name: "bad json", body: `[{`,
+			statusCode: 400, wantBody: "400 - Metric json cannot be decoded: unexpected end of JSON input\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPost, "/values/", strings.NewReader(tt.body))
+			request.Header.Add("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+
+			r.ServeHTTP(w, request)
+			result := w.Result()
+			defer result.Body.Close()
+
+			assert.Equal(t, tt.statusCode, result.StatusCode)
+			if tt.want == nil {
+				assert.Equal(t, tt.wantBody, w.Body.String())
+				return
+			}
+			var ms []models.Metrics
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &ms))
+			ids := []string{}
+			for _, m := range ms {
+				ids = append(ids, m.ID)
+				assert.NoError(t, m.CompareHash(cfg.Key))
+				assert.Equal(t, updated, *m.UpdatedAt)
+			}
+			assert.Equal(t, tt.want, ids)
+		})
+	}
+
+	request := httptest.NewRequest(http.MethodPost, "/values/", strings.NewReader(`{"pattern":"*"}`))
+	request.Header.Add("Content-Type", "application/json")
+	request.Header.Add("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, request)
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	gz, err := gzip.NewReader(w.Body)
+	assert.NoError(t, err)
+	var ms []models.Metrics
+	assert.NoError(t, json.NewDecoder(gz).Decode(&ms))
+	assert.Len(t, ms, 3)
+}
+
+func TestStream(t *testing.T) {
+	cfg := prepConf()
+	db := storage.Connect(cfg, logger)
+	r, dbUpdated := MetricRouter(db, nil, nil, cfg, logger)
+	go func() {
+		for range dbUpdated {
+		}
+	}()
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/stream?pattern=Poll*")
+	assert.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	// the first update may come before client is subscribed, keep writing until it gets one
+	events := make(chan string, 100)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			if strings.HasPrefix(scanner.Text(), "data: ") {
+				events <- strings.TrimPrefix(scanner.Text(), "data: ")
+			}
+		}
+	}()
+	for i := 0; ; i++ {
+		resp, err := http.Post(srv.URL+"/update/counter/PollCount/1", "text/plain", nil)
+		assert.NoError(t, err)
+		resp.Body.Close()
+		resp, err = http.Post(srv.URL+"/update/gauge/Alloc/1", "text/plain", nil)
+		assert.NoError(t, err)
+		resp.Body.Close()
+
+		select {
+		case data := <-events:
+			var m models.Metrics
+			assert.NoError(t, json.Unmarshal([]byte(data), &m))
+			assert.Equal(t, "PollCount", m.ID)
+			assert.LessOrEqual(t, *m.Delta, int64(i+1))
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+		if i > 100 {
+			t.Fatal("no update was streamed")
+		}
+	}
+}
+
+func TestDashboard(t *testing.T) {
+	cfg := prepConf()
+	db := storage.Connect(cfg, logger)
+	r, _ := MetricRouter(db, nil, nil, cfg, logger)
+
+	tests := []struct {
+		name        string
+		request     string
+		statusCode  int
+		contentType string
+		location    string
+		body        string
+	}{
+		{name: "root page", request: "/", statusCode: 200, contentType: "text/html; charset=utf-8", body: `<script src="/dashboard/dashboard.js">`},
+		{name: "old address", request: "/dashboard", statusCode: 301, location: "/"},
+		{name: "old address with slash", request: "/dashboard/", statusCode: 301, location: "/"},
+		{name: "script", request: "/dashboard/dashboard.js", statusCode: 200, contentType: "text/javascript; charset=utf-8", body: `new EventSource("/stream")`},
+		{name: "style", request: "/dashboard/dashboard.css", statusCode: 200, contentType: "text/css; charset=utf-8"},
+		{name: "unknown", request: "/dashboard/unknown.js", statusCode: 404},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, tt.request, nil)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, request)
+
+			assert.Equal(t, tt.statusCode, w.Code)
+			if tt.contentType != "" {
+				assert.Equal(t, tt.contentType, w.Header().Get("Content-Type"))
+			}
+			assert.Equal(t, tt.location, w.Header().Get("Location"))
+			assert.Contains(t, w.Body.String(), tt.body)
+		})
+	}
+}
+
 func TestPostHandlerUpdateWithPostgres(t *testing.T) {
 	f := float64(1.5)
 	cfg := prepConf()
 
 	cfg.Key = "test"
+	// requests are not signed, only metric hashes are checked
+	cfg.AllowUnsigned = true
 	ctrl := gomock.NewController(t)
 	mockdb := pgxpoolmock.NewMockPgxPool(ctrl)
 
-	mockdb.EXPECT().Exec(gomock.Any(), gomock.Any(), gomock.Any()).Return([]byte("test"), nil)
+	inserted := pgxpoolmock.NewRows([]string{"inserted", "value", "updated_at", "bounds", "counts", "registers", "info"}).
+		AddRow(true, 1.5, time.Now(), []float64(nil), []int64(nil), []int16(nil), (*string)(nil)).ToPgxRows()
+	inserted.Next()
+	mockdb.EXPECT().QueryRow(gomock.Any(), gomock.Any(), gomock.Any()).Return(inserted)
 
 	db := storage.ConnectPG(context.Background(), cfg, logger)
 	db.Conn = mockdb
@@ -441,7 +745,7 @@ func TestPostHandlerUpdateWithPostgres(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 
-			r, dbUpdated := MetricRouter(db, cfg, logger)
+			r, dbUpdated := MetricRouter(db, nil, nil, cfg, logger)
 			go func() { <-dbUpdated }()
 			body, _ := json.Marshal(tt.request.body)
 			request := httptest.NewRequest(http.MethodPost, tt.request.request, bytes.NewBuffer(body))
@@ -458,6 +762,1125 @@ func TestPostHandlerUpdateWithPostgres(t *testing.T) {
 	}
 }
 
+func TestPostHandlerUpdatesWithQueue(t *testing.T) {
+	d := int64(2)
+	v := float64(1)
+	cfg := prepConf()
+	cfg.QueueSize = 1
+	db := storage.Connect(cfg, logger)
+	db.InsertGouge("Alloc", 1)
+	// writers are not started, so only the first request fits into the queue
+	queue := ingest.NewQueue(db, cfg, logger)
+
+	type want struct {
+		statusCode int
+		retryAfter string
+	}
+	tests := []struct {
+		name string
+		body []models.Metrics
+		want want
+	}{
+		{name: "queued", body: []models.Metrics{{ID: "PollCount", MType: "counter", Delta: &d}},
+			want: want{statusCode: 200}},
+		{name: "queue full", body: []models.Metrics{{ID: "PollCount", MType: "counter", Delta: &d}},
+			want: want{statusCode: 503, retryAfter: "1"}},
+		{name: "stored with other type", body: []models.Metrics{{ID: "Alloc", MType: "counter", Delta: &d}},
+			want: want{statusCode: 409}},
+		{name: "queued with other type", body: []models.Metrics{{ID: "PollCount", MType: "gauge", Value: &v}},
+			want: want{statusCode: 409}},
+		{name: "no value", body: []models.Metrics{{ID: "PollCount", MType: "counter"}},
+			want: want{statusCode: 400}},
+		{name: "unknown type", body: []models.Metrics{{ID: "PollCount", MType: "unknown", Delta: &d}},
+			want: want{statusCode: 501}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := MetricRouter(db, queue, nil, cfg, logger)
+			body, _ := json.Marshal(tt.body)
+			request := httptest.NewRequest(http.MethodPost, "/updates/", bytes.NewBuffer(body))
+			request.Header.Add("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+
+			r.ServeHTTP(w, request)
+			result := w.Result()
+			defer result.Body.Close()
+
+			assert.Equal(t, tt.want.statusCode, result.StatusCode)
+			assert.Equal(t, tt.want.retryAfter, result.Header.Get("Retry-After"))
+		})
+	}
+
+	queue.Start(nil)
+	queue.Close()
+	assert.Equal(t, int64(2), db.Counter["PollCount"])
+}
+
+func TestPostHandlerUpdatesWithLimits(t *testing.T) {
+	d := int64(2)
+	cfg := prepConf()
+	cfg.MaxSeries = 2
+	cfg.AgentRate = 4
+	db := storage.Connect(cfg, logger)
+	r, dbUpdated := MetricRouter(db, nil, nil, cfg, logger)
+	go func() {
+		for {
+			<-dbUpdated
+		}
+	}()
+
+	type want struct {
+		statusCode int
+		rejected   string
+		retryAfter string
+	}
+	tests := []struct {
+		name   string
+		body   []models.Metrics
+		realIP string
+		want   want
+	}{
+		{name: "empty", body: []models.Metrics{}, want: want{statusCode: 200}},
+		{name: "accepted", body: []models.Metrics{{ID: "c1", MType: "counter", Delta: &d}},
+			want: want{statusCode: 200}},
+		{name: "partly rejected", body: []models.Metrics{{ID: "c1", MType: "counter", Delta: &d}, {ID: "c2", MType: "counter", Delta: &d}, {ID: "c3", MType: "counter", Delta: &d}},
+			want: want{statusCode: 200, rejected: "1"}},
+		{name: "over rate", body: []models.Metrics{{ID: "c1", MType: "counter", Delta: &d}},
+			want: want{statusCode: 429, retryAfter: "1"}},
+		// agent is known by its connection, not by headers
+		{name: "over rate with other address in header", body: []models.Metrics{{ID: "c1", MType: "counter", Delta: &d}}, realIP: "10.1.2.3",
+			want: want{statusCode: 429, retryAfter: "1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, _ := json.Marshal(tt.body)
+			request := httptest.NewRequest(http.MethodPost, "/updates/", bytes.NewBuffer(body))
+			request.Header.Add("Content-Type", "application/json")
+			if tt.realIP != "" {
+				request.Header.Set("X-Real-IP", tt.realIP)
+			}
+			w := httptest.NewRecorder()
+
+			r.ServeHTTP(w, request)
+			result := w.Result()
+			defer result.Body.Close()
+
+			assert.Equal(t, tt.want.statusCode, result.StatusCode)
+			assert.Equal(t, tt.want.rejected, result.Header.Get("X-Rejected-Metrics"))
+			assert.Equal(t, tt.want.retryAfter, result.Header.Get("Retry-After"))
+		})
+	}
+
+	assert.Equal(t, int64(4), db.ValueFromCounter("c1"))
+	assert.False(t, db.NameInCounter("c3"))
+	assert.Equal(t, int64(1), db.ValueFromCounter(limits.RejectedSeries))
+	assert.Equal(t, int64(2), db.ValueFromCounter(limits.RejectedSamples))
+}
+
+func TestLimitRejectionsWithQueue(t *testing.T) {
+	d := int64(2)
+	cfg := prepConf()
+	cfg.MaxSeries = 1
+	cfg.QueueSize = 10
+	db := storage.Connect(cfg, logger)
+	queue := ingest.NewQueue(db, cfg, logger)
+	r, _ := MetricRouter(db, queue, nil, cfg, logger)
+
+	body, _ := json.Marshal([]models.Metrics{{ID: "c1", MType: "counter", Delta: &d}, {ID: "c2", MType: "counter", Delta: &d}})
+	request := httptest.NewRequest(http.MethodPost, "/updates/", bytes.NewBuffer(body))
+	request.Header.Add("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, request)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "1", w.Header().Get("X-Rejected-Metrics"))
+
+	// rejections are queued like any other metrics, nothing is written before the queue is flushed
+	assert.False(t, db.NameInCounter(limits.RejectedSeries))
+	queue.Start(nil)
+	queue.Close()
+	assert.Equal(t, int64(1), db.ValueFromCounter(limits.RejectedSeries))
+	assert.Equal(t, int64(2), db.ValueFromCounter("c1"))
+}
+
+func TestRequestRateLimits(t *testing.T) {
+	cfg := prepConf()
+	cfg.RateLimits = config.RequestRates{config.RoutesIngest: {PerSecond: 0.5, Burst: 1}}
+	db := storage.Connect(cfg, logger)
+	r, dbUpdated := MetricRouter(db, nil, nil, cfg, logger)
+	go func() {
+		for {
+			<-dbUpdated
+		}
+	}()
+	// test requests come from 192.0.2.1
+	require.NoError(t, cfg.TrustedProxies.Set("192.0.2.0/24"))
+	proxied, proxiedUpdated := MetricRouter(db, nil, nil, cfg, logger)
+	go func() {
+		for {
+			<-proxiedUpdated
+		}
+	}()
+
+	tests := []struct {
+		name       string
+		router     http.Handler
+		method     string
+		request    string
+		body       string
+		realIP     string
+		statusCode int
+		retryAfter string
+	}{
+		{name: "write", router: r, method: http.MethodPost, request: "/updates/", body: `[{"id":"Alloc","type":"gauge","value":1}]`, statusCode: 200},
+		{name: "write over rate", router: r, method: http.MethodPost, request: "/update/", body: `{"id":"Alloc","type":"gauge","value":1}`,
+			statusCode: 429, retryAfter: "2"},
+		{name: "api v2 write over rate", router: r, method: http.MethodPost, request: "/api/v2/metrics", body: `[{"id":"Alloc","type":"gauge","value":1}]`,
+			statusCode: 429, retryAfter: "2"},
+		{name: "X-Real-IP of client is ignored", router: r, method: http.MethodPost, request: "/updates/", body: `[{"id":"Alloc","type":"gauge","value":1}]`,
+			realIP: "10.0.0.1", statusCode: 429, retryAfter: "2"},
+		{name: "read is not limited", router: r, method: http.MethodGet, request: "/value/gauge/Alloc", statusCode: 200},
+		{name: "behind proxy", router: proxied, method: http.MethodPost, request: "/updates/", body: `[{"id":"Alloc","type":"gauge","value":1}]`,
+			realIP: "10.0.0.1", statusCode: 200},
+		{name: "behind proxy over rate", router: proxied, method: http.MethodPost, request: "/updates/", body: `[{"id":"Alloc","type":"gauge","value":1}]`,
+			realIP: "10.0.0.1", statusCode: 429, retryAfter: "2"},
+		{name: "other client behind proxy", router: proxied, method: http.MethodPost, request: "/updates/", body: `[{"id":"Alloc","type":"gauge","value":1}]`,
+			realIP: "10.0.0.2", statusCode: 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(tt.method, tt.request, strings.NewReader(tt.body))
+			request.Header.Add("Content-Type", "application/json")
+			if tt.realIP != "" {
+				request.Header.Set("X-Real-IP", tt.realIP)
+			}
+			w := httptest.NewRecorder()
+
+			tt.router.ServeHTTP(w, request)
+
+			assert.Equal(t, tt.statusCode, w.Code)
+			assert.Equal(t, tt.retryAfter, w.Header().Get("Retry-After"))
+		})
+	}
+}
+
+func TestHashKeyRotation(t *testing.T) {
+	cfg := prepConf()
+	cfg.Key = "ignored"
+	require.NoError(t, cfg.HashKeys.Set("../hashkeys/testdata/keys.json"))
+	// requests are not signed, only metric hashes are checked
+	cfg.AllowUnsigned = true
+	db := storage.Connect(cfg, logger)
+	r, dbUpdated := MetricRouter(db, nil, nil, cfg, logger)
+	go func() {
+		for {
+			<-dbUpdated
+		}
+	}()
+
+	signed := func(id, secret string) models.Metrics {
+		v := 2.5
+		m := models.Metrics{ID: "Alloc", MType: "gauge", Value: &v}
+		switch {
+		case secret == "":
+		case id == "":
+			m.CalcHash(secret)
+		default:
+			m.CalcHashWithID(id, secret)
+		}
+		return m
+	}
+	tests := []struct {
+		name       string
+		request    string
+		metric     models.Metrics
+		statusCode int
+		want       string
+	}{
+		{name: "current key", request: "/update/", metric: signed("k2", "new-secret"), statusCode: 200},
+		{name: "previous key", request: "/update/", metric: signed("k1", "old-secret"), statusCode: 200},
+		{name: "previous key without id", request: "/updates/", metric: signed("", "old-secret"), statusCode: 200},
+		{name: "unknown key", request: "/update/", metric: signed("k0", "older-secret"), statusCode: 400, want: "400 - Unknown hash key k0\n"},
+		{name: "wrong key", request: "/updates/", metric: signed("k2", "old-secret"), statusCode: 400, want: "400 - Hashes do not agree\n"},
+		{name: "single key is not used with file", request: "/update/", metric: signed("", "ignored"), statusCode: 400, want: "400 - Hashes do not agree\n"},
+		{name: "unsigned batch", request: "/updates/", metric: signed("", ""), statusCode: 400, want: "400 - Hashes do not agree\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body []byte
+			if tt.request == "/updates/" {
+				body, _ = json.Marshal([]models.Metrics{tt.metric})
+			} else {
+				body, _ = json.Marshal(tt.metric)
+			}
+			request := httptest.NewRequest(http.MethodPost, tt.request, bytes.NewBuffer(body))
+			request.Header.Add("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+
+			r.ServeHTTP(w, request)
+
+			assert.Equal(t, tt.statusCode, w.Code)
+			if tt.want != "" {
+				assert.Equal(t, tt.want, w.Body.String())
+			}
+		})
+	}
+
+	// read metrics are signed with the current key
+	request := httptest.NewRequest(http.MethodPost, "/value/", strings.NewReader(`{"id":"Alloc","type":"gauge"}`))
+	request.Header.Add("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, request)
+	require.Equal(t, http.StatusOK, w.Code)
+	var m models.Metrics
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &m))
+	assert.Equal(t, signed("k2", "new-secret").Hash, m.Hash)
+}
+
+func TestReplayProtection(t *testing.T) {
+	cfg := prepConf()
+	cfg.Key = "test"
+	cfg.AllowUnsigned = true
+	db := storage.Connect(cfg, logger)
+	r, dbUpdated := MetricRouter(db, nil, nil, cfg, logger)
+	go func() {
+		for {
+			<-dbUpdated
+		}
+	}()
+	cfg.AllowUnsigned = false
+	strict, strictUpdated := MetricRouter(db, nil, nil, cfg, logger)
+	go func() {
+		for {
+			<-strictUpdated
+		}
+	}()
+
+	keys := hashkeys.New(hashkeys.Key{Secret: "test"})
+	delta := int64(5)
+	m := models.Metrics{ID: "ReplayCount", MType: "counter", Delta: &delta}
+	m.CalcHash("test")
+	body, _ := json.Marshal([]models.Metrics{m})
+	sign := func(uri string) http.Header {
+		r := httptest.NewRequest(http.MethodPost, uri, nil)
+		require.NoError(t, keys.SignRequest(r, body, time.Now()))
+		return r.Header
+	}
+	signed := sign("/updates/")
+	signedV2 := sign("/api/v2/metrics")
+
+	tests := []struct {
+		name       string
+		router     http.Handler
+		request    string
+		header     http.Header
+		statusCode int
+		reason     string
+		want       string
+	}{
+		{name: "signed", router: r, request: "/updates/", header: signed, statusCode: 200},
+		{name: "replayed", router: r, request: "/updates/", header: signed, statusCode: 400, reason: "replayed",
+			want: "400 - Request is rejected: nonce was already used\n"},
+		{name: "signed for other path", router: r, request: "/api/v2/metrics", header: sign("/updates/"), statusCode: 400, reason: "bad-signature",
+			want: `{"error":{"status":400,"message":"Request is rejected: signature does not agree"}}` + "\n"},
+		{name: "unsigned when allowed", router: r, request: "/updates/", header: http.Header{}, statusCode: 200},
+		{name: "unsigned", router: strict, request: "/updates/", header: http.Header{}, statusCode: 400, reason: "missing-signature",
+			want: "400 - Request is rejected: request signature is required\n"},
+		{name: "api v2 signed", router: r, request: "/api/v2/metrics", header: signedV2, statusCode: 200},
+		{name: "api v2 replayed", router: r, request: "/api/v2/metrics", header: signedV2, statusCode: 400, reason: "replayed",
+			want: `{"error":{"status":400,"message":"Request is rejected: nonce was already used"}}` + "\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// body is signed before compression
+			request := httptest.NewRequest(http.MethodPost, tt.request, gzData2(body))
+			request.Header.Add("Content-Type", "application/json")
+			request.Header.Add("Content-Encoding", "gzip")
+			for k, v := range tt.header {
+				request.Header[k] = v
+			}
+			w := httptest.NewRecorder()
+
+			tt.router.ServeHTTP(w, request)
+
+			assert.Equal(t, tt.statusCode, w.Code)
+			assert.Equal(t, tt.reason, w.Header().Get(hashkeys.RejectHeader))
+			if tt.want != "" {
+				assert.Equal(t, tt.want, w.Body.String())
+			}
+		})
+	}
+	// only signed, unsigned and api v2 writes are counted
+	assert.Equal(t, int64(15), db.ValueFromCounter("ReplayCount"))
+}
+
+func TestTrustedSubnet(t *testing.T) {
+	cfg := prepConf()
+	require.NoError(t, cfg.TrustedSubnet.Set("10.0.0.0/8"))
+	// httptest requests come from 192.0.2.1
+	require.NoError(t, cfg.TrustedProxies.Set("192.0.2.0/24"))
+	db := storage.Connect(cfg, logger)
+	db.InsertGouge("Alloc", 1)
+	r, dbUpdated := MetricRouter(db, nil, nil, cfg, logger)
+	go func() {
+		for {
+			<-dbUpdated
+		}
+	}()
+
+	tests := []struct {
+		name       string
+		method     string
+		request    string
+		body       string
+		remoteAddr string
+		realIP     string
+		statusCode int
+		want       string
+	}{
+		{name: "trusted behind proxy", method: http.MethodPost, request: "/update/gauge/Alloc/2", realIP: "10.1.2.3", statusCode: 200},
+		{name: "untrusted behind proxy", method: http.MethodPost, request: "/update/gauge/Alloc/2", realIP: "192.168.1.1", statusCode: 403,
+			want: "403 - Address 192.168.1.1 is not in trusted subnet\n"},
+		{name: "batch untrusted", method: http.MethodPost, request: "/updates/", body: `[{"id":"Alloc","type":"gauge","value":1}]`,
+			realIP: "192.168.1.1", statusCode: 403, want: "403 - Address 192.168.1.1 is not in trusted subnet\n"},
+		{name: "proxy without header", method: http.MethodPost, request: "/update/", body: `{"id":"Alloc","type":"gauge","value":1}`, statusCode: 403,
+			want: "403 - Address 192.0.2.1 is not in trusted subnet\n"},
+		{name: "bad header", method: http.MethodPost, request: "/updates/", body: `[{"id":"Alloc","type":"gauge","value":1}]`,
+			realIP: "somewhere", statusCode: 403, want: "403 - Address somewhere is not in trusted subnet\n"},
+		{name: "trusted connection", method: http.MethodPost, request: "/update/gauge/Alloc/2", remoteAddr: "10.1.2.3:1234", statusCode: 200},
+		{name: "trusted connection with any header", method: http.MethodPost, request: "/update/gauge/Alloc/2", remoteAddr: "10.1.2.3:1234",
+			realIP: "192.168.1.1", statusCode: 200},
+		{name: "spoofed header", method: http.MethodPost, request: "/update/gauge/Alloc/2", remoteAddr: "203.0.113.5:1234",
+			realIP: "10.1.2.3", statusCode: 403, want: "403 - Address 203.0.113.5 is not in trusted subnet\n"},
+		{name: "read is open", method: http.MethodGet, request: "/value/gauge/Alloc", realIP: "192.168.1.1", statusCode: 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(tt.method, tt.request, strings.NewReader(tt.body))
+			request.Header.Add("Content-Type", "application/json")
+			if tt.remoteAddr != "" {
+				request.RemoteAddr = tt.remoteAddr
+			}
+			if tt.realIP != "" {
+				request.Header.Set("X-Real-IP", tt.realIP)
+			}
+			w := httptest.NewRecorder()
+
+			r.ServeHTTP(w, request)
+
+			assert.Equal(t, tt.statusCode, w.Code)
+			if tt.want != "" {
+				assert.Equal(t, tt.want, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	cfg := prepConf()
+	require.NoError(t, cfg.APIKeys.Set("../auth/testdata/keys.json"))
+	db := storage.Connect(cfg, logger)
+	db.InsertGouge("Alloc", 1)
+	r, dbUpdated := MetricRouter(db, nil, nil, cfg, logger)
+	go func() {
+		for {
+			<-dbUpdated
+		}
+	}()
+
+	tests := []struct {
+		name       string
+		method     string
+		request    string
+		body       string
+		key        string
+		statusCode int
+	}{
+		{name: "page without key", method: http.MethodGet, request: "/", statusCode: 401},
+		{name: "page", method: http.MethodGet, request: "/", key: "read-key", statusCode: 200},
+		{name: "dashboard files without key", method: http.MethodGet, request: "/dashboard/dashboard.js", statusCode: 401},
+		{name: "value", method: http.MethodGet, request: "/value/gauge/Alloc", key: "read-key", statusCode: 200},
+		{name: "write with read key", method: http.MethodPost, request: "/update/gauge/Alloc/2", key: "read-key", statusCode: 403},
+		{name: "write", method: http.MethodPost, request: "/update/gauge/Alloc/2", key: "write-key", statusCode: 200},
+		{name: "batch without key", method: http.MethodPost, request: "/updates/", body: `[{"id":"Alloc","type":"gauge","value":1}]`, statusCode: 401},
+		{name: "api v2 write", method: http.MethodPost, request: "/api/v2/metrics", body: `[{"id":"Alloc","type":"gauge","value":1}]`, key: "write-key", statusCode: 200},
+		{name: "api v2 read without key", method: http.MethodGet, request: "/api/v2/metrics", statusCode: 401},
+		{name: "api v2 spec is open", method: http.MethodGet, request: "/api/v2/openapi.json", statusCode: 200},
+		{name: "admin with write key", method: http.MethodDelete, request: "/value/gauge/Alloc", key: "write-key", statusCode: 403},
+		{name: "admin", method: http.MethodDelete, request: "/value/gauge/Alloc", key: "admin-key", statusCode: 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(tt.method, tt.request, strings.NewReader(tt.body))
+			request.Header.Add("Content-Type", "application/json")
+			if tt.key != "" {
+				request.Header.Set("Authorization", "Bearer "+tt.key)
+			}
+			w := httptest.NewRecorder()
+
+			r.ServeHTTP(w, request)
+
+			assert.Equal(t, tt.statusCode, w.Code)
+		})
+	}
+}
+
+func TestBodyLimits(t *testing.T) {
+	cfg := prepConf()
+	cfg.MaxBodySize = 512
+	cfg.MaxDecodedSize = 1024
+	cfg.MaxBatch = 2
+	db := storage.Connect(cfg, logger)
+	r, dbUpdated := MetricRouter(db, nil, nil, cfg, logger)
+	go func() {
+		for {
+			<-dbUpdated
+		}
+	}()
+
+	metric := `{"id":"Alloc","type":"gauge","value":1}`
+	tests := []struct {
+		name       string
+		request    string
+		body       *bytes.Buffer
+		encoding   string
+		statusCode int
+		want       string
+	}{
+		{name: "batch", request: "/updates/", body: bytes.NewBufferString("[" + metric + "," + metric + "]"),
+			statusCode: 200},
+		{name: "batch too long", request: "/updates/", body: bytes.NewBufferString("[" + metric + "," + metric + "," + metric + "]"),
+			statusCode: 413, want: "413 - Batch of 3 metrics is larger than 2\n"},
+		{name: "body too large", request: "/update/", body: bytes.NewBufferString(metric + strings.Repeat(" ", 512)),
+			statusCode: 413, want: "413 - Request body is larger than 512 bytes\n"},
+		{name: "decoded body too large", request: "/update/", body: gzData(metric + strings.Repeat(" ", 1024)), encoding: "gzip",
+			statusCode: 413, want: "413 - Decoded request body is larger than 1024 bytes\n"},
+		{name: "deflate", request: "/update/", body: deflateData(metric), encoding: "deflate",
+			statusCode: 200},
+		{name: "api v2 batch too long", request: "/api/v2/metrics", body: bytes.NewBufferString("[" + metric + "," + metric + "," + metric + "]"),
+			statusCode: 413, want: `{"error":{"status":413,"message":"batch of 3 metrics is larger than 2"}}` + "\n"},
+		{name: "api v2 decoded body too large", request: "/api/v2/metrics", body: gzData("[" + metric + strings.Repeat(" ", 1024) + "]"), encoding: "gzip",
+			statusCode: 413, want: `{"error":{"status":413,"message":"Decoded request body is larger than 1024 bytes"}}` + "\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPost, tt.request, tt.body)
+			request.Header.Add("Content-Type", "application/json")
+			if tt.encoding != "" {
+				request.Header.Add("Content-Encoding", tt.encoding)
+			}
+			w := httptest.NewRecorder()
+
+			r.ServeHTTP(w, request)
+
+			assert.Equal(t, tt.statusCode, w.Code)
+			if tt.want != "" {
+				assert.Equal(t, tt.want, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestGetHandlerQuery(t *testing.T) {
+	cfg := prepConf()
+	db := storage.Connect(cfg, logger)
+	db.InsertGouge(`Alloc{agent="a1"}`, 1.5)
+	db.InsertGouge(`Alloc{agent="a2"}`, 2.5)
+	r, _ := MetricRouter(db, nil, nil, cfg, logger)
+
+	type want struct {
+		statusCode int
+		body       string
+	}
+	tests := []struct {
+		name    string
+		request string
+		want    want
+	}{
+		{name: "sum", request: "/query?name=Alloc&agg=sum",
+			want: want{statusCode: 200, body: `[{"labels":{},"value":4}]` + "\n"}},
+		{name: "match", request: "/query?name=Alloc&match=agent%3Da2",
+			want: want{statusCode: 200, body: `[{"name":"Alloc","type":"gauge","labels":{"agent":"a2"},"value":2.5}]` + "\n"}},
+		{name: "topk", request: "/query?agg=topk&k=1&by=agent&match=agent%3D~a.*",
+			want: want{statusCode: 200, body: `[{"name":"Alloc","type":"gauge","labels":{"agent":"a1"},"value":1.5},{"name":"Alloc","type":"gauge","labels":{"agent":"a2"},"value":2.5}]` + "\n"}},
+		{name: "bad k", request: "/query?agg=topk&k=one",
+			want: want{statusCode: 400, body: "400 - k must be int\n"}},
+		{name: "bad matcher", request: "/query?match=agent",
+			want: want{statusCode: 400, body: "400 - bad query: matcher \"agent\" must look like label=value\n"}},
+		{name: "bad agg", request: "/query?agg=median",
+			want: want{statusCode: 400, body: "400 - bad query: unknown aggregation median\n"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, tt.request, nil)
+			w := httptest.NewRecorder()
+
+			r.ServeHTTP(w, request)
+			result := w.Result()
+			defer result.Body.Close()
+
+			assert.Equal(t, tt.want.statusCode, result.StatusCode)
+			assert.Equal(t, tt.want.body, w.Body.String())
+		})
+	}
+}
+
+func TestCounterRates(t *testing.T) {
+	cfg := prepConf()
+	cfg.RateWindow = time.Minute
+	db := storage.Connect(cfg, logger)
+	db.InsertCounter(`PollCount{agent="a1"}`, 3)
+	db.InsertGouge("Alloc", 1.5)
+	tracker := rates.NewTracker(db, cfg, logger)
+	tracker.Sample(time.Now().Add(-30 * time.Second))
+	db.InsertCounter(`PollCount{agent="a1"}`, 6)
+	tracker.Sample(time.Now())
+
+	r, _ := MetricRouter(db, nil, tracker, cfg, logger)
+
+	type want struct {
+		statusCode int
+		body       string
+	}
+	tests := []struct {
+		name    string
+		request string
+		want    want
+	}{
+		{name: "value increase", request: "/value/counter/PollCount%7Bagent=%22a1%22%7D?fn=increase",
+			want: want{statusCode: 200, body: "6.000"}},
+		{name: "bad window", request: "/value/counter/PollCount%7Bagent=%22a1%22%7D?fn=rate&window=1",
+			want: want{statusCode: 400, body: "400 - bad window: time: missing unit in duration \"1\"\n"}},
+		{name: "unknown fn", request: "/value/counter/PollCount%7Bagent=%22a1%22%7D?fn=delta",
+			want: want{statusCode: 400, body: "400 - unknown function delta\n"}},
+		{name: "query", request: "/query?fn=increase&agg=sum",
+			want: want{statusCode: 200, body: `[{"labels":{},"value":6}]` + "\n"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, tt.request, nil)
+			w := httptest.NewRecorder()
+
+			r.ServeHTTP(w, request)
+			result := w.Result()
+			defer result.Body.Close()
+
+			assert.Equal(t, tt.want.statusCode, result.StatusCode)
+			assert.Equal(t, tt.want.body, w.Body.String())
+		})
+	}
+
+	// rate depends on time of the request, so it is compared roughly
+	request := httptest.NewRequest(http.MethodGet, "/value/counter/PollCount%7Bagent=%22a1%22%7D?fn=rate&window=1m", nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, request)
+	assert.Equal(t, http.StatusOK, w.Code)
+	rate, err := strconv.ParseFloat(w.Body.String(), 64)
+	assert.NoError(t, err)
+	assert.InDelta(t, 0.2, rate, 0.01)
+
+	request = httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, request)
+	assert.Equal(t, http.StatusOK, w.Code)
+	lines := strings.Split(w.Body.String(), "\n")
+	assert.Equal(t, []string{
+		"# TYPE Alloc gauge",
+		"Alloc 1.5",
+		"# TYPE PollCount counter",
+		`PollCount{agent="a1"} 9`,
+		"# TYPE PollCount_increase gauge",
+		`PollCount_increase{agent="a1"} 6`,
+		"# TYPE PollCount_rate gauge",
+	}, lines[:7])
+	assert.True(t, strings.HasPrefix(lines[7], `PollCount_rate{agent="a1"} 0.`))
+
+	// without tracker rates cannot be calculated
+	r, _ = MetricRouter(db, nil, nil, cfg, logger)
+	request = httptest.NewRequest(http.MethodGet, "/query?fn=rate", nil)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, request)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestPrometheusCollisions(t *testing.T) {
+	cfg := prepConf()
+	cfg.RateWindow = time.Minute
+	db := storage.Connect(cfg, logger)
+	db.InsertGouge("a.b", 1)
+	db.InsertGouge("a_b", 2)
+	db.InsertCounter("x", 3)
+	db.InsertGouge("x_rate", 5)
+	db.InsertHistogram("h", &models.Histogram{Bounds: []float64{1}, Counts: []uint64{1, 0}, Count: 1, Sum: 0.5})
+	db.InsertGouge("h_count", 7)
+	tracker := rates.NewTracker(db, cfg, logger)
+	tracker.Sample(time.Now().Add(-30 * time.Second))
+	db.InsertCounter("x", 6)
+	tracker.Sample(time.Now())
+
+	r, _ := MetricRouter(db, nil, tracker, cfg, logger)
+	request := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, request)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `# TYPE a_b gauge
+a_b 1
+# TYPE h histogram
+h_bucket{le="1"} 1
+h_bucket{le="+Inf"} 1
+h_sum 0.5
+h_count 1
+# TYPE x counter
+x 9
+# TYPE x_increase gauge
+x_increase 6
+# TYPE x_rate gauge
+x_rate 5
+`, w.Body.String())
+}
+
+func TestHistograms(t *testing.T) {
+	cfg := prepConf()
+	db := storage.Connect(cfg, logger)
+	r, dbUpdated := MetricRouter(db, nil, rates.NewTracker(db, cfg, logger), cfg, logger)
+	go func() {
+		for range dbUpdated {
+		}
+	}()
+
+	h := models.Histogram{Bounds: []float64{1, 2}, Counts: []uint64{1, 2, 1}, Count: 4, Sum: 6}
+	for i := 0; i < 2; i++ {
+		body, _ := json.Marshal(models.Metrics{ID: "GCPause", MType: "histogram", Histogram: &h})
+		request := httptest.NewRequest(http.MethodPost, "/update/", bytes.NewBuffer(body))
+		request.Header.Add("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, request)
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+
+	bad, _ := json.Marshal(models.Metrics{ID: "GCPause", MType: "histogram", Histogram: &models.Histogram{Bounds: []float64{1}, Counts: []uint64{1}}})
+	request := httptest.NewRequest(http.MethodPost, "/update/", bytes.NewBuffer(bad))
+	request.Header.Add("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, request)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	type want struct {
+		statusCode int
+		body       string
+	}
+	tests := []struct {
+		name    string
+		request string
+		want    want
+	}{
+		{name: "value", request: "/value/histogram/GCPause",
+			want: want{statusCode: 200, body: `{"bounds":[1,2],"counts":[2,4,2],"count":8,"sum":12}` + "\n"}},
+		{name: "quantile", request: "/value/histogram/GCPause?q=0.5",
+			want: want{statusCode: 200, body: "1.500"}},
+		{name: "bad quantile", request: "/value/histogram/GCPause?q=2",
+			want: want{statusCode: 400, body: "400 - q must be float between 0 and 1\n"}},
+		{name: "unknown", request: "/value/histogram/Unknown",
+			want: want{statusCode: 404, body: "Unknown does not exist in Histogram db\n"}},
+		{name: "query", request: "/query?q=0.5",
+			want: want{statusCode: 200, body: `[{"name":"GCPause","type":"histogram","labels":{},"value":1.5}]` + "\n"}},
+		{name: "query with fn", request: "/query?q=0.5&fn=rate",
+			want: want{statusCode: 400, body: "400 - q cannot be used together with fn\n"}},
+		{name: "prometheus", request: "/metrics",
+			want: want{statusCode: 200, body: `# TYPE GCPause histogram
+GCPause_bucket{le="1"} 2
+GCPause_bucket{le="2"} 6
+GCPause_bucket{le="+Inf"} 8
+GCPause_sum 12
+GCPause_count 8
+`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, tt.request, nil)
+			w := httptest.NewRecorder()
+
+			r.ServeHTTP(w, request)
+			result := w.Result()
+			defer result.Body.Close()
+
+			assert.Equal(t, tt.want.statusCode, result.StatusCode)
+			assert.Equal(t, tt.want.body, w.Body.String())
+		})
+	}
+}
+
+func TestSets(t *testing.T) {
+	cfg := prepConf()
+	db := storage.Connect(cfg, logger)
+	r, dbUpdated := MetricRouter(db, nil, nil, cfg, logger)
+	go func() {
+		for range dbUpdated {
+		}
+	}()
+
+	// two agents see partly the same users
+	for _, users := range [][]string{{"u1", "u2", "u3"}, {"u3", "u4"}} {
+		set := models.NewSet(models.DefaultSetPrecision)
+		for _, u := range users {
+			set.Add(u)
+		}
+		body, _ := json.Marshal(models.Metrics{ID: "Users", MType: "set", Set: set})
+		request := httptest.NewRequest(http.MethodPost, "/update/", bytes.NewBuffer(body))
+		request.Header.Add("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, request)
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+
+	bad, _ := json.Marshal(models.Metrics{ID: "Users", MType: "set", Set: &models.Set{Precision: 4, Registers: []byte{1}}})
+	request := httptest.NewRequest(http.MethodPost, "/update/", bytes.NewBuffer(bad))
+	request.Header.Add("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, request)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	type want struct {
+		statusCode int
+		body       string
+	}
+	tests := []struct {
+		name    string
+		request string
+		want    want
+	}{
+		{name: "value", request: "/value/set/Users",
+			want: want{statusCode: 200, body: "4"}},
+		{name: "unknown", request: "/value/set/Unknown",
+			want: want{statusCode: 404, body: "Unknown does not exist in Set db\n"}},
+		{name: "query", request: "/query?type=set",
+			want: want{statusCode: 200, body: `[{"name":"Users","type":"set","labels":{},"value":4}]` + "\n"}},
+		{name: "prometheus", request: "/metrics",
+			want: want{statusCode: 200, body: "# TYPE Users gauge\nUsers 4\n"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, tt.request, nil)
+			w := httptest.NewRecorder()
+
+			r.ServeHTTP(w, request)
+			result := w.Result()
+			defer result.Body.Close()
+
+			assert.Equal(t, tt.want.statusCode, result.StatusCode)
+			assert.Equal(t, tt.want.body, w.Body.String())
+		})
+	}
+
+	request = httptest.NewRequest(http.MethodGet, "/?type=set", nil)
+	request.Header.Set("Accept", "text/csv")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, request)
+	assert.Contains(t, w.Body.String(), "\nUsers,set,4,")
+}
+
+func TestInfos(t *testing.T) {
+	cfg := prepConf()
+	db := storage.Connect(cfg, logger)
+	r, dbUpdated := MetricRouter(db, nil, nil, cfg, logger)
+	go func() {
+		for range dbUpdated {
+		}
+	}()
+
+	for _, v := range []string{"v1.0.0", `v1.1.0 "rc"`} {
+		info := v
+		body, _ := json.Marshal(models.Metrics{ID: `AgentVersion{agent="a1"}`, MType: "info", Info: &info})
+		request := httptest.NewRequest(http.MethodPost, "/update/", bytes.NewBuffer(body))
+		request.Header.Add("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, request)
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+
+	type want struct {
+		statusCode int
+		body       string
+	}
+	tests := []struct {
+		name    string
+		request string
+		want    want
+	}{
+		{name: "value", request: "/value/info/AgentVersion%7Bagent=%22a1%22%7D",
+			want: want{statusCode: 200, body: `v1.1.0 "rc"`}},
+		{name: "unknown", request: "/value/info/Unknown",
+			want: want{statusCode: 404, body: "Unknown does not exist in Info db\n"}},
+		{name: "not in query", request: "/query",
+			want: want{statusCode: 200, body: "[]\n"}},
+		{name: "prometheus", request: "/metrics",
+			want: want{statusCode: 200, body: "# TYPE AgentVersion_info gauge\n" + `AgentVersion_info{agent="a1",value="v1.1.0 \"rc\""} 1` + "\n"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, tt.request, nil)
+			w := httptest.NewRecorder()
+
+			r.ServeHTTP(w, request)
+			result := w.Result()
+			defer result.Body.Close()
+
+			assert.Equal(t, tt.want.statusCode, result.StatusCode)
+			assert.Equal(t, tt.want.body, w.Body.String())
+		})
+	}
+
+	body, _ := json.Marshal(models.Metrics{ID: `AgentVersion{agent="a1"}`, MType: "info"})
+	request := httptest.NewRequest(http.MethodPost, "/value/", bytes.NewBuffer(body))
+	request.Header.Add("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, request)
+	var m models.Metrics
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&m))
+	assert.Equal(t, `v1.1.0 "rc"`, *m.Info)
+
+	request = httptest.NewRequest(http.MethodGet, "/?type=info", nil)
+	request.Header.Set("Accept", "text/csv")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, request)
+	assert.Contains(t, w.Body.String(), `"AgentVersion{agent=""a1""}",info,"v1.1.0 ""rc""",`)
+}
+
+func TestMeta(t *testing.T) {
+	cfg := prepConf()
+	db := storage.Connect(cfg, logger)
+	db.InsertGouge(`HeapIdle{agent="a1"}`, 1024)
+	r, dbUpdated := MetricRouter(db, nil, nil, cfg, logger)
+	go func() {
+		for range dbUpdated {
+		}
+	}()
+
+	type want struct {
+		statusCode int
+		body       string
+	}
+	tests := []struct {
+		name    string
+		method  string
+		request string
+		body    string
+		want    want
+	}{
+		{name: "put", method: http.MethodPut, request: "/meta/HeapIdle", body: `{"description":"Bytes in idle heap spans","unit":"bytes","type":"gauge"}`,
+			want: want{statusCode: 200, body: `{"name":"HeapIdle","description":"Bytes in idle heap spans","unit":"bytes","type":"gauge"}` + "\n"}},
+		{name: "put unknown type", method: http.MethodPut, request: "/meta/HeapIdle", body: `{"type":"float"}`,
+			want: want{statusCode: 400, body: "400 - metric type unknown\n"}},
+		{name: "put bad json", method: http.MethodPut, request: "/meta/HeapIdle", body: `{`,
+			want: want{statusCode: 400, body: "400 - Metadata json cannot be decoded: unexpected EOF\n"}},
+		{name: "put list", method: http.MethodPut, request: "/meta/", body: `[{"name":"Alloc","unit":"bytes","type":"gauge"},{"name":"PollCount","type":"counter"}]`,
+			want: want{statusCode: 200, body: `[{"name":"Alloc","unit":"bytes","type":"gauge"},{"name":"PollCount","type":"counter"}]` + "\n"}},
+		{name: "put list invalid", method: http.MethodPut, request: "/meta/", body: `[{"name":"Sys","type":"gauge"},{"name":"Frees","type":"float"}]`,
+			want: want{statusCode: 400, body: "400 - Frees: metric type unknown\n"}},
+		{name: "put list without name", method: http.MethodPut, request: "/meta/", body: `[{"type":"gauge"}]`,
+			want: want{statusCode: 400, body: "400 - metric name is not given\n"}},
+		{name: "get", method: http.MethodGet, request: "/meta/HeapIdle",
+			want: want{statusCode: 200, body: `{"name":"HeapIdle","description":"Bytes in idle heap spans","unit":"bytes","type":"gauge"}` + "\n"}},
+		{name: "get unknown", method: http.MethodGet, request: "/meta/Unknown",
+			want: want{statusCode: 404, body: "404 - No metadata for Unknown\n"}},
+		{name: "list", method: http.MethodGet, request: "/meta/",
+			want: want{statusCode: 200, body: `[{"name":"Alloc","unit":"bytes","type":"gauge"},` +
+				`{"name":"HeapIdle","description":"Bytes in idle heap spans","unit":"bytes","type":"gauge"},{"name":"PollCount","type":"counter"}]` + "\n"}},
+		{name: "prometheus", method: http.MethodGet, request: "/metrics",
+			want: want{statusCode: 200, body: "# HELP HeapIdle Bytes in idle heap spans (bytes)\n# TYPE HeapIdle gauge\n" + `HeapIdle{agent="a1"} 1024` + "\n"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(tt.method, tt.request, strings.NewReader(tt.body))
+			request.Header.Add("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+
+			r.ServeHTTP(w, request)
+			result := w.Result()
+			defer result.Body.Close()
+
+			assert.Equal(t, tt.want.statusCode, result.StatusCode)
+			assert.Equal(t, tt.want.body, w.Body.String())
+		})
+	}
+
+	// dashboard shows descriptions from api v2
+	request := httptest.NewRequest(http.MethodGet, "/api/v2/meta", nil)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, request)
+	assert.Contains(t, w.Body.String(), `"description":"Bytes in idle heap spans"`)
+}
+
+func TestDeleteHandlers(t *testing.T) {
+	cfg := prepConf()
+	cfg.AdminUser = "admin"
+	cfg.AdminPassword = "secret"
+	db := storage.Connect(cfg, logger)
+
+	type want struct {
+		statusCode int
+		body       string
+	}
+	tests := []struct {
+		name     string
+		method   string
+		request  string
+		password string
+		want     want
+	}{
+		{name: "no credentials", method: http.MethodDelete, request: "/value/gauge/Alloc",
+			want: want{statusCode: 401, body: "401 - Admin credentials required\n"}},
+		{name: "wrong password", method: http.MethodDelete, request: "/value/gauge/Alloc", password: "wrong",
+			want: want{statusCode: 401, body: "401 - Admin credentials required\n"}},
+		{name: "delete one", method: http.MethodDelete, request: "/value/gauge/Alloc", password: "secret",
+			want: want{statusCode: 200, body: `{"deleted":1}`}},
+		{name: "delete unknown", method: http.MethodDelete, request: "/value/gauge/Alloc", password: "secret",
+			want: want{statusCode: 404, body: "Alloc does not exist in gauge db\n"}},
+		{name: "delete by prefix", method: http.MethodDelete, request: "/value/?prefix=host1.", password: "secret",
+			want: want{statusCode: 200, body: `{"deleted":2}`}},
+		{name: "delete by pattern", method: http.MethodDelete, request: "/value/?pattern=host*", password: "secret",
+			want: want{statusCode: 200, body: `{"deleted":1}`}},
+		{name: "delete without pattern", method: http.MethodDelete, request: "/value/", password: "secret",
+			want: want{statusCode: 400, body: "400 - pattern or prefix must be given\n"}},
+		{name: "reset counter", method: http.MethodPost, request: "/reset/counter/PollCount", password: "secret",
+			want: want{statusCode: 200, body: `{"status":"ok"}`}},
+		{name: "reset unknown", method: http.MethodPost, request: "/reset/counter/Unknown", password: "secret",
+			want: want{statusCode: 404, body: "Unknown does not exist in Counter db\n"}},
+	}
+
+	db.InsertGouge("Alloc", 1)
+	db.InsertGouge("host1.cpu", 1)
+	db.InsertCounter("host1.requests", 1)
+	db.InsertGouge("host2.cpu", 1)
+	db.InsertCounter("PollCount", 3)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, dbUpdated := MetricRouter(db, nil, nil, cfg, logger)
+			go func() { <-dbUpdated }()
+
+			request := httptest.NewRequest(tt.method, tt.request, nil)
+			if tt.password != "" {
+				request.SetBasicAuth("admin", tt.password)
+			}
+			w := httptest.NewRecorder()
+
+			r.ServeHTTP(w, request)
+			result := w.Result()
+			defer result.Body.Close()
+
+			assert.Equal(t, tt.want.statusCode, result.StatusCode)
+			assert.Equal(t, tt.want.body, w.Body.String())
+		})
+	}
+	assert.Equal(t, int64(0), db.Counter["PollCount"])
+	assert.Empty(t, db.Gouge)
+}
+
+func TestTypeConflicts(t *testing.T) {
+	cfg := prepConf()
+	cfg.AdminUser = "admin"
+	cfg.AdminPassword = "secret"
+	db := storage.Connect(cfg, logger)
+	db.InsertGouge("Alloc", 1.6)
+	db.InsertGouge("Temperature", 36.6)
+	db.InsertHistogram("GCPause", models.NewHistogram([]float64{1}))
+	r, dbUpdated := MetricRouter(db, nil, nil, cfg, logger)
+	go func() {
+		for range dbUpdated {
+		}
+	}()
+
+	type want struct {
+		statusCode int
+		body       string
+	}
+	tests := []struct {
+		name     string
+		request  string
+		body     string
+		password string
+		want     want
+	}{
+		{name: "plain", request: "/update/counter/Alloc/1",
+			want: want{statusCode: 409, body: "409 - Alloc is registered as gauge, cannot write it as counter\n"}},
+		{name: "json", request: "/update/", body: `{"id":"Alloc","type":"counter","delta":1}`,
+			want: want{statusCode: 409, body: "409 - Alloc is registered as gauge, cannot write it as counter\n"}},
+		{name: "batch", request: "/updates/", body: `[{"id":"New","type":"gauge","value":1},{"id":"New","type":"counter","delta":1}]`,
+			want: want{statusCode: 409, body: "409 - New is registered as gauge, cannot write it as counter\n"}},
+		{name: "same type", request: "/update/gauge/Alloc/2.4",
+			want: want{statusCode: 200, body: `{"status":"ok}`}},
+		{name: "retype without credentials", request: "/retype/Alloc?type=counter",
+			want: want{statusCode: 401, body: "401 - Admin credentials required\n"}},
+		{name: "retype to unknown", request: "/retype/Alloc?type=float", password: "secret",
+			want: want{statusCode: 400, body: "400 - Metric type unknown: float\n"}},
+		{name: "retype unknown", request: "/retype/Unknown?type=counter", password: "secret",
+			want: want{statusCode: 404, body: "404 - Unknown does not exist in db\n"}},
+		{name: "retype", request: "/retype/Alloc?type=counter", password: "secret",
+			want: want{statusCode: 200, body: `{"name":"Alloc","from":"gauge","to":"counter","converted":true}`}},
+		{name: "retype histogram", request: "/retype/GCPause?type=gauge", password: "secret",
+			want: want{statusCode: 200, body: `{"name":"GCPause","from":"histogram","to":"gauge","converted":false}`}},
+		{name: "new type", request: "/update/counter/Alloc/1",
+			want: want{statusCode: 200, body: `{"status":"ok}`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPost, tt.request, strings.NewReader(tt.body))
+			if tt.body != "" {
+				request.Header.Add("Content-Type", "application/json")
+			}
+			if tt.password != "" {
+				request.SetBasicAuth("admin", tt.password)
+			}
+			w := httptest.NewRecorder()
+
+			r.ServeHTTP(w, request)
+			result := w.Result()
+			defer result.Body.Close()
+
+			assert.Equal(t, tt.want.statusCode, result.StatusCode)
+			assert.Equal(t, tt.want.body, w.Body.String())
+		})
+	}
+	assert.Equal(t, int64(3), db.Counter["Alloc"])
+	assert.NotContains(t, db.Gouge, "Alloc")
+	assert.NotContains(t, db.Gouge, "New")
+	assert.False(t, db.NameInHistogram("GCPause"))
+}
+
+// failingRetypeDB fails to change metric types like a db which lost connection in the middle of it.
+type failingRetypeDB struct {
+	*storage.InMemoryDB
+}
+
+func (db failingRetypeDB) Retype(name string, to string) (string, bool, error) {
+	return "", false, errors.New("connection lost")
+}
+
+func TestPostHandlerRetypeFailed(t *testing.T) {
+	cfg := prepConf()
+	cfg.AdminUser = "admin"
+	cfg.AdminPassword = "secret"
+	db := storage.Connect(cfg, logger)
+	db.InsertGouge("Alloc", 1.6)
+	r, dbUpdated := MetricRouter(failingRetypeDB{db}, nil, nil, cfg, logger)
+	go func() {
+		for range dbUpdated {
+		}
+	}()
+
+	request := httptest.NewRequest(http.MethodPost, "/retype/Alloc?type=counter", nil)
+	request.SetBasicAuth("admin", "secret")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, request)
+	result := w.Result()
+	defer result.Body.Close()
+
+	assert.Equal(t, http.StatusInternalServerError, result.StatusCode)
+	assert.Equal(t, "500 - metric type cannot be changed\n", w.Body.String())
+	assert.Equal(t, 1.6, db.ValueFromGouge("Alloc"))
+	assert.False(t, db.NameInCounter("Alloc"))
+}
+
 // seems there is a bug for returning single value
 /*func TestPostHandlerReturnWithPG(t *testing.T) {
 	f := float64(1.5)
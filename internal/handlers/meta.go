@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap"
+
+	"github.com/maffka123/metricCollector/internal/models"
+)
+
+// PutHandlerMeta processes PUT request with json to set description, unit and type of a metric.
+// Name is taken from the path, metadata is kept per name without labels.
+func (mh *MetricHandler) PutHandlerMeta(dbUpdated chan time.Time) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var meta models.Meta
+		if err := json.NewDecoder(r.Body).Decode(&meta); err != nil {
+			http.Error(w, fmt.Sprintf("400 - Metadata json cannot be decoded: %s", err), http.StatusBadRequest)
+			return
+		}
+		meta.Name = chi.URLParam(r, "name")
+		if err := meta.Validate(); err != nil {
+			http.Error(w, fmt.Sprintf("400 - %s", err), http.StatusBadRequest)
+			return
+		}
+		mh.db.InsertMeta(meta)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(meta)
+		mh.logger.Debug("Got metadata: ", zap.String("name", meta.Name))
+		dbUpdated <- time.Now()
+	}
+}
+
+// PutHandlerMetaList processes PUT request with json list to set metadata of many metrics at once.
+// Names are taken from the list, nothing is set if any of metadata is invalid.
+func (mh *MetricHandler) PutHandlerMetaList(dbUpdated chan time.Time) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var metas []models.Meta
+		if err := json.NewDecoder(r.Body).Decode(&metas); err != nil {
+			http.Error(w, fmt.Sprintf("400 - Metadata json cannot be decoded: %s", err), http.StatusBadRequest)
+			return
+		}
+		for i := range metas {
+			if err := metas[i].Validate(); errors.Is(err, models.ErrNoName) {
+				http.Error(w, fmt.Sprintf("400 - %s", err), http.StatusBadRequest)
+				return
+			} else if err != nil {
+				http.Error(w, fmt.Sprintf("400 - %s: %s", metas[i].Name, err), http.StatusBadRequest)
+				return
+			}
+		}
+		for _, meta := range metas {
+			mh.db.InsertMeta(meta)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(metas)
+		mh.logger.Debug("Got metadata list: ", zap.Int("n", len(metas)))
+		dbUpdated <- time.Now()
+	}
+}
+
+// GetHandlerMeta processes GET request to return metadata of a metric.
+func (mh *MetricHandler) GetHandlerMeta() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := chi.URLParam(r, "name")
+		meta, ok := mh.db.SelectMeta(name)
+		if !ok {
+			http.Error(w, "404 - No metadata for "+name, http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(meta)
+	}
+}
+
+// GetHandlerMetaList processes GET request to return metadata of all metrics.
+func (mh *MetricHandler) GetHandlerMetaList() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(mh.db.SelectAllMeta())
+	}
+}
+
+// metaByName collects metadata of all metrics into a map.
+func (mh *MetricHandler) metaByName() map[string]models.Meta {
+	res := map[string]models.Meta{}
+	for _, meta := range mh.db.SelectAllMeta() {
+		res[meta.Name] = meta
+	}
+	return res
+}
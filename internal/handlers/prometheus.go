@@ -0,0 +1,221 @@
+package handlers
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/maffka123/metricCollector/internal/models"
+	"github.com/maffka123/metricCollector/internal/query"
+)
+
+// promSeries is one series of prometheus exposition, histogram takes several lines.
+type promSeries struct {
+	labels map[string]string
+	value  float64
+	hist   *models.Histogram
+}
+
+// promFamily collects all series of one metric name.
+// Source is the metric the family is made of, e.g. "counter a.b" or "rate of a.b", different sources cannot share a family.
+type promFamily struct {
+	name   string
+	mType  string
+	help   string
+	source string
+	series []promSeries
+}
+
+// histogramSuffixes are added to histogram family name for its lines.
+var histogramSuffixes = []string{"_bucket", "_sum", "_count"}
+
+// GetHandlerPrometheus processes GET request to return all metrics in prometheus text format.
+// For every counter its rate and increase within rates window are added as gauges <name>_rate and <name>_increase.
+// Histograms are written with cumulative buckets <name>_bucket, <name>_sum and <name>_count, sets as gauges of their estimates.
+// Info is written like prometheus info metric <name>_info{value="..."} 1.
+// If metric has metadata, its description and unit are written as # HELP.
+// Names which collide after replacing characters prometheus does not allow, or with added gauges and histogram lines,
+// would make the whole exposition invalid, so only the first of them is written, stored metrics go before added gauges.
+func (mh *MetricHandler) GetHandlerPrometheus() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		families := map[string]*promFamily{}
+		metas := mh.metaByName()
+		skipped := map[string]bool{}
+		add := func(name string, mType string, help string, source string, s promSeries) {
+			f, ok := families[name]
+			if !ok && promCollides(families, name, mType) {
+				skipped[source] = true
+				return
+			}
+			if !ok {
+				f = &promFamily{name: name, mType: mType, help: help, source: source}
+				families[name] = f
+			}
+			if f.source != source {
+				skipped[source] = true
+				return
+			}
+			f.series = append(f.series, s)
+		}
+
+		ms := mh.db.SelectMetrics()
+		// the same metric wins a collision every time
+		sort.Slice(ms, func(i, j int) bool {
+			if ms[i].ID == ms[j].ID {
+				return ms[i].MType < ms[j].MType
+			}
+			return ms[i].ID < ms[j].ID
+		})
+		var counters []models.Metrics
+		for _, m := range ms {
+			name, labels, err := models.SplitID(m.ID)
+			if err != nil {
+				continue
+			}
+			meta := metas[name]
+			help := meta.Help()
+			source := m.MType + " " + name
+			name = promName(name)
+			switch m.MType {
+			case "histogram":
+				add(name, "histogram", help, source, promSeries{labels: labels, hist: m.Histogram})
+			case "counter":
+				add(name, "counter", help, source, promSeries{labels: labels, value: float64(*m.Delta)})
+				counters = append(counters, m)
+			case "set":
+				add(name, "gauge", help, source, promSeries{labels: labels, value: float64(m.Set.Estimate())})
+			case "info":
+				if !strings.HasSuffix(name, "_info") {
+					name += "_info"
+				}
+				add(name, "gauge", help, source, promSeries{labels: withLabel(labels, "value", *m.Info), value: 1})
+			default:
+				add(name, "gauge", help, source, promSeries{labels: labels, value: *m.Value})
+			}
+		}
+
+		for _, m := range counters {
+			if mh.rates == nil {
+				break
+			}
+			name, labels, _ := models.SplitID(m.ID)
+			for _, fn := range []string{query.FnRate, query.FnIncrease} {
+				q := query.Query{Fn: fn, Window: mh.rates.Window(), Counters: mh.rates}
+				if v, ok := q.Apply(m.ID); ok {
+					add(promName(name)+"_"+fn, "gauge", "", fn+" of "+name, promSeries{labels: labels, value: v})
+				}
+			}
+		}
+
+		if len(skipped) > 0 {
+			sources := make([]string, 0, len(skipped))
+			for s := range skipped {
+				sources = append(sources, s)
+			}
+			sort.Strings(sources)
+			mh.logger.Warn("Metrics are left out of prometheus exposition, their names collide with other metrics", zap.Strings("metrics", sources))
+		}
+
+		names := make([]string, 0, len(families))
+		for name := range families {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.WriteHeader(http.StatusOK)
+		for _, name := range names {
+			writeFamily(w, families[name])
+		}
+	}
+}
+
+// promCollides checks if new family would write lines with the same names as existing histograms, or the other way round.
+func promCollides(families map[string]*promFamily, name string, mType string) bool {
+	for _, suffix := range histogramSuffixes {
+		if f, ok := families[strings.TrimSuffix(name, suffix)]; ok && f.mType == "histogram" && strings.HasSuffix(name, suffix) {
+			return true
+		}
+		if _, ok := families[name+suffix]; ok && mType == "histogram" {
+			return true
+		}
+	}
+	return false
+}
+
+// writeFamily writes one metric family in prometheus text format.
+func writeFamily(w io.Writer, f *promFamily) {
+	sort.Slice(f.series, func(i, j int) bool { return promLabels(f.series[i].labels) < promLabels(f.series[j].labels) })
+	if f.help != "" {
+		fmt.Fprintf(w, "# HELP %s %s\n", f.name, strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(f.help))
+	}
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.mType)
+	for _, s := range f.series {
+		if s.hist == nil {
+			fmt.Fprintln(w, f.name+promLabels(s.labels)+" "+promValue(s.value))
+			continue
+		}
+		var cumulative uint64
+		for i, c := range s.hist.Counts {
+			cumulative += c
+			le := "+Inf"
+			if i < len(s.hist.Bounds) {
+				le = promValue(s.hist.Bounds[i])
+			}
+			fmt.Fprintln(w, f.name+"_bucket"+promLabels(withLabel(s.labels, "le", le))+" "+strconv.FormatUint(cumulative, 10))
+		}
+		fmt.Fprintln(w, f.name+"_sum"+promLabels(s.labels)+" "+promValue(s.hist.Sum))
+		fmt.Fprintln(w, f.name+"_count"+promLabels(s.labels)+" "+strconv.FormatUint(s.hist.Count, 10))
+	}
+}
+
+// promValue formats float value.
+func promValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// withLabel returns copy of labels with one more label.
+func withLabel(labels map[string]string, k string, v string) map[string]string {
+	res := make(map[string]string, len(labels)+1)
+	for lk, lv := range labels {
+		res[lk] = lv
+	}
+	res[k] = v
+	return res
+}
+
+// promLabels formats labels like {a="1",b="2"}.
+func promLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	for _, k := range keys {
+		pairs = append(pairs, promName(k)+`="`+replacer.Replace(labels[k])+`"`)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// promName replaces characters which are not allowed in prometheus names.
+func promName(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		ok := c == '_' || c == ':' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (i > 0 && c >= '0' && c <= '9')
+		if !ok {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
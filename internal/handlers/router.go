@@ -10,42 +10,125 @@ import (
 	"go.uber.org/zap"
 
 	"crypto/rsa"
+	"github.com/maffka123/metricCollector/internal/audit"
+	"github.com/maffka123/metricCollector/internal/auth"
+	"github.com/maffka123/metricCollector/internal/ingest"
+	"github.com/maffka123/metricCollector/internal/limits"
+	"github.com/maffka123/metricCollector/internal/rates"
+	"github.com/maffka123/metricCollector/internal/replay"
+	"github.com/maffka123/metricCollector/internal/replication"
 	"github.com/maffka123/metricCollector/internal/server/config"
 	"github.com/maffka123/metricCollector/internal/storage"
+	"github.com/maffka123/metricCollector/internal/stream"
 )
 
 // MetricRouter routes the API.
-func MetricRouter(db storage.Repositories, cfg *config.Config, logger *zap.Logger) (chi.Router, chan time.Time) {
+// If ingestion queue is given, all updates go through it, otherwise they are written to db right away.
+// If rates tracker is given, counter rates can be requested from value, query and prometheus endpoints.
+// If limits are configured, metrics over them are not written.
+// Request bodies and batches over configured sizes are rejected with 413.
+// Clients over request rate of ingest or read routes get 429.
+// If trusted subnet is configured, metrics can be written only from it.
+// If hash keys are configured, written metrics must be signed by one of them, read ones are signed by the current one.
+// Signed write requests must be fresh and cannot be sent twice.
+// If API keys are configured, every route except /ping needs a key of read, write or admin scope.
+// Written metrics are published to clients of /stream.
+// If db takes part in replication, replication endpoints are added and updates are allowed only on primary.
+func MetricRouter(db storage.Repositories, queue *ingest.Queue, rates *rates.Tracker, cfg *config.Config, logger *zap.Logger) (chi.Router, chan time.Time) {
 	dbUpdated := make(chan time.Time)
 
 	r := chi.NewRouter()
 	mh := NewMetricHandler(db, logger)
+	mh.queue = queue
+	mh.rates = rates
+	mh.limiter = limits.NewLimiter(db, cfg, logger)
+	mh.staleTTL = cfg.StaleTTL
+	mh.maxBatch = cfg.MaxBatch
+	subnets := NewSubnetMW(cfg.TrustedSubnet, cfg.TrustedProxies)
+	// rate is checked first, so that guessing keys is slow
+	mh.ingestGuard = chain(subnets.checkSubnet, limits.NewRequestLimiter(config.RoutesIngest, cfg, subnets.clientIP, logger).Limit, cfg.APIKeys.Require(auth.ScopeWrite))
+	mh.readGuard = chain(limits.NewRequestLimiter(config.RoutesRead, cfg, subnets.clientIP, logger).Limit, cfg.APIKeys.Require(auth.ScopeRead))
+	requireAdmin := cfg.APIKeys.Require(auth.ScopeAdmin)
+	keys := cfg.HashKeys.Or(cfg.Key)
+	mh.checkSigned = replay.NewGuard(keys, cfg, logger).Check
 	rsaMW := NewRsaMW(rsa.PrivateKey(cfg.CryptoKey))
+	bodyMW := NewBodyMW(cfg.MaxBodySize, cfg.MaxDecodedSize)
+	adminMW := NewAdminMW(cfg.AdminUser, cfg.AdminPassword)
+
+	trail, err := audit.NewTrail(cfg.AuditFile, logger)
+	if err != nil {
+		logger.Error("audit file cannot be opened, audit goes to the log: ", zap.Error(err))
+		trail, _ = audit.NewTrail("", logger)
+	}
+	mh.audit = trail
+	// denied admin requests are audited too
+	adminGuard := Middleware(trail.Guard(chain(requireAdmin, adminMW.checkAdmin)))
+
+	mh.hub = stream.NewHub(cfg, logger)
+	if queue != nil {
+		queue.OnFlush(mh.hub.Publish)
+	}
+
+	checkWritable := Middleware(func(next http.Handler) http.HandlerFunc { return next.ServeHTTP })
+	node, replicated := db.(*replication.Node)
+	if replicated {
+		checkWritable = node.CheckWritable
+	}
 
 	// use inbuild middleware
 	r.Use(middleware.RequestID)
+	// address of the connection is kept for limits and trusted subnet, X-Real-IP is used by them only from trusted proxies
+	r.Use(keepPeer)
 	r.Use(middleware.RealIP)
 	r.Use(middleware.Logger)
 	r.Use(middleware.Recoverer)
 
 	r.Route("/update/", func(r chi.Router) {
-		r.Post("/gauge/*", Conveyor(mh.PostHandlerGouge(dbUpdated), checkForPost, checkForLength, unpackGZIP))
-		r.Post("/counter/*", Conveyor(mh.PostHandlerCounter(dbUpdated), checkForPost, checkForLength, unpackGZIP))
-		r.Post("/*", func(w http.ResponseWriter, r *http.Request) {
+		r.Post("/gauge/*", Conveyor(mh.PostHandlerGouge(dbUpdated), mh.checkSigned, checkForPost, checkForLength, bodyMW.unpack, checkWritable, mh.ingestGuard))
+		r.Post("/counter/*", Conveyor(mh.PostHandlerCounter(dbUpdated), mh.checkSigned, checkForPost, checkForLength, bodyMW.unpack, checkWritable, mh.ingestGuard))
+		r.Post("/*", Conveyor(func(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "501 - Metric type unknown!", http.StatusNotImplemented)
-		})
-		r.Post("/", Conveyor(mh.PostHandlerUpdate(dbUpdated, &cfg.Key), checkForJSON, checkForPost, unpackGZIP))
+		}, mh.ingestGuard))
+		r.Post("/", Conveyor(mh.PostHandlerUpdate(dbUpdated, keys), mh.checkSigned, checkForJSON, checkForPost, bodyMW.unpack, checkWritable, mh.ingestGuard))
 
 	})
 
 	r.Route("/value/", func(r chi.Router) {
-		r.Get("/{type}/{name}", mh.GetHandlerValue())
-		r.Post("/", Conveyor(mh.PostHandlerReturn(&cfg.Key), checkForJSON, checkForPost, packGZIP, unpackGZIP))
+		r.Get("/{type}/{name}", Conveyor(mh.GetHandlerValue(), mh.readGuard))
+		r.Post("/", Conveyor(mh.PostHandlerReturn(keys), checkForJSON, checkForPost, packGZIP, bodyMW.unpack, mh.readGuard))
+		r.Delete("/{type}/{name}", Conveyor(mh.DeleteHandlerValue(dbUpdated), checkWritable, adminGuard))
+		r.Delete("/", Conveyor(mh.DeleteHandlerValues(dbUpdated), checkWritable, adminGuard))
 	})
 
+	r.Post("/values/", Conveyor(mh.PostHandlerValues(keys), checkForJSON, checkForPost, packGZIP, bodyMW.unpack, mh.readGuard))
+
+	r.Route("/meta/", func(r chi.Router) {
+		r.Get("/", Conveyor(mh.GetHandlerMetaList(), mh.readGuard))
+		r.Put("/", Conveyor(mh.PutHandlerMetaList(dbUpdated), mh.checkSigned, checkForJSON, bodyMW.unpack, checkWritable, mh.ingestGuard))
+		r.Get("/{name}", Conveyor(mh.GetHandlerMeta(), mh.readGuard))
+		r.Put("/{name}", Conveyor(mh.PutHandlerMeta(dbUpdated), mh.checkSigned, checkForJSON, bodyMW.unpack, checkWritable, mh.ingestGuard))
+	})
+
+	r.Post("/reset/counter/{name}", Conveyor(mh.PostHandlerResetCounter(dbUpdated), checkWritable, adminGuard))
+	r.Post("/retype/{name}", Conveyor(mh.PostHandlerRetype(dbUpdated), checkWritable, adminGuard))
+
+	if replicated {
+		// replicas apply whatever is sent here, so the routes are closed if neither admin user nor API keys are configured
+		r.Mount("/replication", Conveyor(node.Routes(dbUpdated).ServeHTTP, adminGuard))
+	}
+
+	r.Get("/query", Conveyor(mh.GetHandlerQuery(), packGZIP, mh.readGuard))
+	r.Get("/metrics", Conveyor(mh.GetHandlerPrometheus(), packGZIP, mh.readGuard))
 	r.Get("/ping", mh.GetHandlerPing())
-	r.Post("/updates/", Conveyor(mh.PostHandlerUpdates(dbUpdated, &cfg.Key), checkForJSON, checkForPost, rsaMW.decodeRSA, unpackGZIP))
-	r.Get("/", Conveyor(mh.GetAllNames(), packGZIP))
+	r.Get("/stream", Conveyor(mh.hub.ServeHTTP, mh.readGuard))
+	r.Post("/updates/", Conveyor(mh.PostHandlerUpdates(dbUpdated, keys), mh.checkSigned, checkForJSON, checkForPost, rsaMW.decodeRSA, bodyMW.unpack, checkWritable, mh.ingestGuard))
+	r.Get("/", Conveyor(mh.GetAllNames(), packGZIP, mh.readGuard))
+	// dashboard is the root page, only its static files are served under /dashboard/
+	r.Get("/dashboard", http.RedirectHandler("/", http.StatusMovedPermanently).ServeHTTP)
+	r.Get("/dashboard/", http.RedirectHandler("/", http.StatusMovedPermanently).ServeHTTP)
+	r.Get("/dashboard/*", Conveyor(dashboard(), packGZIP, mh.readGuard))
+
+	r.Mount("/api/v2", mh.APIv2(dbUpdated, keys, bodyMW.unpack, checkWritable))
 
 	return r, dbUpdated
 }
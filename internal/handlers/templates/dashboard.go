@@ -0,0 +1,9 @@
+// Package templates holds static files of the dashboard, which is the root page of the server.
+package templates
+
+import "embed"
+
+// Dashboard holds static files of the dashboard, they are built into the server binary.
+//
+//go:embed dashboard
+var Dashboard embed.FS
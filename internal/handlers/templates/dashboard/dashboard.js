@@ -0,0 +1,264 @@
+// Dashboard loads all metrics from /api/v2 once and then keeps them up to date from /stream.
+// Sparklines start with values the server sampled before the page was opened, from /api/v2/history.
+(function () {
+    "use strict";
+
+    var historySize = 60;
+    var pollInterval = 10000;
+
+    var metrics = {}; // by type and id
+    var meta = {}; // by name without labels
+    var sampled = {}; // values from /api/v2/history by type and id
+    var sort = { key: "name", dir: 1 };
+
+    var tbody = document.getElementById("metrics");
+    var filter = document.getElementById("filter");
+    var typeSelect = document.getElementById("type");
+    var group = document.getElementById("group");
+    var staleOnly = document.getElementById("stale");
+    var status = document.getElementById("status");
+
+    // splitID parses Alloc{agent="a1"} into name and labels.
+    function splitID(id) {
+        var i = id.indexOf("{");
+        if (i < 0 || id[id.length - 1] !== "}") {
+            return { name: id, labels: {} };
+        }
+        var labels = {};
+        var re = /\s*([^=,\s]+)\s*=\s*"((?:[^"\\]|\\.)*)"\s*,?/g;
+        var m;
+        while ((m = re.exec(id.slice(i + 1, -1))) !== null) {
+            labels[m[1]] = m[2].replace(/\\(.)/g, "$1");
+        }
+        return { name: id.slice(0, i), labels: labels };
+    }
+
+    // setEstimate is the same HyperLogLog estimate as models.Set.Estimate.
+    function setEstimate(set) {
+        var regs = atob(set.registers || "");
+        var m = regs.length;
+        if (m === 0) {
+            return 0;
+        }
+        var sum = 0;
+        var zeros = 0;
+        for (var i = 0; i < m; i++) {
+            var r = regs.charCodeAt(i);
+            sum += Math.pow(2, -r);
+            if (r === 0) {
+                zeros++;
+            }
+        }
+        var alpha = { 16: 0.673, 32: 0.697, 64: 0.709 }[m] || 0.7213 / (1 + 1.079 / m);
+        var e = alpha * m * m / sum;
+        if (e <= 2.5 * m && zeros > 0) {
+            e = m * Math.log(m / zeros);
+        }
+        return Math.round(e);
+    }
+
+    // numeric returns value used for sorting and sparklines, info metrics have none.
+    function numeric(m) {
+        switch (m.type) {
+        case "counter":
+            return m.delta;
+        case "gauge":
+            return m.value;
+        case "histogram":
+            return m.histogram.count;
+        case "set":
+            return setEstimate(m.set);
+        }
+        return null;
+    }
+
+    function display(m) {
+        switch (m.type) {
+        case "counter":
+            return String(m.delta);
+        case "gauge":
+            return m.value.toFixed(3);
+        case "histogram":
+            return "count " + m.histogram.count + ", sum " + m.histogram.sum.toFixed(3);
+        case "set":
+            return "~" + setEstimate(m.set);
+        case "info":
+            return m.info;
+        }
+        return "";
+    }
+
+    // update stores new value of a metric and remembers it for the sparkline.
+    function update(m, live) {
+        var key = m.type + ":" + m.id;
+        var row = metrics[key];
+        if (!row) {
+            var parts = splitID(m.id);
+            row = metrics[key] = { id: m.id, name: parts.name, agent: parts.labels.agent || "", type: m.type, history: sampled[key] || [] };
+        }
+        row.metric = m;
+        row.value = numeric(m);
+        row.updated = m.updated_at || "";
+        row.stale = !!m.stale && !live;
+        row.live = live;
+        if (row.value !== null && (row.history.length === 0 || row.updated !== row.lastUpdated)) {
+            row.history.push(row.value);
+            if (row.history.length > historySize) {
+                row.history.shift();
+            }
+        }
+        row.lastUpdated = row.updated;
+    }
+
+    function sparkline(values) {
+        if (values.length < 2) {
+            return "";
+        }
+        var min = Math.min.apply(null, values);
+        var max = Math.max.apply(null, values);
+        var points = values.map(function (v, i) {
+            var x = i / (values.length - 1) * 120;
+            var y = max === min ? 12 : 22 - (v - min) / (max - min) * 20;
+            return x.toFixed(1) + "," + y.toFixed(1);
+        });
+        return '<svg class="spark" viewBox="0 0 120 24"><polyline points="' + points.join(" ") + '"/></svg>';
+    }
+
+    function escapeHTML(s) {
+        return String(s).replace(/[&<>"']/g, function (c) {
+            return { "&": "&amp;", "<": "&lt;", ">": "&gt;", '"': "&quot;", "'": "&#39;" }[c];
+        });
+    }
+
+    // matcher turns filter into a function, glob characters make it a glob, otherwise it is a substring.
+    function matcher(s) {
+        if (s === "") {
+            return function () { return true; };
+        }
+        if (/[*?[]/.test(s)) {
+            var re = new RegExp("^" + s.replace(/[.+^${}()|\\]/g, "\\$&").replace(/\*/g, ".*").replace(/\?/g, ".") + "$");
+            return function (id) { return re.test(id); };
+        }
+        s = s.toLowerCase();
+        return function (id) { return id.toLowerCase().indexOf(s) >= 0; };
+    }
+
+    function compare(a, b) {
+        var x = a[sort.key];
+        var y = b[sort.key];
+        if (x === y) {
+            return a.id < b.id ? -1 : 1;
+        }
+        if (x === null || x === undefined) {
+            return 1;
+        }
+        if (y === null || y === undefined) {
+            return -1;
+        }
+        return (x < y ? -1 : 1) * sort.dir;
+    }
+
+    function render() {
+        var match = matcher(filter.value.trim());
+        var rows = Object.keys(metrics).map(function (k) { return metrics[k]; }).filter(function (r) {
+            return match(r.id) && (typeSelect.value === "" || r.type === typeSelect.value) && (!staleOnly.checked || r.stale);
+        });
+        rows.sort(compare);
+        if (group.checked) {
+            rows.sort(function (a, b) { return a.agent === b.agent ? compare(a, b) : (a.agent < b.agent ? -1 : 1); });
+        }
+
+        var html = [];
+        var agent = null;
+        rows.forEach(function (r) {
+            if (group.checked && r.agent !== agent) {
+                agent = r.agent;
+                html.push('<tr class="group"><td colspan="6">' + escapeHTML(agent || "no agent") + "</td></tr>");
+            }
+            var m = meta[r.name] || {};
+            var help = m.description ? " <small>" + escapeHTML(m.description + (m.unit ? " (" + m.unit + ")" : "")) + "</small>" : "";
+            var cls = (r.stale ? "stale " : "") + (r.live ? "updated" : "");
+            html.push('<tr class="' + cls + '"><td>' + escapeHTML(r.id) + help + "</td><td>" + escapeHTML(r.agent) +
+                "</td><td>" + r.type + '</td><td class="num">' + escapeHTML(display(r.metric)) + "</td><td>" +
+                sparkline(r.history) + "</td><td>" + escapeHTML(r.updated.replace("T", " ").replace(/\..*|Z$/, "")) + "</td></tr>");
+            r.live = false;
+        });
+        tbody.innerHTML = html.join("");
+        document.getElementById("empty").hidden = rows.length > 0;
+    }
+
+    function getJSON(url) {
+        return fetch(url).then(function (resp) { return resp.json(); }).then(function (body) {
+            if (body.error) {
+                throw new Error(body.error.message);
+            }
+            return body.data;
+        });
+    }
+
+    // load gets all metrics, history is needed only when the page is opened.
+    function load(withHistory) {
+        var requests = [getJSON("/api/v2/metrics"), getJSON("/api/v2/meta")];
+        if (withHistory) {
+            requests.push(getJSON("/api/v2/history"));
+        }
+        return Promise.all(requests).then(function (res) {
+            (res[2] || []).forEach(function (h) {
+                sampled[h.type + ":" + h.id] = h.points.map(function (p) { return p.value; }).slice(-historySize);
+            });
+            res[0].forEach(function (m) { update(m, false); });
+            res[1].forEach(function (m) { meta[m.name] = m; });
+            render();
+        }).catch(function (err) {
+            status.textContent = "error: " + err.message;
+        });
+    }
+
+    // listen keeps metrics up to date from the live stream, while it is down metrics are polled.
+    function listen() {
+        var poll = null;
+        var source = new EventSource("/stream");
+        var pending = false;
+        source.addEventListener("open", function () {
+            status.textContent = "live";
+            status.className = "status live";
+            clearInterval(poll);
+            poll = null;
+        });
+        source.addEventListener("metric", function (e) {
+            update(JSON.parse(e.data), true);
+            // render at most once per frame, writes come in batches
+            if (!pending) {
+                pending = true;
+                requestAnimationFrame(function () {
+                    pending = false;
+                    render();
+                });
+            }
+        });
+        source.addEventListener("error", function () {
+            status.textContent = "reconnecting…";
+            status.className = "status";
+            if (poll === null) {
+                poll = setInterval(function () { load(false); }, pollInterval);
+            }
+        });
+    }
+
+    document.querySelectorAll("th[data-key]").forEach(function (th) {
+        th.addEventListener("click", function () {
+            var key = th.getAttribute("data-key");
+            sort.dir = sort.key === key ? -sort.dir : 1;
+            sort.key = key;
+            document.querySelectorAll("th").forEach(function (h) { h.classList.remove("asc", "desc"); });
+            th.classList.add(sort.dir > 0 ? "asc" : "desc");
+            render();
+        });
+    });
+    [filter, typeSelect, group, staleOnly].forEach(function (el) {
+        el.addEventListener("input", render);
+        el.addEventListener("change", render);
+    });
+
+    load(true).then(listen);
+}());
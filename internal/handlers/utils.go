@@ -3,13 +3,22 @@ package handlers
 import (
 	"bytes"
 	"compress/gzip"
+	"compress/zlib"
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"strings"
+
+	"github.com/maffka123/metricCollector/internal/auth"
+	"github.com/maffka123/metricCollector/internal/server/config"
 )
 
 type Middleware func(http.Handler) http.HandlerFunc
@@ -53,30 +62,119 @@ func checkForJSON(next http.Handler) http.HandlerFunc {
 	})
 }
 
-func unpackGZIP(next http.Handler) http.HandlerFunc {
+// errBodyTooLarge is returned when request body is over the configured limit.
+var errBodyTooLarge = errors.New("request body is too large")
+
+// bodyMW limits and decodes request bodies, 0 means no limit.
+type bodyMW struct {
+	maxBody    int64 // bytes as they are sent
+	maxDecoded int64 // bytes after every content coding is decoded
+}
+
+func NewBodyMW(maxBody int64, maxDecoded int64) bodyMW {
+	return bodyMW{
+		maxBody:    maxBody,
+		maxDecoded: maxDecoded,
+	}
+}
+
+// unpack reads body within limits and decodes gzip and deflate content codings in reverse order they are listed,
+// as the last listed coding was applied last. 64base is decoded by decodeRSA, so it is left in Content-Encoding
+// together with codings listed before it.
+func (b bodyMW) unpack(next http.Handler) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		for _, b := range r.Header.Values("Content-Encoding") {
-			if b != "gzip" && b != "64base" {
-				http.Error(w, "Only gzip encoding is allowed", http.StatusMethodNotAllowed)
+		codings := contentCodings(r.Header)
+		for _, c := range codings {
+			if c != "gzip" && c != "x-gzip" && c != "deflate" && c != "64base" {
+				http.Error(w, fmt.Sprintf("415 - Content-Encoding %s is not supported", c), http.StatusUnsupportedMediaType)
 				return
 			}
 		}
-		if len(r.Header.Values("Content-Encoding")) == 0 ||
-			(len(r.Header.Values("Content-Encoding")) == 1 && r.Header.Get("Content-Encoding") == "64base") {
-			next.ServeHTTP(w, r)
+
+		body, err := readGuarded(r.Body, b.maxBody)
+		if errors.Is(err, errBodyTooLarge) {
+			http.Error(w, fmt.Sprintf("413 - Request body is larger than %d bytes", b.maxBody), http.StatusRequestEntityTooLarge)
 			return
 		}
-
-		rw, err := gzip.NewReader(r.Body)
 		if err != nil {
-			io.WriteString(w, err.Error())
+			http.Error(w, fmt.Sprintf("400 - Body cannot be read: %s", err), http.StatusBadRequest)
 			return
 		}
-		r.Body = rw
+
+		for len(codings) > 0 && codings[len(codings)-1] != "64base" {
+			body, err = decodeBody(codings[len(codings)-1], body, b.maxDecoded)
+			if errors.Is(err, errBodyTooLarge) {
+				http.Error(w, fmt.Sprintf("413 - Decoded request body is larger than %d bytes", b.maxDecoded), http.StatusRequestEntityTooLarge)
+				return
+			}
+			if err != nil {
+				http.Error(w, fmt.Sprintf("400 - Body cannot be decoded: %s", err), http.StatusBadRequest)
+				return
+			}
+			codings = codings[:len(codings)-1]
+		}
+
+		setContentCodings(r.Header, codings)
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
 		next.ServeHTTP(w, r)
 	})
 }
 
+// contentCodings returns all codings from Content-Encoding headers in the order they are listed, identity is skipped.
+func contentCodings(h http.Header) []string {
+	var codings []string
+	for _, v := range h.Values("Content-Encoding") {
+		for _, c := range strings.Split(v, ",") {
+			c = strings.ToLower(strings.TrimSpace(c))
+			if c != "" && c != "identity" {
+				codings = append(codings, c)
+			}
+		}
+	}
+	return codings
+}
+
+// setContentCodings replaces Content-Encoding with codings which are not decoded yet.
+func setContentCodings(h http.Header, codings []string) {
+	if len(codings) == 0 {
+		h.Del("Content-Encoding")
+		return
+	}
+	h.Set("Content-Encoding", strings.Join(codings, ", "))
+}
+
+// decodeBody decodes one gzip or deflate coding, decoded body cannot be larger than limit.
+func decodeBody(coding string, body []byte, limit int64) ([]byte, error) {
+	var rc io.ReadCloser
+	var err error
+	if coding == "deflate" {
+		rc, err = zlib.NewReader(bytes.NewReader(body))
+	} else {
+		rc, err = gzip.NewReader(bytes.NewReader(body))
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return readGuarded(rc, limit)
+}
+
+// readGuarded reads everything, but not more than limit bytes, 0 means no limit.
+func readGuarded(r io.Reader, limit int64) ([]byte, error) {
+	if limit <= 0 {
+		return ioutil.ReadAll(r)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > limit {
+		return nil, errBodyTooLarge
+	}
+	return body, nil
+}
+
 type rsaMW struct {
 	key *rsa.PrivateKey
 }
@@ -87,32 +185,67 @@ func NewRsaMW(key rsa.PrivateKey) rsaMW {
 	}
 }
 
+// decodeRSA decrypts body if 64base is the last coding left in Content-Encoding, it runs after bodyMW.unpack.
 func (rsaMW rsaMW) decodeRSA(next http.Handler) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		for _, b := range r.Header.Values("Content-Encoding") {
-			if b != "gzip" && b != "64base" {
-				http.Error(w, "Only 64base encoding is allowed", http.StatusMethodNotAllowed)
-				return
-			}
-		}
-		if len(r.Header.Values("Content-Encoding")) == 0 ||
-			(len(r.Header.Values("Content-Encoding")) == 1 && r.Header.Get("Content-Encoding") == "gzip") {
+		codings := contentCodings(r.Header)
+		if len(codings) == 0 {
 			next.ServeHTTP(w, r)
 			return
 		}
+		if codings[len(codings)-1] != "64base" {
+			http.Error(w, "415 - Only 64base encoding is allowed", http.StatusUnsupportedMediaType)
+			return
+		}
 
 		body, err := ioutil.ReadAll(r.Body)
 		if err != nil {
-			io.WriteString(w, err.Error())
+			http.Error(w, fmt.Sprintf("400 - Body cannot be read: %s", err), http.StatusBadRequest)
 			return
 		}
 		hash := sha256.New()
 		drb, err := rsa.DecryptOAEP(hash, rand.Reader, rsaMW.key, body, nil)
 		if err != nil {
-			io.WriteString(w, err.Error())
+			http.Error(w, fmt.Sprintf("400 - Body cannot be decrypted: %s", err), http.StatusBadRequest)
+			return
+		}
+		setContentCodings(r.Header, codings[:len(codings)-1])
+		r.Body = ioutil.NopCloser(bytes.NewReader(drb))
+		next.ServeHTTP(w, r)
+	})
+}
+
+type adminMW struct {
+	user     string
+	password string
+}
+
+func NewAdminMW(user string, password string) adminMW {
+	return adminMW{
+		user:     user,
+		password: password,
+	}
+}
+
+// checkAdmin lets through only requests with admin credentials in basic auth, or with API key already checked for admin scope.
+func (a adminMW) checkAdmin(next http.Handler) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := auth.ClientFrom(r.Context()); ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if a.user == "" {
+			http.Error(w, "403 - Admin operations are disabled", http.StatusForbidden)
+			return
+		}
+		user, password, ok := r.BasicAuth()
+		if !ok ||
+			subtle.ConstantTimeCompare([]byte(user), []byte(a.user)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(password), []byte(a.password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="admin"`)
+			http.Error(w, "401 - Admin credentials required", http.StatusUnauthorized)
 			return
 		}
-		r.Body = ioutil.NopCloser(bytes.NewBufferString(string(drb)))
 		next.ServeHTTP(w, r)
 	})
 }
@@ -136,6 +269,75 @@ func packGZIP(next http.Handler) http.HandlerFunc {
 	})
 }
 
+type peerKey struct{}
+
+// keepPeer remembers address of the connection, before middleware.RealIP replaces it with one from client headers.
+func keepPeer(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), peerKey{}, r.RemoteAddr)))
+	})
+}
+
+// peerIP returns ip of the connection remembered by keepPeer, it cannot be changed by client headers.
+func peerIP(r *http.Request) string {
+	addr, ok := r.Context().Value(peerKey{}).(string)
+	if !ok {
+		addr = r.RemoteAddr
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+type subnetMW struct {
+	trusted config.Subnets
+	proxies config.Subnets
+}
+
+func NewSubnetMW(trusted config.Subnets, proxies config.Subnets) subnetMW {
+	return subnetMW{trusted: trusted, proxies: proxies}
+}
+
+// checkSubnet lets through only requests from trusted subnets, everything is let through if none are configured.
+// Address of the connection is checked, X-Real-IP is used instead only if connection comes from a trusted proxy,
+// so that clients cannot pretend to be in trusted subnet.
+func (s subnetMW) checkSubnet(next http.Handler) http.HandlerFunc {
+	if len(s.trusted) == 0 {
+		return next.ServeHTTP
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		addr := s.clientIP(r)
+		ip := net.ParseIP(addr)
+		if ip == nil || !s.trusted.Contains(ip) {
+			http.Error(w, fmt.Sprintf("403 - Address %s is not in trusted subnet", addr), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+// clientIP returns address of the connection, or X-Real-IP if the connection comes from a trusted proxy.
+func (s subnetMW) clientIP(r *http.Request) string {
+	addr := peerIP(r)
+	if forwarded := r.Header.Get("X-Real-IP"); forwarded != "" && s.proxies.Contains(net.ParseIP(addr)) {
+		return strings.TrimSpace(forwarded)
+	}
+	return addr
+}
+
+// chain makes one middleware of many, the first one runs first.
+func chain(middlewares ...Middleware) Middleware {
+	return func(next http.Handler) http.HandlerFunc {
+		h := http.HandlerFunc(next.ServeHTTP)
+		for i := len(middlewares) - 1; i >= 0; i-- {
+			h = middlewares[i](h)
+		}
+		return h
+	}
+}
+
 func Conveyor(h http.HandlerFunc, middlewares ...Middleware) http.HandlerFunc {
 	for _, middleware := range middlewares {
 		h = middleware(h)
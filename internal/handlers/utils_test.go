@@ -3,6 +3,7 @@ package handlers
 import (
 	"bytes"
 	"compress/gzip"
+	"compress/zlib"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
@@ -15,6 +16,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -117,65 +119,86 @@ func Test_checkForPost(t *testing.T) {
 	}
 }
 
-func Test_unpackGZIP(t *testing.T) {
-	type args struct {
-		next http.Handler
-	}
-	type want struct {
-		status int
-		body   string
-	}
+func Test_bodyMW_unpack(t *testing.T) {
+	echo := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Content-Encoding", r.Header.Get("Content-Encoding"))
+		w.WriteHeader(http.StatusOK)
+		io.Copy(w, r.Body)
+	})
+	body := `{"some": "stuff"}`
+	bomb := gzData(strings.Repeat("0", 64<<10))
+
 	tests := []struct {
-		name    string
-		args    args
-		want    want
-		request *http.Request
-		header  string
+		name      string
+		body      io.Reader
+		encodings []string
+		status    int
+		want      string
+		wantLeft  string
 	}{
-		{name: "fail", args: args{
-			next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) }),
-		},
-			want:    want{status: 405, body: "Only gzip encoding is allowed\n"},
-			request: httptest.NewRequest(http.MethodPost, "/update/", nil),
-			header:  "something"},
-		{name: "success", args: args{
-			next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				w.WriteHeader(http.StatusOK)
-				defer r.Body.Close()
-				bodyBytes, err := io.ReadAll(r.Body)
-				if err != nil {
-					fmt.Println(err)
-					os.Exit(1)
-				}
-				w.Write(bodyBytes)
-			}),
-		},
-			want:    want{status: 200, body: `{"some": "stuff"}`},
-			request: httptest.NewRequest(http.MethodPost, "/update/", gzData(`{"some": "stuff"}`)),
-			header:  "gzip"},
+		{name: "fail", body: strings.NewReader(body), encodings: []string{"something"},
+			status: 415, want: "415 - Content-Encoding something is not supported\n"},
+		{name: "plain", body: strings.NewReader(body), status: 200, want: body},
+		{name: "identity", body: strings.NewReader(body), encodings: []string{"identity"}, status: 200, want: body},
+		{name: "gzip", body: gzData(body), encodings: []string{"gzip"}, status: 200, want: body},
+		{name: "deflate", body: deflateData(body), encodings: []string{"deflate"}, status: 200, want: body},
+		{name: "stacked in one header", body: deflateData(gzData(body).String()), encodings: []string{"gzip, deflate"},
+			status: 200, want: body},
+		{name: "stacked in two headers", body: gzData(deflateData(body).String()), encodings: []string{"deflate", "gzip"},
+			status: 200, want: body},
+		{name: "wrong order", body: deflateData(gzData(body).String()), encodings: []string{"deflate", "gzip"},
+			status: 400, want: "400 - Body cannot be decoded: gzip: invalid header\n"},
+		{name: "64base is left", body: gzData(body), encodings: []string{"64base", "gzip"},
+			status: 200, want: body, wantLeft: "64base"},
+		{name: "too large", body: strings.NewReader(strings.Repeat("0", 1025)),
+			status: 413, want: "413 - Request body is larger than 1024 bytes\n"},
+		{name: "bomb", body: bomb, encodings: []string{"gzip"},
+			status: 413, want: "413 - Decoded request body is larger than 4096 bytes\n"},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			request := tt.request
-			request.Header.Set("Content-Encoding", tt.header)
+			request := httptest.NewRequest(http.MethodPost, "/update/", tt.body)
+			for _, e := range tt.encodings {
+				request.Header.Add("Content-Encoding", e)
+			}
 			w := httptest.NewRecorder()
-			h := http.HandlerFunc(unpackGZIP(tt.args.next))
-			h.ServeHTTP(w, request)
-			result := w.Result()
-			defer result.Body.Close()
+			NewBodyMW(1024, 4096).unpack(echo).ServeHTTP(w, request)
 
-			bodyBytes, err := io.ReadAll(result.Body)
-			if err != nil {
-				fmt.Println(err)
+			assert.Equal(t, tt.status, w.Code)
+			assert.Equal(t, tt.want, w.Body.String())
+			if tt.status == http.StatusOK {
+				assert.Equal(t, tt.wantLeft, w.Header().Get("X-Content-Encoding"))
 			}
-			bodyString := string(bodyBytes)
-
-			assert.Equal(t, tt.want.status, result.StatusCode)
-			assert.Equal(t, tt.want.body, bodyString)
 		})
 	}
 }
 
+func Test_readGuarded(t *testing.T) {
+	b, err := readGuarded(strings.NewReader("12345"), 5)
+	assert.NoError(t, err)
+	assert.Equal(t, "12345", string(b))
+
+	_, err = readGuarded(strings.NewReader("123456"), 5)
+	assert.ErrorIs(t, err, errBodyTooLarge)
+
+	b, err = readGuarded(strings.NewReader("123456"), 0)
+	assert.NoError(t, err)
+	assert.Equal(t, "123456", string(b))
+}
+
+func deflateData(s string) *bytes.Buffer {
+	var buf bytes.Buffer
+	z := zlib.NewWriter(&buf)
+	if _, err := z.Write([]byte(s)); err != nil {
+		fmt.Println(err)
+	}
+	if err := z.Close(); err != nil {
+		fmt.Println(err)
+	}
+
+	return &buf
+}
+
 func gzData(s string) *bytes.Buffer {
 	var buf bytes.Buffer
 	g := gzip.NewWriter(&buf)
@@ -207,9 +230,9 @@ func Test_decodeRSA(t *testing.T) {
 		{name: "fail", args: args{
 			next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) }),
 		},
-			want:    want{status: 405, body: "Only gzip encoding is allowed\n"},
-			request: httptest.NewRequest(http.MethodPost, "/update/", nil),
-			header:  "something"},
+			want:    want{status: 400, body: "400 - Body cannot be decrypted: crypto/rsa: decryption error\n"},
+			request: httptest.NewRequest(http.MethodPost, "/update/", gzData2(rsaEncodedData(`{"some": "stuff"}`))),
+			header:  "gzip, 64base"},
 		{name: "success", args: args{
 			next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 				w.WriteHeader(http.StatusOK)
@@ -224,7 +247,7 @@ func Test_decodeRSA(t *testing.T) {
 		},
 			want:    want{status: 200, body: `{"some": "stuff"}`},
 			request: httptest.NewRequest(http.MethodPost, "/update/", gzData2(rsaEncodedData(`{"some": "stuff"}`))),
-			header:  "gzip"},
+			header:  "64base, gzip"},
 		{name: "simple success", args: args{
 			next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 				w.WriteHeader(http.StatusOK)
@@ -239,19 +262,15 @@ func Test_decodeRSA(t *testing.T) {
 		},
 			want:    want{status: 200, body: `{"some": "stuff"}`},
 			request: httptest.NewRequest(http.MethodPost, "/update/", bytes.NewBuffer(rsaEncodedData(`{"some": "stuff"}`))),
-			header:  ""},
+			header:  "64base"},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			request := tt.request
-			if tt.header != "" {
-				request.Header.Add("Content-Encoding", tt.header)
-			}
-
-			request.Header.Add("Content-Encoding", "64base")
+			request.Header.Set("Content-Encoding", tt.header)
 			w := httptest.NewRecorder()
 			rsaMW := NewRsaMW(rsa.PrivateKey(getPrivKey()))
-			h := http.HandlerFunc(unpackGZIP(rsaMW.decodeRSA(tt.args.next)))
+			h := NewBodyMW(0, 0).unpack(rsaMW.decodeRSA(tt.args.next))
 			h.ServeHTTP(w, request)
 			result := w.Result()
 			defer result.Body.Close()
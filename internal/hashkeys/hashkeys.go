@@ -0,0 +1,306 @@
+// Package hashkeys holds keys for metric hashes.
+// Every key has an id which is written into the hash, so that several keys can be active at once
+// and a key can be rotated without restarting agents and server together.
+package hashkeys
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/maffka123/metricCollector/internal/models"
+)
+
+// Errors of Verify and VerifyRequest.
+var (
+	ErrUnknownKey = errors.New("unknown hash key")
+	ErrMismatch   = errors.New("hashes do not agree")
+)
+
+// Headers of request signature, server tells in RejectHeader why it rejected a signed request, e.g. stale or replayed.
+const (
+	TimestampHeader = "X-Timestamp"
+	NonceHeader     = "X-Nonce"
+	SignatureHeader = "X-Signature"
+	RejectHeader    = "X-Reject-Reason"
+)
+
+// Key is a secret for metric hashes, it has no id if it is given as single -k key.
+type Key struct {
+	ID     string `json:"id"`
+	Secret string `json:"key"`
+}
+
+// Ring holds active keys, the first one is current and signs metrics, all of them are accepted.
+// Copies of a ring share its keys, so a ring reloaded from its file is reloaded everywhere.
+// Zero Ring has no keys, nothing is signed and everything is accepted then.
+type Ring struct {
+	s *state
+}
+
+type state struct {
+	mu   sync.RWMutex
+	file string
+	keys []Key
+}
+
+// New makes ring of given keys, keys without secret are left out.
+func New(keys ...Key) Ring {
+	var active []Key
+	for _, k := range keys {
+		if k.Secret != "" {
+			active = append(active, k)
+		}
+	}
+	if len(active) == 0 {
+		return Ring{}
+	}
+	return Ring{s: &state{keys: active}}
+}
+
+// Load reads keys file, which is json array like [{"id": "2024-10", "key": "..."}, {"id": "2024-07", "key": "..."}].
+// The first key is current, the rest are previous ones which are still accepted.
+func Load(file string) (Ring, error) {
+	keys, err := readKeys(file)
+	if err != nil {
+		return Ring{}, err
+	}
+	return Ring{s: &state{file: file, keys: keys}}, nil
+}
+
+func readKeys(file string) ([]Key, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var keys []Key
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("hash keys file cannot be decoded: %w", err)
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("hash keys file has no keys")
+	}
+	seen := make(map[string]bool, len(keys))
+	for i, k := range keys {
+		if k.ID == "" || k.Secret == "" {
+			return nil, fmt.Errorf("hash key %d has no id or no key", i)
+		}
+		if strings.Contains(k.ID, ":") {
+			return nil, fmt.Errorf("hash key id %q cannot contain ':'", k.ID)
+		}
+		if seen[k.ID] {
+			return nil, fmt.Errorf("hash key %s is given twice", k.ID)
+		}
+		seen[k.ID] = true
+	}
+	return keys, nil
+}
+
+// Reload reads keys file again, the ring keeps its keys if the file cannot be read. Rings without file are not changed.
+func (r Ring) Reload() error {
+	if r.s == nil || r.s.file == "" {
+		return nil
+	}
+	keys, err := readKeys(r.s.file)
+	if err != nil {
+		return err
+	}
+	r.s.mu.Lock()
+	r.s.keys = keys
+	r.s.mu.Unlock()
+	return nil
+}
+
+// Watch reloads the ring every time a signal comes from c, e.g. SIGHUP, until c is closed.
+func (r Ring) Watch(c <-chan os.Signal, logger *zap.Logger) {
+	for range c {
+		if err := r.Reload(); err != nil {
+			logger.Error("hash keys cannot be reloaded, old keys stay: ", zap.Error(err))
+			continue
+		}
+		logger.Info("hash keys reloaded", zap.Strings("ids", r.IDs()))
+	}
+}
+
+// Or returns the ring if it has keys, otherwise a ring with single key without id, as it is given in -k.
+func (r Ring) Or(secret string) Ring {
+	if r.Enabled() {
+		return r
+	}
+	return New(Key{Secret: secret})
+}
+
+func (r Ring) String() string {
+	if r.s == nil {
+		return ""
+	}
+	return r.s.file
+}
+
+// Set loads keys from file given in flag.
+func (r *Ring) Set(file string) error {
+	if file == "" {
+		*r = Ring{}
+		return nil
+	}
+	loaded, err := Load(file)
+	if err != nil {
+		return err
+	}
+	*r = loaded
+	return nil
+}
+
+// UnmarshalText loads keys from file given in env variable or config file.
+func (r *Ring) UnmarshalText(text []byte) error {
+	return r.Set(string(text))
+}
+
+// Enabled checks if ring has any keys.
+func (r Ring) Enabled() bool {
+	return r.s != nil
+}
+
+// Current returns key which signs metrics.
+func (r Ring) Current() (Key, bool) {
+	if r.s == nil {
+		return Key{}, false
+	}
+	r.s.mu.RLock()
+	defer r.s.mu.RUnlock()
+	return r.s.keys[0], true
+}
+
+// IDs returns ids of active keys, current first.
+func (r Ring) IDs() []string {
+	if r.s == nil {
+		return nil
+	}
+	r.s.mu.RLock()
+	defer r.s.mu.RUnlock()
+	ids := make([]string, len(r.s.keys))
+	for i, k := range r.s.keys {
+		ids[i] = k.ID
+	}
+	return ids
+}
+
+// Sign calculates hash of the metric with current key.
+func (r Ring) Sign(m *models.Metrics) {
+	k, ok := r.Current()
+	if !ok {
+		return
+	}
+	if k.ID == "" {
+		m.CalcHash(k.Secret)
+		return
+	}
+	m.CalcHashWithID(k.ID, k.Secret)
+}
+
+// Verify checks hash of the metric with the key which id is in the hash.
+// Hash without id, as older agents send, is checked with every active key.
+func (r Ring) Verify(m *models.Metrics) error {
+	if r.s == nil {
+		return nil
+	}
+	r.s.mu.RLock()
+	defer r.s.mu.RUnlock()
+
+	id := m.HashKeyID()
+	for _, k := range r.s.keys {
+		if id != "" && k.ID != id {
+			continue
+		}
+		if m.CompareHash(k.Secret) == nil {
+			return nil
+		}
+		if id != "" {
+			return ErrMismatch
+		}
+	}
+	if id != "" {
+		return fmt.Errorf("%w %s", ErrUnknownKey, id)
+	}
+	return ErrMismatch
+}
+
+// SignRequest signs request method, uri and body together with current time and a random nonce, so that server can reject
+// replayed requests. Body is signed as it is before compression and encryption. Nothing is done if ring has no keys.
+func (r Ring) SignRequest(req *http.Request, body []byte, now time.Time) error {
+	k, ok := r.Current()
+	if !ok {
+		return nil
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	ts := strconv.FormatInt(now.Unix(), 10)
+	nonce := hex.EncodeToString(b)
+	sig := requestHash(k.Secret, req.Method, req.URL.RequestURI(), ts, nonce, body)
+	if k.ID != "" {
+		sig = k.ID + ":" + sig
+	}
+	req.Header.Set(TimestampHeader, ts)
+	req.Header.Set(NonceHeader, nonce)
+	req.Header.Set(SignatureHeader, sig)
+	return nil
+}
+
+// VerifyRequest checks request signature with the key which id is in the signature, signature without id is checked with every key.
+// Timestamp and nonce are only checked to be covered by the signature, it is up to caller to check if they are fresh.
+func (r Ring) VerifyRequest(req *http.Request, body []byte) error {
+	if r.s == nil {
+		return nil
+	}
+	h := req.Header
+	sig := h.Get(SignatureHeader)
+	id := ""
+	if i := strings.LastIndex(sig, ":"); i >= 0 {
+		id, sig = sig[:i], sig[i+1:]
+	}
+	got, err := hex.DecodeString(sig)
+	if err != nil {
+		return ErrMismatch
+	}
+
+	r.s.mu.RLock()
+	defer r.s.mu.RUnlock()
+	known := false
+	for _, k := range r.s.keys {
+		if id != "" && k.ID != id {
+			continue
+		}
+		known = true
+		want, _ := hex.DecodeString(requestHash(k.Secret, req.Method, req.URL.RequestURI(), h.Get(TimestampHeader), h.Get(NonceHeader), body))
+		if hmac.Equal(got, want) {
+			return nil
+		}
+	}
+	if !known {
+		return fmt.Errorf("%w %s", ErrUnknownKey, id)
+	}
+	return ErrMismatch
+}
+
+// requestHash is hmac of method, uri, timestamp, nonce and sha256 of the body.
+func requestHash(secret, method, uri, ts, nonce string, body []byte) string {
+	sum := sha256.Sum256(body)
+	h := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(h, "%s\n%s\n%s\n%s\n%x", method, uri, ts, nonce, sum)
+	return hex.EncodeToString(h.Sum(nil))
+}
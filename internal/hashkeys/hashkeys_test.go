@@ -0,0 +1,194 @@
+package hashkeys
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/maffka123/metricCollector/internal/models"
+)
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{name: "bad json", content: `{`, wantErr: "hash keys file cannot be decoded"},
+		{name: "empty", content: `[]`, wantErr: "hash keys file has no keys"},
+		{name: "no id", content: `[{"key": "s"}]`, wantErr: "hash key 0 has no id or no key"},
+		{name: "bad id", content: `[{"id": "a:b", "key": "s"}]`, wantErr: `hash key id "a:b" cannot contain ':'`},
+		{name: "same id", content: `[{"id": "k1", "key": "s"}, {"id": "k1", "key": "t"}]`, wantErr: "hash key k1 is given twice"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(dir, "keys.json")
+			require.NoError(t, ioutil.WriteFile(file, []byte(tt.content), 0600))
+			_, err := Load(file)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.wantErr)
+		})
+	}
+
+	r, err := Load("testdata/keys.json")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"k2", "k1"}, r.IDs())
+	k, ok := r.Current()
+	assert.True(t, ok)
+	assert.Equal(t, Key{ID: "k2", Secret: "new-secret"}, k)
+}
+
+func TestRing_Verify(t *testing.T) {
+	var r Ring
+	require.NoError(t, r.Set("testdata/keys.json"))
+	gauge := func(hash string) *models.Metrics {
+		v := 0.5
+		return &models.Metrics{ID: "Alloc", MType: "gauge", Value: &v, Hash: hash}
+	}
+	signed := func(id, secret string) string {
+		m := gauge("")
+		if id == "" {
+			m.CalcHash(secret)
+		} else {
+			m.CalcHashWithID(id, secret)
+		}
+		return m.Hash
+	}
+
+	tests := []struct {
+		name    string
+		hash    string
+		wantErr error
+	}{
+		{name: "current", hash: signed("k2", "new-secret")},
+		{name: "previous", hash: signed("k1", "old-secret")},
+		{name: "without id", hash: signed("", "old-secret")},
+		{name: "wrong secret", hash: signed("k2", "old-secret"), wantErr: ErrMismatch},
+		{name: "unknown id", hash: signed("k0", "older-secret"), wantErr: ErrUnknownKey},
+		{name: "without id unknown secret", hash: signed("", "older-secret"), wantErr: ErrMismatch},
+		{name: "no hash", wantErr: ErrMismatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := r.Verify(gauge(tt.hash))
+			if tt.wantErr == nil {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorIs(t, err, tt.wantErr)
+		})
+	}
+
+	// without keys nothing is signed and everything is accepted
+	m := gauge("")
+	Ring{}.Sign(m)
+	assert.Equal(t, "", m.Hash)
+	assert.NoError(t, Ring{}.Verify(gauge("whatever")))
+
+	r.Sign(m)
+	assert.Equal(t, "k2", m.HashKeyID())
+	assert.Equal(t, signed("k2", "new-secret"), m.Hash)
+}
+
+func TestRing_Reload(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "keys.json")
+	require.NoError(t, ioutil.WriteFile(file, []byte(`[{"id": "k1", "key": "old-secret"}]`), 0600))
+	r, err := Load(file)
+	require.NoError(t, err)
+	// copies share keys
+	c := r
+
+	require.NoError(t, ioutil.WriteFile(file, []byte(`[{"id": "k2", "key": "new-secret"}, {"id": "k1", "key": "old-secret"}]`), 0600))
+	require.NoError(t, r.Reload())
+	assert.Equal(t, []string{"k2", "k1"}, c.IDs())
+
+	// broken file does not drop keys
+	require.NoError(t, ioutil.WriteFile(file, []byte(`[`), 0600))
+	assert.Error(t, r.Reload())
+	assert.Equal(t, []string{"k2", "k1"}, c.IDs())
+
+	// single key from -k is used only without file
+	assert.Equal(t, []string{"k2", "k1"}, r.Or("secret").IDs())
+	k, _ := Ring{}.Or("secret").Current()
+	assert.Equal(t, Key{Secret: "secret"}, k)
+	assert.False(t, Ring{}.Or("").Enabled())
+}
+
+func TestRing_SignRequest(t *testing.T) {
+	r, err := Load("testdata/keys.json")
+	require.NoError(t, err)
+	body := []byte(`[{"id":"Alloc","type":"gauge","value":0.5}]`)
+	now := time.Unix(1700000000, 0)
+
+	req := httptest.NewRequest(http.MethodPost, "/updates/", nil)
+	require.NoError(t, r.SignRequest(req, body, now))
+	h := req.Header
+	assert.Equal(t, "1700000000", h.Get(TimestampHeader))
+	assert.Len(t, h.Get(NonceHeader), 32)
+	assert.True(t, strings.HasPrefix(h.Get(SignatureHeader), "k2:"))
+	assert.NoError(t, r.VerifyRequest(req, body))
+
+	// nonces are random
+	other := httptest.NewRequest(http.MethodPost, "/updates/", nil)
+	require.NoError(t, r.SignRequest(other, body, now))
+	assert.NotEqual(t, h.Get(NonceHeader), other.Header.Get(NonceHeader))
+
+	tests := []struct {
+		name    string
+		method  string
+		uri     string
+		change  func(h http.Header)
+		body    []byte
+		wantErr error
+	}{
+		{name: "other body", change: func(h http.Header) {}, body: []byte(`[]`), wantErr: ErrMismatch},
+		{name: "other timestamp", change: func(h http.Header) { h.Set(TimestampHeader, "1700000001") }, body: body, wantErr: ErrMismatch},
+		{name: "other path", uri: "/update/counter/PollCount/1", change: func(h http.Header) {}, body: body, wantErr: ErrMismatch},
+		{name: "other query", uri: "/updates/?id=a1", change: func(h http.Header) {}, body: body, wantErr: ErrMismatch},
+		{name: "other method", method: http.MethodPut, change: func(h http.Header) {}, body: body, wantErr: ErrMismatch},
+		{name: "other nonce", change: func(h http.Header) { h.Set(NonceHeader, "00") }, body: body, wantErr: ErrMismatch},
+		{name: "unknown key", change: func(h http.Header) {
+			h.Set(SignatureHeader, "k0"+strings.TrimPrefix(h.Get(SignatureHeader), "k2"))
+		}, body: body, wantErr: ErrUnknownKey},
+		{name: "previous key", change: func(h http.Header) {
+			h.Set(SignatureHeader, "k1:"+requestHash("old-secret", http.MethodPost, "/updates/", h.Get(TimestampHeader), h.Get(NonceHeader), body))
+		}, body: body},
+		{name: "without id", change: func(h http.Header) {
+			h.Set(SignatureHeader, requestHash("old-secret", http.MethodPost, "/updates/", h.Get(TimestampHeader), h.Get(NonceHeader), body))
+		}, body: body},
+		{name: "not hex", change: func(h http.Header) { h.Set(SignatureHeader, "k2:zz") }, body: body, wantErr: ErrMismatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method, uri := http.MethodPost, "/updates/"
+			if tt.method != "" {
+				method = tt.method
+			}
+			if tt.uri != "" {
+				uri = tt.uri
+			}
+			c := httptest.NewRequest(method, uri, nil)
+			c.Header = h.Clone()
+			tt.change(c.Header)
+			err := r.VerifyRequest(c, tt.body)
+			if tt.wantErr == nil {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorIs(t, err, tt.wantErr)
+		})
+	}
+
+	// without keys nothing is signed
+	req = httptest.NewRequest(http.MethodPost, "/updates/", nil)
+	require.NoError(t, Ring{}.SignRequest(req, body, now))
+	assert.Empty(t, req.Header)
+}
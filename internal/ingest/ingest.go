@@ -0,0 +1,248 @@
+// Package ingest implements asynchronous ingestion queue between handlers and storage.
+// Handlers put validated metrics into the queue and a pool of writers flushes them to db in groups,
+// either when enough metrics are collected or when flush interval is over.
+// Metrics of one name always go to the same writer, so they are written in the order they were put.
+package ingest
+
+import (
+	"errors"
+	"hash/fnv"
+	"math"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/maffka123/metricCollector/internal/models"
+	"github.com/maffka123/metricCollector/internal/server/config"
+	"github.com/maffka123/metricCollector/internal/storage"
+)
+
+// ErrQueueFull is returned when there is no more place in the queue, client should retry later.
+var ErrQueueFull = errors.New("ingestion queue is full")
+
+// ErrQueueClosed is returned when queue does not accept metrics anymore.
+var ErrQueueClosed = errors.New("ingestion queue is closed")
+
+// Queue type holds metrics waiting to be written to db.
+type Queue struct {
+	db        storage.Repositories
+	chs       []chan []models.Metrics // one per writer
+	batchSize int
+	interval  time.Duration
+	log       *zap.Logger
+	wg        sync.WaitGroup
+	mu        sync.RWMutex
+	closed    bool
+	onFlush   func([]models.Metrics)
+	pending   map[string]queuedType
+}
+
+// queuedType is type of metrics of one name which wait in the queue and how many of them wait.
+type queuedType struct {
+	mType string
+	n     int
+}
+
+// NewQueue initializes queue, writers are not started yet.
+func NewQueue(db storage.Repositories, cfg *config.Config, logger *zap.Logger) *Queue {
+	q := Queue{
+		db:        db,
+		batchSize: cfg.BatchSize,
+		interval:  cfg.FlushInterval,
+		log:       logger,
+		pending:   map[string]queuedType{},
+	}
+	workers := cfg.QueueWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	q.chs = make([]chan []models.Metrics, workers)
+	for i := range q.chs {
+		q.chs[i] = make(chan []models.Metrics, cfg.QueueSize)
+	}
+	if q.batchSize < 1 {
+		q.batchSize = 1
+	}
+	if q.interval <= 0 {
+		q.interval = 100 * time.Millisecond
+	}
+	return &q
+}
+
+// Start starts writers, every group commit is signaled to dbUpdated.
+func (q *Queue) Start(dbUpdated chan time.Time) {
+	for _, ch := range q.chs {
+		q.wg.Add(1)
+		go q.writer(ch, dbUpdated)
+	}
+	q.log.Info("Ingestion queue started", zap.Int("workers", len(q.chs)), zap.Int("size", cap(q.chs[0])))
+}
+
+// Put adds metrics to the queue without blocking, they are split between writers by name.
+// Either all metrics are queued or none of them, when a writer has no more place ErrQueueFull is returned.
+// Metrics are checked against types of stored and queued metrics first, if any of them has another type
+// nothing is queued and *storage.TypeConflictError is returned, like BatchInsert does.
+func (q *Queue) Put(ms []models.Metrics) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return ErrQueueClosed
+	}
+	if err := q.checkTypes(ms); err != nil {
+		return err
+	}
+	parts := make(map[int][]models.Metrics)
+	for _, m := range ms {
+		i := q.writerOf(m.ID)
+		parts[i] = append(parts[i], m)
+	}
+	// writers only take from their channels and puts are serialized by the lock, so checked place cannot be taken
+	for i := range parts {
+		if len(q.chs[i]) == cap(q.chs[i]) {
+			return ErrQueueFull
+		}
+	}
+	for i, part := range parts {
+		q.chs[i] <- part
+	}
+	for _, m := range ms {
+		t := q.pending[m.ID]
+		q.pending[m.ID] = queuedType{mType: m.MType, n: t.n + 1}
+	}
+	return nil
+}
+
+// writerOf returns index of writer which writes metrics with the name.
+func (q *Queue) writerOf(name string) int {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return int(h.Sum32() % uint32(len(q.chs)))
+}
+
+// checkTypes finds metrics which names are stored or queued with another type, or come with another type earlier in ms.
+func (q *Queue) checkTypes(ms []models.Metrics) error {
+	names := make([]string, len(ms))
+	for i, m := range ms {
+		names[i] = m.ID
+	}
+	types := q.db.SelectTypes(names)
+	var conflicts []models.Metrics
+	for _, m := range ms {
+		mType, ok := types[m.ID]
+		if !ok {
+			if t, queued := q.pending[m.ID]; queued {
+				mType, ok = t.mType, true
+			}
+		}
+		if !ok {
+			types[m.ID] = m.MType
+			continue
+		}
+		if mType != m.MType {
+			types[m.ID] = mType
+			conflicts = append(conflicts, m)
+		}
+	}
+	if len(conflicts) > 0 {
+		return &storage.TypeConflictError{Metrics: conflicts, Types: types}
+	}
+	return nil
+}
+
+// done forgets types of written metrics, from now on they are checked against db.
+func (q *Queue) done(ms []models.Metrics) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, m := range ms {
+		t := q.pending[m.ID]
+		if t.n <= 1 {
+			delete(q.pending, m.ID)
+			continue
+		}
+		t.n--
+		q.pending[m.ID] = t
+	}
+}
+
+// OnFlush sets function called with stored values of every written group of metrics, it must be set before queue is started.
+func (q *Queue) OnFlush(fn func([]models.Metrics)) {
+	q.onFlush = fn
+}
+
+// RetryAfter tells clients in how many seconds they should retry if queue was full.
+func (q *Queue) RetryAfter() int {
+	return int(math.Ceil(q.interval.Seconds()))
+}
+
+// Close stops accepting metrics and waits until writers flushed everything what is left in the queue.
+func (q *Queue) Close() {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		for _, ch := range q.chs {
+			close(ch)
+		}
+	}
+	q.mu.Unlock()
+	q.wg.Wait()
+	q.log.Info("Ingestion queue drained")
+}
+
+// writer collects metrics from its channel and writes them to db.
+func (q *Queue) writer(ch chan []models.Metrics, dbUpdated chan time.Time) {
+	defer q.wg.Done()
+	ticker := time.NewTicker(q.interval)
+	defer ticker.Stop()
+
+	buf := make([]models.Metrics, 0, q.batchSize)
+	for {
+		select {
+		case ms, ok := <-ch:
+			if !ok {
+				q.flush(buf, dbUpdated)
+				return
+			}
+			buf = append(buf, ms...)
+			if len(buf) >= q.batchSize {
+				buf = q.flush(buf, dbUpdated)
+			}
+		case <-ticker.C:
+			buf = q.flush(buf, dbUpdated)
+		}
+	}
+}
+
+// flush writes collected metrics in one batch and returns emptied buffer.
+func (q *Queue) flush(buf []models.Metrics, dbUpdated chan time.Time) []models.Metrics {
+	if len(buf) == 0 {
+		return buf
+	}
+	defer q.done(buf)
+	stored, err := q.db.BatchInsert(buf)
+	var conflict *storage.TypeConflictError
+	if errors.As(err, &conflict) {
+		// types are checked by Put, but names can be retyped or deleted meanwhile;
+		// batch is rejected as a whole, so it is written again without conflicting metrics
+		q.log.Warn("Metrics dropped: ", zap.Int("metrics n", len(conflict.Metrics)), zap.Error(err))
+		rest := make([]models.Metrics, 0, len(buf))
+		for _, m := range buf {
+			if !conflict.Conflicts(m) {
+				rest = append(rest, m)
+			}
+		}
+		stored, err = q.db.BatchInsert(rest)
+	}
+	if err != nil {
+		q.log.Error("Group commit failed: ", zap.Error(err))
+		return buf[:0]
+	}
+	q.log.Debug("Group commit", zap.Int("metrics n", len(buf)))
+	if q.onFlush != nil {
+		q.onFlush(stored)
+	}
+	if dbUpdated != nil {
+		dbUpdated <- time.Now()
+	}
+	return buf[:0]
+}
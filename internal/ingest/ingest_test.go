@@ -0,0 +1,198 @@
+package ingest
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/maffka123/metricCollector/internal/models"
+	"github.com/maffka123/metricCollector/internal/server/config"
+	"github.com/maffka123/metricCollector/internal/storage"
+)
+
+var logger *zap.Logger = zap.NewNop()
+
+func counters(n int) []models.Metrics {
+	ms := make([]models.Metrics, n)
+	for i := range ms {
+		d := int64(1)
+		ms[i] = models.Metrics{ID: "PollCount", MType: "counter", Delta: &d}
+	}
+	return ms
+}
+
+func TestQueue_GroupCommit(t *testing.T) {
+	tests := []struct {
+		name      string
+		cfg       config.Config
+		puts      int
+		wantFlush int
+	}{
+		{name: "by size", cfg: config.Config{QueueSize: 10, QueueWorkers: 1, BatchSize: 4, FlushInterval: time.Hour}, puts: 4, wantFlush: 2},
+		{name: "by interval", cfg: config.Config{QueueSize: 10, QueueWorkers: 1, BatchSize: 100, FlushInterval: 10 * time.Millisecond}, puts: 3, wantFlush: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := storage.Connect(&config.Config{}, logger)
+			dbUpdated := make(chan time.Time, 10)
+			q := NewQueue(db, &tt.cfg, logger)
+			q.Start(dbUpdated)
+
+			for i := 0; i < tt.puts; i++ {
+				assert.NoError(t, q.Put(counters(2)))
+			}
+			for i := 0; i < tt.wantFlush; i++ {
+				select {
+				case <-dbUpdated:
+				case <-time.After(time.Second):
+					t.Fatal("no group commit happened")
+				}
+			}
+			assert.Equal(t, int64(2*tt.puts), db.ValueFromCounter("PollCount"))
+			q.Close()
+		})
+	}
+}
+
+// slowDB takes random time to commit, so that writers would overtake each other.
+type slowDB struct {
+	storage.Repositories
+}
+
+func (db slowDB) BatchInsert(ms []models.Metrics) ([]models.Metrics, error) {
+	time.Sleep(time.Duration(rand.Intn(200)) * time.Microsecond)
+	return db.Repositories.BatchInsert(ms)
+}
+
+func TestQueue_Order(t *testing.T) {
+	db := storage.Connect(&config.Config{}, logger)
+	// every request is flushed on its own, so writers compete for db
+	cfg := config.Config{QueueSize: 1000, QueueWorkers: 4, BatchSize: 1, FlushInterval: time.Hour}
+	q := NewQueue(slowDB{db}, &cfg, logger)
+	var mu sync.Mutex
+	var written []float64
+	q.OnFlush(func(ms []models.Metrics) {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, m := range ms {
+			if m.ID == "Alloc" {
+				written = append(written, *m.Value)
+			}
+		}
+	})
+	q.Start(nil)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				v := float64(i)
+				assert.NoError(t, q.Put([]models.Metrics{{ID: fmt.Sprintf("Other%d", g), MType: "gauge", Value: &v}}))
+			}
+		}(g)
+	}
+	const n = 200
+	for i := 1; i <= n; i++ {
+		v := float64(i)
+		require.NoError(t, q.Put([]models.Metrics{{ID: "Alloc", MType: "gauge", Value: &v}}))
+	}
+	wg.Wait()
+	q.Close()
+
+	assert.Equal(t, float64(n), db.ValueFromGouge("Alloc"), "last write wins")
+	assert.Len(t, written, n)
+	assert.IsIncreasing(t, written, "writes are flushed in the order they were put")
+}
+
+func TestQueue_FlushConflict(t *testing.T) {
+	db := storage.Connect(&config.Config{}, logger)
+	cfg := config.Config{QueueSize: 10, QueueWorkers: 1, BatchSize: 100, FlushInterval: time.Hour}
+	dbUpdated := make(chan time.Time, 10)
+	q := NewQueue(db, &cfg, logger)
+	var flushed []models.Metrics
+	q.OnFlush(func(ms []models.Metrics) { flushed = append(flushed, ms...) })
+	q.Start(dbUpdated)
+
+	d := int64(1)
+	assert.NoError(t, q.Put(counters(2)))
+	assert.NoError(t, q.Put([]models.Metrics{{ID: "Alloc", MType: "counter", Delta: &d}}))
+	// name is written with another type after it was queued
+	db.InsertGouge("Alloc", 1)
+	q.Close()
+
+	assert.Equal(t, int64(2), db.ValueFromCounter("PollCount"), "metrics of other requests must be written")
+	assert.Equal(t, float64(1), db.ValueFromGouge("Alloc"))
+	require.Len(t, flushed, 1, "stored values are flushed once per metric")
+	assert.Equal(t, "PollCount", flushed[0].ID)
+	assert.Equal(t, int64(2), *flushed[0].Delta)
+}
+
+func TestQueue_PutConflict(t *testing.T) {
+	db := storage.Connect(&config.Config{}, logger)
+	db.InsertGouge("Alloc", 1)
+	q := NewQueue(db, &config.Config{QueueSize: 10}, logger)
+	require.NoError(t, q.Put(counters(1)))
+
+	d := int64(1)
+	v := float64(1)
+	tests := []struct {
+		name      string
+		ms        []models.Metrics
+		conflicts []string
+	}{
+		{name: "stored with other type", ms: []models.Metrics{{ID: "Alloc", MType: "counter", Delta: &d}}, conflicts: []string{"Alloc"}},
+		{name: "queued with other type", ms: []models.Metrics{{ID: "PollCount", MType: "gauge", Value: &v}}, conflicts: []string{"PollCount"}},
+		{name: "other type in the same request", ms: []models.Metrics{
+			{ID: "Heap", MType: "gauge", Value: &v}, {ID: "Heap", MType: "counter", Delta: &d},
+		}, conflicts: []string{"Heap"}},
+		{name: "same types", ms: []models.Metrics{{ID: "Alloc", MType: "gauge", Value: &v}, {ID: "PollCount", MType: "counter", Delta: &d}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := q.Put(tt.ms)
+			if tt.conflicts == nil {
+				assert.NoError(t, err)
+				return
+			}
+			var conflict *storage.TypeConflictError
+			require.ErrorAs(t, err, &conflict)
+			for i, m := range conflict.Metrics {
+				assert.Equal(t, tt.conflicts[i], m.ID)
+			}
+		})
+	}
+
+	// nothing of rejected requests is written, types of written metrics are forgotten
+	q.Start(nil)
+	q.Close()
+	assert.Equal(t, int64(2), db.ValueFromCounter("PollCount"))
+	assert.False(t, db.NameInGouge("Heap"))
+	assert.Empty(t, q.pending)
+}
+
+func TestQueue_Put(t *testing.T) {
+	db := storage.Connect(&config.Config{}, logger)
+	q := NewQueue(db, &config.Config{QueueSize: 1}, logger)
+	flushed := 0
+	q.OnFlush(func(ms []models.Metrics) { flushed += len(ms) })
+
+	// writers are not started, so the second request does not fit
+	assert.NoError(t, q.Put(counters(1)))
+	assert.ErrorIs(t, q.Put(counters(1)), ErrQueueFull)
+	assert.Equal(t, 1, q.RetryAfter())
+
+	// close drains what is left
+	q.Start(nil)
+	q.Close()
+	assert.Equal(t, int64(1), db.ValueFromCounter("PollCount"))
+	assert.Equal(t, 1, flushed)
+	assert.ErrorIs(t, q.Put(counters(1)), ErrQueueClosed)
+}
@@ -0,0 +1,229 @@
+// Package limits protects server from agents sending too many metrics.
+// It caps total number of series, number of series written by one agent and samples per second of one agent.
+// Rejected writes are counted in server self-metrics, which caller writes as usual counters, see Rejections.
+package limits
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/maffka123/metricCollector/internal/models"
+	"github.com/maffka123/metricCollector/internal/server/config"
+	"github.com/maffka123/metricCollector/internal/storage"
+)
+
+// Names of server self-metrics.
+const (
+	RejectedSamples = "LimitRejectedSamples"
+	RejectedSeries  = "LimitRejectedSeries"
+)
+
+// RateError is returned when agent sends samples faster than allowed.
+type RateError struct {
+	RetryAfter int
+}
+
+func (e *RateError) Error() string {
+	return fmt.Sprintf("samples rate limit exceeded, retry in %d s", e.RetryAfter)
+}
+
+// Agents which were not seen for idleAfter are forgotten, it is checked every pruneInterval.
+// New series which are accepted but not in db yet, e.g. waiting in ingest queue, are counted for pendingTTL at most.
+const (
+	idleAfter  = 10 * time.Minute
+	pendingTTL = time.Minute
+)
+
+// series identifies one metric.
+type series struct {
+	mType string
+	name  string
+}
+
+// agent holds what limiter knows about one agent.
+type agent struct {
+	series map[series]struct{}
+	tokens float64
+	last   time.Time
+	seen   time.Time
+}
+
+// Limiter checks metrics before they are written to db, zero limit means no limit.
+type Limiter struct {
+	db             storage.Repositories
+	maxSeries      int
+	maxAgentSeries int
+	rate           float64
+	agents         map[string]*agent
+	pending        map[series]time.Time // new series accepted since they were checked in db
+	rejections     map[string]int64     // rejected metrics by self-metric name, not written yet
+	lastPrune      time.Time
+	mu             sync.Mutex
+	log            *zap.Logger
+}
+
+// NewLimiter initializes limiter, nil is returned if no limits are configured.
+func NewLimiter(db storage.Repositories, cfg *config.Config, logger *zap.Logger) *Limiter {
+	if cfg.MaxSeries <= 0 && cfg.MaxAgentSeries <= 0 && cfg.AgentRate <= 0 {
+		return nil
+	}
+	return &Limiter{
+		db:             db,
+		maxSeries:      cfg.MaxSeries,
+		maxAgentSeries: cfg.MaxAgentSeries,
+		rate:           cfg.AgentRate,
+		agents:         map[string]*agent{},
+		pending:        map[series]time.Time{},
+		rejections:     map[string]int64{},
+		lastPrune:      time.Now(),
+		log:            logger,
+	}
+}
+
+// Allow checks metrics sent by the agent and returns those which can be written.
+// Agent id must not be taken from what client sends, otherwise it can get new quotas by changing it.
+// If agent exceeded its rate nothing is accepted and RateError is returned.
+// Metrics which would create series over the limits are dropped and returned as rejected.
+func (l *Limiter) Allow(agentID string, ms []models.Metrics) (accepted []models.Metrics, rejected []models.Metrics, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastPrune) > pruneInterval {
+		l.forgetIdle(now)
+	}
+	a, ok := l.agents[agentID]
+	if !ok {
+		a = &agent{series: map[series]struct{}{}, tokens: l.rate, last: now}
+		l.agents[agentID] = a
+	}
+	a.seen = now
+
+	if err = l.take(a, len(ms)); err != nil {
+		l.rejections[RejectedSamples] += int64(len(ms))
+		l.log.Warn("Agent is over rate limit", zap.String("agent", agentID), zap.Int("metrics n", len(ms)))
+		return nil, ms, err
+	}
+
+	total := -1
+	accepted = make([]models.Metrics, 0, len(ms))
+	for _, m := range ms {
+		key := series{mType: m.MType, name: m.ID}
+		exists := l.exists(key)
+
+		if _, known := a.series[key]; !known && l.maxAgentSeries > 0 && len(a.series) >= l.maxAgentSeries {
+			l.prune(a)
+			if len(a.series) >= l.maxAgentSeries {
+				rejected = append(rejected, m)
+				continue
+			}
+		}
+
+		if _, counted := l.pending[key]; !exists && !counted && l.maxSeries > 0 {
+			// series count is needed only when a new one appears, so it is not asked for every write
+			if total < 0 {
+				total = l.db.CountMetrics() + l.prunePending(now)
+			}
+			if total >= l.maxSeries {
+				rejected = append(rejected, m)
+				continue
+			}
+			total++
+			l.pending[key] = now
+		}
+
+		a.series[key] = struct{}{}
+		accepted = append(accepted, m)
+	}
+
+	if len(rejected) > 0 {
+		l.rejections[RejectedSeries] += int64(len(rejected))
+		l.log.Warn("Agent is over series limit", zap.String("agent", agentID), zap.Int("rejected n", len(rejected)))
+	}
+	return accepted, rejected, nil
+}
+
+// Rejections returns self-metrics with metrics rejected since the previous call, nil limiter has none.
+// They are written by caller outside of the limiter, so that they go through the same write path as any other metrics.
+func (l *Limiter) Rejections() []models.Metrics {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var ms []models.Metrics
+	for _, name := range []string{RejectedSamples, RejectedSeries} {
+		if n := l.rejections[name]; n > 0 {
+			ms = append(ms, models.Metrics{ID: name, MType: "counter", Delta: &n})
+			delete(l.rejections, name)
+		}
+	}
+	return ms
+}
+
+// take takes n samples from agent token bucket, bucket holds samples for one second.
+// Request bigger than bucket is allowed when bucket is full, then agent has to wait longer for the next one.
+func (l *Limiter) take(a *agent, n int) error {
+	if l.rate <= 0 {
+		return nil
+	}
+	now := time.Now()
+	a.tokens = math.Min(l.rate, a.tokens+now.Sub(a.last).Seconds()*l.rate)
+	a.last = now
+
+	need := math.Min(float64(n), l.rate)
+	if a.tokens < need {
+		return &RateError{RetryAfter: int(math.Ceil((need - a.tokens) / l.rate))}
+	}
+	a.tokens -= float64(n)
+	return nil
+}
+
+// exists checks if series is in db already.
+func (l *Limiter) exists(s series) bool {
+	switch s.mType {
+	case "counter":
+		return l.db.NameInCounter(s.name)
+	case "histogram":
+		return l.db.NameInHistogram(s.name)
+	case "set":
+		return l.db.NameInSet(s.name)
+	case "info":
+		return l.db.NameInInfo(s.name)
+	}
+	return l.db.NameInGouge(s.name)
+}
+
+// prunePending forgets pending series which got into db or did not get there in time, e.g. their write failed,
+// and returns how many are left.
+func (l *Limiter) prunePending(now time.Time) int {
+	for s, t := range l.pending {
+		if now.Sub(t) > pendingTTL || l.exists(s) {
+			delete(l.pending, s)
+		}
+	}
+	return len(l.pending)
+}
+
+// forgetIdle forgets agents which were not seen for a while, so that limiter does not grow with every agent ever seen.
+func (l *Limiter) forgetIdle(now time.Time) {
+	for id, a := range l.agents {
+		if now.Sub(a.seen) > idleAfter {
+			delete(l.agents, id)
+		}
+	}
+	l.lastPrune = now
+}
+
+// prune forgets agent series which are not in db anymore, e.g. deleted or evicted.
+func (l *Limiter) prune(a *agent) {
+	for s := range a.series {
+		if !l.exists(s) {
+			delete(a.series, s)
+		}
+	}
+}
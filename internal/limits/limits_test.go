@@ -0,0 +1,159 @@
+package limits
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/maffka123/metricCollector/internal/models"
+	"github.com/maffka123/metricCollector/internal/server/config"
+	"github.com/maffka123/metricCollector/internal/storage"
+)
+
+var logger *zap.Logger = zap.NewNop()
+
+func gauges(names ...string) []models.Metrics {
+	ms := make([]models.Metrics, 0, len(names))
+	for _, n := range names {
+		f := 1.5
+		ms = append(ms, models.Metrics{ID: n, MType: "gauge", Value: &f})
+	}
+	return ms
+}
+
+func TestNewLimiter(t *testing.T) {
+	assert.Nil(t, NewLimiter(nil, &config.Config{}, logger))
+	assert.Nil(t, NewLimiter(nil, &config.Config{}, logger).Rejections())
+	assert.NotNil(t, NewLimiter(nil, &config.Config{MaxSeries: 1}, logger))
+}
+
+func TestLimiter_Allow(t *testing.T) {
+	tests := []struct {
+		name         string
+		cfg          config.Config
+		agent        string
+		ms           []models.Metrics
+		wantAccepted int
+		wantRejected int
+	}{
+		{name: "existing series", cfg: config.Config{MaxSeries: 2}, agent: "a1", ms: gauges("g1", "g2"), wantAccepted: 2},
+		{name: "total limit", cfg: config.Config{MaxSeries: 3}, agent: "a1", ms: gauges("g1", "g3", "g3", "g4"), wantAccepted: 3, wantRejected: 1},
+		{name: "agent limit", cfg: config.Config{MaxAgentSeries: 1}, agent: "a1", ms: gauges("g1", "g2", "g3"), wantAccepted: 1, wantRejected: 2},
+		{name: "no limits reached", cfg: config.Config{MaxSeries: 10, MaxAgentSeries: 10, AgentRate: 10}, agent: "a1", ms: gauges("g1", "g3"), wantAccepted: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := storage.Connect(&config.Config{}, logger)
+			db.BatchInsert(gauges("g1", "g2"))
+			l := NewLimiter(db, &tt.cfg, logger)
+
+			accepted, rejected, err := l.Allow(tt.agent, tt.ms)
+			require.NoError(t, err)
+			assert.Len(t, accepted, tt.wantAccepted)
+			assert.Len(t, rejected, tt.wantRejected)
+			// rejections are written by caller
+			assert.False(t, db.NameInCounter(RejectedSeries))
+			self := l.Rejections()
+			if tt.wantRejected == 0 {
+				assert.Empty(t, self)
+				return
+			}
+			require.Len(t, self, 1)
+			assert.Equal(t, RejectedSeries, self[0].ID)
+			assert.Equal(t, int64(tt.wantRejected), *self[0].Delta)
+			assert.Empty(t, l.Rejections(), "rejections are returned once")
+		})
+	}
+}
+
+func TestLimiter_AllowAgentSeriesPruned(t *testing.T) {
+	db := storage.Connect(&config.Config{}, logger)
+	l := NewLimiter(db, &config.Config{MaxAgentSeries: 1}, logger)
+
+	accepted, _, _ := l.Allow("a1", gauges("g1"))
+	db.BatchInsert(accepted)
+	_, rejected, _ := l.Allow("a1", gauges("g2"))
+	assert.Len(t, rejected, 1)
+
+	// other agents have their own limit
+	_, rejected, _ = l.Allow("a2", gauges("g2"))
+	assert.Empty(t, rejected)
+
+	// deleted metric does not count anymore
+	db.DeleteMetric("gauge", "g1")
+	_, rejected, _ = l.Allow("a1", gauges("g2"))
+	assert.Empty(t, rejected)
+}
+
+func TestLimiter_AllowPending(t *testing.T) {
+	db := storage.Connect(&config.Config{}, logger)
+	l := NewLimiter(db, &config.Config{MaxSeries: 3}, logger)
+
+	// accepted series are counted before they are written, e.g. while they wait in ingest queue
+	for _, name := range []string{"g1", "g2", "g3"} {
+		accepted, _, _ := l.Allow("a1", gauges(name))
+		assert.Len(t, accepted, 1)
+	}
+	_, rejected, _ := l.Allow("a2", gauges("g4"))
+	assert.Len(t, rejected, 1)
+
+	// written ones are counted in db, lost ones are forgotten after a while
+	db.BatchInsert(gauges("g1"))
+	l.pending[series{mType: "gauge", name: "g2"}] = time.Now().Add(-2 * pendingTTL)
+	l.pending[series{mType: "gauge", name: "g3"}] = time.Now().Add(-2 * pendingTTL)
+	accepted, _, _ := l.Allow("a2", gauges("g1", "g4"))
+	assert.Len(t, accepted, 2)
+	assert.Len(t, l.pending, 1)
+}
+
+func TestLimiter_AllowForgetsIdleAgents(t *testing.T) {
+	db := storage.Connect(&config.Config{}, logger)
+	l := NewLimiter(db, &config.Config{AgentRate: 10}, logger)
+
+	l.Allow("a1", gauges("g1"))
+	l.Allow("a2", gauges("g1"))
+	l.agents["a1"].seen = time.Now().Add(-2 * idleAfter)
+	l.lastPrune = time.Now().Add(-2 * pruneInterval)
+
+	l.Allow("a2", gauges("g1"))
+	assert.NotContains(t, l.agents, "a1")
+	assert.Contains(t, l.agents, "a2")
+}
+
+func TestLimiter_AllowRate(t *testing.T) {
+	db := storage.Connect(&config.Config{}, logger)
+	l := NewLimiter(db, &config.Config{AgentRate: 100}, logger)
+
+	names := make([]string, 150)
+	for i := range names {
+		names[i] = fmt.Sprintf("g%d", i)
+	}
+
+	// big request is allowed with full bucket
+	_, _, err := l.Allow("a1", gauges(names...))
+	require.NoError(t, err)
+
+	_, rejected, err := l.Allow("a1", gauges("g1"))
+	var rateErr *RateError
+	require.ErrorAs(t, err, &rateErr)
+	assert.Equal(t, 1, rateErr.RetryAfter)
+	assert.Len(t, rejected, 1)
+	_, _, err = l.Allow("a1", gauges("g1", "g2"))
+	require.ErrorAs(t, err, &rateErr)
+	self := l.Rejections()
+	require.Len(t, self, 1)
+	assert.Equal(t, RejectedSamples, self[0].ID)
+	assert.Equal(t, int64(3), *self[0].Delta)
+
+	_, _, err = l.Allow("a2", gauges("g1"))
+	assert.NoError(t, err)
+
+	// bucket is refilled with time
+	l.agents["a1"].last = time.Now().Add(-2 * time.Second)
+	_, _, err = l.Allow("a1", gauges("g1"))
+	assert.NoError(t, err)
+}
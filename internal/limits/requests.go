@@ -0,0 +1,137 @@
+package limits
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/maffka123/metricCollector/internal/auth"
+	"github.com/maffka123/metricCollector/internal/server/config"
+)
+
+// pruneInterval is how often buckets of clients which are quiet long enough to refill are forgotten.
+const pruneInterval = time.Minute
+
+// bucket holds request tokens of one client.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RequestLimiter limits requests of every client with a token bucket.
+type RequestLimiter struct {
+	group     string
+	rate      float64
+	burst     float64
+	byAgent   bool
+	keys      auth.Keys
+	clientIP  func(r *http.Request) string
+	clients   map[string]*bucket
+	lastPrune time.Time
+	mu        sync.Mutex
+	log       *zap.Logger
+}
+
+// NewRequestLimiter initializes limiter for route group, nil is returned if the group has no rate.
+// Clients are told apart by ip returned by clientIP, which must not trust client headers,
+// if limitBy is "agent" verified agents behind one ip are told apart as well.
+// Without clientIP address of the connection is used.
+func NewRequestLimiter(group string, cfg *config.Config, clientIP func(r *http.Request) string, logger *zap.Logger) *RequestLimiter {
+	r, ok := cfg.RateLimits[group]
+	if !ok || r.PerSecond <= 0 {
+		return nil
+	}
+	burst := float64(r.Burst)
+	if burst < 1 {
+		burst = math.Ceil(r.PerSecond)
+	}
+	return &RequestLimiter{
+		group:     group,
+		rate:      r.PerSecond,
+		burst:     burst,
+		byAgent:   cfg.RateLimitBy == "agent",
+		keys:      cfg.APIKeys,
+		clientIP:  clientIP,
+		clients:   map[string]*bucket{},
+		lastPrune: time.Now(),
+		log:       logger,
+	}
+}
+
+// Limit rejects requests of clients over their rate with 429 and Retry-After, nil limiter lets everything through.
+func (l *RequestLimiter) Limit(next http.Handler) http.HandlerFunc {
+	if l == nil {
+		return next.ServeHTTP
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		client := l.client(r)
+		if wait := l.take(client, time.Now()); wait > 0 {
+			l.log.Warn("Client is over request rate", zap.String("group", l.group), zap.String("client", client))
+			w.Header().Set("Retry-After", strconv.Itoa(wait))
+			http.Error(w, fmt.Sprintf("429 - Too many requests, retry in %d s", wait), http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+// client identifies client by ip and, if it is configured, by agent.
+// Agent is known only by verified client certificate or known API key, so that new header values do not make new clients.
+func (l *RequestLimiter) client(r *http.Request) string {
+	ip := r.RemoteAddr
+	if l.clientIP != nil {
+		ip = l.clientIP(r)
+	} else if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		ip = host
+	}
+	if !l.byAgent {
+		return ip
+	}
+	if name := auth.CertName(r); name != "" {
+		return ip + " cert:" + name
+	}
+	if c, ok := l.keys.ClientOf(r); ok {
+		return ip + " key:" + c.Name
+	}
+	return ip
+}
+
+// take takes one token from client bucket and returns 0, or seconds to wait if bucket is empty.
+func (l *RequestLimiter) take(client string, now time.Time) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastPrune) > pruneInterval {
+		l.prune(now)
+	}
+
+	b, ok := l.clients[client]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.clients[client] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		return int(math.Ceil((1 - b.tokens) / l.rate))
+	}
+	b.tokens--
+	return 0
+}
+
+// prune forgets clients which buckets are full by now, they are the same as new ones, l.mu must be held.
+func (l *RequestLimiter) prune(now time.Time) {
+	for c, b := range l.clients {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.clients, c)
+		}
+	}
+	l.lastPrune = now
+}
@@ -0,0 +1,98 @@
+package limits
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/maffka123/metricCollector/internal/auth"
+	"github.com/maffka123/metricCollector/internal/server/config"
+)
+
+func TestNewRequestLimiter(t *testing.T) {
+	assert.Nil(t, NewRequestLimiter(config.RoutesIngest, &config.Config{}, nil, logger))
+	cfg := config.Config{RateLimits: config.RequestRates{config.RoutesRead: {PerSecond: 1}}}
+	assert.Nil(t, NewRequestLimiter(config.RoutesIngest, &cfg, nil, logger))
+	assert.NotNil(t, NewRequestLimiter(config.RoutesRead, &cfg, nil, logger))
+
+	// nil limiter lets everything through
+	var l *RequestLimiter
+	w := httptest.NewRecorder()
+	l.Limit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/updates/", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestRequestLimiter_Limit(t *testing.T) {
+	keys, err := auth.Load("../auth/testdata/keys.json")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		limitBy    string
+		remoteAddr string
+		key        string
+		header     http.Header
+		statusCode int
+		retryAfter string
+	}{
+		{name: "first", remoteAddr: "10.0.0.1:5000", statusCode: 200},
+		{name: "burst", remoteAddr: "10.0.0.1:5001", key: "write-key", statusCode: 200},
+		{name: "over rate", remoteAddr: "10.0.0.1:5002", key: "read-key", statusCode: 429, retryAfter: "2"},
+		{name: "client headers are ignored", remoteAddr: "10.0.0.1:5003",
+			header: http.Header{"X-Agent-Id": {"a1"}, "X-Real-Ip": {"10.0.0.9"}}, statusCode: 429, retryAfter: "2"},
+		{name: "other ip", remoteAddr: "10.0.0.2:5000", statusCode: 200},
+		{name: "by agent", limitBy: "agent", remoteAddr: "10.0.0.1:5000", key: "write-key", statusCode: 200},
+		{name: "by agent burst", limitBy: "agent", remoteAddr: "10.0.0.1:5001", key: "write-key", statusCode: 200},
+		{name: "by agent over rate", limitBy: "agent", remoteAddr: "10.0.0.1:5002", key: "write-key", statusCode: 429, retryAfter: "2"},
+		{name: "other agent", limitBy: "agent", remoteAddr: "10.0.0.1:5003", key: "read-key", statusCode: 200},
+		{name: "same agent from other ip", limitBy: "agent", remoteAddr: "10.0.0.2:5000", key: "write-key", statusCode: 200},
+		{name: "unknown key", limitBy: "agent", remoteAddr: "10.0.0.1:5004", key: "guess-1", statusCode: 200},
+		{name: "other unknown key", limitBy: "agent", remoteAddr: "10.0.0.1:5005", key: "guess-2", statusCode: 200},
+		{name: "unknown keys over rate", limitBy: "agent", remoteAddr: "10.0.0.1:5006", key: "guess-3",
+			header: http.Header{"X-Agent-Id": {"a2"}}, statusCode: 429, retryAfter: "2"},
+	}
+	limiters := map[string]*RequestLimiter{}
+	for _, by := range []string{"", "agent"} {
+		cfg := config.Config{RateLimits: config.RequestRates{config.RoutesIngest: {PerSecond: 0.5, Burst: 2}}, RateLimitBy: by, APIKeys: keys}
+		limiters[by] = NewRequestLimiter(config.RoutesIngest, &cfg, nil, logger)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPost, "/updates/", nil)
+			request.RemoteAddr = tt.remoteAddr
+			for k, v := range tt.header {
+				request.Header[k] = v
+			}
+			if tt.key != "" {
+				request.Header.Set("Authorization", "Bearer "+tt.key)
+			}
+			w := httptest.NewRecorder()
+			limiters[tt.limitBy].Limit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(w, request)
+
+			assert.Equal(t, tt.statusCode, w.Code)
+			assert.Equal(t, tt.retryAfter, w.Header().Get("Retry-After"))
+		})
+	}
+}
+
+func TestRequestLimiter_take(t *testing.T) {
+	cfg := config.Config{RateLimits: config.RequestRates{config.RoutesIngest: {PerSecond: 10, Burst: 1}}}
+	l := NewRequestLimiter(config.RoutesIngest, &cfg, nil, logger)
+	now := time.Now()
+
+	assert.Equal(t, 0, l.take("c1", now))
+	assert.Equal(t, 1, l.take("c1", now))
+	// bucket is refilled with time
+	assert.Equal(t, 0, l.take("c1", now.Add(100*time.Millisecond)))
+
+	// full buckets are forgotten
+	l.take("c2", now.Add(150*time.Millisecond))
+	l.prune(now.Add(200 * time.Millisecond))
+	assert.Equal(t, 1, len(l.clients))
+	assert.Contains(t, l.clients, "c2")
+}
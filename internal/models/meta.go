@@ -0,0 +1,37 @@
+package models
+
+import (
+	"errors"
+	"strings"
+)
+
+// ErrNoName is returned for metadata without metric name.
+var ErrNoName = errors.New("metric name is not given")
+
+// Meta describes what metric means, it does not depend on labels, so it is kept per metric name.
+type Meta struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Unit        string `json:"unit,omitempty"` // e.g. bytes or seconds
+	Type        string `json:"type,omitempty"` // type metric is sent with
+}
+
+// Validate checks that metadata has a name and known type if type is given.
+func (m *Meta) Validate() error {
+	if m.Name == "" {
+		return ErrNoName
+	}
+	switch m.Type {
+	case "", "counter", "gauge", "histogram", "set", "info":
+		return nil
+	}
+	return ErrUnknownType
+}
+
+// Help returns description together with unit, e.g. "Bytes of allocated heap objects (bytes)".
+func (m *Meta) Help() string {
+	if m.Unit == "" {
+		return m.Description
+	}
+	return strings.TrimSpace(m.Description + " (" + m.Unit + ")")
+}
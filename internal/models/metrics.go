@@ -7,15 +7,230 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"math"
+	"strings"
+	"time"
 )
 
 // Metrics type defines metric that is exchanged between agent and server.
 type Metrics struct {
 	ID    string   `json:"id"`              // metrics name
-	MType string   `json:"type"`            // metrics type: can be counter or gauge
+	MType string   `json:"type"`            // metrics type: can be counter, gauge, histogram, set or info
 	Delta *int64   `json:"delta,omitempty"` // metrics values if type is counter
 	Value *float64 `json:"value,omitempty"` // metrics values if type is gauge
 	Hash  string   `json:"hash,omitempty"`  // hash-value
+
+	Histogram *Histogram `json:"histogram,omitempty"` // metrics values if type is histogram
+	Set       *Set       `json:"set,omitempty"`       // metrics values if type is set
+	Info      *string    `json:"info,omitempty"`      // metrics value if type is info, e.g. version or state
+
+	UpdatedAt *time.Time `json:"updated_at,omitempty"` // when metric was updated last time, only set by server
+	Stale     bool       `json:"stale,omitempty"`      // metric was not updated for too long, only set by server
+}
+
+// IsStale checks if metric was not updated longer than ttl, zero ttl means metrics never get stale.
+func (m *Metrics) IsStale(ttl time.Duration) bool {
+	return ttl > 0 && m.UpdatedAt != nil && time.Since(*m.UpdatedAt) > ttl
+}
+
+// ErrBadLabels is returned for metric id with labels which cannot be parsed.
+var ErrBadLabels = errors.New("metric labels cannot be parsed")
+
+// SplitID splits metric id into name and labels, labels are given in id like this: Alloc{agent="a1",env="prod"}.
+func SplitID(id string) (string, map[string]string, error) {
+	labels := map[string]string{}
+	i := strings.IndexByte(id, '{')
+	if i < 0 {
+		return id, labels, nil
+	}
+	name, rest := id[:i], id[i+1:]
+	if !strings.HasSuffix(rest, "}") {
+		return id, nil, ErrBadLabels
+	}
+	rest = rest[:len(rest)-1]
+
+	for rest != "" {
+		eq := strings.IndexByte(rest, '=')
+		if eq < 1 || len(rest) < eq+2 || rest[eq+1] != '"' {
+			return id, nil, ErrBadLabels
+		}
+		key := strings.TrimSpace(rest[:eq])
+		rest = rest[eq+2:]
+
+		var value strings.Builder
+		closed := false
+		for j := 0; j < len(rest); j++ {
+			if rest[j] == '\\' && j+1 < len(rest) {
+				j++
+				value.WriteByte(rest[j])
+				continue
+			}
+			if rest[j] == '"' {
+				rest = strings.TrimPrefix(strings.TrimSpace(rest[j+1:]), ",")
+				closed = true
+				break
+			}
+			value.WriteByte(rest[j])
+		}
+		if !closed {
+			return id, nil, ErrBadLabels
+		}
+		labels[key] = value.String()
+		rest = strings.TrimSpace(rest)
+	}
+	return name, labels, nil
+}
+
+// ErrUnknownType is returned for metrics of not supported type.
+var ErrUnknownType = errors.New("metric type unknown")
+
+// ErrNoValue is returned for metrics without value.
+var ErrNoValue = errors.New("metric has no value")
+
+// ErrBadHistogram is returned for histograms which buckets do not agree with each other.
+var ErrBadHistogram = errors.New("histogram buckets are not consistent")
+
+// Histogram holds observations distributed over buckets.
+// Bucket i counts observations <= Bounds[i] (and > Bounds[i-1]), the last bucket counts everything above the last bound.
+// Agent sends new observations only, server adds them up.
+type Histogram struct {
+	Bounds []float64 `json:"bounds"` // upper bounds of buckets, sorted
+	Counts []uint64  `json:"counts"` // observations in every bucket, one more than bounds
+	Count  uint64    `json:"count"`  // all observations
+	Sum    float64   `json:"sum"`    // sum of all observations
+}
+
+// NewHistogram initializes empty histogram with given bucket bounds.
+func NewHistogram(bounds []float64) *Histogram {
+	b := make([]float64, len(bounds))
+	copy(b, bounds)
+	return &Histogram{Bounds: b, Counts: make([]uint64, len(bounds)+1)}
+}
+
+// Observe adds one observation.
+func (h *Histogram) Observe(v float64) {
+	i := 0
+	for i < len(h.Bounds) && v > h.Bounds[i] {
+		i++
+	}
+	h.Counts[i]++
+	h.Count++
+	h.Sum += v
+}
+
+// Validate checks that bounds are sorted and counts agree with them.
+func (h *Histogram) Validate() error {
+	if len(h.Counts) != len(h.Bounds)+1 {
+		return ErrBadHistogram
+	}
+	for i := 1; i < len(h.Bounds); i++ {
+		if h.Bounds[i] <= h.Bounds[i-1] {
+			return ErrBadHistogram
+		}
+	}
+	var n uint64
+	for _, c := range h.Counts {
+		n += c
+	}
+	if n != h.Count {
+		return ErrBadHistogram
+	}
+	return nil
+}
+
+// Copy makes a deep copy of histogram.
+func (h *Histogram) Copy() *Histogram {
+	c := NewHistogram(h.Bounds)
+	copy(c.Counts, h.Counts)
+	c.Count = h.Count
+	c.Sum = h.Sum
+	return c
+}
+
+// SameBounds checks if both histograms have the same buckets.
+func (h *Histogram) SameBounds(o *Histogram) bool {
+	if len(h.Bounds) != len(o.Bounds) {
+		return false
+	}
+	for i := range h.Bounds {
+		if h.Bounds[i] != o.Bounds[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Merge adds observations of other histogram.
+// If buckets are different, histogram is replaced by the other one, because old observations cannot be moved to new buckets.
+func (h *Histogram) Merge(o *Histogram) {
+	if !h.SameBounds(o) {
+		*h = *o.Copy()
+		return
+	}
+	for i := range h.Counts {
+		h.Counts[i] += o.Counts[i]
+	}
+	h.Count += o.Count
+	h.Sum += o.Sum
+}
+
+// Quantile estimates q-quantile (0 <= q <= 1) assuming observations are spread evenly inside buckets.
+// Lower bound of the first bucket is taken as 0, quantile in the last bucket is its lower bound. NaN is returned for empty histogram.
+func (h *Histogram) Quantile(q float64) float64 {
+	if h.Count == 0 || q < 0 || q > 1 {
+		return math.NaN()
+	}
+	rank := q * float64(h.Count)
+	var seen float64
+	for i, c := range h.Counts {
+		if c == 0 || seen+float64(c) < rank {
+			seen += float64(c)
+			continue
+		}
+		if i == len(h.Bounds) {
+			if i == 0 {
+				return math.NaN()
+			}
+			return h.Bounds[i-1]
+		}
+		lower := 0.0
+		if i > 0 {
+			lower = h.Bounds[i-1]
+		}
+		return lower + (h.Bounds[i]-lower)*(rank-seen)/float64(c)
+	}
+	return math.NaN()
+}
+
+// Validate checks that metric has known type and value of this type.
+func (m *Metrics) Validate() error {
+	switch m.MType {
+	case "counter":
+		if m.Delta == nil {
+			return ErrNoValue
+		}
+	case "gauge":
+		if m.Value == nil {
+			return ErrNoValue
+		}
+	case "histogram":
+		if m.Histogram == nil {
+			return ErrNoValue
+		}
+		return m.Histogram.Validate()
+	case "set":
+		if m.Set == nil {
+			return ErrNoValue
+		}
+		return m.Set.Validate()
+	case "info":
+		if m.Info == nil {
+			return ErrNoValue
+		}
+	default:
+		return ErrUnknownType
+	}
+	return nil
 }
 
 // CalcHash calculates hash from key.
@@ -23,10 +238,23 @@ func (m *Metrics) CalcHash(key string) {
 	m.Hash = m.newHash(key)
 }
 
-// CompareHash compares to hashes.
+// CalcHashWithID calculates hash from key and prefixes it with key id as id:hash, so that receiver knows which key to check it with.
+func (m *Metrics) CalcHashWithID(id string, key string) {
+	m.Hash = id + ":" + m.newHash(key)
+}
+
+// HashKeyID returns id of the key which hash was calculated with, it is empty for hashes without id.
+func (m *Metrics) HashKeyID() string {
+	if i := strings.LastIndex(m.Hash, ":"); i >= 0 {
+		return m.Hash[:i]
+	}
+	return ""
+}
+
+// CompareHash compares to hashes, key id in the hash is not checked.
 func (m *Metrics) CompareHash(key string) error {
 	hash := m.newHash(key)
-	if hash != m.Hash {
+	if hash != m.Hash[strings.LastIndex(m.Hash, ":")+1:] {
 		err := errors.New("hashes are not equal")
 		return err
 	}
@@ -45,6 +273,12 @@ func (m *Metrics) newHash(key string) string {
 	var h string
 	if m.MType == "counter" {
 		h = hex.EncodeToString(hash(fmt.Sprintf("%s:counter:%d", m.ID, *m.Delta), key))
+	} else if m.MType == "histogram" {
+		h = hex.EncodeToString(hash(fmt.Sprintf("%s:histogram:%v:%v:%d:%f", m.ID, m.Histogram.Bounds, m.Histogram.Counts, m.Histogram.Count, m.Histogram.Sum), key))
+	} else if m.MType == "set" {
+		h = hex.EncodeToString(hash(fmt.Sprintf("%s:set:%d:%x", m.ID, m.Set.Precision, m.Set.Registers), key))
+	} else if m.MType == "info" {
+		h = hex.EncodeToString(hash(fmt.Sprintf("%s:info:%s", m.ID, *m.Info), key))
 	} else {
 		h = hex.EncodeToString(hash(fmt.Sprintf("%s:gauge:%f", m.ID, *m.Value), key))
 	}
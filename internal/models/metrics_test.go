@@ -0,0 +1,91 @@
+package models
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHistogram_Observe(t *testing.T) {
+	h := NewHistogram([]float64{1, 2})
+	for _, v := range []float64{0.5, 1, 1.5, 3} {
+		h.Observe(v)
+	}
+	assert.Equal(t, []uint64{2, 1, 1}, h.Counts)
+	assert.Equal(t, uint64(4), h.Count)
+	assert.Equal(t, 6.0, h.Sum)
+	assert.NoError(t, h.Validate())
+}
+
+func TestHistogram_Validate(t *testing.T) {
+	tests := []struct {
+		name string
+		h    Histogram
+		err  error
+	}{
+		{name: "ok", h: Histogram{Bounds: []float64{1, 2}, Counts: []uint64{1, 0, 2}, Count: 3}},
+		{name: "no bounds", h: Histogram{Counts: []uint64{2}, Count: 2}},
+		{name: "wrong counts", h: Histogram{Bounds: []float64{1, 2}, Counts: []uint64{1, 2}, Count: 3}, err: ErrBadHistogram},
+		{name: "not sorted", h: Histogram{Bounds: []float64{2, 1}, Counts: []uint64{0, 0, 0}}, err: ErrBadHistogram},
+		{name: "wrong count", h: Histogram{Bounds: []float64{1}, Counts: []uint64{1, 1}, Count: 3}, err: ErrBadHistogram},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.err, tt.h.Validate())
+		})
+	}
+}
+
+func TestHistogram_Merge(t *testing.T) {
+	h := &Histogram{Bounds: []float64{1, 2}, Counts: []uint64{1, 0, 2}, Count: 3, Sum: 7}
+	h.Merge(&Histogram{Bounds: []float64{1, 2}, Counts: []uint64{0, 1, 0}, Count: 1, Sum: 1.5})
+	assert.Equal(t, &Histogram{Bounds: []float64{1, 2}, Counts: []uint64{1, 1, 2}, Count: 4, Sum: 8.5}, h)
+
+	// other buckets replace old observations
+	o := &Histogram{Bounds: []float64{5}, Counts: []uint64{1, 0}, Count: 1, Sum: 4}
+	h.Merge(o)
+	assert.Equal(t, o, h)
+	o.Counts[0] = 10
+	assert.Equal(t, uint64(1), h.Counts[0], "merged histogram must not share counts")
+}
+
+func TestHistogram_Quantile(t *testing.T) {
+	h := &Histogram{Bounds: []float64{1, 2, 4}, Counts: []uint64{2, 0, 4, 2}, Count: 8}
+	tests := []struct {
+		name string
+		q    float64
+		want float64
+	}{
+		{name: "min", q: 0, want: 0},
+		{name: "first bucket", q: 0.125, want: 0.5},
+		{name: "median", q: 0.5, want: 3},
+		{name: "last bucket", q: 0.99, want: 4},
+		{name: "bad q", q: 1.5, want: math.NaN()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := h.Quantile(tt.q)
+			if math.IsNaN(tt.want) {
+				assert.True(t, math.IsNaN(got))
+				return
+			}
+			assert.InDelta(t, tt.want, got, 1e-9)
+		})
+	}
+	assert.True(t, math.IsNaN(NewHistogram([]float64{1}).Quantile(0.5)))
+}
+
+func TestMetrics_CalcHashWithID(t *testing.T) {
+	v := 0.5
+	m := Metrics{ID: "Alloc", MType: "gauge", Value: &v}
+	m.CalcHash("secret")
+	plain := m.Hash
+	assert.Equal(t, "", m.HashKeyID())
+
+	m.CalcHashWithID("2024-10", "secret")
+	assert.Equal(t, "2024-10:"+plain, m.Hash)
+	assert.Equal(t, "2024-10", m.HashKeyID())
+	assert.NoError(t, m.CompareHash("secret"))
+	assert.Error(t, m.CompareHash("other"))
+}
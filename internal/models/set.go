@@ -0,0 +1,126 @@
+package models
+
+import (
+	"errors"
+	"hash/fnv"
+	"math"
+	"math/bits"
+)
+
+// Precision limits of set sketch, set has 2^precision registers.
+const (
+	MinSetPrecision     = 4
+	MaxSetPrecision     = 16
+	DefaultSetPrecision = 14
+)
+
+// ErrBadSet is returned for sets which registers do not agree with precision.
+var ErrBadSet = errors.New("set registers are not consistent")
+
+// Set counts distinct values approximately, it is a HyperLogLog sketch.
+// Agent sends sketch of values it has seen, server merges sketches, so only the estimated number of distinct values is known.
+type Set struct {
+	Precision uint8  `json:"precision"` // number of bits used to choose register
+	Registers []byte `json:"registers"` // max rank seen by every register, base64 in json
+}
+
+// NewSet initializes empty set with given precision.
+func NewSet(precision uint8) *Set {
+	return &Set{Precision: precision, Registers: make([]byte, 1<<precision)}
+}
+
+// Add puts value into set.
+func (s *Set) Add(v string) {
+	h := fnv.New64a()
+	h.Write([]byte(v))
+	x := mix(h.Sum64())
+
+	i := x >> (64 - s.Precision)
+	// rank is position of the first 1 bit after register bits, marker bit limits it if all bits are zero
+	w := x<<s.Precision | 1<<(s.Precision-1)
+	rank := byte(bits.LeadingZeros64(w) + 1)
+	if rank > s.Registers[i] {
+		s.Registers[i] = rank
+	}
+}
+
+// mix spreads bits of fnv hash, so that all of them are equally random.
+func mix(x uint64) uint64 {
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// Validate checks that precision is supported and registers agree with it.
+func (s *Set) Validate() error {
+	if s.Precision < MinSetPrecision || s.Precision > MaxSetPrecision {
+		return ErrBadSet
+	}
+	if len(s.Registers) != 1<<s.Precision {
+		return ErrBadSet
+	}
+	for _, r := range s.Registers {
+		if int(r) > 64-int(s.Precision)+1 {
+			return ErrBadSet
+		}
+	}
+	return nil
+}
+
+// Copy makes a deep copy of set.
+func (s *Set) Copy() *Set {
+	c := Set{Precision: s.Precision, Registers: make([]byte, len(s.Registers))}
+	copy(c.Registers, s.Registers)
+	return &c
+}
+
+// Merge adds values of other set.
+// If precision is different, set is replaced by the other one, like histograms with other buckets.
+func (s *Set) Merge(o *Set) {
+	if s.Precision != o.Precision || len(s.Registers) != len(o.Registers) {
+		*s = *o.Copy()
+		return
+	}
+	for i, r := range o.Registers {
+		if r > s.Registers[i] {
+			s.Registers[i] = r
+		}
+	}
+}
+
+// Estimate returns estimated number of distinct values.
+// Standard error is about 1.04/sqrt(2^precision), small sets are counted by empty registers (linear counting).
+func (s *Set) Estimate() uint64 {
+	m := float64(len(s.Registers))
+	if m == 0 {
+		return 0
+	}
+	var sum float64
+	zeros := 0
+	for _, r := range s.Registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+
+	var alpha float64
+	switch len(s.Registers) {
+	case 16:
+		alpha = 0.673
+	case 32:
+		alpha = 0.697
+	case 64:
+		alpha = 0.709
+	default:
+		alpha = 0.7213 / (1 + 1.079/m)
+	}
+	e := alpha * m * m / sum
+	if e <= 2.5*m && zeros > 0 {
+		e = m * math.Log(m/float64(zeros))
+	}
+	return uint64(e + 0.5)
+}
@@ -0,0 +1,68 @@
+package models
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSet_Estimate(t *testing.T) {
+	tests := []struct {
+		name string
+		n    int
+	}{
+		{name: "empty", n: 0},
+		{name: "small", n: 10},
+		{name: "medium", n: 1000},
+		{name: "large", n: 100000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewSet(DefaultSetPrecision)
+			for i := 0; i < tt.n; i++ {
+				// every value is added twice, duplicates must not be counted
+				s.Add(fmt.Sprintf("user-%d", i))
+				s.Add(fmt.Sprintf("user-%d", i))
+			}
+			assert.InDelta(t, float64(tt.n), float64(s.Estimate()), float64(tt.n)*0.03)
+		})
+	}
+}
+
+func TestSet_Merge(t *testing.T) {
+	a, b := NewSet(10), NewSet(10)
+	for i := 0; i < 500; i++ {
+		a.Add(fmt.Sprintf("a-%d", i))
+		b.Add(fmt.Sprintf("b-%d", i))
+		b.Add(fmt.Sprintf("a-%d", i))
+	}
+	a.Merge(b)
+	assert.InDelta(t, 1000, float64(a.Estimate()), 1000*0.1)
+
+	// other precision replaces old values
+	c := NewSet(4)
+	c.Add("c")
+	a.Merge(c)
+	assert.Equal(t, c, a)
+	c.Registers[0] = 10
+	assert.NotEqual(t, c, a, "merged set must not share registers")
+}
+
+func TestSet_Validate(t *testing.T) {
+	tests := []struct {
+		name string
+		s    Set
+		err  error
+	}{
+		{name: "ok", s: *NewSet(DefaultSetPrecision)},
+		{name: "low precision", s: *NewSet(2), err: ErrBadSet},
+		{name: "wrong registers", s: Set{Precision: 4, Registers: make([]byte, 8)}, err: ErrBadSet},
+		{name: "wrong rank", s: Set{Precision: 4, Registers: append(make([]byte, 15), 62)}, err: ErrBadSet},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.err, tt.s.Validate())
+		})
+	}
+}
@@ -0,0 +1,339 @@
+// Package query selects metrics by name and labels and aggregates them.
+// Labels are part of metric id, e.g. Alloc{agent="a1",env="prod"}, so queries work with any storage.
+package query
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/maffka123/metricCollector/internal/models"
+	"github.com/maffka123/metricCollector/internal/storage"
+)
+
+// Aggregations supported by the query.
+const (
+	AggSum   = "sum"
+	AggAvg   = "avg"
+	AggMin   = "min"
+	AggMax   = "max"
+	AggCount = "count"
+	AggTopK  = "topk"
+)
+
+// Functions applied to counters or histograms before aggregation.
+const (
+	FnRate     = "rate"
+	FnIncrease = "increase"
+	FnQuantile = "quantile"
+)
+
+// Counters tells how fast counters grow, e.g. rates.Tracker.
+type Counters interface {
+	Rate(id string, window time.Duration) (float64, bool)
+	Increase(id string, window time.Duration) (float64, bool)
+}
+
+// ErrBadQuery is returned when query cannot be executed.
+var ErrBadQuery = errors.New("bad query")
+
+// Matcher checks one label of a series.
+type Matcher struct {
+	Label string
+	Op    string // one of =, !=, =~, !~
+	Value string
+	re    *regexp.Regexp
+}
+
+// ParseMatcher parses matcher given like env=prod, env!=prod, env=~pr.* or env!~pr.*.
+func ParseMatcher(s string) (Matcher, error) {
+	i := strings.IndexAny(s, "=!")
+	if i < 1 {
+		return Matcher{}, fmt.Errorf("%w: matcher %q must look like label=value", ErrBadQuery, s)
+	}
+	m := Matcher{Label: s[:i]}
+	rest := s[i:]
+	for _, op := range []string{"=~", "!~", "!=", "="} {
+		if strings.HasPrefix(rest, op) {
+			m.Op = op
+			m.Value = rest[len(op):]
+			break
+		}
+	}
+	if m.Op == "" {
+		return Matcher{}, fmt.Errorf("%w: matcher %q has unknown operator", ErrBadQuery, s)
+	}
+	if m.Op == "=~" || m.Op == "!~" {
+		re, err := regexp.Compile("^(?:" + m.Value + ")$")
+		if err != nil {
+			return Matcher{}, fmt.Errorf("%w: %s", ErrBadQuery, err)
+		}
+		m.re = re
+	}
+	return m, nil
+}
+
+// Matches checks labels of a series, missing label has empty value.
+func (m Matcher) Matches(labels map[string]string) bool {
+	v := labels[m.Label]
+	switch m.Op {
+	case "=":
+		return v == m.Value
+	case "!=":
+		return v != m.Value
+	case "=~":
+		return m.re.MatchString(v)
+	default:
+		return !m.re.MatchString(v)
+	}
+}
+
+// Query describes which metrics are selected and how they are aggregated.
+type Query struct {
+	Name     string        // glob pattern for metric name, empty means all
+	MType    string        // metric type, empty means all
+	Matchers []Matcher     // all of them must match
+	Agg      string        // aggregation, empty means selected series are returned as they are
+	By       []string      // labels to group by
+	K        int           // how many series topk returns per group
+	Fn       string        // rate or increase of counters or quantile of histograms, other metrics are skipped
+	Window   time.Duration // window for rate and increase
+	Counters Counters      // needed for rate and increase
+	Quantile float64       // which quantile of histograms is calculated
+}
+
+// Sample is one result of the query, name is set only for series, not for aggregated values.
+type Sample struct {
+	Name   string            `json:"name,omitempty"`
+	Type   string            `json:"type,omitempty"`
+	Labels map[string]string `json:"labels"`
+	Value  float64           `json:"value"`
+}
+
+// Validate checks query before it is executed.
+func (q Query) Validate() error {
+	if q.Name != "" {
+		if _, err := path.Match(q.Name, ""); err != nil {
+			return fmt.Errorf("%w: %s", ErrBadQuery, err)
+		}
+	}
+	switch q.MType {
+	case "", "counter", "gauge", "histogram", "set":
+	default:
+		return fmt.Errorf("%w: unknown type %s", ErrBadQuery, q.MType)
+	}
+	switch q.Fn {
+	case "":
+	case FnRate, FnIncrease:
+		if q.Counters == nil {
+			return fmt.Errorf("%w: counter rates are not tracked", ErrBadQuery)
+		}
+		if q.Window <= 0 {
+			return fmt.Errorf("%w: %s needs window > 0", ErrBadQuery, q.Fn)
+		}
+	case FnQuantile:
+		if q.Quantile < 0 || q.Quantile > 1 {
+			return fmt.Errorf("%w: quantile must be between 0 and 1", ErrBadQuery)
+		}
+	default:
+		return fmt.Errorf("%w: unknown function %s", ErrBadQuery, q.Fn)
+	}
+	switch q.Agg {
+	case "", AggSum, AggAvg, AggMin, AggMax, AggCount:
+	case AggTopK:
+		if q.K < 1 {
+			return fmt.Errorf("%w: topk needs k > 0", ErrBadQuery)
+		}
+	default:
+		return fmt.Errorf("%w: unknown aggregation %s", ErrBadQuery, q.Agg)
+	}
+	return nil
+}
+
+// Select returns series matching the query, sorted by name and labels.
+func (q Query) Select(db storage.Repositories) []Sample {
+	res := []Sample{}
+	for _, m := range db.SelectMetrics() {
+		if q.MType != "" && m.MType != q.MType {
+			continue
+		}
+		if !q.accepts(m.MType) {
+			continue
+		}
+		name, labels, err := models.SplitID(m.ID)
+		if err != nil {
+			continue
+		}
+		if q.Name != "" {
+			if ok, _ := path.Match(q.Name, name); !ok {
+				continue
+			}
+		}
+		if !q.matches(labels) {
+			continue
+		}
+		s := Sample{Name: name, Type: m.MType, Labels: labels, Value: value(m)}
+		switch q.Fn {
+		case FnQuantile:
+			if s.Value = m.Histogram.Quantile(q.Quantile); math.IsNaN(s.Value) {
+				continue
+			}
+		case FnRate, FnIncrease:
+			var ok bool
+			if s.Value, ok = q.Apply(m.ID); !ok {
+				continue
+			}
+		}
+		res = append(res, s)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].key() < res[j].key() })
+	return res
+}
+
+// Exec selects series and aggregates them.
+func (q Query) Exec(db storage.Repositories) ([]Sample, error) {
+	if err := q.Validate(); err != nil {
+		return nil, err
+	}
+	series := q.Select(db)
+	if q.Agg == "" {
+		return series, nil
+	}
+
+	groups := map[string][]Sample{}
+	var keys []string
+	for _, s := range series {
+		k := groupKey(s.Labels, q.By)
+		if _, ok := groups[k]; !ok {
+			keys = append(keys, k)
+		}
+		groups[k] = append(groups[k], s)
+	}
+	sort.Strings(keys)
+
+	res := []Sample{}
+	for _, k := range keys {
+		g := groups[k]
+		if q.Agg == AggTopK {
+			sort.SliceStable(g, func(i, j int) bool { return g[i].Value > g[j].Value })
+			if len(g) > q.K {
+				g = g[:q.K]
+			}
+			res = append(res, g...)
+			continue
+		}
+		res = append(res, Sample{Labels: groupLabels(g[0].Labels, q.By), Value: aggregate(q.Agg, g)})
+	}
+	return res, nil
+}
+
+// accepts checks if function can be applied to metrics of given type.
+// Without function histograms and infos are skipped, because they have no single numeric value.
+func (q Query) accepts(mType string) bool {
+	switch q.Fn {
+	case FnRate, FnIncrease:
+		return mType == "counter"
+	case FnQuantile:
+		return mType == "histogram"
+	}
+	return mType != "histogram" && mType != "info"
+}
+
+// Apply calculates rate or increase for the counter, false is returned if it cannot be calculated yet.
+func (q Query) Apply(id string) (float64, bool) {
+	if q.Fn == FnRate {
+		return q.Counters.Rate(id, q.Window)
+	}
+	return q.Counters.Increase(id, q.Window)
+}
+
+func (q Query) matches(labels map[string]string) bool {
+	for _, m := range q.Matchers {
+		if !m.Matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+// aggregate calculates aggregation over group of series.
+func aggregate(agg string, g []Sample) float64 {
+	switch agg {
+	case AggCount:
+		return float64(len(g))
+	case AggMin:
+		v := math.Inf(1)
+		for _, s := range g {
+			v = math.Min(v, s.Value)
+		}
+		return v
+	case AggMax:
+		v := math.Inf(-1)
+		for _, s := range g {
+			v = math.Max(v, s.Value)
+		}
+		return v
+	}
+	var sum float64
+	for _, s := range g {
+		sum += s.Value
+	}
+	if agg == AggAvg {
+		return sum / float64(len(g))
+	}
+	return sum
+}
+
+// value returns metric value independent of its type.
+func value(m models.Metrics) float64 {
+	if m.MType == "counter" && m.Delta != nil {
+		return float64(*m.Delta)
+	}
+	if m.MType == "set" && m.Set != nil {
+		return float64(m.Set.Estimate())
+	}
+	if m.Value != nil {
+		return *m.Value
+	}
+	return 0
+}
+
+// groupLabels keeps only labels used for grouping.
+func groupLabels(labels map[string]string, by []string) map[string]string {
+	res := make(map[string]string, len(by))
+	for _, l := range by {
+		res[l] = labels[l]
+	}
+	return res
+}
+
+// groupKey builds string which is the same for all series of a group.
+func groupKey(labels map[string]string, by []string) string {
+	var b strings.Builder
+	for _, l := range by {
+		b.WriteString(strconv.Quote(labels[l]))
+		b.WriteByte(',')
+	}
+	return b.String()
+}
+
+// key builds string to sort series.
+func (s Sample) key() string {
+	keys := make([]string, 0, len(s.Labels))
+	for k := range s.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.WriteString(s.Name)
+	for _, k := range keys {
+		b.WriteString("," + k + "=" + strconv.Quote(s.Labels[k]))
+	}
+	return b.String()
+}
@@ -0,0 +1,109 @@
+package query
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/maffka123/metricCollector/internal/server/config"
+	"github.com/maffka123/metricCollector/internal/storage"
+)
+
+func prepDB() storage.Repositories {
+	db := storage.Connect(&config.Config{}, zap.NewNop())
+	db.InsertGouge(`Alloc{agent="a1",env="prod"}`, 10)
+	db.InsertGouge(`Alloc{agent="a2",env="prod"}`, 30)
+	db.InsertGouge(`Alloc{agent="a3",env="test"}`, 5)
+	db.InsertGouge("Alloc", 1)
+	db.InsertGouge(`HeapAlloc{agent="a1",env="prod"}`, 7)
+	db.InsertCounter(`PollCount{agent="a1",env="prod"}`, 3)
+	return db
+}
+
+func TestParseMatcher(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       string
+		want    Matcher
+		wantErr bool
+	}{
+		{name: "equal", s: "env=prod", want: Matcher{Label: "env", Op: "=", Value: "prod"}},
+		{name: "not equal", s: "env!=prod", want: Matcher{Label: "env", Op: "!=", Value: "prod"}},
+		{name: "empty value", s: "env=", want: Matcher{Label: "env", Op: "=", Value: ""}},
+		{name: "no label", s: "=prod", wantErr: true},
+		{name: "no operator", s: "env", wantErr: true},
+		{name: "bad regexp", s: "env=~(", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseMatcher(tt.s)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrBadQuery)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	m, err := ParseMatcher("env=~pr.*")
+	require.NoError(t, err)
+	assert.True(t, m.Matches(map[string]string{"env": "prod"}))
+	assert.False(t, m.Matches(map[string]string{"env": "test"}))
+	m, err = ParseMatcher("env!~pr.*")
+	require.NoError(t, err)
+	assert.True(t, m.Matches(map[string]string{}))
+}
+
+func TestQuery_Exec(t *testing.T) {
+	db := prepDB()
+	prod := Matcher{Label: "env", Op: "=", Value: "prod"}
+	tests := []struct {
+		name    string
+		q       Query
+		want    []Sample
+		wantErr bool
+	}{
+		{name: "select", q: Query{Name: "Alloc", Matchers: []Matcher{prod}}, want: []Sample{
+			{Name: "Alloc", Type: "gauge", Labels: map[string]string{"agent": "a1", "env": "prod"}, Value: 10},
+			{Name: "Alloc", Type: "gauge", Labels: map[string]string{"agent": "a2", "env": "prod"}, Value: 30},
+		}},
+		{name: "sum by env", q: Query{Name: "Alloc", Agg: AggSum, By: []string{"env"}}, want: []Sample{
+			{Labels: map[string]string{"env": ""}, Value: 1},
+			{Labels: map[string]string{"env": "prod"}, Value: 40},
+			{Labels: map[string]string{"env": "test"}, Value: 5},
+		}},
+		{name: "avg", q: Query{Name: "Alloc", Matchers: []Matcher{prod}, Agg: AggAvg}, want: []Sample{
+			{Labels: map[string]string{}, Value: 20},
+		}},
+		{name: "min", q: Query{Name: "*Alloc", Agg: AggMin}, want: []Sample{{Labels: map[string]string{}, Value: 1}}},
+		{name: "max", q: Query{Name: "*Alloc", Agg: AggMax}, want: []Sample{{Labels: map[string]string{}, Value: 30}}},
+		{name: "count by agent", q: Query{MType: "gauge", Matchers: []Matcher{prod}, Agg: AggCount, By: []string{"agent"}}, want: []Sample{
+			{Labels: map[string]string{"agent": "a1"}, Value: 2},
+			{Labels: map[string]string{"agent": "a2"}, Value: 1},
+		}},
+		{name: "topk", q: Query{Name: "Alloc", Agg: AggTopK, K: 1, By: []string{"env"}}, want: []Sample{
+			{Name: "Alloc", Type: "gauge", Labels: map[string]string{}, Value: 1},
+			{Name: "Alloc", Type: "gauge", Labels: map[string]string{"agent": "a2", "env": "prod"}, Value: 30},
+			{Name: "Alloc", Type: "gauge", Labels: map[string]string{"agent": "a3", "env": "test"}, Value: 5},
+		}},
+		{name: "counter", q: Query{MType: "counter", Agg: AggSum}, want: []Sample{{Labels: map[string]string{}, Value: 3}}},
+		{name: "nothing", q: Query{Name: "Unknown", Agg: AggSum}, want: []Sample{}},
+		{name: "topk without k", q: Query{Agg: AggTopK}, wantErr: true},
+		{name: "unknown agg", q: Query{Agg: "median"}, wantErr: true},
+		{name: "bad pattern", q: Query{Name: "["}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.q.Exec(db)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrBadQuery)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,233 @@
+// Package rates calculates how fast counters grow.
+// Storage keeps only running totals of counters, so tracker samples them periodically and keeps the samples for a window.
+// If counter value goes down (counter was reset or deleted and written again), it is treated as counter started from zero.
+// Samples of other numeric metrics are kept as well, so that recent history of every metric can be shown.
+package rates
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/maffka123/metricCollector/internal/models"
+	"github.com/maffka123/metricCollector/internal/server/config"
+	"github.com/maffka123/metricCollector/internal/storage"
+)
+
+// point is one sample of a counter.
+type point struct {
+	t time.Time
+	v float64
+}
+
+// Point is one sample of metric value.
+type Point struct {
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+}
+
+// History holds recent samples of one metric, oldest first.
+type History struct {
+	ID     string  `json:"id"`
+	MType  string  `json:"type"`
+	Points []Point `json:"points"`
+}
+
+// Tracker holds recent samples of all counters and other numeric metrics.
+type Tracker struct {
+	db       storage.Repositories
+	interval time.Duration
+	window   time.Duration
+	series   map[string][]point // counters by id
+	values   map[key][]point    // other numeric metrics
+	mu       sync.RWMutex
+	log      *zap.Logger
+}
+
+// key identifies metric which is not a counter.
+type key struct {
+	mType string
+	id    string
+}
+
+// NewTracker initializes tracker, sampling is not started yet.
+func NewTracker(db storage.Repositories, cfg *config.Config, logger *zap.Logger) *Tracker {
+	t := Tracker{
+		db:       db,
+		interval: cfg.RateInterval,
+		window:   cfg.RateWindow,
+		series:   map[string][]point{},
+		values:   map[key][]point{},
+		log:      logger,
+	}
+	if t.interval <= 0 {
+		t.interval = 10 * time.Second
+	}
+	if t.window < t.interval {
+		t.window = t.interval
+	}
+	return &t
+}
+
+// Window returns for how long samples are kept.
+func (t *Tracker) Window() time.Duration {
+	return t.window
+}
+
+// Start samples counters until context is done.
+func (t *Tracker) Start(ctx context.Context) {
+	t.Sample(time.Now())
+	go func() {
+		ticker := time.NewTicker(t.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				t.Sample(now)
+			}
+		}
+	}()
+	t.log.Info("Counter rates are tracked", zap.Duration("interval", t.interval), zap.Duration("window", t.window))
+}
+
+// Sample records current values of all counters and other numeric metrics, and forgets samples older than window.
+func (t *Tracker) Sample(now time.Time) {
+	ms := t.db.SelectMetrics()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	seen := make(map[string]bool, len(t.series))
+	values := make(map[key][]point, len(t.values))
+	for _, m := range ms {
+		if m.MType == "counter" && m.Delta != nil {
+			seen[m.ID] = true
+			t.series[m.ID] = append(dropBefore(t.series[m.ID], now.Add(-t.window)), point{t: now, v: float64(*m.Delta)})
+			continue
+		}
+		// unlike counters, samples of deleted metrics are not needed, so they are dropped
+		if v, ok := numeric(m); ok {
+			k := key{m.MType, m.ID}
+			values[k] = append(dropBefore(t.values[k], now.Add(-t.window)), point{t: now, v: v})
+		}
+	}
+	t.values = values
+	for id, ps := range t.series {
+		if seen[id] {
+			continue
+		}
+		// counter is not in db anymore, keep what was before, so that increase before deletion is not lost
+		if ps = dropBefore(ps, now.Add(-t.window)); len(ps) == 0 {
+			delete(t.series, id)
+		} else {
+			t.series[id] = ps
+		}
+	}
+}
+
+// numeric returns value of gauge, count of histogram and estimate of set, infos have no numeric value.
+func numeric(m models.Metrics) (float64, bool) {
+	switch {
+	case m.MType == "gauge" && m.Value != nil:
+		return *m.Value, true
+	case m.MType == "histogram" && m.Histogram != nil:
+		return float64(m.Histogram.Count), true
+	case m.MType == "set" && m.Set != nil:
+		return float64(m.Set.Estimate()), true
+	}
+	return 0, false
+}
+
+// History returns samples within the window of all sampled metrics, sorted by type and id.
+func (t *Tracker) History() []History {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	res := make([]History, 0, len(t.series)+len(t.values))
+	for id, ps := range t.series {
+		res = append(res, History{ID: id, MType: "counter", Points: points(ps)})
+	}
+	for k, ps := range t.values {
+		res = append(res, History{ID: k.id, MType: k.mType, Points: points(ps)})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].MType == res[j].MType {
+			return res[i].ID < res[j].ID
+		}
+		return res[i].MType < res[j].MType
+	})
+	return res
+}
+
+// points copies samples for History.
+func points(ps []point) []Point {
+	res := make([]Point, len(ps))
+	for i, p := range ps {
+		res[i] = Point{Time: p.t, Value: p.v}
+	}
+	return res
+}
+
+// Increase returns how much counter grew within the window till now.
+// False is returned if there is not enough samples to tell.
+func (t *Tracker) Increase(id string, window time.Duration) (float64, bool) {
+	ps, ok := t.points(id, window)
+	if !ok {
+		return 0, false
+	}
+	return increase(ps), true
+}
+
+// Rate returns per-second growth of the counter within the window till now.
+// False is returned if there is not enough samples to tell.
+func (t *Tracker) Rate(id string, window time.Duration) (float64, bool) {
+	ps, ok := t.points(id, window)
+	if !ok {
+		return 0, false
+	}
+	elapsed := ps[len(ps)-1].t.Sub(ps[0].t).Seconds()
+	if elapsed <= 0 {
+		return 0, false
+	}
+	return increase(ps) / elapsed, true
+}
+
+// points returns samples within the window together with current counter value.
+func (t *Tracker) points(id string, window time.Duration) ([]point, bool) {
+	now := time.Now()
+	t.mu.RLock()
+	ps := dropBefore(t.series[id], now.Add(-window))
+	res := make([]point, len(ps), len(ps)+1)
+	copy(res, ps)
+	t.mu.RUnlock()
+
+	if t.db.NameInCounter(id) {
+		res = append(res, point{t: now, v: float64(t.db.ValueFromCounter(id))})
+	}
+	return res, len(res) > 1
+}
+
+// increase sums growth between samples, after reset counter starts from zero.
+func increase(ps []point) float64 {
+	var inc float64
+	for i := 1; i < len(ps); i++ {
+		if d := ps[i].v - ps[i-1].v; d >= 0 {
+			inc += d
+		} else {
+			inc += ps[i].v
+		}
+	}
+	return inc
+}
+
+// dropBefore removes samples older than given time.
+func dropBefore(ps []point, before time.Time) []point {
+	i := 0
+	for i < len(ps) && ps[i].t.Before(before) {
+		i++
+	}
+	return ps[i:]
+}
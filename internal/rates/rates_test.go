@@ -0,0 +1,103 @@
+package rates
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"github.com/maffka123/metricCollector/internal/models"
+	"github.com/maffka123/metricCollector/internal/server/config"
+	"github.com/maffka123/metricCollector/internal/storage"
+)
+
+func TestTracker(t *testing.T) {
+	db := storage.Connect(&config.Config{}, zap.NewNop())
+	tracker := NewTracker(db, &config.Config{RateInterval: 10 * time.Second, RateWindow: time.Minute}, zap.NewNop())
+	now := time.Now()
+
+	db.InsertCounter("PollCount", 10)
+	db.InsertGouge("Alloc", 1)
+	tracker.Sample(now.Add(-30 * time.Second))
+	db.InsertCounter("PollCount", 5)
+	tracker.Sample(now.Add(-20 * time.Second))
+	// counter is reset, so growth after reset is counted from zero
+	db.ResetCounter("PollCount")
+	db.InsertCounter("PollCount", 4)
+	tracker.Sample(now.Add(-10 * time.Second))
+
+	inc, ok := tracker.Increase("PollCount", time.Minute)
+	assert.True(t, ok)
+	assert.Equal(t, float64(9), inc)
+
+	rate, ok := tracker.Rate("PollCount", time.Minute)
+	assert.True(t, ok)
+	assert.InDelta(t, 0.3, rate, 0.01)
+
+	inc, ok = tracker.Increase("PollCount", 15*time.Second)
+	assert.True(t, ok)
+	assert.Equal(t, float64(0), inc)
+
+	_, ok = tracker.Rate("Alloc", time.Minute)
+	assert.False(t, ok)
+	_, ok = tracker.Rate("Unknown", time.Minute)
+	assert.False(t, ok)
+
+	// old samples are forgotten
+	tracker.Sample(now.Add(time.Minute))
+	assert.Len(t, tracker.series["PollCount"], 1)
+
+	db.DeleteMetric("counter", "PollCount")
+	tracker.Sample(now.Add(3 * time.Minute))
+	assert.Empty(t, tracker.series)
+}
+
+func TestTracker_History(t *testing.T) {
+	db := storage.Connect(&config.Config{}, zap.NewNop())
+	tracker := NewTracker(db, &config.Config{RateInterval: 10 * time.Second, RateWindow: time.Minute}, zap.NewNop())
+	now := time.Now()
+
+	db.InsertCounter("PollCount", 10)
+	db.InsertGouge("Alloc", 1)
+	db.InsertHistogram("GCPause", &models.Histogram{Bounds: []float64{1}, Counts: []uint64{1, 1}, Count: 2, Sum: 3})
+	db.InsertInfo("Version", "v1")
+	tracker.Sample(now.Add(-20 * time.Second))
+	db.InsertCounter("PollCount", 5)
+	db.InsertGouge("Alloc", 2)
+	tracker.Sample(now.Add(-10 * time.Second))
+
+	assert.Equal(t, []History{
+		{ID: "PollCount", MType: "counter", Points: []Point{{Time: now.Add(-20 * time.Second), Value: 10}, {Time: now.Add(-10 * time.Second), Value: 15}}},
+		{ID: "Alloc", MType: "gauge", Points: []Point{{Time: now.Add(-20 * time.Second), Value: 1}, {Time: now.Add(-10 * time.Second), Value: 2}}},
+		{ID: "GCPause", MType: "histogram", Points: []Point{{Time: now.Add(-20 * time.Second), Value: 2}, {Time: now.Add(-10 * time.Second), Value: 2}}},
+	}, tracker.History())
+
+	// samples of deleted gauge are dropped, old samples are forgotten
+	db.DeleteMetric("gauge", "Alloc")
+	tracker.Sample(now.Add(time.Minute))
+	history := tracker.History()
+	assert.Len(t, history, 2)
+	assert.Equal(t, []Point{{Time: now.Add(time.Minute), Value: 15}}, history[0].Points)
+}
+
+func Test_increase(t *testing.T) {
+	tests := []struct {
+		name string
+		vs   []float64
+		want float64
+	}{
+		{name: "growing", vs: []float64{1, 2, 5}, want: 4},
+		{name: "reset", vs: []float64{10, 12, 3, 4}, want: 6},
+		{name: "one sample", vs: []float64{10}, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ps := make([]point, 0, len(tt.vs))
+			for _, v := range tt.vs {
+				ps = append(ps, point{v: v})
+			}
+			assert.Equal(t, tt.want, increase(ps))
+		})
+	}
+}
@@ -0,0 +1,151 @@
+// Package replay rejects replayed writes. Agents sign every request with a timestamp and a random nonce,
+// server accepts only fresh timestamps and remembers nonces while they are fresh, so a captured request cannot be sent again.
+package replay
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/maffka123/metricCollector/internal/hashkeys"
+	"github.com/maffka123/metricCollector/internal/server/config"
+)
+
+// Reasons of rejection sent in hashkeys.RejectHeader.
+const (
+	ReasonMissing   = "missing-signature"
+	ReasonTimestamp = "bad-timestamp"
+	ReasonStale     = "stale"
+	ReasonReplayed  = "replayed"
+	ReasonSignature = "bad-signature"
+	ReasonKey       = "unknown-key"
+)
+
+// pruneInterval is how often nonces which are not fresh anymore are forgotten.
+const pruneInterval = time.Minute
+
+// Guard checks request signatures, freshness of their timestamps and uniqueness of their nonces.
+type Guard struct {
+	keys      hashkeys.Ring
+	window    time.Duration
+	require   bool
+	nonces    map[string]time.Time
+	lastPrune time.Time
+	mu        sync.Mutex
+	log       *zap.Logger
+}
+
+// NewGuard initializes guard, nil is returned if there are no keys, so that unsigned deployments work as before.
+// Timestamps can differ from server time by window in both directions.
+func NewGuard(keys hashkeys.Ring, cfg *config.Config, logger *zap.Logger) *Guard {
+	if !keys.Enabled() {
+		return nil
+	}
+	window := cfg.SignWindow
+	if window <= 0 {
+		window = 5 * time.Minute
+	}
+	return &Guard{
+		keys:      keys,
+		window:    window,
+		require:   !cfg.AllowUnsigned,
+		nonces:    map[string]time.Time{},
+		lastPrune: time.Now(),
+		log:       logger,
+	}
+}
+
+// rejection is why request is not accepted.
+type rejection struct {
+	reason string
+	msg    string
+}
+
+// Check lets through only fresh signed requests which were not seen before, nil guard lets everything through.
+// Requests without signature are let through too only if they are explicitly allowed, per metric hashes are still checked for them.
+// Body must be decoded already, as it is signed before compression and encryption.
+func (g *Guard) Check(next http.Handler) http.HandlerFunc {
+	if g == nil {
+		return next.ServeHTTP
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(hashkeys.SignatureHeader) == "" && !g.require {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("400 - Body cannot be read: %s", err), http.StatusBadRequest)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		if rej := g.verify(r, body, time.Now()); rej != nil {
+			g.log.Warn("Request is rejected", zap.String("reason", rej.reason), zap.String("remote_addr", r.RemoteAddr))
+			w.Header().Set(hashkeys.RejectHeader, rej.reason)
+			http.Error(w, "400 - Request is rejected: "+rej.msg, http.StatusBadRequest)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+// verify checks request, nonce is remembered only if everything else is right, so that it cannot be taken by a forged request.
+func (g *Guard) verify(r *http.Request, body []byte, now time.Time) *rejection {
+	h := r.Header
+	if h.Get(hashkeys.SignatureHeader) == "" {
+		return &rejection{ReasonMissing, "request signature is required"}
+	}
+	sec, err := strconv.ParseInt(h.Get(hashkeys.TimestampHeader), 10, 64)
+	nonce := h.Get(hashkeys.NonceHeader)
+	if err != nil || nonce == "" {
+		return &rejection{ReasonTimestamp, "timestamp and nonce must be given"}
+	}
+	ts := time.Unix(sec, 0)
+	if ts.Before(now.Add(-g.window)) || ts.After(now.Add(g.window)) {
+		return &rejection{ReasonStale, fmt.Sprintf("timestamp is off server time %s by more than %s", now.UTC().Format(time.RFC3339), g.window)}
+	}
+	if err := g.keys.VerifyRequest(r, body); err != nil {
+		if errors.Is(err, hashkeys.ErrUnknownKey) {
+			return &rejection{ReasonKey, err.Error()}
+		}
+		return &rejection{ReasonSignature, "signature does not agree"}
+	}
+	if !g.remember(nonce, ts.Add(g.window), now) {
+		return &rejection{ReasonReplayed, "nonce was already used"}
+	}
+	return nil
+}
+
+// remember keeps nonce until it expires, false is returned if it is kept already.
+func (g *Guard) remember(nonce string, expires time.Time, now time.Time) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if now.Sub(g.lastPrune) > pruneInterval {
+		g.prune(now)
+	}
+	if exp, ok := g.nonces[nonce]; ok && now.Before(exp) {
+		return false
+	}
+	g.nonces[nonce] = expires
+	return true
+}
+
+// prune forgets expired nonces, requests with them are stale anyway, g.mu must be held.
+func (g *Guard) prune(now time.Time) {
+	for n, exp := range g.nonces {
+		if !now.Before(exp) {
+			delete(g.nonces, n)
+		}
+	}
+	g.lastPrune = now
+}
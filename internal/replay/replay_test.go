@@ -0,0 +1,150 @@
+package replay
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/maffka123/metricCollector/internal/hashkeys"
+	"github.com/maffka123/metricCollector/internal/server/config"
+)
+
+var logger *zap.Logger = zap.NewNop()
+
+var keys = hashkeys.New(hashkeys.Key{ID: "k1", Secret: "secret"})
+
+func TestNewGuard(t *testing.T) {
+	assert.Nil(t, NewGuard(hashkeys.Ring{}, &config.Config{}, logger))
+	g := NewGuard(keys, &config.Config{}, logger)
+	require.NotNil(t, g)
+	assert.Equal(t, 5*time.Minute, g.window)
+	assert.True(t, g.require, "signature is required unless unsigned requests are allowed")
+	assert.False(t, NewGuard(keys, &config.Config{AllowUnsigned: true}, logger).require)
+
+	// nil guard lets everything through
+	g = nil
+	w := httptest.NewRecorder()
+	g.Check(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/updates/", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestGuard_verify(t *testing.T) {
+	g := NewGuard(keys, &config.Config{SignWindow: time.Minute}, logger)
+	now := time.Unix(1700000000, 0)
+	body := []byte(`[{"id":"PollCount","type":"counter","delta":1}]`)
+	signed := func(at time.Time) http.Header {
+		r := httptest.NewRequest(http.MethodPost, "/updates/", nil)
+		require.NoError(t, keys.SignRequest(r, body, at))
+		return r.Header
+	}
+	request := func(method, uri string, h http.Header) *http.Request {
+		r := httptest.NewRequest(method, uri, nil)
+		r.Header = h
+		return r
+	}
+	first := signed(now)
+
+	tests := []struct {
+		name   string
+		method string
+		uri    string
+		header http.Header
+		body   []byte
+		want   string
+	}{
+		{name: "fresh", header: first, body: body},
+		{name: "replayed", header: first, body: body, want: ReasonReplayed},
+		{name: "a bit late", header: signed(now.Add(-50 * time.Second)), body: body},
+		{name: "a bit early", header: signed(now.Add(50 * time.Second)), body: body},
+		{name: "stale", header: signed(now.Add(-2 * time.Minute)), body: body, want: ReasonStale},
+		{name: "from future", header: signed(now.Add(2 * time.Minute)), body: body, want: ReasonStale},
+		{name: "no signature", header: http.Header{}, body: body, want: ReasonMissing},
+		{name: "no timestamp", header: http.Header{hashkeys.SignatureHeader: {"k1:00"}}, body: body, want: ReasonTimestamp},
+		{name: "changed body", header: signed(now), body: []byte(`[{"id":"PollCount","type":"counter","delta":100}]`), want: ReasonSignature},
+		{name: "changed path", uri: "/api/v2/metrics", header: signed(now), body: body, want: ReasonSignature},
+		{name: "changed query", uri: "/updates/?id=a1", header: signed(now), body: body, want: ReasonSignature},
+		{name: "changed method", method: http.MethodPut, header: signed(now), body: body, want: ReasonSignature},
+		{name: "unknown key", header: http.Header{
+			hashkeys.TimestampHeader: {"1700000000"}, hashkeys.NonceHeader: {"n1"}, hashkeys.SignatureHeader: {"k0:00"},
+		}, body: body, want: ReasonKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method, uri := http.MethodPost, "/updates/"
+			if tt.method != "" {
+				method = tt.method
+			}
+			if tt.uri != "" {
+				uri = tt.uri
+			}
+			rej := g.verify(request(method, uri, tt.header), tt.body, now)
+			if tt.want == "" {
+				assert.Nil(t, rej)
+				return
+			}
+			require.NotNil(t, rej)
+			assert.Equal(t, tt.want, rej.reason)
+		})
+	}
+
+	// nonce of rejected request is not taken
+	h := signed(now)
+	assert.NotNil(t, g.verify(request(http.MethodPost, "/updates/", h), []byte(`[]`), now))
+	assert.Nil(t, g.verify(request(http.MethodPost, "/updates/", h), body, now))
+
+	// expired nonces are forgotten, their requests are stale anyway
+	g.prune(now.Add(2 * time.Minute))
+	assert.Empty(t, g.nonces)
+	assert.Equal(t, ReasonStale, g.verify(request(http.MethodPost, "/updates/", first), body, now.Add(2*time.Minute)).reason)
+}
+
+func TestGuard_Check(t *testing.T) {
+	body := `[{"id":"PollCount","type":"counter","delta":1}]`
+	signed := httptest.NewRequest(http.MethodPost, "/updates/", nil)
+	require.NoError(t, keys.SignRequest(signed, []byte(body), time.Now()))
+	h := signed.Header
+
+	tests := []struct {
+		name          string
+		allowUnsigned bool
+		header        http.Header
+		statusCode    int
+		reason        string
+		want          string
+	}{
+		{name: "unsigned when allowed", allowUnsigned: true, header: http.Header{}, statusCode: 200, want: body},
+		{name: "signed", header: h, statusCode: 200, want: body},
+		{name: "replayed", header: h, statusCode: 400, reason: ReasonReplayed, want: "400 - Request is rejected: nonce was already used\n"},
+		{name: "unsigned", header: http.Header{}, statusCode: 400, reason: ReasonMissing,
+			want: "400 - Request is rejected: request signature is required\n"},
+	}
+	guards := map[bool]*Guard{
+		false: NewGuard(keys, &config.Config{}, logger),
+		true:  NewGuard(keys, &config.Config{AllowUnsigned: true}, logger),
+	}
+	echo := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		w.Write(b)
+	})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPost, "/updates/", strings.NewReader(body))
+			for k, v := range tt.header {
+				request.Header[k] = v
+			}
+			w := httptest.NewRecorder()
+			guards[tt.allowUnsigned].Check(echo).ServeHTTP(w, request)
+
+			assert.Equal(t, tt.statusCode, w.Code)
+			assert.Equal(t, tt.reason, w.Header().Get(hashkeys.RejectHeader))
+			assert.Equal(t, tt.want, w.Body.String())
+		})
+	}
+}
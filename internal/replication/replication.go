@@ -0,0 +1,665 @@
+// Package replication implements primary/replica replication between metric servers.
+//
+// Primary wraps its storage: every applied write is appended to an in-memory log of numbered entries,
+// which is streamed over http to all configured replicas. Replicas apply entries strictly in order,
+// serve only read endpoints and can be promoted to primary.
+// Replica which is new, was restarted, fell behind the log or followed another primary gets a snapshot
+// of the whole db first, and entries after it.
+// Stale metrics are not replicated as deletions, every node evicts them on its own.
+package replication
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap"
+
+	"github.com/maffka123/metricCollector/internal/models"
+	"github.com/maffka123/metricCollector/internal/server/config"
+	"github.com/maffka123/metricCollector/internal/storage"
+)
+
+// Server roles.
+const (
+	RolePrimary = "primary"
+	RoleReplica = "replica"
+)
+
+// sendBatch is how many entries are sent to a replica in one request.
+const sendBatch = 100
+
+// Operations which can be replicated besides inserting metrics.
+const (
+	opInsert         = ""
+	opDelete         = "delete"
+	opDeleteMatching = "delete_matching"
+	opReset          = "reset"
+	opRetype         = "retype"
+	opMeta           = "meta"
+)
+
+// Entry is one applied write, it is sent from primary to replicas.
+type Entry struct {
+	Epoch   int64            `json:"epoch"`
+	Seq     uint64           `json:"seq"`
+	Time    time.Time        `json:"time"`
+	Op      string           `json:"op,omitempty"`
+	Pattern string           `json:"pattern,omitempty"`
+	Metrics []models.Metrics `json:"metrics,omitempty"`
+	Meta    *models.Meta     `json:"meta,omitempty"`
+}
+
+// Snapshot is the whole db of primary at entry Seq, it replaces db of a replica which cannot catch up from the log.
+type Snapshot struct {
+	Epoch   int64            `json:"epoch"`
+	Seq     uint64           `json:"seq"`
+	Time    time.Time        `json:"time"`
+	Metrics []models.Metrics `json:"metrics"`
+	Meta    []models.Meta    `json:"meta"`
+}
+
+// ReplicaStatus shows how far a replica is behind primary.
+type ReplicaStatus struct {
+	Address    string  `json:"address"`
+	AckedSeq   uint64  `json:"acked_seq"`
+	LagEntries uint64  `json:"lag_entries"`
+	LagSeconds float64 `json:"lag_seconds"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// Status is returned by status endpoint of both primary and replica.
+type Status struct {
+	Role string `json:"role"`
+	// epoch of primary, on replica the one of applied entries
+	Epoch int64 `json:"epoch,omitempty"`
+	// primary
+	Seq      uint64          `json:"seq"`
+	Replicas []ReplicaStatus `json:"replicas,omitempty"`
+	// replica
+	AppliedSeq    uint64     `json:"applied_seq"`
+	LastAppliedAt *time.Time `json:"last_applied_at,omitempty"`
+	LagSeconds    float64    `json:"lag_seconds"`
+}
+
+// replica holds streaming state of one replica on primary side.
+type replica struct {
+	address string
+	epoch   int64 // epoch replica follows, it gets a snapshot if it is not the current one
+	acked   uint64
+	err     error
+	notify  chan struct{}
+}
+
+// Node wraps storage of a server taking part in replication.
+type Node struct {
+	storage.Repositories
+	role   string
+	epoch  int64
+	seq    uint64
+	log    []Entry
+	maxLog int
+
+	replicaAddresses []string
+	replicas         []*replica
+	key              string // API key sent to replicas
+	adminUser        string // admin credentials sent to replicas if there is no API key
+	adminPassword    string
+
+	appliedEpoch int64
+	applied      uint64
+	lastEntry    time.Time
+	lastApplied  time.Time
+
+	client *http.Client
+	logger *zap.Logger
+	mu     sync.Mutex
+	ctx    context.Context
+}
+
+// NewNode wraps db into replication node with role from config.
+func NewNode(db storage.Repositories, cfg *config.Config, logger *zap.Logger) *Node {
+	n := Node{
+		Repositories:     db,
+		role:             cfg.Role,
+		epoch:            time.Now().UnixNano(),
+		maxLog:           cfg.ReplicationLog,
+		replicaAddresses: cfg.Replicas,
+		key:              cfg.ReplicationKey,
+		adminUser:        cfg.AdminUser,
+		adminPassword:    cfg.AdminPassword,
+		client:           &http.Client{Timeout: 5 * time.Second},
+		logger:           logger,
+	}
+	if n.maxLog <= 0 {
+		n.maxLog = 10000
+	}
+	if n.role == "" {
+		n.role = RolePrimary
+	}
+	return &n
+}
+
+// Start starts streaming to replicas if node is primary. Streaming stops with ctx.
+func (n *Node) Start(ctx context.Context) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.ctx = ctx
+	if n.role == RolePrimary {
+		n.startStreaming()
+	}
+	n.logger.Info("Replication started", zap.String("role", n.role))
+}
+
+// startStreaming starts one sender per configured replica, must be called under lock.
+func (n *Node) startStreaming() {
+	for _, a := range n.replicaAddresses {
+		if !strings.HasPrefix(a, "http://") && !strings.HasPrefix(a, "https://") {
+			a = "http://" + a
+		}
+		rep := &replica{address: a, notify: make(chan struct{}, 1)}
+		n.replicas = append(n.replicas, rep)
+		go n.stream(n.ctx, rep)
+	}
+}
+
+// Role returns current role of the node.
+func (n *Node) Role() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.role
+}
+
+// InsertGouge writes gauge and appends it to replication log.
+func (n *Node) InsertGouge(name string, val float64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.Repositories.InsertGouge(name, val)
+	n.append(Entry{Metrics: []models.Metrics{{ID: name, MType: "gauge", Value: &val}}})
+}
+
+// InsertCounter writes counter and appends it to replication log.
+func (n *Node) InsertCounter(name string, val int64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.Repositories.InsertCounter(name, val)
+	n.append(Entry{Metrics: []models.Metrics{{ID: name, MType: "counter", Delta: &val}}})
+}
+
+// InsertHistogram writes histogram and appends it to replication log.
+func (n *Node) InsertHistogram(name string, h *models.Histogram) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.Repositories.InsertHistogram(name, h)
+	n.append(Entry{Metrics: []models.Metrics{{ID: name, MType: "histogram", Histogram: h.Copy()}}})
+}
+
+// InsertSet writes set and appends it to replication log.
+func (n *Node) InsertSet(name string, set *models.Set) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.Repositories.InsertSet(name, set)
+	n.append(Entry{Metrics: []models.Metrics{{ID: name, MType: "set", Set: set.Copy()}}})
+}
+
+// InsertInfo writes info and appends it to replication log.
+func (n *Node) InsertInfo(name string, val string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.Repositories.InsertInfo(name, val)
+	n.append(Entry{Metrics: []models.Metrics{{ID: name, MType: "info", Info: &val}}})
+}
+
+// InsertMeta writes metadata and appends it to replication log.
+func (n *Node) InsertMeta(meta models.Meta) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.Repositories.InsertMeta(meta)
+	n.append(Entry{Op: opMeta, Meta: &meta})
+}
+
+// BatchInsert writes metrics and appends them to replication log, metrics which were not written are not replicated.
+func (n *Node) BatchInsert(ms []models.Metrics) ([]models.Metrics, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	stored, err := n.Repositories.BatchInsert(ms)
+	if err != nil {
+		return nil, err
+	}
+	// callers may reuse the slice
+	cp := make([]models.Metrics, len(ms))
+	copy(cp, ms)
+	n.append(Entry{Metrics: cp})
+	return stored, nil
+}
+
+// DeleteMetric deletes metric and appends deletion to replication log.
+func (n *Node) DeleteMetric(mType string, name string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	ok := n.Repositories.DeleteMetric(mType, name)
+	if ok {
+		n.append(Entry{Op: opDelete, Metrics: []models.Metrics{{ID: name, MType: mType}}})
+	}
+	return ok
+}
+
+// Retype changes type of metric and appends it to replication log, replicas convert the value in the same way.
+func (n *Node) Retype(name string, to string) (string, bool, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	from, converted, err := n.Repositories.Retype(name, to)
+	if err == nil && from != to {
+		n.append(Entry{Op: opRetype, Metrics: []models.Metrics{{ID: name, MType: to}}})
+	}
+	return from, converted, err
+}
+
+// DeleteMetrics deletes metrics matching pattern and appends deletion to replication log.
+func (n *Node) DeleteMetrics(pattern string) int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	deleted := n.Repositories.DeleteMetrics(pattern)
+	if deleted > 0 {
+		n.append(Entry{Op: opDeleteMatching, Pattern: pattern})
+	}
+	return deleted
+}
+
+// ResetCounter resets counter and appends reset to replication log.
+func (n *Node) ResetCounter(name string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	ok := n.Repositories.ResetCounter(name)
+	if ok {
+		n.append(Entry{Op: opReset, Metrics: []models.Metrics{{ID: name, MType: "counter"}}})
+	}
+	return ok
+}
+
+// append adds new entry to the log and wakes up senders, must be called under lock.
+func (n *Node) append(e Entry) {
+	if len(n.replicas) == 0 {
+		return
+	}
+	n.seq++
+	e.Epoch = n.epoch
+	e.Seq = n.seq
+	e.Time = time.Now()
+	n.log = append(n.log, e)
+	n.trim()
+	for _, rep := range n.replicas {
+		select {
+		case rep.notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// trim removes entries acked by all replicas and keeps log not longer than maxLog, must be called under lock.
+func (n *Node) trim() {
+	minAcked := n.seq
+	for _, rep := range n.replicas {
+		if rep.acked < minAcked {
+			minAcked = rep.acked
+		}
+	}
+	drop := 0
+	for drop < len(n.log) && (n.log[drop].Seq <= minAcked || len(n.log)-drop > n.maxLog) {
+		drop++
+	}
+	if drop > 0 {
+		n.log = append(n.log[:0], n.log[drop:]...)
+	}
+}
+
+// pending returns entries replica has not acked yet, true is returned if they are not in the log anymore
+// or replica follows another epoch, then it needs a snapshot.
+func (n *Node) pending(rep *replica) ([]Entry, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if rep.epoch != n.epoch {
+		return nil, true
+	}
+	if rep.acked >= n.seq {
+		return nil, false
+	}
+	if len(n.log) == 0 || n.log[0].Seq > rep.acked+1 {
+		return nil, true
+	}
+	start := int(rep.acked + 1 - n.log[0].Seq)
+	end := start + sendBatch
+	if end > len(n.log) {
+		end = len(n.log)
+	}
+	entries := make([]Entry, end-start)
+	copy(entries, n.log[start:end])
+	return entries, false
+}
+
+// snapshot takes the whole db together with seq of the last entry, writes wait meanwhile, so nothing is missed or applied twice.
+func (n *Node) snapshot() Snapshot {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return Snapshot{
+		Epoch:   n.epoch,
+		Seq:     n.seq,
+		Time:    time.Now(),
+		Metrics: n.Repositories.SelectMetrics(),
+		Meta:    n.Repositories.SelectAllMeta(),
+	}
+}
+
+// stream sends log entries to one replica until ctx is done, failed requests are retried every second.
+func (n *Node) stream(ctx context.Context, rep *replica) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-rep.notify:
+		case <-ticker.C:
+		}
+
+		for {
+			entries, needSnapshot := n.pending(rep)
+			if !needSnapshot && len(entries) == 0 {
+				break
+			}
+			var err error
+			if needSnapshot {
+				err = n.sendSnapshot(ctx, rep)
+			} else {
+				err = n.send(ctx, rep, "/replication/apply", entries)
+			}
+			n.mu.Lock()
+			rep.err = err
+			n.mu.Unlock()
+			if err != nil {
+				n.logger.Error("Replication failed", zap.String("replica", rep.address), zap.Error(err))
+				break
+			}
+		}
+	}
+}
+
+// sendSnapshot replaces db of replica with snapshot of primary.
+func (n *Node) sendSnapshot(ctx context.Context, rep *replica) error {
+	s := n.snapshot()
+	if err := n.send(ctx, rep, "/replication/snapshot", s); err != nil {
+		return err
+	}
+	n.logger.Info("Snapshot sent", zap.String("replica", rep.address), zap.Uint64("seq", s.Seq), zap.Int("metrics n", len(s.Metrics)))
+	return nil
+}
+
+// send posts entries or snapshot to replica and remembers what replica acked.
+func (n *Node) send(ctx context.Context, rep *replica, path string, data interface{}) error {
+	body, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, rep.address+path, bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if n.key != "" {
+		request.Header.Set("Authorization", "Bearer "+n.key)
+	} else if n.adminUser != "" {
+		request.SetBasicAuth(n.adminUser, n.adminPassword)
+	}
+
+	response, err := n.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	var st Status
+	if response.StatusCode != http.StatusOK && response.StatusCode != http.StatusConflict {
+		return fmt.Errorf("replica answered: %s", response.Status)
+	}
+	if err := json.NewDecoder(response.Body).Decode(&st); err != nil {
+		return err
+	}
+	if st.Role != RoleReplica {
+		return fmt.Errorf("%s is not a replica anymore", rep.address)
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	// replica did not have previous entries, start again from what it has
+	rep.epoch = st.Epoch
+	rep.acked = st.AppliedSeq
+	n.trim()
+	return nil
+}
+
+// Status returns replication state of the node.
+func (n *Node) Status() Status {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	st := Status{Role: n.role}
+	if n.role == RolePrimary {
+		st.Epoch = n.epoch
+		st.Seq = n.seq
+		for _, rep := range n.replicas {
+			rs := ReplicaStatus{Address: rep.address, AckedSeq: rep.acked, LagEntries: n.seq - rep.acked}
+			// oldest not acked entry shows how long replica is behind
+			for _, e := range n.log {
+				if e.Seq > rep.acked {
+					rs.LagSeconds = time.Since(e.Time).Seconds()
+					break
+				}
+			}
+			if rep.err != nil {
+				rs.Error = rep.err.Error()
+			}
+			st.Replicas = append(st.Replicas, rs)
+		}
+		return st
+	}
+
+	st.Epoch = n.appliedEpoch
+	st.AppliedSeq = n.applied
+	if !n.lastApplied.IsZero() {
+		t := n.lastApplied
+		st.LastAppliedAt = &t
+		st.LagSeconds = n.lastApplied.Sub(n.lastEntry).Seconds()
+	}
+	return st
+}
+
+// apply applies entries from primary in order, entries which were already applied are skipped.
+// It returns false if there is a gap, then primary has to resend from applied seq.
+// Entries of another epoch are not applied on top of what replica has, primary was restarted or another one was promoted,
+// so their state may differ and replica needs a snapshot.
+func (n *Node) apply(entries []Entry) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, e := range entries {
+		if e.Epoch != n.appliedEpoch {
+			return false
+		}
+		if e.Seq <= n.applied {
+			continue
+		}
+		if e.Seq != n.applied+1 {
+			return false
+		}
+		n.applyEntry(e)
+		n.applied = e.Seq
+		n.lastEntry = e.Time
+		n.lastApplied = time.Now()
+	}
+	return true
+}
+
+// restore replaces the whole db with snapshot, so that entries after snapshot seq can be applied.
+func (n *Node) restore(s Snapshot) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	// values are replaced and not merged, e.g. counters are not added up
+	for _, m := range n.Repositories.SelectMetrics() {
+		n.Repositories.DeleteMetric(m.MType, m.ID)
+	}
+	if len(s.Metrics) > 0 {
+		if _, err := n.Repositories.BatchInsert(s.Metrics); err != nil {
+			n.logger.Error("Snapshot metrics cannot be written: ", zap.Error(err))
+		}
+	}
+	for _, meta := range s.Meta {
+		n.Repositories.InsertMeta(meta)
+	}
+	n.appliedEpoch = s.Epoch
+	n.applied = s.Seq
+	n.lastEntry = s.Time
+	n.lastApplied = time.Now()
+	n.logger.Info("Snapshot restored", zap.Uint64("seq", s.Seq), zap.Int("metrics n", len(s.Metrics)))
+}
+
+// applyEntry applies one entry to underlying db.
+func (n *Node) applyEntry(e Entry) {
+	switch e.Op {
+	case opInsert:
+		if _, err := n.Repositories.BatchInsert(e.Metrics); err != nil {
+			n.logger.Error("Replicated metrics cannot be written: ", zap.Uint64("seq", e.Seq), zap.Error(err))
+		}
+	case opDelete:
+		for _, m := range e.Metrics {
+			n.Repositories.DeleteMetric(m.MType, m.ID)
+		}
+	case opDeleteMatching:
+		n.Repositories.DeleteMetrics(e.Pattern)
+	case opReset:
+		for _, m := range e.Metrics {
+			n.Repositories.ResetCounter(m.ID)
+		}
+	case opRetype:
+		for _, m := range e.Metrics {
+			if _, _, err := n.Repositories.Retype(m.ID, m.MType); err != nil {
+				n.logger.Error("Replicated retype cannot be applied: ", zap.Uint64("seq", e.Seq), zap.Error(err))
+			}
+		}
+	case opMeta:
+		if e.Meta != nil {
+			n.Repositories.InsertMeta(*e.Meta)
+		}
+	default:
+		n.logger.Error("Unknown replication operation", zap.String("op", e.Op))
+	}
+}
+
+// Promote makes replica a primary: it starts accepting writes and streaming to its own replicas.
+func (n *Node) Promote() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.role == RolePrimary {
+		return
+	}
+	n.role = RolePrimary
+	n.epoch = time.Now().UnixNano()
+	if n.ctx != nil {
+		n.startStreaming()
+	}
+	n.logger.Info("Promoted to primary")
+}
+
+// Ping pings underlying db if it can be pinged.
+func (n *Node) Ping(ctx context.Context) error {
+	p, ok := n.Repositories.(interface{ Ping(context.Context) error })
+	if !ok {
+		return errors.New("db cannot be pinged")
+	}
+	return p.Ping(ctx)
+}
+
+// CheckWritable does not let write requests through on replica.
+func (n *Node) CheckWritable(next http.Handler) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if n.Role() != RolePrimary {
+			http.Error(w, "403 - Replica is read-only", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Routes returns replication endpoints, every applied batch is signaled to dbUpdated.
+func (n *Node) Routes(dbUpdated chan time.Time) chi.Router {
+	r := chi.NewRouter()
+	r.Post("/apply", n.applyHandler(dbUpdated))
+	r.Post("/snapshot", n.snapshotHandler(dbUpdated))
+	r.Post("/promote", n.promoteHandler())
+	r.Get("/status", n.statusHandler())
+	return r
+}
+
+// applyHandler processes entries sent by primary.
+func (n *Node) applyHandler(dbUpdated chan time.Time) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if n.Role() != RoleReplica {
+			writeStatus(w, http.StatusConflict, n.Status())
+			return
+		}
+		var entries []Entry
+		if err := json.NewDecoder(r.Body).Decode(&entries); err != nil {
+			http.Error(w, fmt.Sprintf("400 - Entries cannot be decoded: %s", err), http.StatusBadRequest)
+			return
+		}
+		if !n.apply(entries) {
+			writeStatus(w, http.StatusConflict, n.Status())
+			return
+		}
+		writeStatus(w, http.StatusOK, n.Status())
+		dbUpdated <- time.Now()
+	}
+}
+
+// snapshotHandler replaces db with snapshot sent by primary.
+func (n *Node) snapshotHandler(dbUpdated chan time.Time) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if n.Role() != RoleReplica {
+			writeStatus(w, http.StatusConflict, n.Status())
+			return
+		}
+		var s Snapshot
+		if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+			http.Error(w, fmt.Sprintf("400 - Snapshot cannot be decoded: %s", err), http.StatusBadRequest)
+			return
+		}
+		n.restore(s)
+		writeStatus(w, http.StatusOK, n.Status())
+		dbUpdated <- time.Now()
+	}
+}
+
+// promoteHandler promotes replica to primary.
+func (n *Node) promoteHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		n.Promote()
+		writeStatus(w, http.StatusOK, n.Status())
+	}
+}
+
+// statusHandler returns replication status including lag.
+func (n *Node) statusHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeStatus(w, http.StatusOK, n.Status())
+	}
+}
+
+func writeStatus(w http.ResponseWriter, code int, st Status) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(st)
+}
@@ -0,0 +1,250 @@
+package replication_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/maffka123/metricCollector/internal/auth"
+	"github.com/maffka123/metricCollector/internal/handlers"
+	"github.com/maffka123/metricCollector/internal/replication"
+	"github.com/maffka123/metricCollector/internal/server/config"
+	"github.com/maffka123/metricCollector/internal/storage"
+)
+
+var logger *zap.Logger = zap.NewNop()
+
+// startServer starts metric server with replication node as its db.
+func startServer(ctx context.Context, cfg *config.Config) (*httptest.Server, *replication.Node) {
+	node := replication.NewNode(storage.Connect(cfg, logger), cfg, logger)
+	node.Start(ctx)
+	r, dbUpdated := handlers.MetricRouter(node, nil, nil, cfg, logger)
+	go func() {
+		for {
+			<-dbUpdated
+		}
+	}()
+	return httptest.NewServer(r), node
+}
+
+// do sends request with admin credentials of test servers.
+func do(t *testing.T, method string, url string) (int, string) {
+	request, err := http.NewRequest(method, url, nil)
+	require.NoError(t, err)
+	request.SetBasicAuth("admin", "secret")
+	response, err := http.DefaultClient.Do(request)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	body, _ := io.ReadAll(response.Body)
+	return response.StatusCode, string(body)
+}
+
+func status(t *testing.T, url string) replication.Status {
+	_, body := do(t, http.MethodGet, url+"/replication/status")
+	var st replication.Status
+	require.NoError(t, json.Unmarshal([]byte(body), &st))
+	return st
+}
+
+func TestReplication(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	replica, _ := startServer(ctx, &config.Config{Role: replication.RoleReplica, AdminUser: "admin", AdminPassword: "secret"})
+	defer replica.Close()
+	primary, _ := startServer(ctx, &config.Config{Role: replication.RolePrimary, Replicas: []string{replica.URL}, AdminUser: "admin", AdminPassword: "secret"})
+	defer primary.Close()
+
+	code, _ := do(t, http.MethodPost, primary.URL+"/update/counter/PollCount/3")
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = do(t, http.MethodPost, primary.URL+"/update/counter/PollCount/2")
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = do(t, http.MethodPost, primary.URL+"/update/gauge/Alloc/1.5")
+	assert.Equal(t, http.StatusOK, code)
+
+	// replica catches up
+	assert.Eventually(t, func() bool {
+		_, body := do(t, http.MethodGet, replica.URL+"/value/counter/PollCount")
+		return body == "5"
+	}, 2*time.Second, 10*time.Millisecond)
+	_, body := do(t, http.MethodGet, replica.URL+"/value/gauge/Alloc")
+	assert.Equal(t, "1.500", body)
+
+	st := status(t, primary.URL)
+	assert.Equal(t, replication.RolePrimary, st.Role)
+	assert.Equal(t, uint64(3), st.Seq)
+	require.Len(t, st.Replicas, 1)
+	assert.Eventually(t, func() bool {
+		return status(t, primary.URL).Replicas[0].LagEntries == 0
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, uint64(3), status(t, replica.URL).AppliedSeq)
+
+	// deletions are replicated as well
+	request, _ := http.NewRequest(http.MethodDelete, primary.URL+"/value/gauge/Alloc", nil)
+	request.SetBasicAuth("admin", "secret")
+	response, err := http.DefaultClient.Do(request)
+	require.NoError(t, err)
+	response.Body.Close()
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Eventually(t, func() bool {
+		code, _ := do(t, http.MethodGet, replica.URL+"/value/gauge/Alloc")
+		return code == http.StatusNotFound
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// retype is replicated as one entry and value is converted on replica
+	code, _ = do(t, http.MethodPost, primary.URL+"/update/gauge/Temperature/36.6")
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = do(t, http.MethodPost, primary.URL+"/retype/Temperature?type=counter")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Eventually(t, func() bool {
+		_, body := do(t, http.MethodGet, replica.URL+"/value/counter/Temperature")
+		return body == "37"
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// replica is read-only
+	code, _ = do(t, http.MethodPost, replica.URL+"/update/counter/PollCount/1")
+	assert.Equal(t, http.StatusForbidden, code)
+
+	// only admin can promote
+	response, err = http.Post(replica.URL+"/replication/promote", "", nil)
+	require.NoError(t, err)
+	response.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, response.StatusCode)
+
+	// after promotion replica takes writes and does not accept entries from old primary
+	code, _ = do(t, http.MethodPost, replica.URL+"/replication/promote")
+	assert.Equal(t, http.StatusOK, code)
+	code, _ = do(t, http.MethodPost, replica.URL+"/update/counter/PollCount/1")
+	assert.Equal(t, http.StatusOK, code)
+	_, body = do(t, http.MethodGet, replica.URL+"/value/counter/PollCount")
+	assert.Equal(t, "6", body)
+
+	do(t, http.MethodPost, primary.URL+"/update/counter/PollCount/10")
+	assert.Eventually(t, func() bool {
+		return status(t, primary.URL).Replicas[0].Error != ""
+	}, 2*time.Second, 10*time.Millisecond)
+	_, body = do(t, http.MethodGet, replica.URL+"/value/counter/PollCount")
+	assert.Equal(t, "6", body)
+}
+
+func TestReplicationWithKeys(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	file := filepath.Join(t.TempDir(), "keys.json")
+	require.NoError(t, ioutil.WriteFile(file, []byte(`[{"name": "primary", "key": "replication-key", "scope": "admin"}]`), 0600))
+	keys, err := auth.Load(file)
+	require.NoError(t, err)
+
+	replica, _ := startServer(ctx, &config.Config{Role: replication.RoleReplica, APIKeys: keys})
+	defer replica.Close()
+	primary, _ := startServer(ctx, &config.Config{Role: replication.RolePrimary, Replicas: []string{replica.URL}, ReplicationKey: "replication-key"})
+	defer primary.Close()
+
+	// entries from anyone else are not applied
+	code, _ := do(t, http.MethodPost, replica.URL+"/replication/apply")
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	code, _ = do(t, http.MethodPost, primary.URL+"/update/counter/PollCount/3")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Eventually(t, func() bool {
+		request, _ := http.NewRequest(http.MethodGet, replica.URL+"/value/counter/PollCount", nil)
+		request.Header.Set("Authorization", "Bearer replication-key")
+		response, err := http.DefaultClient.Do(request)
+		require.NoError(t, err)
+		defer response.Body.Close()
+		body, _ := io.ReadAll(response.Body)
+		return string(body) == "3"
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestReplicationWithoutCredentials(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	replica, node := startServer(ctx, &config.Config{Role: replication.RoleReplica})
+	defer replica.Close()
+
+	for _, path := range []string{"/replication/apply", "/replication/promote"} {
+		response, err := http.Post(replica.URL+path, "application/json", strings.NewReader(`[]`))
+		require.NoError(t, err)
+		response.Body.Close()
+		assert.Equal(t, http.StatusForbidden, response.StatusCode, path)
+	}
+	assert.Equal(t, replication.RoleReplica, node.Role())
+}
+
+// unreachable wraps server handler, entries and snapshots are refused while down is set, as if the server was stopped.
+type unreachable struct {
+	handler http.Handler
+	down    atomic.Value
+}
+
+func (u *unreachable) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if down, _ := u.down.Load().(bool); down && r.URL.Path != "/replication/promote" && r.Method == http.MethodPost {
+		http.Error(w, "503 - Down", http.StatusServiceUnavailable)
+		return
+	}
+	u.handler.ServeHTTP(w, r)
+}
+
+func TestReplicationSnapshot(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	admin := func(cfg config.Config) *config.Config {
+		cfg.AdminUser, cfg.AdminPassword = "admin", "secret"
+		return &cfg
+	}
+	value := func(url string) string {
+		_, body := do(t, http.MethodGet, url+"/value/counter/PollCount")
+		return body
+	}
+
+	second, _ := startServer(ctx, admin(config.Config{Role: replication.RoleReplica}))
+	defer second.Close()
+	first, _ := startServer(ctx, admin(config.Config{Role: replication.RoleReplica, Replicas: []string{second.URL}}))
+	defer first.Close()
+	switched := &unreachable{handler: first.Config.Handler}
+	first.Config.Handler = switched
+	primary, _ := startServer(ctx, admin(config.Config{Role: replication.RolePrimary, Replicas: []string{first.URL, second.URL}, ReplicationLog: 1}))
+	defer primary.Close()
+
+	do(t, http.MethodPost, primary.URL+"/update/counter/PollCount/3")
+	assert.Eventually(t, func() bool { return value(first.URL) == "3" && value(second.URL) == "3" }, 3*time.Second, 10*time.Millisecond)
+
+	// entries first replica misses are removed from the log, it catches up from snapshot
+	switched.down.Store(true)
+	do(t, http.MethodPost, primary.URL+"/update/counter/PollCount/2")
+	do(t, http.MethodPost, primary.URL+"/update/counter/PollCount/4")
+	assert.Eventually(t, func() bool { return value(second.URL) == "9" }, 3*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "3", value(first.URL))
+	switched.down.Store(false)
+	assert.Eventually(t, func() bool { return value(first.URL) == "9" }, 3*time.Second, 10*time.Millisecond)
+
+	// after promotion of first replica, second one gets its state and not only entries after promotion
+	switched.down.Store(true)
+	do(t, http.MethodPost, primary.URL+"/update/counter/PollCount/1")
+	assert.Eventually(t, func() bool { return value(second.URL) == "10" }, 3*time.Second, 10*time.Millisecond)
+	code, _ := do(t, http.MethodPost, first.URL+"/replication/promote")
+	require.Equal(t, http.StatusOK, code)
+	switched.down.Store(false)
+	code, _ = do(t, http.MethodPost, first.URL+"/update/counter/PollCount/1")
+	require.Equal(t, http.StatusOK, code)
+	assert.Eventually(t, func() bool {
+		return value(second.URL) == "10" && status(t, second.URL).Epoch == status(t, first.URL).Epoch
+	},
+		3*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "10", value(first.URL))
+}
@@ -3,11 +3,14 @@ package config
 
 import (
 	"flag"
+	"io/ioutil"
 	"math/big"
+	"net"
 	"os"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestGetConfig(t *testing.T) {
@@ -75,3 +78,81 @@ func TestFlagForKeys(t *testing.T) {
 		})
 	}
 }
+
+func TestRegisterFlags(t *testing.T) {
+	var cfg Config
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	// flag defined twice panics
+	require.NotPanics(t, func() { registerFlags(fs, &cfg) })
+
+	require.NoError(t, fs.Parse([]string{"-rl", "500", "-rlim", "ingest=10:20"}))
+	assert.Equal(t, 500, cfg.ReplicationLog)
+	assert.Equal(t, RequestRates{RoutesIngest: {PerSecond: 10, Burst: 20}}, cfg.RateLimits)
+}
+
+func TestRequestRates(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    RequestRates
+		wantErr bool
+	}{
+		{name: "empty", value: "", want: nil},
+		{name: "both groups", value: "ingest=10:20, read=2.5",
+			want: RequestRates{RoutesIngest: {PerSecond: 10, Burst: 20}, RoutesRead: {PerSecond: 2.5, Burst: 3}}},
+		{name: "unknown group", value: "admin=1", wantErr: true},
+		{name: "no rate", value: "ingest", wantErr: true},
+		{name: "bad rate", value: "ingest=0", wantErr: true},
+		{name: "bad burst", value: "ingest=1:a", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg Config
+			os.Setenv("RATE_LIMITS", tt.value)
+			defer os.Unsetenv("RATE_LIMITS")
+			err := GetConfig(&cfg)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, cfg.RateLimits)
+		})
+	}
+
+	assert.Equal(t, "ingest=10:20,read=2.5:3", RequestRates{RoutesIngest: {PerSecond: 10, Burst: 20}, RoutesRead: {PerSecond: 2.5, Burst: 3}}.String())
+}
+
+func TestSubnets(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{name: "empty", value: "", want: ""},
+		{name: "one", value: "192.168.1.0/24", want: "192.168.1.0/24"},
+		{name: "several", value: "10.0.0.0/8, 192.168.1.7/24", want: "10.0.0.0/8,192.168.1.0/24"},
+		{name: "no mask", value: "10.0.0.1", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg Config
+			os.Setenv("TRUSTED_SUBNET", tt.value)
+			defer os.Unsetenv("TRUSTED_SUBNET")
+			err := GetConfig(&cfg)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, cfg.TrustedSubnet.String())
+		})
+	}
+
+	var s Subnets
+	assert.NoError(t, s.Set("10.0.0.0/8,172.16.0.0/12"))
+	assert.True(t, s.Contains(net.ParseIP("172.20.1.1")))
+	assert.False(t, s.Contains(net.ParseIP("192.168.1.1")))
+}
@@ -2,9 +2,16 @@
 package server
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"time"
 
 	"github.com/go-chi/chi/v5"
+	"go.uber.org/zap"
+
 	"github.com/maffka123/metricCollector/internal/server/config"
 	"github.com/maffka123/metricCollector/internal/storage"
 	"net/http"
@@ -14,6 +21,44 @@ func NewServer(endpoint string, handlers chi.Router) *http.Server {
 	return &http.Server{Addr: endpoint, Handler: handlers}
 }
 
+// TLSConfig configures https, nil is returned if no server certificate is given.
+// If client CA is given, clients have to present a certificate signed by it.
+func TLSConfig(cfg *config.Config) (*tls.Config, error) {
+	if cfg.TLSCert == "" {
+		if cfg.ClientCA != "" {
+			return nil, errors.New("client certificates can be verified only over https, server certificate is not given")
+		}
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey)
+	if err != nil {
+		return nil, err
+	}
+	tlsCfg := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if cfg.ClientCA != "" {
+		pem, err := ioutil.ReadFile(cfg.ClientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", cfg.ClientCA)
+		}
+		tlsCfg.ClientCAs = pool
+		tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsCfg, nil
+}
+
+// ListenAndServe serves https if server has TLS config, otherwise http.
+func ListenAndServe(srv *http.Server) error {
+	if srv.TLSConfig != nil {
+		// certificate is in TLS config already
+		return srv.ListenAndServeTLS("", "")
+	}
+	return srv.ListenAndServe()
+}
+
 /* DealWithDumps configures db dumping options: if store interval is >0 then it will be written asynchonousely
 if store interavl is 0, dump will be triggered right after db change*/
 func DealWithDumps(cfg *config.Config, db storage.Repositories, dbUpdated chan time.Time) {
@@ -30,6 +75,32 @@ func DealWithDumps(cfg *config.Config, db storage.Repositories, dbUpdated chan t
 
 }
 
+// DealWithStale periodically deletes metrics which were not updated longer than cfg.EvictAfter.
+// Nothing is deleted if EvictAfter is 0.
+func DealWithStale(cfg *config.Config, db storage.Repositories, logger *zap.Logger, dbUpdated chan time.Time) {
+	if cfg.EvictAfter <= 0 {
+		return
+	}
+	// check often enough, so that metric does not live much longer than it should
+	interval := cfg.EvictAfter / 10
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	go runEviction(ticker.C, cfg.EvictAfter, db, logger, dbUpdated)
+}
+
+// runEviction starts infinite loop to delete stale metrics.
+func runEviction(c <-chan time.Time, evictAfter time.Duration, db storage.Repositories, logger *zap.Logger, dbUpdated chan time.Time) {
+	for {
+		t := <-c
+		if n := db.DeleteStale(t.Add(-evictAfter)); n > 0 {
+			logger.Info("Evicted stale metrics", zap.Int("n", n))
+			dbUpdated <- time.Now()
+		}
+	}
+}
+
 // runDump starts infinite loop to dump db asynchronesely
 func runDump(c <-chan time.Time, db storage.Repositories) {
 	for {
@@ -2,15 +2,31 @@ package server
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"math/big"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
 
 	"encoding/json"
 
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/maffka123/metricCollector/internal/agent"
+	agentConfig "github.com/maffka123/metricCollector/internal/agent/config"
+	"github.com/maffka123/metricCollector/internal/auth"
 	"github.com/maffka123/metricCollector/internal/handlers"
 	"github.com/maffka123/metricCollector/internal/models"
 	"github.com/maffka123/metricCollector/internal/server/config"
@@ -20,7 +36,8 @@ import (
 
 func Example() {
 	// Init config and logger
-	cfg := config.Config{Endpoint: "localhost:8086", Key: "testkey", Restore: false}
+	// requests below are not signed, only metric hashes are checked
+	cfg := config.Config{Endpoint: "localhost:8086", Key: "testkey", AllowUnsigned: true, Restore: false}
 	logger, err := zap.NewDevelopment()
 	if err != nil {
 		log.Fatal("Could not initialize logger: " + err.Error())
@@ -28,7 +45,7 @@ func Example() {
 
 	// Init in-memory db and flush dbupdated channel, otherwise it blocks everything
 	db := storage.Connect(&cfg, logger)
-	r, dbUpdated := handlers.MetricRouter(db, &cfg, logger)
+	r, dbUpdated := handlers.MetricRouter(db, nil, nil, &cfg, logger)
 	go func() {
 		for {
 			<-dbUpdated
@@ -127,7 +144,10 @@ func Example() {
 	}
 	defer response.Body.Close()
 
-	responseData, _ = ioutil.ReadAll(response.Body)
+	// update time is different every run, do not print it
+	json.NewDecoder(response.Body).Decode(&m)
+	m.UpdatedAt = nil
+	responseData, _ = json.Marshal(m)
 
 	fmt.Println(string(responseData))
 
@@ -139,3 +159,104 @@ func Example() {
 	//
 	// {"id":"RandomValue","type":"counter","delta":4,"hash":"8def3c216b2fb10be4531880af9f3958808fdb97d2ab79040c7ea661e04459a2"}
 }
+
+// writeCert makes certificate signed by parent, or self signed CA if parent is nil, and writes it with its key to dir.
+func writeCert(t *testing.T, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return cert, key
+}
+
+func TestTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := writeCert(t, dir, "ca", nil, nil)
+	writeCert(t, dir, "server", ca, caKey)
+	writeCert(t, dir, "agent-1", ca, caKey)
+	file := func(name string) string { return filepath.Join(dir, name) }
+
+	tests := []struct {
+		name    string
+		cfg     config.Config
+		wantNil bool
+		wantErr bool
+	}{
+		{name: "plain http", cfg: config.Config{}, wantNil: true},
+		{name: "client ca without cert", cfg: config.Config{ClientCA: file("ca.crt")}, wantErr: true},
+		{name: "missing key", cfg: config.Config{TLSCert: file("server.crt"), TLSKey: file("missing.key")}, wantErr: true},
+		{name: "bad ca", cfg: config.Config{TLSCert: file("server.crt"), TLSKey: file("server.key"), ClientCA: file("server.key")}, wantErr: true},
+		{name: "https", cfg: config.Config{TLSCert: file("server.crt"), TLSKey: file("server.key")}},
+		{name: "mtls", cfg: config.Config{TLSCert: file("server.crt"), TLSKey: file("server.key"), ClientCA: file("ca.crt")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tlsCfg, err := TLSConfig(&tt.cfg)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantNil, tlsCfg == nil)
+		})
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := writeCert(t, dir, "ca", nil, nil)
+	writeCert(t, dir, "server", ca, caKey)
+	writeCert(t, dir, "agent-1", ca, caKey)
+	file := func(name string) string { return filepath.Join(dir, name) }
+
+	cfg := config.Config{TLSCert: file("server.crt"), TLSKey: file("server.key"), ClientCA: file("ca.crt")}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(auth.CertName(r)))
+	}))
+	var err error
+	srv.TLS, err = TLSConfig(&cfg)
+	require.NoError(t, err)
+	srv.StartTLS()
+	defer srv.Close()
+
+	// agent with certificate is known by its subject
+	client, err := agent.NewClient(agentConfig.Config{CACert: file("ca.crt"), TLSCert: file("agent-1.crt"), TLSKey: file("agent-1.key")})
+	require.NoError(t, err)
+	response, err := client.Get(srv.URL)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	body, _ := ioutil.ReadAll(response.Body)
+	assert.Equal(t, "agent-1", string(body))
+
+	// agent without certificate is not let in
+	client, err = agent.NewClient(agentConfig.Config{CACert: file("ca.crt")})
+	require.NoError(t, err)
+	_, err = client.Get(srv.URL)
+	assert.Error(t, err)
+
+	// server is not trusted without CA
+	client, err = agent.NewClient(agentConfig.Config{TLSCert: file("agent-1.crt"), TLSKey: file("agent-1.key")})
+	require.NoError(t, err)
+	_, err = client.Get(srv.URL)
+	assert.Error(t, err)
+}
@@ -2,7 +2,10 @@ package storage
 
 import (
 	"errors"
-	"fmt"
+	"math"
+	"path"
+	"sort"
+	"sync"
 	"time"
 
 	"go.uber.org/zap"
@@ -13,23 +16,42 @@ import (
 
 // InMemoryDB type for holding all parameters of in-memory storage.
 type InMemoryDB struct {
-	Gouge         map[string]float64 `json:"gauge"`
-	Counter       map[string]int64   `json:"counter"`
-	StoreInterval time.Duration      `json:"-"`
-	StoreFile     string             `json:"-"`
-	Restore       bool               `json:"-"`
-	log           *zap.Logger        `json:"-"`
+	Gouge            map[string]float64           `json:"gauge"`
+	Counter          map[string]int64             `json:"counter"`
+	Histogram        map[string]*models.Histogram `json:"histogram"`
+	Set              map[string]*models.Set       `json:"set"`
+	Info             map[string]string            `json:"info"`
+	Meta             map[string]models.Meta       `json:"meta"`
+	GougeUpdated     map[string]time.Time         `json:"gauge_updated"`
+	CounterUpdated   map[string]time.Time         `json:"counter_updated"`
+	HistogramUpdated map[string]time.Time         `json:"histogram_updated"`
+	SetUpdated       map[string]time.Time         `json:"set_updated"`
+	InfoUpdated      map[string]time.Time         `json:"info_updated"`
+	StoreInterval    time.Duration                `json:"-"`
+	StoreFile        string                       `json:"-"`
+	Restore          bool                         `json:"-"`
+	log              *zap.Logger                  `json:"-"`
+	mu               sync.RWMutex                 `json:"-"`
 }
 
 // Connect initilizes in-memory storage.
 func Connect(cfg *config.Config, logger *zap.Logger) *InMemoryDB {
-	db := InMemoryDB{
-		Gouge:         map[string]float64{},
-		Counter:       map[string]int64{},
-		StoreInterval: cfg.StoreInterval,
-		StoreFile:     cfg.StoreFile,
-		Restore:       cfg.Restore,
-		log:           logger,
+	db := &InMemoryDB{
+		Gouge:            map[string]float64{},
+		Counter:          map[string]int64{},
+		Histogram:        map[string]*models.Histogram{},
+		Set:              map[string]*models.Set{},
+		Info:             map[string]string{},
+		Meta:             map[string]models.Meta{},
+		GougeUpdated:     map[string]time.Time{},
+		CounterUpdated:   map[string]time.Time{},
+		HistogramUpdated: map[string]time.Time{},
+		SetUpdated:       map[string]time.Time{},
+		InfoUpdated:      map[string]time.Time{},
+		StoreInterval:    cfg.StoreInterval,
+		StoreFile:        cfg.StoreFile,
+		Restore:          cfg.Restore,
+		log:              logger,
 	}
 
 	if cfg.Restore {
@@ -39,21 +61,116 @@ func Connect(cfg *config.Config, logger *zap.Logger) *InMemoryDB {
 		}
 	}
 
-	return &db
+	return db
 }
 
 // InsertGouge appends/updates gouge in metrics map.
 func (db *InMemoryDB) InsertGouge(name string, val float64) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
 	db.Gouge[name] = val
+	db.setUpdated("gauge", name, time.Now())
 }
 
 // InsertCounter appends/updates counter in metrics mao.
 func (db *InMemoryDB) InsertCounter(name string, val int64) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
 	db.Counter[name] += val
+	db.setUpdated("counter", name, time.Now())
+}
+
+// InsertHistogram adds observations to histogram in metrics map.
+func (db *InMemoryDB) InsertHistogram(name string, h *models.Histogram) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.mergeHistogram(name, h)
+	db.setUpdated("histogram", name, time.Now())
+}
+
+// mergeHistogram merges copy of histogram into the map, must be called under lock.
+func (db *InMemoryDB) mergeHistogram(name string, h *models.Histogram) {
+	if db.Histogram == nil {
+		db.Histogram = map[string]*models.Histogram{}
+	}
+	if old, ok := db.Histogram[name]; ok {
+		old.Merge(h)
+	} else {
+		db.Histogram[name] = h.Copy()
+	}
+}
+
+// InsertSet adds values of set to set in metrics map.
+func (db *InMemoryDB) InsertSet(name string, set *models.Set) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.mergeSet(name, set)
+	db.setUpdated("set", name, time.Now())
+}
+
+// mergeSet merges copy of set into the map, must be called under lock.
+func (db *InMemoryDB) mergeSet(name string, set *models.Set) {
+	if db.Set == nil {
+		db.Set = map[string]*models.Set{}
+	}
+	if old, ok := db.Set[name]; ok {
+		old.Merge(set)
+	} else {
+		db.Set[name] = set.Copy()
+	}
+}
+
+// InsertInfo appends/updates info in metrics map.
+func (db *InMemoryDB) InsertInfo(name string, val string) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.setInfo(name, val)
+	db.setUpdated("info", name, time.Now())
+}
+
+// setInfo puts info into the map, must be called under lock.
+func (db *InMemoryDB) setInfo(name string, val string) {
+	if db.Info == nil {
+		db.Info = map[string]string{}
+	}
+	db.Info[name] = val
+}
+
+// setUpdated remembers when metric was updated, must be called under lock.
+func (db *InMemoryDB) setUpdated(mType string, name string, t time.Time) {
+	if db.GougeUpdated == nil {
+		db.GougeUpdated = map[string]time.Time{}
+	}
+	if db.CounterUpdated == nil {
+		db.CounterUpdated = map[string]time.Time{}
+	}
+	if db.HistogramUpdated == nil {
+		db.HistogramUpdated = map[string]time.Time{}
+	}
+	if db.SetUpdated == nil {
+		db.SetUpdated = map[string]time.Time{}
+	}
+	if db.InfoUpdated == nil {
+		db.InfoUpdated = map[string]time.Time{}
+	}
+	switch mType {
+	case "counter":
+		db.CounterUpdated[name] = t
+	case "histogram":
+		db.HistogramUpdated[name] = t
+	case "set":
+		db.SetUpdated[name] = t
+	case "info":
+		db.InfoUpdated[name] = t
+	default:
+		db.GougeUpdated[name] = t
+	}
 }
 
 // NameInGouge checks if given gouge already exists in the map.
 func (db *InMemoryDB) NameInGouge(s string) bool {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
 	if _, ok := db.Gouge[s]; ok {
 		return true
 	}
@@ -62,36 +179,82 @@ func (db *InMemoryDB) NameInGouge(s string) bool {
 
 // NameInCounter checks if given counter already exists in the map.
 func (db *InMemoryDB) NameInCounter(s string) bool {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
 	if _, ok := db.Counter[s]; ok {
 		return true
 	}
 	return false
 }
 
+// NameInHistogram checks if given histogram already exists in the map.
+func (db *InMemoryDB) NameInHistogram(s string) bool {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	_, ok := db.Histogram[s]
+	return ok
+}
+
+// NameInSet checks if given set already exists in the map.
+func (db *InMemoryDB) NameInSet(s string) bool {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	_, ok := db.Set[s]
+	return ok
+}
+
+// NameInInfo checks if given info already exists in the map.
+func (db *InMemoryDB) NameInInfo(s string) bool {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	_, ok := db.Info[s]
+	return ok
+}
+
 // ValueFromCounter gets counter by its name.
 func (db *InMemoryDB) ValueFromCounter(s string) int64 {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
 	return db.Counter[s]
 }
 
 // ValueFromGouge gets gouge by its name.
 func (db *InMemoryDB) ValueFromGouge(s string) float64 {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
 	return db.Gouge[s]
 }
 
-// SelectAll select all available metrics.
-func (db *InMemoryDB) SelectAll() ([]string, []string) {
-	var listCounter []string
-	var listGouge []string
-
-	for k, v := range db.Counter {
-		listCounter = append(listCounter, fmt.Sprintf("[%s]: [%d]\n", k, v))
+// ValueFromHistogram gets copy of histogram by its name, nil if there is no such histogram.
+func (db *InMemoryDB) ValueFromHistogram(s string) *models.Histogram {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if h, ok := db.Histogram[s]; ok {
+		return h.Copy()
 	}
+	return nil
+}
 
-	for k, v := range db.Gouge {
-		listGouge = append(listGouge, fmt.Sprintf("[%s]: [%.3f]\n", k, v))
+// ValueFromSet gets copy of set by its name, nil if there is no such set.
+func (db *InMemoryDB) ValueFromSet(s string) *models.Set {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if set, ok := db.Set[s]; ok {
+		return set.Copy()
 	}
+	return nil
+}
+
+// ValueFromInfo gets info by its name.
+func (db *InMemoryDB) ValueFromInfo(s string) string {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.Info[s]
+}
 
-	return listCounter, listGouge
+// SelectAll selects metrics matching options, total number of matching metrics is returned for paging.
+func (db *InMemoryDB) SelectAll(opts ListOptions) ([]models.Metrics, int) {
+	return opts.Apply(db.SelectMetrics())
 }
 
 // DumpDB stores metrics in a file as json.
@@ -103,8 +266,10 @@ func (db *InMemoryDB) DumpDB() error {
 		return err
 	}
 	defer p.Close()
+	db.mu.RLock()
+	defer db.mu.RUnlock()
 	db.log.Info("Saved db")
-	return p.encoder.Encode(&db)
+	return p.encoder.Encode(db)
 }
 
 // RestoreDB reads metrics from json file.
@@ -117,27 +282,441 @@ func (db *InMemoryDB) RestoreDB() error {
 	}
 	defer c.Close()
 
-	if err := c.decoder.Decode(&db); err != nil {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := c.decoder.Decode(db); err != nil {
 		return err
 	}
 
+	// dumps made before update times were stored do not have them, take restore time
+	now := time.Now()
+	for k := range db.Counter {
+		if _, ok := db.CounterUpdated[k]; !ok {
+			db.setUpdated("counter", k, now)
+		}
+	}
+	for k := range db.Gouge {
+		if _, ok := db.GougeUpdated[k]; !ok {
+			db.setUpdated("gauge", k, now)
+		}
+	}
+	for k := range db.Histogram {
+		if _, ok := db.HistogramUpdated[k]; !ok {
+			db.setUpdated("histogram", k, now)
+		}
+	}
+	for k := range db.Set {
+		if _, ok := db.SetUpdated[k]; !ok {
+			db.setUpdated("set", k, now)
+		}
+	}
+	for k := range db.Info {
+		if _, ok := db.InfoUpdated[k]; !ok {
+			db.setUpdated("info", k, now)
+		}
+	}
+
 	return nil
 }
 
 // CloseConnection empties metrics map.
 func (db *InMemoryDB) CloseConnection() {
-	var zeroDB = &InMemoryDB{}
-	*db = *zeroDB
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.Gouge = nil
+	db.Counter = nil
+	db.Histogram = nil
+	db.GougeUpdated = nil
+	db.CounterUpdated = nil
+	db.HistogramUpdated = nil
+	db.Set = nil
+	db.SetUpdated = nil
+	db.Info = nil
+	db.InfoUpdated = nil
+}
+
+// BatchInsert insert several metrics at one time into map and returns their stored values, every metric once.
+// If any name is registered with another type, also by an earlier metric of the batch, nothing is written
+// and *TypeConflictError is returned.
+func (db *InMemoryDB) BatchInsert(ms []models.Metrics) ([]models.Metrics, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.checkTypes(ms); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for _, m := range ms {
+		switch m.MType {
+		case "counter":
+			db.Counter[m.ID] += *m.Delta
+		case "histogram":
+			db.mergeHistogram(m.ID, m.Histogram)
+		case "set":
+			db.mergeSet(m.ID, m.Set)
+		case "info":
+			db.setInfo(m.ID, *m.Info)
+		default:
+			db.Gouge[m.ID] = *m.Value
+		}
+		db.setUpdated(m.MType, m.ID, now)
+	}
+
+	res := make([]models.Metrics, 0, len(ms))
+	seen := make(map[string]bool, len(ms))
+	for _, m := range ms {
+		if !seen[m.ID] {
+			seen[m.ID] = true
+			res = append(res, db.stored(m.MType, m.ID))
+		}
+	}
+	return res, nil
+}
+
+// stored returns copy of stored metric, lock must be held.
+func (db *InMemoryDB) stored(mType string, name string) models.Metrics {
+	m := models.Metrics{ID: name, MType: mType}
+	var t time.Time
+	switch mType {
+	case "counter":
+		delta := db.Counter[name]
+		m.Delta = &delta
+		t = db.CounterUpdated[name]
+	case "histogram":
+		m.Histogram = db.Histogram[name].Copy()
+		t = db.HistogramUpdated[name]
+	case "set":
+		m.Set = db.Set[name].Copy()
+		t = db.SetUpdated[name]
+	case "info":
+		info := db.Info[name]
+		m.Info = &info
+		t = db.InfoUpdated[name]
+	default:
+		value := db.Gouge[name]
+		m.Value = &value
+		t = db.GougeUpdated[name]
+	}
+	m.UpdatedAt = &t
+	return m
 }
 
-// BatchInsert insert several metrics at one time into map.
-func (db *InMemoryDB) BatchInsert(ms []models.Metrics) {
+// checkTypes checks that every metric is written with the type its name is registered with, lock must be held.
+func (db *InMemoryDB) checkTypes(ms []models.Metrics) error {
+	types := make(map[string]string, len(ms))
+	var conflicts []models.Metrics
 	for _, m := range ms {
-		if m.MType == "counter" {
-			db.InsertCounter(m.ID, *m.Delta)
-		} else {
-			db.InsertGouge(m.ID, *m.Value)
+		t, ok := types[m.ID]
+		if !ok {
+			t, ok = db.typeOf(m.ID)
 		}
+		if !ok {
+			t = m.MType
+		}
+		types[m.ID] = t
+		if t != m.MType {
+			conflicts = append(conflicts, m)
+		}
+	}
+	if len(conflicts) > 0 {
+		return &TypeConflictError{Metrics: conflicts, Types: types}
 	}
+	return nil
+}
 
+// DeleteMetric removes metric of given type, returns false if there was no such metric.
+func (db *InMemoryDB) DeleteMetric(mType string, name string) bool {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.deleteMetric(mType, name)
+}
+
+// Retype changes type of metric, gauge and counter values are converted into each other, other values are dropped.
+func (db *InMemoryDB) Retype(name string, to string) (string, bool, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	from, ok := db.typeOf(name)
+	if !ok {
+		return "", false, ErrNoMetric
+	}
+	if from == to {
+		return from, true, nil
+	}
+	converted := true
+	switch {
+	case from == "gauge" && to == "counter":
+		db.Counter[name] = int64(math.Round(db.Gouge[name]))
+	case from == "counter" && to == "gauge":
+		db.Gouge[name] = float64(db.Counter[name])
+	default:
+		converted = false
+	}
+	db.deleteMetric(from, name)
+	if converted {
+		db.setUpdated(to, name, time.Now())
+	}
+	return from, converted, nil
+}
+
+// deleteMetric removes metric of given type, lock must be held.
+func (db *InMemoryDB) deleteMetric(mType string, name string) bool {
+	switch mType {
+	case "counter":
+		if _, ok := db.Counter[name]; ok {
+			delete(db.Counter, name)
+			delete(db.CounterUpdated, name)
+			return true
+		}
+	case "gauge":
+		if _, ok := db.Gouge[name]; ok {
+			delete(db.Gouge, name)
+			delete(db.GougeUpdated, name)
+			return true
+		}
+	case "histogram":
+		if _, ok := db.Histogram[name]; ok {
+			delete(db.Histogram, name)
+			delete(db.HistogramUpdated, name)
+			return true
+		}
+	case "set":
+		if _, ok := db.Set[name]; ok {
+			delete(db.Set, name)
+			delete(db.SetUpdated, name)
+			return true
+		}
+	case "info":
+		if _, ok := db.Info[name]; ok {
+			delete(db.Info, name)
+			delete(db.InfoUpdated, name)
+			return true
+		}
+	}
+	return false
+}
+
+// DeleteMetrics removes metrics of all types with names matching the glob pattern, returns how many were removed.
+func (db *InMemoryDB) DeleteMetrics(pattern string) int {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	n := 0
+	for k := range db.Counter {
+		if ok, _ := path.Match(pattern, k); ok {
+			delete(db.Counter, k)
+			delete(db.CounterUpdated, k)
+			n++
+		}
+	}
+	for k := range db.Gouge {
+		if ok, _ := path.Match(pattern, k); ok {
+			delete(db.Gouge, k)
+			delete(db.GougeUpdated, k)
+			n++
+		}
+	}
+	for k := range db.Histogram {
+		if ok, _ := path.Match(pattern, k); ok {
+			delete(db.Histogram, k)
+			delete(db.HistogramUpdated, k)
+			n++
+		}
+	}
+	for k := range db.Set {
+		if ok, _ := path.Match(pattern, k); ok {
+			delete(db.Set, k)
+			delete(db.SetUpdated, k)
+			n++
+		}
+	}
+	for k := range db.Info {
+		if ok, _ := path.Match(pattern, k); ok {
+			delete(db.Info, k)
+			delete(db.InfoUpdated, k)
+			n++
+		}
+	}
+	return n
+}
+
+// ResetCounter sets counter to zero, returns false if there was no such counter.
+func (db *InMemoryDB) ResetCounter(name string) bool {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if _, ok := db.Counter[name]; !ok {
+		return false
+	}
+	db.Counter[name] = 0
+	db.setUpdated("counter", name, time.Now())
+	return true
+}
+
+// SelectMetrics selects all metrics together with their update time.
+func (db *InMemoryDB) SelectMetrics() []models.Metrics {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	ms := make([]models.Metrics, 0, len(db.Counter)+len(db.Gouge)+len(db.Histogram)+len(db.Set)+len(db.Info))
+	for k, v := range db.Counter {
+		delta := v
+		m := models.Metrics{ID: k, MType: "counter", Delta: &delta}
+		if t, ok := db.CounterUpdated[k]; ok {
+			m.UpdatedAt = &t
+		}
+		ms = append(ms, m)
+	}
+	for k, v := range db.Gouge {
+		value := v
+		m := models.Metrics{ID: k, MType: "gauge", Value: &value}
+		if t, ok := db.GougeUpdated[k]; ok {
+			m.UpdatedAt = &t
+		}
+		ms = append(ms, m)
+	}
+	for k, v := range db.Histogram {
+		m := models.Metrics{ID: k, MType: "histogram", Histogram: v.Copy()}
+		if t, ok := db.HistogramUpdated[k]; ok {
+			m.UpdatedAt = &t
+		}
+		ms = append(ms, m)
+	}
+	for k, v := range db.Set {
+		m := models.Metrics{ID: k, MType: "set", Set: v.Copy()}
+		if t, ok := db.SetUpdated[k]; ok {
+			m.UpdatedAt = &t
+		}
+		ms = append(ms, m)
+	}
+	for k, v := range db.Info {
+		info := v
+		m := models.Metrics{ID: k, MType: "info", Info: &info}
+		if t, ok := db.InfoUpdated[k]; ok {
+			m.UpdatedAt = &t
+		}
+		ms = append(ms, m)
+	}
+	return ms
+}
+
+// UpdatedAt returns when metric was updated last time, zero time if it is not known.
+func (db *InMemoryDB) UpdatedAt(mType string, name string) time.Time {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	switch mType {
+	case "counter":
+		return db.CounterUpdated[name]
+	case "histogram":
+		return db.HistogramUpdated[name]
+	case "set":
+		return db.SetUpdated[name]
+	case "info":
+		return db.InfoUpdated[name]
+	}
+	return db.GougeUpdated[name]
+}
+
+// CountMetrics returns number of metrics of all types.
+func (db *InMemoryDB) CountMetrics() int {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return len(db.Counter) + len(db.Gouge) + len(db.Histogram) + len(db.Set) + len(db.Info)
+}
+
+// SelectTypes returns types of metrics with given names, names which are not in the map are skipped.
+func (db *InMemoryDB) SelectTypes(names []string) map[string]string {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	res := make(map[string]string, len(names))
+	for _, name := range names {
+		if t, ok := db.typeOf(name); ok {
+			res[name] = t
+		}
+	}
+	return res
+}
+
+// typeOf returns type of metric with given name, lock must be held.
+func (db *InMemoryDB) typeOf(name string) (string, bool) {
+	if _, ok := db.Counter[name]; ok {
+		return "counter", true
+	} else if _, ok := db.Gouge[name]; ok {
+		return "gauge", true
+	} else if _, ok := db.Histogram[name]; ok {
+		return "histogram", true
+	} else if _, ok := db.Set[name]; ok {
+		return "set", true
+	} else if _, ok := db.Info[name]; ok {
+		return "info", true
+	}
+	return "", false
+}
+
+// DeleteStale removes metrics which were updated before the given time, returns how many were removed.
+func (db *InMemoryDB) DeleteStale(before time.Time) int {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	n := 0
+	for k, t := range db.CounterUpdated {
+		if t.Before(before) {
+			delete(db.Counter, k)
+			delete(db.CounterUpdated, k)
+			n++
+		}
+	}
+	for k, t := range db.GougeUpdated {
+		if t.Before(before) {
+			delete(db.Gouge, k)
+			delete(db.GougeUpdated, k)
+			n++
+		}
+	}
+	for k, t := range db.HistogramUpdated {
+		if t.Before(before) {
+			delete(db.Histogram, k)
+			delete(db.HistogramUpdated, k)
+			n++
+		}
+	}
+	for k, t := range db.SetUpdated {
+		if t.Before(before) {
+			delete(db.Set, k)
+			delete(db.SetUpdated, k)
+			n++
+		}
+	}
+	for k, t := range db.InfoUpdated {
+		if t.Before(before) {
+			delete(db.Info, k)
+			delete(db.InfoUpdated, k)
+			n++
+		}
+	}
+	return n
+}
+
+// InsertMeta appends/replaces metadata of a metric.
+func (db *InMemoryDB) InsertMeta(meta models.Meta) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.Meta == nil {
+		db.Meta = map[string]models.Meta{}
+	}
+	db.Meta[meta.Name] = meta
+}
+
+// SelectMeta gets metadata of a metric, false if there is none.
+func (db *InMemoryDB) SelectMeta(name string) (models.Meta, bool) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	meta, ok := db.Meta[name]
+	return meta, ok
+}
+
+// SelectAllMeta selects metadata of all metrics sorted by name.
+func (db *InMemoryDB) SelectAllMeta() []models.Meta {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	res := make([]models.Meta, 0, len(db.Meta))
+	for _, meta := range db.Meta {
+		res = append(res, meta)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res
 }
@@ -4,14 +4,15 @@ import (
 	"fmt"
 	"log"
 	"os"
-	"reflect"
 	"testing"
+	"time"
 
 	"github.com/caarlos0/env/v6"
 	"github.com/stretchr/testify/assert"
 	"go.uber.org/zap"
 
 	globalConf "github.com/maffka123/metricCollector/internal/config"
+	"github.com/maffka123/metricCollector/internal/models"
 	"github.com/maffka123/metricCollector/internal/server/config"
 )
 
@@ -206,35 +207,43 @@ func TestInMemoryDB_ValueFromGouge(t *testing.T) {
 }
 
 func TestInMemoryDB_SelectAll(t *testing.T) {
-	type fields struct {
-		Gouge   map[string]float64
-		Counter map[string]int64
-	}
-	type want struct {
-		GougeList   []string
-		CounterList []string
+	t1 := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	t2 := t1.Add(time.Hour)
+	stale, live := true, false
+	db := &InMemoryDB{
+		Gouge:          map[string]float64{"g1": 0.5, "g2": 1.5, "h1": 2},
+		Counter:        map[string]int64{"c1": 32},
+		GougeUpdated:   map[string]time.Time{"g1": t2, "g2": t1, "h1": t2},
+		CounterUpdated: map[string]time.Time{"c1": t1},
 	}
 	tests := []struct {
-		name   string
-		fields fields
-		want   want
+		name      string
+		opts      ListOptions
+		want      []string
+		wantTotal int
 	}{
-		{name: "test1", fields: fields{Gouge: map[string]float64{"g1": 0.5}, Counter: map[string]int64{"c1": 32}},
-			want: want{GougeList: []string{"[g1]: [0.500]\n"}, CounterList: []string{"[c1]: [32]\n"}}},
+		{name: "all", want: []string{"c1", "g1", "g2", "h1"}, wantTotal: 4},
+		{name: "type", opts: ListOptions{Type: "gauge"}, want: []string{"g1", "g2", "h1"}, wantTotal: 3},
+		{name: "prefix", opts: ListOptions{Prefix: "g"}, want: []string{"g1", "g2"}, wantTotal: 2},
+		{name: "desc", opts: ListOptions{Desc: true}, want: []string{"h1", "g2", "g1", "c1"}, wantTotal: 4},
+		{name: "by updated", opts: ListOptions{Sort: "updated"}, want: []string{"c1", "g2", "g1", "h1"}, wantTotal: 4},
+		{name: "by type desc", opts: ListOptions{Sort: "type", Desc: true}, want: []string{"h1", "g2", "g1", "c1"}, wantTotal: 4},
+		{name: "stale", opts: ListOptions{Stale: &stale, StaleTTL: time.Since(t2) + time.Minute}, want: []string{"c1", "g2"}, wantTotal: 2},
+		{name: "live", opts: ListOptions{Stale: &live, StaleTTL: time.Since(t2) + time.Minute}, want: []string{"g1", "h1"}, wantTotal: 2},
+		{name: "nothing is stale without ttl", opts: ListOptions{Stale: &stale}, want: []string{}, wantTotal: 0},
+		{name: "page", opts: ListOptions{Offset: 1, Limit: 2}, want: []string{"g1", "g2"}, wantTotal: 4},
+		{name: "last page", opts: ListOptions{Offset: 3, Limit: 2}, want: []string{"h1"}, wantTotal: 4},
+		{name: "after last page", opts: ListOptions{Offset: 5, Limit: 2}, want: []string{}, wantTotal: 4},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			db := &InMemoryDB{
-				Gouge:   tt.fields.Gouge,
-				Counter: tt.fields.Counter,
-			}
-			got, got1 := db.SelectAll()
-			if !reflect.DeepEqual(got, tt.want.CounterList) {
-				t.Errorf("InMemoryDB.SelectAll() got = %v, want %v", got, tt.want.CounterList)
-			}
-			if !reflect.DeepEqual(got1, tt.want.GougeList) {
-				t.Errorf("InMemoryDB.SelectAll() got1 = %v, want %v", got1, tt.want.GougeList)
+			got, total := db.SelectAll(tt.opts)
+			ids := []string{}
+			for _, m := range got {
+				ids = append(ids, m.ID)
 			}
+			assert.Equal(t, tt.want, ids)
+			assert.Equal(t, tt.wantTotal, total)
 		})
 	}
 }
@@ -305,3 +314,209 @@ func TestInMemoryDB_RestoreDB(t *testing.T) {
 		})
 	}
 }
+
+func TestInMemoryDB_DeleteMetric(t *testing.T) {
+	tests := []struct {
+		name  string
+		mType string
+		s     string
+		want  bool
+	}{
+		{name: "gauge", mType: "gauge", s: "g1", want: true},
+		{name: "counter", mType: "counter", s: "c1", want: true},
+		{name: "wrong type", mType: "counter", s: "g1", want: false},
+		{name: "unknown", mType: "gauge", s: "g2", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := &InMemoryDB{
+				Gouge:   map[string]float64{"g1": 0.5},
+				Counter: map[string]int64{"c1": 32},
+			}
+			assert.Equal(t, tt.want, db.DeleteMetric(tt.mType, tt.s))
+			if tt.want {
+				assert.False(t, db.NameInGouge(tt.s) || db.NameInCounter(tt.s))
+			}
+		})
+	}
+}
+
+func TestInMemoryDB_Retype(t *testing.T) {
+	tests := []struct {
+		name          string
+		s             string
+		to            string
+		wantFrom      string
+		wantConverted bool
+		wantErr       error
+	}{
+		{name: "gauge to counter", s: "g1", to: "counter", wantFrom: "gauge", wantConverted: true},
+		{name: "counter to gauge", s: "c1", to: "gauge", wantFrom: "counter", wantConverted: true},
+		{name: "same type", s: "g1", to: "gauge", wantFrom: "gauge", wantConverted: true},
+		{name: "dropped", s: "c1", to: "histogram", wantFrom: "counter"},
+		{name: "unknown", s: "g2", to: "counter", wantErr: ErrNoMetric},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := &InMemoryDB{
+				Gouge:   map[string]float64{"g1": 2.5},
+				Counter: map[string]int64{"c1": 32},
+			}
+			from, converted, err := db.Retype(tt.s, tt.to)
+			assert.ErrorIs(t, err, tt.wantErr)
+			assert.Equal(t, tt.wantFrom, from)
+			assert.Equal(t, tt.wantConverted, converted)
+			if tt.wantErr != nil {
+				return
+			}
+			types := db.SelectTypes([]string{tt.s})
+			if tt.wantConverted {
+				assert.Equal(t, tt.to, types[tt.s])
+			} else {
+				assert.NotContains(t, types, tt.s)
+			}
+		})
+	}
+
+	db := &InMemoryDB{Gouge: map[string]float64{"g1": 2.5}, Counter: map[string]int64{"c1": 32}}
+	db.Retype("g1", "counter")
+	db.Retype("c1", "gauge")
+	assert.Equal(t, int64(3), db.ValueFromCounter("g1"))
+	assert.Equal(t, 32.0, db.ValueFromGouge("c1"))
+	assert.False(t, db.UpdatedAt("counter", "g1").IsZero())
+}
+
+func TestInMemoryDB_DeleteMetrics(t *testing.T) {
+	tests := []struct {
+		name    string
+		pattern string
+		want    int
+		left    []string
+	}{
+		{name: "prefix", pattern: "host1.*", want: 2, left: []string{"host2.cpu"}},
+		{name: "pattern", pattern: "host?.cpu", want: 2, left: []string{"host1.mem"}},
+		{name: "nothing", pattern: "host3*", want: 0, left: []string{"host1.cpu", "host1.mem", "host2.cpu"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := &InMemoryDB{
+				Gouge:   map[string]float64{"host1.cpu": 0.5, "host2.cpu": 0.7},
+				Counter: map[string]int64{"host1.mem": 32},
+			}
+			assert.Equal(t, tt.want, db.DeleteMetrics(tt.pattern))
+			var left []string
+			for k := range db.Gouge {
+				left = append(left, k)
+			}
+			for k := range db.Counter {
+				left = append(left, k)
+			}
+			assert.ElementsMatch(t, tt.left, left)
+		})
+	}
+}
+
+func TestInMemoryDB_ResetCounter(t *testing.T) {
+	db := &InMemoryDB{
+		Gouge:   map[string]float64{"g1": 0.5},
+		Counter: map[string]int64{"c1": 32},
+	}
+	assert.True(t, db.ResetCounter("c1"))
+	assert.Equal(t, int64(0), db.ValueFromCounter("c1"))
+	assert.False(t, db.ResetCounter("g1"))
+}
+
+func TestInMemoryDB_DeleteStale(t *testing.T) {
+	now := time.Now()
+	db := &InMemoryDB{
+		Gouge:          map[string]float64{"g1": 0.5, "g2": 1},
+		Counter:        map[string]int64{"c1": 32},
+		GougeUpdated:   map[string]time.Time{"g1": now.Add(-time.Hour), "g2": now},
+		CounterUpdated: map[string]time.Time{"c1": now.Add(-time.Hour)},
+	}
+	assert.Equal(t, 2, db.DeleteStale(now.Add(-time.Minute)))
+	assert.False(t, db.NameInGouge("g1"))
+	assert.True(t, db.NameInGouge("g2"))
+	assert.False(t, db.NameInCounter("c1"))
+	assert.Empty(t, db.CounterUpdated)
+}
+
+func TestInMemoryDB_InsertHistogram(t *testing.T) {
+	db := Connect(&config.Config{}, logger)
+	h := &models.Histogram{Bounds: []float64{1}, Counts: []uint64{1, 0}, Count: 1, Sum: 0.5}
+	db.InsertHistogram("h1", h)
+	db.InsertHistogram("h1", h)
+	assert.True(t, db.NameInHistogram("h1"))
+	assert.Equal(t, &models.Histogram{Bounds: []float64{1}, Counts: []uint64{2, 0}, Count: 2, Sum: 1}, db.ValueFromHistogram("h1"))
+	assert.Equal(t, uint64(1), h.Count, "inserted histogram must not be changed")
+
+	assert.True(t, db.DeleteMetric("histogram", "h1"))
+	assert.False(t, db.NameInHistogram("h1"))
+	assert.Nil(t, db.ValueFromHistogram("h1"))
+}
+
+func TestInMemoryDB_SelectTypes(t *testing.T) {
+	db := Connect(&config.Config{}, logger)
+	db.InsertGouge("g1", 1)
+	db.InsertCounter("c1", 1)
+	info := "v1"
+	db.BatchInsert([]models.Metrics{{ID: "i1", MType: "info", Info: &info}})
+	assert.Equal(t, map[string]string{"g1": "gauge", "c1": "counter", "i1": "info"}, db.SelectTypes([]string{"g1", "c1", "i1", "unknown"}))
+}
+
+func TestInMemoryDB_BatchInsert(t *testing.T) {
+	db := Connect(&config.Config{}, logger)
+	db.InsertCounter("c1", 3)
+	d := int64(1)
+	f := 1.5
+	stored, err := db.BatchInsert([]models.Metrics{{ID: "c1", MType: "counter", Delta: &d}, {ID: "g1", MType: "gauge", Value: &f},
+		{ID: "c1", MType: "counter", Delta: &d}})
+	assert.NoError(t, err)
+	// counter written twice is returned once with its total
+	assert.Len(t, stored, 2)
+	assert.Equal(t, int64(5), *stored[0].Delta)
+	assert.Equal(t, f, *stored[1].Value)
+	assert.NotNil(t, stored[1].UpdatedAt)
+	assert.Equal(t, int64(1), d, "written metrics must not be changed")
+}
+
+func TestInMemoryDB_BatchInsertConflict(t *testing.T) {
+	db := Connect(&config.Config{}, logger)
+	db.InsertGouge("g1", 1)
+	f := 2.5
+	d := int64(1)
+	tests := []struct {
+		name    string
+		ms      []models.Metrics
+		wantErr string
+	}{
+		{name: "registered in db", ms: []models.Metrics{{ID: "c1", MType: "counter", Delta: &d}, {ID: "g1", MType: "counter", Delta: &d}},
+			wantErr: "g1 is registered as gauge, cannot write it as counter"},
+		{name: "registered in batch", ms: []models.Metrics{{ID: "m1", MType: "gauge", Value: &f}, {ID: "m1", MType: "counter", Delta: &d}},
+			wantErr: "m1 is registered as gauge, cannot write it as counter"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := db.BatchInsert(tt.ms)
+			var conflict *TypeConflictError
+			assert.ErrorAs(t, err, &conflict)
+			assert.EqualError(t, err, tt.wantErr)
+			assert.Equal(t, []models.Metrics{tt.ms[1]}, conflict.Metrics)
+		})
+	}
+	assert.Equal(t, 1, db.CountMetrics(), "nothing of conflicting batch must be written")
+	_, err := db.BatchInsert([]models.Metrics{{ID: "g1", MType: "gauge", Value: &f}})
+	assert.NoError(t, err)
+	assert.Equal(t, f, db.ValueFromGouge("g1"))
+}
+
+func TestInMemoryDB_CountMetrics(t *testing.T) {
+	db := Connect(&config.Config{}, logger)
+	assert.Equal(t, 0, db.CountMetrics())
+	db.InsertGouge("g1", 1)
+	db.InsertGouge("g1", 2)
+	db.InsertCounter("c1", 1)
+	assert.Equal(t, 2, db.CountMetrics())
+	db.DeleteMetric("gauge", "g1")
+	assert.Equal(t, 1, db.CountMetrics())
+}
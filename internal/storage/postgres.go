@@ -3,7 +3,10 @@ package storage
 import (
 	"context"
 	"errors"
-	"fmt"
+	"math"
+	"math/bits"
+	"path"
+	"sync/atomic"
 	"time"
 
 	"github.com/jackc/pgconn"
@@ -21,11 +24,61 @@ type PGinterface interface {
 	Exec(context.Context, string, ...interface{}) (pgconn.CommandTag, error)
 	Query(context.Context, string, ...interface{}) (pgx.Rows, error)
 	QueryRow(context.Context, string, ...interface{}) pgx.Row
+	SendBatch(context.Context, *pgx.Batch) pgx.BatchResults
 	Close()
 }
 
+// upsert queries shared by single and batch inserts, they return true if metric was inserted and not updated,
+// and the stored value. Metric registered with another type is not updated, no row is returned then.
+const (
+	insertGaugeSQL = `INSERT INTO metrics (name, value, type, updated_at)
+					VALUES($1,$2,'gauge', now()) 
+					ON CONFLICT (name) DO 
+	    		UPDATE SET value = $2, updated_at = now()
+					WHERE metrics.type = EXCLUDED.type
+					RETURNING (xmax = 0), value, updated_at, bounds, counts, registers, info;`
+	insertCounterSQL = `INSERT INTO metrics (name, value, type, updated_at)
+					VALUES($1,$2, 'counter', now()) 
+					ON CONFLICT (name) DO 
+	    		UPDATE SET value = metrics.value+$2, updated_at = now()
+					WHERE metrics.type = EXCLUDED.type
+					RETURNING (xmax = 0), value, updated_at, bounds, counts, registers, info;`
+	// histogram sum is kept in value, counts are added up element by element if buckets are the same
+	insertHistogramSQL = `INSERT INTO metrics (name, value, type, bounds, counts, updated_at)
+					VALUES($1, $2, 'histogram', $3, $4, now())
+					ON CONFLICT (name) DO
+				UPDATE SET value = CASE WHEN metrics.bounds = $3::double precision[] THEN metrics.value+$2 ELSE $2 END,
+					counts = CASE WHEN metrics.bounds = $3::double precision[]
+						THEN ARRAY(SELECT a+b FROM unnest(metrics.counts, $4::bigint[]) WITH ORDINALITY AS t(a, b, i) ORDER BY i)
+						ELSE $4::bigint[] END,
+					bounds = $3, updated_at = now()
+					WHERE metrics.type = EXCLUDED.type
+					RETURNING (xmax = 0), value, updated_at, bounds, counts, registers, info;`
+	// set registers are merged by taking max of every register if precision is the same,
+	// value is not used, because estimate is calculated from registers on read
+	insertSetSQL = `INSERT INTO metrics (name, value, type, registers, updated_at)
+					VALUES($1, 0, 'set', $2, now())
+					ON CONFLICT (name) DO
+				UPDATE SET registers = CASE WHEN cardinality(metrics.registers) = cardinality($2::smallint[])
+						THEN ARRAY(SELECT GREATEST(a, b) FROM unnest(metrics.registers, $2::smallint[]) WITH ORDINALITY AS t(a, b, i) ORDER BY i)
+						ELSE $2::smallint[] END,
+					updated_at = now()
+					WHERE metrics.type = EXCLUDED.type
+					RETURNING (xmax = 0), value, updated_at, bounds, counts, registers, info;`
+	// info value is kept as text, value is always 1 like in prometheus info metrics
+	insertInfoSQL = `INSERT INTO metrics (name, value, type, info, updated_at)
+					VALUES($1, 1, 'info', $2, now())
+					ON CONFLICT (name) DO
+				UPDATE SET info = $2, updated_at = now()
+					WHERE metrics.type = EXCLUDED.type
+					RETURNING (xmax = 0), value, updated_at, bounds, counts, registers, info;`
+)
+
 // PGDB type defined pd database.
 type PGDB struct {
+	// number of metrics, it is kept up to date on writes, so that it is known without scanning the table;
+	// it goes first to be aligned for atomic operations
+	series        int64
 	StoreInterval time.Duration `json:"-"`
 	StoreFile     string        `json:"-"`
 	Restore       bool          `json:"-"`
@@ -52,7 +105,37 @@ func ConnectPG(ctx context.Context, cfg *config.Config, logger *zap.Logger) *PGD
 	}
 	db.Conn = conn
 
-	_, err = db.Conn.Exec(ctx, "CREATE TABLE IF NOT EXISTS metrics (id serial PRIMARY KEY, name VARCHAR (30) UNIQUE NOT NULL, value float, type VARCHAR (10) NOT NULL);")
+	_, err = db.Conn.Exec(ctx, "CREATE TABLE IF NOT EXISTS metrics (id serial PRIMARY KEY, name TEXT UNIQUE NOT NULL, value float, type VARCHAR (10) NOT NULL);")
+	if err != nil {
+		db.log.Error("table creation failed: ", zap.Error(err))
+	}
+
+	// ids with labels do not fit into 30 characters
+	_, err = db.Conn.Exec(ctx, "ALTER TABLE metrics ALTER COLUMN name TYPE TEXT;")
+	if err != nil {
+		db.log.Error("table migration failed: ", zap.Error(err))
+	}
+
+	_, err = db.Conn.Exec(ctx, "ALTER TABLE metrics ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ NOT NULL DEFAULT now();")
+	if err != nil {
+		db.log.Error("table migration failed: ", zap.Error(err))
+	}
+
+	_, err = db.Conn.Exec(ctx, "ALTER TABLE metrics ADD COLUMN IF NOT EXISTS bounds DOUBLE PRECISION[], ADD COLUMN IF NOT EXISTS counts BIGINT[];")
+	if err != nil {
+		db.log.Error("table migration failed: ", zap.Error(err))
+	}
+
+	_, err = db.Conn.Exec(ctx, "ALTER TABLE metrics ADD COLUMN IF NOT EXISTS registers SMALLINT[], ADD COLUMN IF NOT EXISTS info TEXT;")
+	if err != nil {
+		db.log.Error("table migration failed: ", zap.Error(err))
+	}
+
+	if err := db.Conn.QueryRow(ctx, "SELECT count(*) FROM metrics").Scan(&db.series); err != nil {
+		db.log.Error("metrics cannot be counted: ", zap.Error(err))
+	}
+
+	_, err = db.Conn.Exec(ctx, "CREATE TABLE IF NOT EXISTS metadata (name VARCHAR (255) PRIMARY KEY, description TEXT NOT NULL DEFAULT '', unit VARCHAR (30) NOT NULL DEFAULT '', type VARCHAR (10) NOT NULL DEFAULT '');")
 	if err != nil {
 		db.log.Error("table creation failed: ", zap.Error(err))
 	}
@@ -77,74 +160,159 @@ func (db *PGDB) DumpDB() error {
 	return errors.New("not implemented")
 }
 
-// SelectAll allows to selec all metrics from database.
-func (db *PGDB) SelectAll() ([]string, []string) {
-	var listCounter []string
-	var listGouge []string
-	type counterRow struct {
-		name  string
-		value int64
+// SelectAll selects metrics matching options, total number of matching metrics is returned for paging.
+func (db *PGDB) SelectAll(opts ListOptions) ([]models.Metrics, int) {
+	return opts.Apply(db.SelectMetrics())
+}
+
+// InsertGouge append or merge gouge.
+func (db *PGDB) InsertGouge(name string, val float64) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := db.upsert(db.Conn.QueryRow(ctx, insertGaugeSQL, name, val))
+	if err != nil {
+		db.log.Error("Insert gauge failed: ", zap.Error(err))
 	}
-	type gaugeRow struct {
-		name  string
-		value float64
+}
+
+// InsertCounter append or merge counter.
+func (db *PGDB) InsertCounter(name string, val int64) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := db.upsert(db.Conn.QueryRow(ctx, insertCounterSQL, name, val))
+	if err != nil {
+		db.log.Error("Insert counter failed: ", zap.Error(err))
 	}
+}
 
-	row, err := db.Conn.Query(context.Background(), "SELECT name, value FROM metrics WHERE type='counter'")
+// InsertHistogram append or merge histogram.
+func (db *PGDB) InsertHistogram(name string, h *models.Histogram) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := db.upsert(db.Conn.QueryRow(ctx, insertHistogramSQL, histogramArgs(name, h)...))
 	if err != nil {
-		db.log.Error("Select counter failed:", zap.Error(err))
+		db.log.Error("Insert histogram failed: ", zap.Error(err))
 	}
-	defer row.Close()
+}
 
-	for row.Next() {
-		var r counterRow
-		err = row.Scan(&r.name, &r.value)
-		if err != nil {
-			db.log.Error("Select counter failed:", zap.Error(err))
-		}
-		listCounter = append(listCounter, fmt.Sprintf("[%s]: [%d]\n", r.name, r.value))
+// errTypeConflict is returned by upsert queries for names registered with another type.
+var errTypeConflict = errors.New("name is registered with another type")
+
+// upsert reads result of upsert query and counts inserted metric.
+func (db *PGDB) upsert(row pgx.Row) error {
+	_, inserted, err := upserted(row, models.Metrics{})
+	if err != nil {
+		return err
+	}
+	if inserted {
+		atomic.AddInt64(&db.series, 1)
 	}
+	return nil
+}
 
-	row, err = db.Conn.Query(context.Background(), "SELECT name, value FROM metrics WHERE type='gauge'")
+// upserted reads result of upsert query of metric m, it returns stored value and true if metric was inserted.
+func upserted(row pgx.Row, m models.Metrics) (models.Metrics, bool, error) {
+	var inserted bool
+	var value float64
+	var updatedAt time.Time
+	var bounds []float64
+	var counts []int64
+	var registers []int16
+	var info *string
+	err := row.Scan(&inserted, &value, &updatedAt, &bounds, &counts, &registers, &info)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return m, false, errTypeConflict
+	}
 	if err != nil {
-		db.log.Error("Select gauge failed: %s", zap.Error(err))
+		return m, false, err
 	}
-	defer row.Close()
+	stored := metricFromRow(m.ID, m.MType, value, updatedAt, bounds, counts, registers, info)
+	return stored, inserted, nil
+}
 
-	for row.Next() {
-		var r gaugeRow
-		err := row.Scan(&r.name, &r.value)
-		if err != nil {
-			db.log.Error("Select gauge failed: %s", zap.Error(err))
-		}
-		listGouge = append(listGouge, fmt.Sprintf("[%s]: [%.3f]\n", r.name, r.value))
+// metricFromRow builds metric from stored columns, value of the metric type is set.
+func metricFromRow(name string, mType string, value float64, updatedAt time.Time,
+	bounds []float64, counts []int64, registers []int16, info *string) models.Metrics {
+	m := models.Metrics{ID: name, MType: mType, UpdatedAt: &updatedAt}
+	switch mType {
+	case "counter":
+		delta := int64(value)
+		m.Delta = &delta
+	case "histogram":
+		m.Histogram = histogramFromRow(value, bounds, counts)
+	case "set":
+		m.Set = setFromRow(registers)
+	case "info":
+		m.Info = info
+	default:
+		m.Value = &value
 	}
-	return listCounter, listGouge
+	return m
 }
 
-// InsertGouge append or merge gouge.
-func (db *PGDB) InsertGouge(name string, val float64) {
+// CountMetrics returns number of metrics of all types.
+func (db *PGDB) CountMetrics() int {
+	return int(atomic.LoadInt64(&db.series))
+}
+
+// histogramArgs prepares arguments for insertHistogramSQL.
+func histogramArgs(name string, h *models.Histogram) []interface{} {
+	counts := make([]int64, len(h.Counts))
+	for i, c := range h.Counts {
+		counts[i] = int64(c)
+	}
+	return []interface{}{name, h.Sum, h.Bounds, counts}
+}
+
+// histogramFromRow builds histogram from stored sum, bounds and counts.
+func histogramFromRow(sum float64, bounds []float64, counts []int64) *models.Histogram {
+	h := models.NewHistogram(bounds)
+	h.Sum = sum
+	if len(counts) != len(h.Counts) {
+		return h
+	}
+	for i, c := range counts {
+		h.Counts[i] = uint64(c)
+		h.Count += uint64(c)
+	}
+	return h
+}
+
+// InsertSet append or merge set.
+func (db *PGDB) InsertSet(name string, set *models.Set) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	_, err := db.Conn.Exec(ctx, `INSERT INTO metrics (name, value, type)
-					VALUES($1,$2,'gauge') 
-					ON CONFLICT (name) DO 
-	    		UPDATE SET value = $2;`, name, val)
+	err := db.upsert(db.Conn.QueryRow(ctx, insertSetSQL, setArgs(name, set)...))
 	if err != nil {
-		db.log.Error("Insert gauge failed: ", zap.Error(err))
+		db.log.Error("Insert set failed: ", zap.Error(err))
 	}
 }
 
-// InsertCounter append or merge counter.
-func (db *PGDB) InsertCounter(name string, val int64) {
+// setArgs prepares arguments for insertSetSQL.
+func setArgs(name string, set *models.Set) []interface{} {
+	registers := make([]int16, len(set.Registers))
+	for i, r := range set.Registers {
+		registers[i] = int16(r)
+	}
+	return []interface{}{name, registers}
+}
+
+// setFromRow builds set from stored registers, precision is known from their number.
+func setFromRow(registers []int16) *models.Set {
+	set := &models.Set{Precision: uint8(bits.Len(uint(len(registers))) - 1), Registers: make([]byte, len(registers))}
+	for i, r := range registers {
+		set.Registers[i] = byte(r)
+	}
+	return set
+}
+
+// InsertInfo append or replace info.
+func (db *PGDB) InsertInfo(name string, val string) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	_, err := db.Conn.Exec(ctx, `INSERT INTO metrics (name, value, type)
-					VALUES($1,$2, 'counter') 
-					ON CONFLICT (name) DO 
-	    		UPDATE SET value = metrics.value+$2;`, name, val)
+	err := db.upsert(db.Conn.QueryRow(ctx, insertInfoSQL, name, val))
 	if err != nil {
-		db.log.Error("Insert counter failed: ", zap.Error(err))
+		db.log.Error("Insert info failed: ", zap.Error(err))
 	}
 }
 
@@ -153,7 +321,7 @@ func (db *PGDB) NameInGouge(s string) bool {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 	var val float64
-	row := db.Conn.QueryRow(ctx, "SELECT value FROM metrics WHERE name=$N", s)
+	row := db.Conn.QueryRow(ctx, "SELECT value FROM metrics WHERE name=$1", s)
 	err := row.Scan(&val)
 	return err == nil
 }
@@ -168,6 +336,76 @@ func (db *PGDB) NameInCounter(s string) bool {
 	return err == nil
 }
 
+// NameInHistogram checks if histogram with the given name already exists in db.
+func (db *PGDB) NameInHistogram(s string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var val float64
+	row := db.Conn.QueryRow(ctx, "SELECT value FROM metrics WHERE name=$1 AND type='histogram'", s)
+	err := row.Scan(&val)
+	return err == nil
+}
+
+// ValueFromHistogram selects histogram, nil if there is no such histogram.
+func (db *PGDB) ValueFromHistogram(s string) *models.Histogram {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var sum float64
+	var bounds []float64
+	var counts []int64
+	row := db.Conn.QueryRow(ctx, "SELECT value, bounds, counts FROM metrics WHERE name=$1 AND type='histogram'", s)
+	if err := row.Scan(&sum, &bounds, &counts); err != nil {
+		db.log.Error("select histogram failed: ", zap.Error(err))
+		return nil
+	}
+	return histogramFromRow(sum, bounds, counts)
+}
+
+// NameInSet checks if set with the given name already exists in db.
+func (db *PGDB) NameInSet(s string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var val float64
+	row := db.Conn.QueryRow(ctx, "SELECT value FROM metrics WHERE name=$1 AND type='set'", s)
+	err := row.Scan(&val)
+	return err == nil
+}
+
+// ValueFromSet selects set, nil if there is no such set.
+func (db *PGDB) ValueFromSet(s string) *models.Set {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var registers []int16
+	row := db.Conn.QueryRow(ctx, "SELECT registers FROM metrics WHERE name=$1 AND type='set'", s)
+	if err := row.Scan(&registers); err != nil {
+		db.log.Error("select set failed: ", zap.Error(err))
+		return nil
+	}
+	return setFromRow(registers)
+}
+
+// NameInInfo checks if info with the given name already exists in db.
+func (db *PGDB) NameInInfo(s string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var val float64
+	row := db.Conn.QueryRow(ctx, "SELECT value FROM metrics WHERE name=$1 AND type='info'", s)
+	err := row.Scan(&val)
+	return err == nil
+}
+
+// ValueFromInfo selects value from info.
+func (db *PGDB) ValueFromInfo(s string) string {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var val string
+	row := db.Conn.QueryRow(ctx, "SELECT info FROM metrics WHERE name=$1 AND type='info'", s)
+	if err := row.Scan(&val); err != nil {
+		db.log.Error("select info failed: ", zap.Error(err))
+	}
+	return val
+}
+
 // ValueFromCounter selects value from counter.
 func (db *PGDB) ValueFromCounter(s string) int64 {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -196,54 +434,456 @@ func (db *PGDB) ValueFromGouge(s string) float64 {
 	return val
 }
 
+// Ping checks that db is reachable.
+func (db *PGDB) Ping(ctx context.Context) error {
+	conn, ok := db.Conn.(*pgxpool.Pool)
+	if !ok {
+		return errors.New("connection cannot be pinged")
+	}
+	return conn.Ping(ctx)
+}
+
 // CloseConnection closes connection to db.
 func (db *PGDB) CloseConnection() {
 	db.Conn.Close()
 }
 
-// BatchInsert allow insert/append multiple values within one transaction.
-func (db *PGDB) BatchInsert(m []models.Metrics) {
+// BatchInsert sends all metrics to db in one round trip using pgx.Batch and returns their stored values.
+// Metrics with the same name are merged beforehand, so every name is upserted only once.
+// Batch is written in a transaction, if any name is registered with another type, nothing is written
+// and *TypeConflictError is returned.
+func (db *PGDB) BatchInsert(m []models.Metrics) ([]models.Metrics, error) {
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ms := aggregateBatch(m)
+	if len(ms) == 0 {
+		return nil, nil
+	}
+
+	// single statement is atomic without a transaction
+	if len(ms) == 1 {
+		query, args := upsertQuery(ms[0])
+		stored, inserted, err := upserted(db.Conn.QueryRow(ctx, query, args...), ms[0])
+		if errors.Is(err, errTypeConflict) {
+			return nil, db.typeConflict(ms, ms)
+		}
+		if err != nil {
+			db.log.Error("Insert metric failed: ", zap.String("name", ms[0].ID), zap.Error(err))
+			return nil, err
+		}
+		if inserted {
+			atomic.AddInt64(&db.series, 1)
+		}
+		return []models.Metrics{stored}, nil
+	}
+
+	tx, err := db.Conn.Begin(ctx)
+	if err != nil {
+		db.log.Error("starting transaction failed: ", zap.Error(err))
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	batch := &pgx.Batch{}
+	for _, v := range ms {
+		query, args := upsertQuery(v)
+		batch.Queue(query, args...)
+	}
+
+	br := tx.SendBatch(ctx, batch)
+	res := make([]models.Metrics, 0, len(ms))
+	var conflicts []models.Metrics
+	var inserted int64
+	for _, v := range ms {
+		stored, ok, err := upserted(br.QueryRow(), v)
+		if errors.Is(err, errTypeConflict) {
+			conflicts = append(conflicts, v)
+			continue
+		}
+		if err != nil {
+			db.log.Error("Insert metric failed: ", zap.String("name", v.ID), zap.Error(err))
+			continue
+		}
+		if ok {
+			inserted++
+		}
+		res = append(res, stored)
+	}
+	if err := br.Close(); err != nil {
+		db.log.Error("Batch failed: ", zap.Error(err))
+		return nil, err
+	}
+	if len(conflicts) > 0 {
+		tx.Rollback(ctx)
+		return nil, db.typeConflict(ms, conflicts)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		db.log.Error("Batch commit failed: ", zap.Error(err))
+		return nil, err
+	}
+	atomic.AddInt64(&db.series, inserted)
+
+	db.log.Debug("Batch inserted",
+		zap.Int("metrics n", len(m)),
+		zap.Int("unique n", len(ms)),
+		zap.Duration("latency", time.Since(start)))
+	return res, nil
+}
+
+// upsertQuery returns upsert query and its arguments for metric.
+func upsertQuery(v models.Metrics) (string, []interface{}) {
+	switch v.MType {
+	case "counter":
+		return insertCounterSQL, []interface{}{v.ID, *v.Delta}
+	case "histogram":
+		return insertHistogramSQL, histogramArgs(v.ID, v.Histogram)
+	case "set":
+		return insertSetSQL, setArgs(v.ID, v.Set)
+	case "info":
+		return insertInfoSQL, []interface{}{v.ID, *v.Info}
+	}
+	return insertGaugeSQL, []interface{}{v.ID, *v.Value}
+}
+
+// typeConflict builds error for conflicting metrics of the batch, a name is registered either by an earlier metric
+// of the same batch or in db.
+func (db *PGDB) typeConflict(ms []models.Metrics, conflicts []models.Metrics) *TypeConflictError {
+	err := &TypeConflictError{Metrics: conflicts, Types: map[string]string{}}
+	var names []string
+	for _, c := range conflicts {
+		for _, v := range ms {
+			if v.ID == c.ID && v.MType != c.MType {
+				err.Types[c.ID] = v.MType
+				break
+			}
+		}
+		if _, ok := err.Types[c.ID]; !ok {
+			names = append(names, c.ID)
+		}
+	}
+	if len(names) > 0 {
+		for name, mType := range db.SelectTypes(names) {
+			err.Types[name] = mType
+		}
+	}
+	return err
+}
+
+// batchKey identifies metric in a batch, metrics with the same name and different types are not merged,
+// so that the type conflict is not hidden by dropping one of them.
+type batchKey struct {
+	name  string
+	mType string
+}
+
+// aggregateBatch merges metrics with the same name and type: counters are summed up, for gauges and infos the last value wins,
+// histograms and sets are merged.
+// Metrics without value are skipped. Order of the first appearance is kept.
+func aggregateBatch(m []models.Metrics) []models.Metrics {
+	idx := make(map[batchKey]int, len(m))
+	res := make([]models.Metrics, 0, len(m))
+
+	for _, v := range m {
+		if !hasValue(v) {
+			continue
+		}
+		key := batchKey{v.ID, v.MType}
+		i, ok := idx[key]
+		if !ok {
+			// copy values, so that input is not changed by merging
+			nm := models.Metrics{ID: v.ID, MType: v.MType}
+			switch v.MType {
+			case "counter":
+				d := *v.Delta
+				nm.Delta = &d
+			case "histogram":
+				nm.Histogram = v.Histogram.Copy()
+			case "set":
+				nm.Set = v.Set.Copy()
+			case "info":
+				info := *v.Info
+				nm.Info = &info
+			default:
+				f := *v.Value
+				nm.Value = &f
+			}
+			idx[key] = len(res)
+			res = append(res, nm)
+			continue
+		}
+		switch v.MType {
+		case "counter":
+			*res[i].Delta += *v.Delta
+		case "histogram":
+			res[i].Histogram.Merge(v.Histogram)
+		case "set":
+			res[i].Set.Merge(v.Set)
+		case "info":
+			*res[i].Info = *v.Info
+		default:
+			*res[i].Value = *v.Value
+		}
+	}
+	return res
+}
+
+// hasValue checks that metric has value of its type.
+func hasValue(m models.Metrics) bool {
+	switch m.MType {
+	case "counter":
+		return m.Delta != nil
+	case "histogram":
+		return m.Histogram != nil
+	case "set":
+		return m.Set != nil
+	case "info":
+		return m.Info != nil
+	}
+	return m.Value != nil
+}
+
+// DeleteMetric deletes metric of given type, returns false if there was no such metric.
+func (db *PGDB) DeleteMetric(mType string, name string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	tag, err := db.Conn.Exec(ctx, "DELETE FROM metrics WHERE name=$1 AND type=$2", name, mType)
+	if err != nil {
+		db.log.Error("delete metric failed: ", zap.Error(err))
+		return false
+	}
+	atomic.AddInt64(&db.series, -tag.RowsAffected())
+	return tag.RowsAffected() > 0
+}
+
+// Retype changes type of metric in one transaction, gauge and counter values are converted into each other, other values are dropped.
+func (db *PGDB) Retype(name string, to string) (string, bool, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
 	tx, err := db.Conn.Begin(ctx)
 	if err != nil {
-		db.log.Error("starting connection failed: ", zap.Error(err))
+		db.log.Error("starting transaction failed: ", zap.Error(err))
+		return "", false, err
 	}
 	defer tx.Rollback(ctx)
 
-	_, err = tx.Prepare(ctx, "batch insert counter", `INSERT INTO metrics (name, value, type)
-													VALUES($1,$2,'counter') 
-													ON CONFLICT (name) DO 
-												UPDATE SET value = metrics.value+$2;`)
+	var from string
+	var value float64
+	err = tx.QueryRow(ctx, "SELECT type, value FROM metrics WHERE name=$1 FOR UPDATE", name).Scan(&from, &value)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", false, ErrNoMetric
+	}
+	if err != nil {
+		db.log.Error("select metric failed: ", zap.String("name", name), zap.Error(err))
+		return "", false, err
+	}
+	if from == to {
+		return from, true, nil
+	}
+
+	var m models.Metrics
+	switch {
+	case from == "gauge" && to == "counter":
+		d := int64(math.Round(value))
+		m = models.Metrics{ID: name, MType: to, Delta: &d}
+	case from == "counter" && to == "gauge":
+		m = models.Metrics{ID: name, MType: to, Value: &value}
+	}
+	if _, err := tx.Exec(ctx, "DELETE FROM metrics WHERE name=$1", name); err != nil {
+		db.log.Error("delete metric failed: ", zap.String("name", name), zap.Error(err))
+		return "", false, err
+	}
+	if m.MType != "" {
+		query, args := upsertQuery(m)
+		if _, _, err := upserted(tx.QueryRow(ctx, query, args...), m); err != nil {
+			db.log.Error("insert converted metric failed: ", zap.String("name", name), zap.Error(err))
+			return "", false, err
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		db.log.Error("retype commit failed: ", zap.Error(err))
+		return "", false, err
+	}
+	if m.MType == "" {
+		atomic.AddInt64(&db.series, -1)
+	}
+	return from, m.MType != "", nil
+}
+
+// DeleteMetrics deletes metrics with names matching the glob pattern, returns how many were deleted.
+func (db *PGDB) DeleteMetrics(pattern string) int {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
 
+	// glob is matched here and not in sql, so that both storages understand patterns in the same way
+	rows, err := db.Conn.Query(ctx, "SELECT name FROM metrics")
 	if err != nil {
-		db.log.Error("prep counter failed: ", zap.Error(err))
+		db.log.Error("select names failed: ", zap.Error(err))
+		return 0
+	}
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			db.log.Error("select names failed: ", zap.Error(err))
+			continue
+		}
+		if ok, _ := path.Match(pattern, name); ok {
+			names = append(names, name)
+		}
+	}
+	rows.Close()
+	if len(names) == 0 {
+		return 0
 	}
 
-	_, err = tx.Prepare(ctx, "batch insert gauge", `INSERT INTO metrics (name, value, type)
-												VALUES($1,$2,'gauge') 
-												ON CONFLICT (name) DO 
-											UPDATE SET value = $2;`)
+	tag, err := db.Conn.Exec(ctx, "DELETE FROM metrics WHERE name = ANY($1)", names)
 	if err != nil {
-		db.log.Error("prep gauge failed: ", zap.Error(err))
+		db.log.Error("delete metrics failed: ", zap.Error(err))
+		return 0
 	}
+	atomic.AddInt64(&db.series, -tag.RowsAffected())
+	return int(tag.RowsAffected())
+}
 
-	for _, v := range m {
-		if v.MType == "counter" {
-			if _, err = tx.Exec(ctx, "batch insert counter", v.ID, v.Delta); err != nil {
-				db.log.Error("Insert counter failed: ", zap.Error(err))
-			}
-		} else {
-			if _, err = tx.Exec(ctx, "batch insert gauge", v.ID, v.Value); err != nil {
-				db.log.Error("Insert gauge failed: ", zap.Error(err))
-			}
+// ResetCounter sets counter to zero, returns false if there was no such counter.
+func (db *PGDB) ResetCounter(name string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	tag, err := db.Conn.Exec(ctx, "UPDATE metrics SET value=0, updated_at=now() WHERE name=$1 AND type='counter'", name)
+	if err != nil {
+		db.log.Error("reset counter failed: ", zap.Error(err))
+		return false
+	}
+	return tag.RowsAffected() > 0
+}
+
+// SelectMetrics selects all metrics together with their update time.
+func (db *PGDB) SelectMetrics() []models.Metrics {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var ms []models.Metrics
+	rows, err := db.Conn.Query(ctx, "SELECT name, type, value, updated_at, bounds, counts, registers, info FROM metrics")
+	if err != nil {
+		db.log.Error("select metrics failed: ", zap.Error(err))
+		return ms
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name, mType string
+		var value float64
+		var updatedAt time.Time
+		var bounds []float64
+		var counts []int64
+		var registers []int16
+		var info *string
+		if err := rows.Scan(&name, &mType, &value, &updatedAt, &bounds, &counts, &registers, &info); err != nil {
+			db.log.Error("select metrics failed: ", zap.Error(err))
+			continue
+		}
+		ms = append(ms, metricFromRow(name, mType, value, updatedAt, bounds, counts, registers, info))
+	}
+	return ms
+}
+
+// UpdatedAt returns when metric was updated last time, zero time if it is not known.
+func (db *PGDB) UpdatedAt(mType string, name string) time.Time {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var t time.Time
+	row := db.Conn.QueryRow(ctx, "SELECT updated_at FROM metrics WHERE name=$1 AND type=$2", name, mType)
+	if err := row.Scan(&t); err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// SelectTypes returns types of metrics with given names, names which are not in db are skipped.
+func (db *PGDB) SelectTypes(names []string) map[string]string {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	res := make(map[string]string, len(names))
+	rows, err := db.Conn.Query(ctx, "SELECT name, type FROM metrics WHERE name = ANY($1)", names)
+	if err != nil {
+		db.log.Error("select types failed: ", zap.Error(err))
+		return res
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name, mType string
+		if err := rows.Scan(&name, &mType); err != nil {
+			db.log.Error("select types failed: ", zap.Error(err))
+			continue
 		}
+		res[name] = mType
+	}
+	return res
+}
 
+// DeleteStale deletes metrics which were updated before the given time, returns how many were deleted.
+func (db *PGDB) DeleteStale(before time.Time) int {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	tag, err := db.Conn.Exec(ctx, "DELETE FROM metrics WHERE updated_at < $1", before)
+	if err != nil {
+		db.log.Error("delete stale metrics failed: ", zap.Error(err))
+		return 0
 	}
+	atomic.AddInt64(&db.series, -tag.RowsAffected())
+	return int(tag.RowsAffected())
+}
 
-	if err = tx.Commit(ctx); err != nil {
-		db.log.Error("Commit failed: ", zap.Error(err))
+// InsertMeta append or replace metadata of a metric.
+func (db *PGDB) InsertMeta(meta models.Meta) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := db.Conn.Exec(ctx, `INSERT INTO metadata (name, description, unit, type)
+					VALUES($1, $2, $3, $4)
+					ON CONFLICT (name) DO
+				UPDATE SET description = $2, unit = $3, type = $4;`, meta.Name, meta.Description, meta.Unit, meta.Type)
+	if err != nil {
+		db.log.Error("Insert metadata failed: ", zap.Error(err))
+	}
+}
+
+// SelectMeta selects metadata of a metric, false if there is none.
+func (db *PGDB) SelectMeta(name string) (models.Meta, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	meta := models.Meta{Name: name}
+	row := db.Conn.QueryRow(ctx, "SELECT description, unit, type FROM metadata WHERE name=$1", name)
+	if err := row.Scan(&meta.Description, &meta.Unit, &meta.Type); err != nil {
+		return models.Meta{}, false
 	}
+	return meta, true
+}
 
+// SelectAllMeta selects metadata of all metrics sorted by name.
+func (db *PGDB) SelectAllMeta() []models.Meta {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	res := []models.Meta{}
+	rows, err := db.Conn.Query(ctx, "SELECT name, description, unit, type FROM metadata ORDER BY name")
+	if err != nil {
+		db.log.Error("select metadata failed: ", zap.Error(err))
+		return res
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var meta models.Meta
+		if err := rows.Scan(&meta.Name, &meta.Description, &meta.Unit, &meta.Type); err != nil {
+			db.log.Error("select metadata failed: ", zap.Error(err))
+			continue
+		}
+		res = append(res, meta)
+	}
+	return res
 }
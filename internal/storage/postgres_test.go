@@ -0,0 +1,249 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/driftprogramming/pgxpoolmock"
+	"github.com/golang/mock/gomock"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/maffka123/metricCollector/internal/models"
+)
+
+// fakeTx runs batch and single queries and remembers if it was committed.
+type fakeTx struct {
+	pgx.Tx
+	br        *fakeBatchResults
+	rows      []pgx.Row
+	sent      *pgx.Batch
+	committed bool
+}
+
+func (tx *fakeTx) SendBatch(ctx context.Context, b *pgx.Batch) pgx.BatchResults {
+	tx.sent = b
+	return tx.br
+}
+func (tx *fakeTx) QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row {
+	row := tx.rows[0]
+	tx.rows = tx.rows[1:]
+	return row
+}
+func (tx *fakeTx) Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error) {
+	return pgconn.CommandTag("DELETE 1"), nil
+}
+func (tx *fakeTx) Commit(ctx context.Context) error   { tx.committed = true; return nil }
+func (tx *fakeTx) Rollback(ctx context.Context) error { return nil }
+
+// fakeBatchResults returns given rows for queries in a batch, when they are over every metric is new.
+type fakeBatchResults struct {
+	pgx.BatchResults
+	rows []pgx.Row
+}
+
+func (br *fakeBatchResults) QueryRow() pgx.Row {
+	if len(br.rows) == 0 {
+		return insertedRow{}
+	}
+	row := br.rows[0]
+	br.rows = br.rows[1:]
+	return row
+}
+func (br *fakeBatchResults) Close() error { return nil }
+
+// insertedRow is result of upsert which inserted a new metric.
+type insertedRow struct{}
+
+func (r insertedRow) Scan(dest ...interface{}) error {
+	*dest[0].(*bool) = true
+	return nil
+}
+
+// conflictRow is result of upsert of a name registered with another type.
+type conflictRow struct{}
+
+func (r conflictRow) Scan(dest ...interface{}) error {
+	return pgx.ErrNoRows
+}
+
+// metricRow is result of selecting type and value of a metric.
+type metricRow struct {
+	mType string
+	value float64
+}
+
+func (r metricRow) Scan(dest ...interface{}) error {
+	*dest[0].(*string) = r.mType
+	*dest[1].(*float64) = r.value
+	return nil
+}
+
+// errRow is result of a failed query.
+type errRow struct{ err error }
+
+func (r errRow) Scan(dest ...interface{}) error {
+	return r.err
+}
+
+func prepBatch(n int, names int) []models.Metrics {
+	ms := make([]models.Metrics, 0, n)
+	for i := 0; i < n; i++ {
+		if i%2 == 0 {
+			d := int64(i)
+			ms = append(ms, models.Metrics{ID: fmt.Sprintf("c%d", i%names), MType: "counter", Delta: &d})
+		} else {
+			f := float64(i)
+			ms = append(ms, models.Metrics{ID: fmt.Sprintf("g%d", i%names), MType: "gauge", Value: &f})
+		}
+	}
+	return ms
+}
+
+func Test_aggregateBatch(t *testing.T) {
+	d1, d2 := int64(1), int64(2)
+	f1, f2 := 1.5, 2.5
+	i1, i2 := "v1", "v2"
+	h1 := &models.Histogram{Bounds: []float64{1}, Counts: []uint64{1, 0}, Count: 1, Sum: 0.5}
+	tests := []struct {
+		name string
+		ms   []models.Metrics
+		want []models.Metrics
+	}{
+		{name: "sum counters", ms: []models.Metrics{{ID: "c1", MType: "counter", Delta: &d1}, {ID: "c1", MType: "counter", Delta: &d2}},
+			want: []models.Metrics{{ID: "c1", MType: "counter", Delta: func() *int64 { d := int64(3); return &d }()}}},
+		{name: "last gauge", ms: []models.Metrics{{ID: "g1", MType: "gauge", Value: &f1}, {ID: "c1", MType: "counter", Delta: &d1}, {ID: "g1", MType: "gauge", Value: &f2}},
+			want: []models.Metrics{{ID: "g1", MType: "gauge", Value: &f2}, {ID: "c1", MType: "counter", Delta: &d1}}},
+		{name: "merge histograms", ms: []models.Metrics{{ID: "h1", MType: "histogram", Histogram: h1}, {ID: "h1", MType: "histogram", Histogram: h1}},
+			want: []models.Metrics{{ID: "h1", MType: "histogram", Histogram: &models.Histogram{Bounds: []float64{1}, Counts: []uint64{2, 0}, Count: 2, Sum: 1}}}},
+		{name: "merge sets", ms: []models.Metrics{{ID: "s1", MType: "set", Set: &models.Set{Precision: 4, Registers: []byte{1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2}}},
+			{ID: "s1", MType: "set", Set: &models.Set{Precision: 4, Registers: []byte{3, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}}}},
+			want: []models.Metrics{{ID: "s1", MType: "set", Set: &models.Set{Precision: 4, Registers: []byte{3, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2}}}}},
+		{name: "last info", ms: []models.Metrics{{ID: "i1", MType: "info", Info: &i1}, {ID: "i1", MType: "info", Info: &i2}},
+			want: []models.Metrics{{ID: "i1", MType: "info", Info: &i2}}},
+		{name: "keep mixed types", ms: []models.Metrics{{ID: "m1", MType: "gauge", Value: &f1}, {ID: "m1", MType: "counter", Delta: &d1}},
+			want: []models.Metrics{{ID: "m1", MType: "gauge", Value: &f1}, {ID: "m1", MType: "counter", Delta: &d1}}},
+		{name: "skip empty", ms: []models.Metrics{{ID: "g1", MType: "gauge"}, {ID: "c1", MType: "counter"}, {ID: "s1", MType: "set"}},
+			want: []models.Metrics{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := aggregateBatch(tt.ms)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+	assert.Equal(t, int64(1), d1, "input must not be changed")
+	assert.Equal(t, uint64(1), h1.Count, "input must not be changed")
+	assert.Equal(t, "v1", i1, "input must not be changed")
+}
+
+func TestPGDB_BatchInsert(t *testing.T) {
+	tests := []struct {
+		name    string
+		ms      []models.Metrics
+		wantLen int
+	}{
+		{name: "unique", ms: prepBatch(10, 10), wantLen: 10},
+		{name: "duplicates", ms: prepBatch(100, 5), wantLen: 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			mockdb := pgxpoolmock.NewMockPgxPool(ctrl)
+			tx := &fakeTx{br: &fakeBatchResults{}}
+			mockdb.EXPECT().Begin(gomock.Any()).Return(tx, nil).Times(1)
+
+			db := &PGDB{Conn: mockdb, log: logger}
+			stored, err := db.BatchInsert(tt.ms)
+			assert.NoError(t, err)
+			assert.Len(t, stored, tt.wantLen)
+			assert.Equal(t, tt.wantLen, tx.sent.Len())
+			assert.True(t, tx.committed)
+			assert.Equal(t, tt.wantLen, db.CountMetrics())
+		})
+	}
+}
+
+func TestPGDB_BatchInsertConflict(t *testing.T) {
+	f := 1.5
+	d := int64(1)
+	tests := []struct {
+		name    string
+		ms      []models.Metrics
+		rows    []pgx.Row
+		inDB    bool
+		wantErr string
+	}{
+		{name: "registered in db", ms: []models.Metrics{{ID: "g1", MType: "gauge", Value: &f}, {ID: "c1", MType: "counter", Delta: &d}},
+			rows: []pgx.Row{insertedRow{}, conflictRow{}}, inDB: true, wantErr: "c1 is registered as gauge, cannot write it as counter"},
+		{name: "registered in batch", ms: []models.Metrics{{ID: "m1", MType: "gauge", Value: &f}, {ID: "m1", MType: "counter", Delta: &d}},
+			rows: []pgx.Row{insertedRow{}, conflictRow{}}, wantErr: "m1 is registered as gauge, cannot write it as counter"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			mockdb := pgxpoolmock.NewMockPgxPool(ctrl)
+			tx := &fakeTx{br: &fakeBatchResults{rows: tt.rows}}
+			mockdb.EXPECT().Begin(gomock.Any()).Return(tx, nil).Times(1)
+			if tt.inDB {
+				rows := pgxpoolmock.NewRows([]string{"name", "type"}).AddRow("c1", "gauge").ToPgxRows()
+				mockdb.EXPECT().Query(gomock.Any(), gomock.Any(), gomock.Any()).Return(rows, nil)
+			}
+
+			db := &PGDB{Conn: mockdb, log: logger}
+			_, err := db.BatchInsert(tt.ms)
+			var conflict *TypeConflictError
+			assert.ErrorAs(t, err, &conflict)
+			assert.EqualError(t, err, tt.wantErr)
+			assert.True(t, conflict.Conflicts(tt.ms[1]))
+			assert.False(t, conflict.Conflicts(tt.ms[0]))
+			assert.False(t, tx.committed)
+			assert.Equal(t, 0, db.CountMetrics())
+		})
+	}
+}
+
+func TestPGDB_Retype(t *testing.T) {
+	tests := []struct {
+		name          string
+		to            string
+		rows          []pgx.Row
+		wantFrom      string
+		wantConverted bool
+		wantErr       string
+		wantCommitted bool
+		wantCount     int
+	}{
+		{name: "gauge to counter", to: "counter", rows: []pgx.Row{metricRow{"gauge", 2.5}, insertedRow{}},
+			wantFrom: "gauge", wantConverted: true, wantCommitted: true, wantCount: 1},
+		{name: "dropped", to: "histogram", rows: []pgx.Row{metricRow{"gauge", 2.5}},
+			wantFrom: "gauge", wantCommitted: true, wantCount: 0},
+		{name: "unknown", to: "counter", rows: []pgx.Row{errRow{pgx.ErrNoRows}},
+			wantErr: ErrNoMetric.Error(), wantCount: 1},
+		{name: "insert failed", to: "counter", rows: []pgx.Row{metricRow{"gauge", 2.5}, errRow{errors.New("connection lost")}},
+			wantErr: "connection lost", wantCount: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			mockdb := pgxpoolmock.NewMockPgxPool(ctrl)
+			tx := &fakeTx{rows: tt.rows}
+			mockdb.EXPECT().Begin(gomock.Any()).Return(tx, nil).Times(1)
+
+			db := &PGDB{Conn: mockdb, log: logger, series: 1}
+			from, converted, err := db.Retype("m1", tt.to)
+			if tt.wantErr != "" {
+				assert.EqualError(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.wantFrom, from)
+			assert.Equal(t, tt.wantConverted, converted)
+			assert.Equal(t, tt.wantCommitted, tx.committed)
+			assert.Equal(t, tt.wantCount, db.CountMetrics())
+		})
+	}
+}
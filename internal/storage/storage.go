@@ -2,6 +2,12 @@
 package storage
 
 import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
 	"github.com/maffka123/metricCollector/internal/models"
 )
 
@@ -9,13 +15,140 @@ import (
 type Repositories interface {
 	InsertGouge(name string, val float64)
 	InsertCounter(name string, val int64)
+	InsertHistogram(name string, h *models.Histogram)
+	InsertSet(name string, set *models.Set)
+	InsertInfo(name string, val string)
 	NameInCounter(s string) bool
 	NameInGouge(s string) bool
+	NameInHistogram(s string) bool
+	NameInSet(s string) bool
+	NameInInfo(s string) bool
 	ValueFromCounter(s string) int64
 	ValueFromGouge(s string) float64
-	SelectAll() ([]string, []string)
+	ValueFromHistogram(s string) *models.Histogram
+	ValueFromSet(s string) *models.Set
+	ValueFromInfo(s string) string
+	SelectAll(opts ListOptions) ([]models.Metrics, int)
+	SelectMetrics() []models.Metrics
+	UpdatedAt(mType string, name string) time.Time
+	SelectTypes(names []string) map[string]string
+	CountMetrics() int
 	DumpDB() error
 	RestoreDB() error
 	CloseConnection()
-	BatchInsert([]models.Metrics)
+	BatchInsert([]models.Metrics) ([]models.Metrics, error)
+	DeleteMetric(mType string, name string) bool
+	Retype(name string, to string) (from string, converted bool, err error)
+	DeleteMetrics(pattern string) int
+	ResetCounter(name string) bool
+	DeleteStale(before time.Time) int
+	InsertMeta(meta models.Meta)
+	SelectMeta(name string) (models.Meta, bool)
+	SelectAllMeta() []models.Meta
+}
+
+// ErrBadSort is returned for unknown sort key.
+var ErrBadSort = errors.New("sort must be name, type or updated")
+
+// ErrNoMetric is returned by Retype for names which are not in db.
+var ErrNoMetric = errors.New("metric does not exist")
+
+// TypeConflictError is returned by BatchInsert when metrics are written with another type than their names are registered with,
+// nothing of the batch is written then.
+type TypeConflictError struct {
+	Metrics []models.Metrics  // conflicting metrics as they were written
+	Types   map[string]string // types their names are registered with
+}
+
+func (e *TypeConflictError) Error() string {
+	m := e.Metrics[0]
+	return fmt.Sprintf("%s is registered as %s, cannot write it as %s", m.ID, e.Types[m.ID], m.MType)
+}
+
+// Conflicts checks if metric is one of conflicting metrics.
+func (e *TypeConflictError) Conflicts(m models.Metrics) bool {
+	for _, c := range e.Metrics {
+		if c.ID == m.ID && c.MType == m.MType {
+			return true
+		}
+	}
+	return false
+}
+
+// ListOptions selects, sorts and pages metrics returned by SelectAll.
+type ListOptions struct {
+	Type     string        // only metrics of this type, empty means all
+	Prefix   string        // only metrics which ids start with prefix
+	Stale    *bool         // only stale or only live metrics, nil means all
+	StaleTTL time.Duration // see models.Metrics.IsStale
+	Sort     string        // name (default), type or updated
+	Desc     bool
+	Offset   int
+	Limit    int // 0 means no limit
+}
+
+// Validate checks that sort key is known.
+func (o ListOptions) Validate() error {
+	switch o.Sort {
+	case "", "name", "type", "updated":
+		return nil
+	}
+	return ErrBadSort
+}
+
+// Apply filters, sorts and pages metrics, total number of metrics before paging is returned as well.
+// Stale flag of returned metrics is set.
+func (o ListOptions) Apply(ms []models.Metrics) ([]models.Metrics, int) {
+	res := make([]models.Metrics, 0, len(ms))
+	for _, m := range ms {
+		if o.Type != "" && m.MType != o.Type || !strings.HasPrefix(m.ID, o.Prefix) {
+			continue
+		}
+		m.Stale = m.IsStale(o.StaleTTL)
+		if o.Stale != nil && *o.Stale != m.Stale {
+			continue
+		}
+		res = append(res, m)
+	}
+
+	less := func(a, b models.Metrics) bool { return a.ID < b.ID }
+	switch o.Sort {
+	case "type":
+		less = func(a, b models.Metrics) bool {
+			if a.MType == b.MType {
+				return a.ID < b.ID
+			}
+			return a.MType < b.MType
+		}
+	case "updated":
+		less = func(a, b models.Metrics) bool {
+			var ta, tb time.Time
+			if a.UpdatedAt != nil {
+				ta = *a.UpdatedAt
+			}
+			if b.UpdatedAt != nil {
+				tb = *b.UpdatedAt
+			}
+			if ta.Equal(tb) {
+				return a.ID < b.ID
+			}
+			return ta.Before(tb)
+		}
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		if o.Desc {
+			return less(res[j], res[i])
+		}
+		return less(res[i], res[j])
+	})
+
+	total := len(res)
+	if o.Offset >= len(res) {
+		return res[:0], total
+	}
+	res = res[o.Offset:]
+	if o.Limit > 0 && o.Limit < len(res) {
+		res = res[:o.Limit]
+	}
+	return res, total
 }
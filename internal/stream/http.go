@@ -0,0 +1,313 @@
+package stream
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// websocketGUID is appended to client key to calculate Sec-WebSocket-Accept, see RFC 6455.
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// websocket opcodes used by the server.
+const (
+	opText  = 0x1
+	opClose = 0x8
+	opPing  = 0x9
+	opPong  = 0xA
+)
+
+// writeTimeout is how long a single websocket frame can be written.
+const writeTimeout = 10 * time.Second
+
+// ServeHTTP streams metric updates to the client, as Server-Sent Events or over WebSocket if client asks for upgrade.
+// Query parameter pattern (can be repeated) selects metrics by their ids with labels, e.g. pattern=Heap*.
+// WebSocket is opened only from pages of the server itself or of allowed origins, as browsers do not restrict it.
+func (h *Hub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if isWebSocket(r) && !h.originAllowed(r) {
+		http.Error(w, "403 - Origin is not allowed", http.StatusForbidden)
+		return
+	}
+	sub, err := h.Subscribe(r.URL.Query()["pattern"])
+	if err != nil {
+		http.Error(w, fmt.Sprintf("400 - Bad pattern: %s", err), http.StatusBadRequest)
+		return
+	}
+	defer h.Unsubscribe(sub)
+
+	if isWebSocket(r) {
+		h.serveWebSocket(w, r, sub)
+		return
+	}
+	h.serveSSE(w, r, sub)
+}
+
+// serveSSE writes every update as "metric" event, if client is dropped "error" event tells why.
+func (h *Hub) serveSSE(w http.ResponseWriter, r *http.Request, sub *Subscription) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "500 - Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ticker := time.NewTicker(h.keepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-sub.Done():
+			if sub.Err() != nil {
+				fmt.Fprintf(w, "event: error\ndata: %s\n\n", sub.Err())
+				flusher.Flush()
+			}
+			return
+		case <-ticker.C:
+			io.WriteString(w, ": keepalive\n\n")
+		case m := <-sub.Updates():
+			data, err := json.Marshal(m)
+			if err != nil {
+				h.log.Error("JSON marshal failed: ", zap.Error(err))
+				continue
+			}
+			fmt.Fprintf(w, "event: metric\ndata: %s\n\n", data)
+		}
+		flusher.Flush()
+	}
+}
+
+// serveWebSocket writes every update as text message, if client is dropped close message tells why.
+func (h *Hub) serveWebSocket(w http.ResponseWriter, r *http.Request, sub *Subscription) {
+	conn, rw, err := upgrade(w, r)
+	if err != nil {
+		h.log.Info("WebSocket upgrade failed: ", zap.Error(err))
+		return
+	}
+	defer conn.Close()
+
+	// client messages are not expected, only control frames are passed on to be answered from the writing loop below
+	control := make(chan frame)
+	closed := make(chan struct{})
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		defer close(closed)
+		for {
+			f, err := readFrame(rw.Reader)
+			if err != nil {
+				return
+			}
+			if f.op != opPing && f.op != opClose {
+				continue
+			}
+			select {
+			case control <- f:
+			case <-stop:
+				return
+			}
+			if f.op == opClose {
+				return
+			}
+		}
+	}()
+
+	send := func(op byte, payload []byte) error {
+		conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		if err := writeFrame(rw.Writer, op, payload); err != nil {
+			return err
+		}
+		return rw.Flush()
+	}
+
+	ticker := time.NewTicker(h.keepAlive)
+	defer ticker.Stop()
+	for {
+		var err error
+		select {
+		case <-closed:
+			return
+		case f := <-control:
+			if f.op == opClose {
+				// close is echoed with the status code client sent, see RFC 6455 section 5.5.1
+				send(opClose, closeCode(f.payload))
+				return
+			}
+			err = send(opPong, f.payload)
+		case <-sub.Done():
+			reason := ""
+			if sub.Err() != nil {
+				reason = sub.Err().Error()
+			}
+			// 1008 is policy violation
+			send(opClose, append([]byte{0x03, 0xF0}, reason...))
+			return
+		case <-ticker.C:
+			err = send(opPing, nil)
+		case m := <-sub.Updates():
+			data, merr := json.Marshal(m)
+			if merr != nil {
+				h.log.Error("JSON marshal failed: ", zap.Error(merr))
+				continue
+			}
+			err = send(opText, data)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// isWebSocket checks if client asks to upgrade connection to WebSocket.
+func isWebSocket(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket") &&
+		strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade")
+}
+
+// originAllowed checks that Origin is the server itself or one of allowed origins, clients which are not browsers send no Origin.
+func (h *Hub) originAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, o := range h.origins {
+		if strings.EqualFold(strings.TrimRight(strings.TrimSpace(o), "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// upgrade makes WebSocket handshake and takes over the connection.
+func upgrade(w http.ResponseWriter, r *http.Request) (net.Conn, *bufio.ReadWriter, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" || r.Header.Get("Sec-WebSocket-Version") != "13" {
+		http.Error(w, "400 - Bad WebSocket handshake", http.StatusBadRequest)
+		return nil, nil, errors.New("bad handshake")
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "500 - WebSocket is not supported", http.StatusInternalServerError)
+		return nil, nil, errors.New("connection cannot be hijacked")
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+		base64.StdEncoding.EncodeToString(sum[:]))
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, rw, nil
+}
+
+// writeFrame writes unfragmented unmasked frame, as server frames are.
+func writeFrame(w io.Writer, op byte, payload []byte) error {
+	header := []byte{0x80 | op}
+	switch n := len(payload); {
+	case n < 126:
+		header = append(header, byte(n))
+	case n <= 0xFFFF:
+		header = append(header, 126, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(n))
+	default:
+		header = append(header, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(n))
+	}
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// frame is a client frame, payload is kept only for control frames.
+type frame struct {
+	op      byte
+	payload []byte
+}
+
+// maxControlPayload is the longest payload of a control frame, see RFC 6455 section 5.5.
+const maxControlPayload = 125
+
+// readFrame reads one client frame, payload of control frames is unmasked, payload of other frames is thrown away.
+func readFrame(r *bufio.Reader) (frame, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return frame{}, err
+	}
+	f := frame{op: header[0] & 0x0F}
+	n := uint64(header[1] & 0x7F)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return frame{}, err
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return frame{}, err
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	var mask [4]byte
+	if header[1]&0x80 != 0 {
+		if _, err := io.ReadFull(r, mask[:]); err != nil {
+			return frame{}, err
+		}
+	}
+
+	// control opcodes have the highest bit set
+	if f.op&0x8 == 0 {
+		_, err := io.CopyN(io.Discard, r, int64(n))
+		return f, err
+	}
+	if n > maxControlPayload {
+		return frame{}, errors.New("control frame is too long")
+	}
+	f.payload = make([]byte, n)
+	if _, err := io.ReadFull(r, f.payload); err != nil {
+		return frame{}, err
+	}
+	for i := range f.payload {
+		f.payload[i] ^= mask[i%4]
+	}
+	return f, nil
+}
+
+// closeCode returns status code of close frame payload without the reason, empty if client sent no code.
+func closeCode(payload []byte) []byte {
+	if len(payload) < 2 {
+		return nil
+	}
+	return payload[:2]
+}
@@ -0,0 +1,150 @@
+// Package stream delivers metric updates to subscribed clients as soon as metrics are written.
+// Every client has its own buffer, a client which does not read fast enough is disconnected,
+// so that writers never wait for clients.
+package stream
+
+import (
+	"errors"
+	"path"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/maffka123/metricCollector/internal/models"
+	"github.com/maffka123/metricCollector/internal/server/config"
+)
+
+// ErrSlowConsumer is given to a client which buffer was full, updates for it were dropped.
+var ErrSlowConsumer = errors.New("client is too slow, updates were dropped")
+
+// Hub type holds subscriptions and publishes written metrics to them.
+type Hub struct {
+	buffer    int
+	origins   []string
+	keepAlive time.Duration
+	mu        sync.Mutex
+	subs      map[*Subscription]struct{}
+	log       *zap.Logger
+}
+
+// Subscription type receives updates of metrics matching its patterns.
+type Subscription struct {
+	patterns []string
+	ch       chan models.Metrics
+	done     chan struct{}
+	err      error
+}
+
+// NewHub initializes hub without subscriptions.
+func NewHub(cfg *config.Config, logger *zap.Logger) *Hub {
+	h := Hub{
+		buffer:    cfg.StreamBuffer,
+		origins:   cfg.StreamOrigins,
+		keepAlive: 15 * time.Second,
+		subs:      map[*Subscription]struct{}{},
+		log:       logger,
+	}
+	if h.buffer < 1 {
+		h.buffer = 256
+	}
+	return &h
+}
+
+// Subscribe adds subscription for metrics which ids (with labels) match one of glob patterns, no patterns means all metrics.
+func (h *Hub) Subscribe(patterns []string) (*Subscription, error) {
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, err
+		}
+	}
+	s := Subscription{
+		patterns: patterns,
+		ch:       make(chan models.Metrics, h.buffer),
+		done:     make(chan struct{}),
+	}
+	h.mu.Lock()
+	h.subs[&s] = struct{}{}
+	h.mu.Unlock()
+	return &s, nil
+}
+
+// Unsubscribe removes subscription, nothing happens if it was already removed.
+func (h *Hub) Unsubscribe(s *Subscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.drop(s, nil)
+}
+
+// drop removes subscription and tells its client why, h.mu must be held.
+func (h *Hub) drop(s *Subscription, err error) {
+	if _, ok := h.subs[s]; !ok {
+		return
+	}
+	delete(h.subs, s)
+	s.err = err
+	close(s.done)
+}
+
+// Subscribers returns number of active subscriptions.
+func (h *Hub) Subscribers() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subs)
+}
+
+// Publish sends stored values of written metrics to matching subscriptions without blocking,
+// e.g. counter total and not the written delta, as storage returns them after write.
+// Subscription which buffer is full is dropped with ErrSlowConsumer.
+func (h *Hub) Publish(ms []models.Metrics) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.subs) == 0 {
+		return
+	}
+	for s := range h.subs {
+		for _, m := range ms {
+			if !s.matches(m.ID) {
+				continue
+			}
+			select {
+			case s.ch <- m:
+			default:
+				h.log.Info("Stream client is too slow, disconnecting")
+				h.drop(s, ErrSlowConsumer)
+			}
+			if s.err != nil {
+				break
+			}
+		}
+	}
+}
+
+// Updates returns channel with metric updates.
+func (s *Subscription) Updates() <-chan models.Metrics {
+	return s.ch
+}
+
+// Done is closed when subscription is removed.
+func (s *Subscription) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err tells why subscription was removed, it is nil if client unsubscribed itself.
+// It should be called only after Done is closed.
+func (s *Subscription) Err() error {
+	return s.err
+}
+
+// matches checks if metric id matches one of subscription patterns.
+func (s *Subscription) matches(id string) bool {
+	if len(s.patterns) == 0 {
+		return true
+	}
+	for _, p := range s.patterns {
+		if ok, _ := path.Match(p, id); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,316 @@
+package stream
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	globalConf "github.com/maffka123/metricCollector/internal/config"
+	"github.com/maffka123/metricCollector/internal/models"
+	"github.com/maffka123/metricCollector/internal/server/config"
+)
+
+var logger = globalConf.InitLogger(true)
+
+func newHub(buffer int) *Hub {
+	cfg := config.Config{StreamBuffer: buffer}
+	return NewHub(&cfg, logger)
+}
+
+func gauge(id string, v float64) models.Metrics {
+	return models.Metrics{ID: id, MType: "gauge", Value: &v}
+}
+
+// waitSubscribers waits until client subscribed, so that published metrics reach it.
+func waitSubscribers(t *testing.T, h *Hub, n int) {
+	require.Eventually(t, func() bool { return h.Subscribers() == n }, time.Second, time.Millisecond)
+}
+
+func TestHub_Publish(t *testing.T) {
+	h := newHub(10)
+	h.Publish([]models.Metrics{gauge("Alloc", 1)}) // nobody is subscribed
+
+	tests := []struct {
+		name     string
+		patterns []string
+		want     []string
+	}{
+		{name: "all", want: []string{"PollCount:5", "HeapIdle:1.5", "Alloc:2.5"}},
+		{name: "pattern", patterns: []string{"Heap*", "Poll*"}, want: []string{"PollCount:5", "HeapIdle:1.5"}},
+		{name: "nothing", patterns: []string{"Unknown"}, want: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sub, err := h.Subscribe(tt.patterns)
+			require.NoError(t, err)
+			defer h.Unsubscribe(sub)
+
+			total := int64(5)
+			h.Publish([]models.Metrics{
+				{ID: "PollCount", MType: "counter", Delta: &total},
+				gauge("HeapIdle", 1.5),
+				gauge("Alloc", 2.5),
+			})
+
+			got := []string{}
+			for len(sub.Updates()) > 0 {
+				m := <-sub.Updates()
+				if m.Delta != nil {
+					got = append(got, fmt.Sprintf("%s:%d", m.ID, *m.Delta))
+				} else {
+					got = append(got, fmt.Sprintf("%s:%v", m.ID, *m.Value))
+				}
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestHub_SlowConsumer(t *testing.T) {
+	h := newHub(1)
+	sub, err := h.Subscribe(nil)
+	require.NoError(t, err)
+
+	ms := []models.Metrics{gauge("Alloc", 1)}
+	h.Publish(ms)
+	h.Publish(ms)
+
+	select {
+	case <-sub.Done():
+	default:
+		t.Fatal("slow subscription is not dropped")
+	}
+	assert.ErrorIs(t, sub.Err(), ErrSlowConsumer)
+	assert.Equal(t, 0, h.Subscribers())
+	// unsubscribing dropped subscription does nothing
+	h.Unsubscribe(sub)
+}
+
+func TestHub_Subscribe(t *testing.T) {
+	h := newHub(0)
+	_, err := h.Subscribe([]string{"["})
+	assert.Error(t, err)
+
+	sub, err := h.Subscribe(nil)
+	require.NoError(t, err)
+	assert.Equal(t, 256, cap(sub.Updates()))
+	h.Unsubscribe(sub)
+	<-sub.Done()
+	assert.NoError(t, sub.Err())
+}
+
+func TestHub_ServeSSE(t *testing.T) {
+	h := newHub(1)
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "?pattern=[")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp, err = http.Get(srv.URL + "?pattern=Alloc")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	waitSubscribers(t, h, 1)
+
+	h.Publish([]models.Metrics{gauge("Alloc", 1.5)})
+	r := bufio.NewReader(resp.Body)
+	assert.Equal(t, "event: metric\n", readLine(t, r))
+	data := strings.TrimPrefix(readLine(t, r), "data: ")
+	var m models.Metrics
+	require.NoError(t, json.Unmarshal([]byte(data), &m))
+	assert.Equal(t, 1.5, *m.Value)
+	assert.Equal(t, "\n", readLine(t, r))
+
+	// client is dropped as if it did not read fast enough
+	h.mu.Lock()
+	for s := range h.subs {
+		h.drop(s, ErrSlowConsumer)
+	}
+	h.mu.Unlock()
+	assert.Equal(t, "event: error\n", readLine(t, r))
+	assert.Equal(t, "data: "+ErrSlowConsumer.Error()+"\n", readLine(t, r))
+}
+
+func TestHub_ServeWebSocket(t *testing.T) {
+	h := newHub(10)
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(srv.URL, "http://"))
+	require.NoError(t, err)
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET /?pattern=Alloc HTTP/1.1\r\nHost: test\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n")
+
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	// example from RFC 6455
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", resp.Header.Get("Sec-WebSocket-Accept"))
+	waitSubscribers(t, h, 1)
+
+	h.Publish([]models.Metrics{gauge("Alloc", 1.5)})
+	header := make([]byte, 2)
+	_, err = io.ReadFull(r, header)
+	require.NoError(t, err)
+	assert.Equal(t, byte(0x80|opText), header[0])
+	payload := make([]byte, header[1])
+	_, err = io.ReadFull(r, payload)
+	require.NoError(t, err)
+	var m models.Metrics
+	require.NoError(t, json.Unmarshal(payload, &m))
+	assert.Equal(t, "Alloc", m.ID)
+
+	// ping is answered with pong carrying the same payload
+	conn.Write(maskedFrame(opPing, []byte("hi")))
+	op, payload := readServerFrame(t, r)
+	assert.Equal(t, byte(opPong), op)
+	assert.Equal(t, []byte("hi"), payload)
+
+	// close frame from client is echoed with its status code and ends the subscription
+	conn.Write(maskedFrame(opClose, []byte{0x03, 0xE8, 'b', 'y', 'e'}))
+	op, payload = readServerFrame(t, r)
+	assert.Equal(t, byte(opClose), op)
+	assert.Equal(t, []byte{0x03, 0xE8}, payload)
+	waitSubscribers(t, h, 0)
+	_, err = r.ReadByte()
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestReadFrame(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		want    frame
+		wantErr bool
+	}{
+		{name: "ping", data: maskedFrame(opPing, []byte("ping")), want: frame{op: opPing, payload: []byte("ping")}},
+		{name: "empty close", data: maskedFrame(opClose, nil), want: frame{op: opClose, payload: []byte{}}},
+		{name: "text is thrown away", data: maskedFrame(opText, []byte("text")), want: frame{op: opText}},
+		{name: "long ping", data: maskedFrame(opPing, make([]byte, 126)), wantErr: true},
+		{name: "cut", data: maskedFrame(opPing, []byte("ping"))[:7], wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := readFrame(bufio.NewReader(strings.NewReader(string(tt.data))))
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, f)
+		})
+	}
+}
+
+// maskedFrame builds frame as client sends it.
+func maskedFrame(op byte, payload []byte) []byte {
+	mask := []byte{1, 2, 3, 4}
+	var b strings.Builder
+	writeFrame(&b, op, payload)
+	data := []byte(b.String())
+	header := len(data) - len(payload)
+	data[1] |= 0x80
+	res := append(append(data[:header:header], mask...), data[header:]...)
+	for i := range payload {
+		res[header+4+i] ^= mask[i%4]
+	}
+	return res
+}
+
+// readServerFrame reads short unmasked frame sent by the server.
+func readServerFrame(t *testing.T, r *bufio.Reader) (byte, []byte) {
+	header := make([]byte, 2)
+	_, err := io.ReadFull(r, header)
+	require.NoError(t, err)
+	payload := make([]byte, header[1])
+	_, err = io.ReadFull(r, payload)
+	require.NoError(t, err)
+	return header[0] &^ 0x80, payload
+}
+
+func TestHub_WebSocketOrigin(t *testing.T) {
+	h := NewHub(&config.Config{StreamOrigins: []string{"https://grafana.local/"}}, logger)
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	tests := []struct {
+		name   string
+		origin string
+		want   int
+	}{
+		{name: "no origin", want: http.StatusSwitchingProtocols},
+		{name: "same host", origin: "http://test", want: http.StatusSwitchingProtocols},
+		{name: "allowed", origin: "https://Grafana.local", want: http.StatusSwitchingProtocols},
+		{name: "other site", origin: "https://evil.example", want: http.StatusForbidden},
+		{name: "allowed host with other scheme", origin: "http://grafana.local", want: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", strings.TrimPrefix(srv.URL, "http://"))
+			require.NoError(t, err)
+			defer conn.Close()
+			origin := ""
+			if tt.origin != "" {
+				origin = "Origin: " + tt.origin + "\r\n"
+			}
+			fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: test\r\n%sUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+				"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n", origin)
+
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			require.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, tt.want, resp.StatusCode)
+		})
+	}
+}
+
+func TestWriteFrame(t *testing.T) {
+	tests := []struct {
+		name   string
+		n      int
+		header []byte
+	}{
+		{name: "short", n: 5, header: []byte{0x81, 5}},
+		{name: "medium", n: 300, header: []byte{0x81, 126, 0x01, 0x2C}},
+		{name: "long", n: 70000, header: []byte{0x81, 127, 0, 0, 0, 0, 0, 0x01, 0x11, 0x70}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b strings.Builder
+			require.NoError(t, writeFrame(&b, opText, make([]byte, tt.n)))
+			got := []byte(b.String())
+			assert.Equal(t, tt.header, got[:len(tt.header)])
+			assert.Equal(t, len(tt.header)+tt.n, len(got))
+
+			// the same frame masked by client is read back
+			masked := append([]byte{tt.header[0], tt.header[1] | 0x80}, tt.header[2:]...)
+			masked = append(masked, 1, 2, 3, 4)
+			masked = append(masked, make([]byte, tt.n)...)
+			f, err := readFrame(bufio.NewReader(strings.NewReader(string(masked))))
+			require.NoError(t, err)
+			assert.Equal(t, byte(opText), f.op)
+			assert.Nil(t, f.payload)
+		})
+	}
+}
+
+func readLine(t *testing.T, r *bufio.Reader) string {
+	line, err := r.ReadString('\n')
+	require.NoError(t, err)
+	return line
+}